@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// EnvSupervise is set in the environment of the background process running a
+// detached warp, to the initial window size of the warp (`<cols>x<rows>`).
+var EnvSupervise = "__WARP_SUPERVISE"
+
+// attachWriteTimeout bounds the time spent writing output to the attached
+// terminal, which is detached if it can't keep up so that it doesn't stall the
+// warp.
+const attachWriteTimeout = 1 * time.Second
+
+// AttachPath returns the path of the unix socket on which the terminal of a
+// detached warp is served. Its prefix differs from the one of the local
+// command server socket so that the two can't collide whatever the warp ID.
+func AttachPath(
+	warp string,
+) string {
+	return path.Join(
+		os.TempDir(),
+		fmt.Sprintf("_warpattach_%s.sock", warp),
+	)
+}
+
+// AttachSrv serves the terminal of a detached warp, letting one terminal at a
+// time attach to it: a terminal attaching detaches the previous one.
+type AttachSrv struct {
+	path  string
+	conn  net.Conn
+	mutex *sync.Mutex
+}
+
+// NewAttachSrv constructs an AttachSrv ready to serve the terminal of a warp.
+func NewAttachSrv(
+	ctx context.Context,
+	warp string,
+) *AttachSrv {
+	return &AttachSrv{
+		path:  AttachPath(warp),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Run serves attaching terminals until ctx is canceled, passing their input to
+// input and their window size to resize. The unix socket is removed once done.
+func (s *AttachSrv) Run(
+	ctx context.Context,
+	input func([]byte),
+	resize func(warp.Size),
+) error {
+	// Start by unlinking the unix socket (the open command ensures warp
+	// uniqueness).
+	syscall.Unlink(s.path)
+
+	// The socket gives access to the shell, it must only be accessible to the
+	// current user.
+	mask := syscall.Umask(0077)
+	ln, err := net.Listen("unix", s.path)
+	syscall.Umask(mask)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer syscall.Unlink(s.path)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.detach(nil)
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			continue
+		}
+		s.detach(conn)
+		go s.handle(ctx, conn, input, resize)
+	}
+}
+
+// detach closes the currently attached terminal if any, replacing it with
+// conn.
+func (s *AttachSrv) detach(
+	conn net.Conn,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+}
+
+// handle receives the updates of an attached terminal until it detaches.
+func (s *AttachSrv) handle(
+	ctx context.Context,
+	conn net.Conn,
+	input func([]byte),
+	resize func(warp.Size),
+) {
+	defer func() {
+		s.mutex.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	updateR := gob.NewDecoder(conn)
+	for {
+		var up warp.AttachUpdate
+		if err := updateR.Decode(&up); err != nil {
+			return
+		}
+		if up.WindowSize.Rows > 0 && up.WindowSize.Cols > 0 {
+			size, err := up.WindowSize.Sanitize()
+			if err == nil {
+				resize(size)
+			}
+		}
+		if len(up.Data) > 0 {
+			input(up.Data)
+		}
+	}
+}
+
+// Write writes the warp output to the attached terminal. Output is dropped
+// while no terminal is attached.
+func (s *AttachSrv) Write(
+	data []byte,
+) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return len(data), nil
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return len(data), nil
+}
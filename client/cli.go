@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
 )
 
 // CmdName represents a command name.
@@ -50,8 +51,9 @@ func New(
 
 	for _, a := range argv {
 		if flagFilterRegexp.MatchString(a) {
-			a = strings.Trim(a, "-")
-			s := strings.Split(a, "=")
+			a = strings.TrimLeft(a, "-")
+			// Flag values may contain `=` (e.g. --command="env A=b sh").
+			s := strings.SplitN(a, "=", 2)
 			if len(s) == 2 {
 				flags[s[0]] = s[1]
 			} else if len(s) == 1 {
@@ -75,6 +77,11 @@ func (c *Cli) Run() error {
 		c.Args = append(c.Args, "help")
 	}
 
+	// The quiet flag is global and applies to all commands.
+	if _, ok := c.Flags["quiet"]; ok {
+		out.SetQuiet(true)
+	}
+
 	var command Command
 	cmd, args := c.Args[0], c.Args[1:]
 	if r, ok := Registrar[CmdName(cmd)]; !ok {
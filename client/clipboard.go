@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// clipboardCommands are the clipboard utilities tried in order by
+// CopyToClipboard, with the arguments making them read the clipboard content
+// from stdin. wl-copy is only tried under Wayland, as it fails otherwise.
+var clipboardCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+}
+
+// CopyToClipboard copies text to the clipboard using the first clipboard
+// utility available (pbcopy, wl-copy, xclip or xsel).
+func CopyToClipboard(
+	text string,
+) error {
+	for _, c := range clipboardCommands {
+		if c[0] == "wl-copy" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			continue
+		}
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command(path, c[1:]...)
+		cmd.Stdin = bytes.NewBufferString(text)
+		// The output is not captured as xclip and xsel keep running in the
+		// background to serve the clipboard, holding it open.
+		if err := cmd.Run(); err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to copy to the clipboard with %s: %v", c[0], err),
+			)
+		}
+		return nil
+	}
+	return errors.Trace(
+		errors.Newf("No clipboard utility found (pbcopy, wl-copy, xclip, xsel)."),
+	)
+}
@@ -9,13 +9,15 @@ import (
 )
 
 func main() {
-	cli, err := cli.New(os.Args[1:])
+	c, err := cli.New(os.Args[1:])
 	if err != nil {
 		out.Errof("[Error] %s\n", err.Error())
+		os.Exit(1)
 	}
 
-	err = cli.Run()
+	err = c.Run()
 	if err != nil {
 		out.Errof("[Error] %s\n", err.Error())
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/out"
+)
+
+// approvalPrompt asks the host to approve the users waiting for a decision
+// (joining the warp or getting write access), one at a time. While a prompt is
+// displayed, input is intercepted until the host answers with y or n.
+type approvalPrompt struct {
+	// question is the question asked about each user.
+	question string
+	// queue is the list of users waiting for approval, the first one being
+	// prompted.
+	queue []warp.User
+	// decided are the users answered that may still be received as pending
+	// until warpd processed the answer.
+	decided map[string]bool
+
+	mutex *sync.Mutex
+}
+
+// newApprovalPrompt constructs and initializes an approvalPrompt asking
+// question about each user.
+func newApprovalPrompt(
+	question string,
+) *approvalPrompt {
+	return &approvalPrompt{
+		question: question,
+		queue:    []warp.User{},
+		decided:  map[string]bool{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Update reconciles the queue with the users pending a decision received from
+// warpd, prompting for the next user if needed.
+func (p *approvalPrompt) Update(
+	pending map[string]warp.User,
+) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for token := range p.decided {
+		if _, ok := pending[token]; !ok {
+			delete(p.decided, token)
+		}
+	}
+
+	queue := []warp.User{}
+	for i, u := range p.queue {
+		if _, ok := pending[u.Token]; ok {
+			queue = append(queue, u)
+		} else if i == 0 {
+			out.Statf("(withdrawn)\r\n")
+		}
+	}
+	prompted := len(queue) > 0 && len(p.queue) > 0 &&
+		queue[0].Token == p.queue[0].Token
+
+	tokens := []string{}
+	for token := range pending {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+TOKENS:
+	for _, token := range tokens {
+		if p.decided[token] {
+			continue
+		}
+		for _, u := range queue {
+			if u.Token == token {
+				continue TOKENS
+			}
+		}
+		// Usernames are displayed in the host terminal.
+		if warp.ValidateUsername(pending[token].Username) != nil {
+			continue
+		}
+		queue = append(queue, pending[token])
+	}
+	p.queue = queue
+
+	if len(p.queue) > 0 && !prompted {
+		p.prompt()
+	}
+}
+
+// prompt displays the prompt for the first user of the queue. The lock must be
+// held.
+func (p *approvalPrompt) prompt() {
+	out.Statf(
+		"\r\n[warp] %s (%s) %s [y/n] ",
+		p.queue[0].Username, p.queue[0].Token, p.question,
+	)
+}
+
+// Feed consumes input data, returning the data to forward to the shell and the
+// decisions made, mapping user tokens to whether they were approved.
+func (p *approvalPrompt) Feed(
+	data []byte,
+) ([]byte, map[string]bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	forward := []byte{}
+	decisions := map[string]bool{}
+	for _, b := range data {
+		if len(p.queue) == 0 {
+			forward = append(forward, b)
+			continue
+		}
+		var approved bool
+		switch b {
+		case 'y', 'Y':
+			approved = true
+		case 'n', 'N':
+			approved = false
+		default:
+			continue
+		}
+		out.Normf("%s\r\n", string([]byte{b}))
+		token := p.queue[0].Token
+		decisions[token] = approved
+		p.decided[token] = true
+		p.queue = p.queue[1:]
+		if len(p.queue) > 0 {
+			p.prompt()
+		}
+	}
+	return forward, decisions
+}
@@ -0,0 +1,205 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"github.com/spolu/warp/lib/plex"
+)
+
+const (
+	// CmdNmAttach is the command name.
+	CmdNmAttach cli.CmdName = "attach"
+)
+
+// ctrlRightBracket is the byte sent by a terminal in raw mode for Ctrl-],
+// which detaches the terminal from the warp.
+const ctrlRightBracket = 0x1d
+
+func init() {
+	cli.Registrar[CmdNmAttach] = NewAttach
+}
+
+// Attach attaches the terminal to a warp opened with `open --detach`.
+type Attach struct {
+	warp string
+}
+
+// NewAttach constructs and initializes the command.
+func NewAttach() cli.Command {
+	return &Attach{}
+}
+
+// Name returns the command name.
+func (c *Attach) Name() cli.CmdName {
+	return CmdNmAttach
+}
+
+// Help prints out the help message for the command.
+func (c *Attach) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp attach <id>\n")
+	out.Normf("\n")
+	out.Normf("  Attaches your terminal to a warp you opened with ")
+	out.Boldf("open --detach")
+	out.Normf(", as if you\n")
+	out.Normf("  were hosting it from your terminal. Attaching from another terminal detaches\n")
+	out.Normf("  the current one.\n")
+	out.Normf("\n")
+	out.Normf("  Press Ctrl-] to detach, the warp keeps running in the background.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  id\n")
+	out.Normf("    The ID of the detached warp.\n")
+	out.Valuf("    goofy-dev\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp attach goofy-dev\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Attach) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Warp ID required."),
+		)
+	} else {
+		c.warp = args[0]
+	}
+
+	if !warp.WarpRegexp.MatchString(c.warp) {
+		return errors.Trace(
+			errors.Newf("Malformed warp ID: %s", c.warp),
+		)
+	}
+	if os.Getenv(warp.EnvWarp) == c.warp {
+		return errors.Trace(
+			errors.Newf("Can't attach to a warp from inside itself."),
+		)
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Attach) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+
+	conn, err := net.Dial("unix", cli.AttachPath(c.warp))
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("No detached warp found: %s", c.warp),
+		)
+	}
+	defer conn.Close()
+
+	// Updates are sent from both the resize and input goroutines.
+	updateW := gob.NewEncoder(conn)
+	mutex := &sync.Mutex{}
+	send := func(up warp.AttachUpdate) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return updateW.Encode(up)
+	}
+
+	out.Normf("Attached to warp: ")
+	out.Valuf("%s", c.warp)
+	out.Normf(" (Ctrl-] to detach)\n")
+
+	old, err := terminal.MakeRaw(stdin)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+		)
+	}
+
+	// Send window resizes.
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGWINCH)
+		defer signal.Stop(ch)
+		for {
+			size, err := terminalSize(stdin)
+			if err != nil {
+				break
+			}
+			if err := send(warp.AttachUpdate{
+				WindowSize: size,
+			}); err != nil {
+				break
+			}
+			select {
+			case <-ch:
+				coalesceSignals(ch, resizeDebounce)
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	// Multiplex Stdin to the warp until Ctrl-] is pressed.
+	go func() {
+		plex.Run(ctx, func(data []byte) {
+			detach := false
+			if i := bytes.IndexByte(data, ctrlRightBracket); i >= 0 {
+				data = data[:i]
+				detach = true
+			}
+			if len(data) > 0 {
+				send(warp.AttachUpdate{Data: data})
+			}
+			if detach {
+				cancel()
+			}
+		}, os.Stdin)
+		cancel()
+	}()
+
+	// Multiplex the warp output to Stdout.
+	go func() {
+		plex.Run(ctx, func(data []byte) {
+			os.Stdout.Write(data)
+		}, conn)
+		cancel()
+	}()
+
+	<-ctx.Done()
+
+	terminal.Restore(stdin, old)
+	fmt.Printf("\n")
+	out.Normf("Detached from warp: ")
+	out.Valuf("%s\n", c.warp)
+
+	return nil
+}
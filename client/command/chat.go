@@ -0,0 +1,181 @@
+package command
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmChat is the command name.
+	CmdNmChat cli.CmdName = "chat"
+)
+
+// chatKey is the byte sent by a terminal in raw mode for Ctrl-], which starts
+// composing a chat message in the connect client.
+const chatKey = 0x1d
+
+func init() {
+	cli.Registrar[CmdNmChat] = NewChat
+}
+
+// Chat sends a chat message to all participants of the warp.
+type Chat struct {
+	text string
+}
+
+// NewChat constructs and initializes the command.
+func NewChat() cli.Command {
+	return &Chat{}
+}
+
+// Name returns the command name.
+func (c *Chat) Name() cli.CmdName {
+	return CmdNmChat
+}
+
+// Help prints out the help message for the command.
+func (c *Chat) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp chat <message>\n")
+	out.Normf("\n")
+	out.Normf("  Sends a chat message to all participants of the current warp. Messages are\n")
+	out.Normf("  displayed outside of the shared shell and are not persisted.\n")
+	out.Normf("\n")
+	out.Normf("  Clients connected with ")
+	out.Boldf("connect")
+	out.Normf(" can send messages by pressing Ctrl-], typing their\n")
+	out.Normf("  message and pressing Enter (Esc to cancel).\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  message\n")
+	out.Normf("    The message to send.\n")
+	out.Valuf("    hello everyone\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp chat let me show you the tests\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Chat) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	c.text = strings.TrimSpace(strings.Join(args, " "))
+	if c.text == "" {
+		return errors.Trace(
+			errors.Newf("Message required."),
+		)
+	}
+	if len(c.text) > warp.MaxChatLength {
+		return errors.Trace(
+			errors.Newf(
+				"Message too long (max %d bytes).", warp.MaxChatLength,
+			),
+		)
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Chat) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	result, err := cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpChat,
+		Args: []string{c.text},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if result.Disconnected {
+		return errors.Trace(
+			errors.Newf(
+				"The warp is currently disconnected. No client is connected " +
+					"to it.",
+			),
+		)
+	}
+
+	return nil
+}
+
+// PrintChatMessage prints a chat message on its own line. It is meant to be
+// used from a terminal in raw mode.
+func PrintChatMessage(
+	ctx context.Context,
+	msg warp.ChatMessage,
+) {
+	out.Statf("\r\n[chat] %s: %s\r\n", msg.Username, msg.Text)
+}
+
+// chatPrompt composes chat messages from terminal input in raw mode. Once
+// started with chatKey, input is echoed locally instead of being sent to the
+// warp until Enter sends the message or Esc (or Ctrl-C) cancels it.
+type chatPrompt struct {
+	active bool
+	buf    []byte
+}
+
+// Feed consumes input data, returning the data to forward to the warp and the
+// messages completed, if any.
+func (p *chatPrompt) Feed(
+	data []byte,
+) ([]byte, []string) {
+	forward := []byte{}
+	messages := []string{}
+	for _, b := range data {
+		if !p.active {
+			if b == chatKey {
+				p.active = true
+				p.buf = []byte{}
+				out.Statf("\r\n[chat] > ")
+				continue
+			}
+			forward = append(forward, b)
+			continue
+		}
+
+		switch b {
+		case '\r', '\n':
+			p.active = false
+			out.Normf("\r\n")
+			if text := strings.TrimSpace(string(p.buf)); text != "" {
+				messages = append(messages, text)
+			}
+		case 0x1b, ctrlC:
+			p.active = false
+			out.Statf(" (cancelled)\r\n")
+		case 0x7f, 0x08:
+			if len(p.buf) > 0 {
+				_, size := utf8.DecodeLastRune(p.buf)
+				p.buf = p.buf[:len(p.buf)-size]
+				out.Normf("\b \b")
+			}
+		default:
+			// Other control characters are ignored.
+			if b < 0x20 || len(p.buf) >= warp.MaxChatLength {
+				continue
+			}
+			p.buf = append(p.buf, b)
+			out.Normf("%s", string([]byte{b}))
+		}
+	}
+	return forward, messages
+}
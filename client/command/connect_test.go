@@ -0,0 +1,58 @@
+package command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestResumeOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		seq  uint64
+		data string
+		want string
+	}{
+		// Resumed from the offset requested.
+		{"resumed", 15, "world", "world"},
+		// The scrollback replayed overlaps the output displayed.
+		{"overlap", 15, "helloworld", "world"},
+		// The scrollback replayed was all displayed already.
+		{"displayed", 10, "hello", ""},
+		{"behind", 8, "hel", ""},
+		// The output missed is no longer in the scrollback.
+		{"lost", 20, "world", "world"},
+	} {
+		c := &Connect{received: 10}
+		got := c.resumeOutput(tc.seq, []byte(tc.data))
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSendErrorOnceDone(t *testing.T) {
+	c := &Connect{errC: make(chan error)}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The first error is received, canceling ctx.
+	go func() {
+		<-c.errC
+		cancel()
+	}()
+	c.sendError(ctx, errors.Newf("first"))
+
+	// Later errors are not received.
+	doneC := make(chan struct{})
+	go func() {
+		c.sendError(ctx, errors.Newf("second"))
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sendError blocked once ctx was done")
+	}
+}
@@ -0,0 +1,94 @@
+package command
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/out"
+)
+
+// diagnostics collects counters on a connection to a warp, dumped on exit for
+// bug reports. Counters are updated atomically so that they can be
+// incremented from the session goroutines without affecting them.
+type diagnostics struct {
+	start time.Time
+
+	// dataIn and dataOut are the bytes of warp output received and of input
+	// sent, wireIn and wireOut the corresponding bytes sent over the
+	// connection (after compression and encryption) by the sessions ended.
+	dataIn  int64
+	dataOut int64
+	wireIn  int64
+	wireOut int64
+
+	states     int64
+	resizes    int64
+	sessions   int64
+	reconnects int64
+
+	// pings is the number of heartbeat pings of the sessions ended and
+	// pingTotal the sum of their round-trip times in nanoseconds.
+	pings     int64
+	pingTotal int64
+}
+
+// newDiagnostics constructs diagnostics starting now.
+func newDiagnostics() *diagnostics {
+	return &diagnostics{
+		start: time.Now(),
+	}
+}
+
+// AddSession accounts for the counters of a session ended.
+func (d *diagnostics) AddSession(
+	ss *cli.Session,
+) {
+	in, out := ss.WireStats()
+	pings, total := ss.PingStats()
+	atomic.AddInt64(&d.wireIn, in)
+	atomic.AddInt64(&d.wireOut, out)
+	atomic.AddInt64(&d.pings, int64(pings))
+	atomic.AddInt64(&d.pingTotal, int64(total))
+	atomic.AddInt64(&d.sessions, 1)
+}
+
+// Print dumps the counters.
+func (d *diagnostics) Print() {
+	load := func(n *int64) int64 {
+		return atomic.LoadInt64(n)
+	}
+	out.Normf("\n")
+	out.Boldf("Diagnostics:\n")
+	out.Normf("  duration:       ")
+	out.Valuf("%s\n", time.Since(d.start).Round(time.Millisecond))
+	out.Normf("  data in:        ")
+	out.Valuf("%s", formatBytes(load(&d.dataIn)))
+	out.Normf(" (wire: ")
+	out.Valuf("%s", formatBytes(load(&d.wireIn)))
+	out.Normf(")\n")
+	out.Normf("  data out:       ")
+	out.Valuf("%s", formatBytes(load(&d.dataOut)))
+	out.Normf(" (wire: ")
+	out.Valuf("%s", formatBytes(load(&d.wireOut)))
+	out.Normf(")\n")
+	out.Normf("  state updates:  ")
+	out.Valuf("%d\n", load(&d.states))
+	out.Normf("  resizes:        ")
+	out.Valuf("%d\n", load(&d.resizes))
+	out.Normf("  sessions:       ")
+	out.Valuf("%d", load(&d.sessions))
+	out.Normf(" (reconnect attempts: ")
+	out.Valuf("%d", load(&d.reconnects))
+	out.Normf(")\n")
+	out.Normf("  ping latency:   ")
+	if pings := load(&d.pings); pings > 0 {
+		avg := time.Duration(load(&d.pingTotal) / pings)
+		out.Valuf("%s", avg.Round(10*time.Microsecond))
+		out.Normf(" average over ")
+		out.Valuf("%d", pings)
+		out.Normf(" pings\n")
+	} else {
+		out.Normf("n/a\n")
+	}
+}
@@ -0,0 +1,146 @@
+package command
+
+import (
+	"context"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmDisconnect is the command name.
+	CmdNmDisconnect cli.CmdName = "disconnect"
+)
+
+func init() {
+	cli.Registrar[CmdNmDisconnect] = NewDisconnect
+}
+
+// Disconnect disconnects a client from the warp.
+type Disconnect struct {
+	usernameOrToken string
+}
+
+// NewDisconnect constructs and initializes the command.
+func NewDisconnect() cli.Command {
+	return &Disconnect{}
+}
+
+// Name returns the command name.
+func (c *Disconnect) Name() cli.CmdName {
+	return CmdNmDisconnect
+}
+
+// Help prints out the help message for the command.
+func (c *Disconnect) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp disconnect <username_or_token>\n")
+	out.Normf("\n")
+	out.Normf("  Disconnects a client from the current warp, closing all its sessions. The\n")
+	out.Normf("  client is free to connect again.\n")
+	out.Normf("\n")
+	out.Normf("  If the username of a user is ambiguous (multiple users connnected with the\n")
+	out.Normf("  same username), you must use the associated user token, as returned by the\n")
+	out.Boldf("  state")
+	out.Normf(" command.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  username_or_token\n")
+	out.Normf("    The username or token of a connected user.\n")
+	out.Valuf("    guest_JpJP50EIas9cOfwo goofy\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp disconnect goofy\n")
+	out.Valuf("  warp disconnect guest_JpJP50EIas9cOfwo\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Disconnect) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Username or token required."),
+		)
+	} else {
+		c.usernameOrToken = args[0]
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Disconnect) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	result, err := cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpState,
+		Args: []string{},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if result.Disconnected {
+		return errors.Trace(
+			errors.Newf(
+				"The warp is currently disconnected. No client is connected " +
+					"to it.",
+			),
+		)
+	}
+
+	args := []string{}
+	for _, u := range result.SessionState.Users {
+		if !u.Hosting {
+			if u.Username == c.usernameOrToken ||
+				u.Token == c.usernameOrToken {
+				args = append(args, u.Token)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf(
+				"Username or token not found: %s. Use `warp state` to "+
+					"retrieve a list of currently connected warp clients.",
+				c.usernameOrToken,
+			),
+		)
+	} else if len(args) > 1 {
+		return errors.Trace(
+			errors.Newf(
+				"Username ambiguous, please provide a user token instead. " +
+					"Warp clients user tokens can be retrieved with " +
+					"`warp state`.",
+			),
+		)
+	}
+
+	result, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpDisconnect,
+		Args: args,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	out.Normf("Disconnected: ")
+	out.Valuf("%s\n", args[0])
+	out.Normf("\n")
+
+	return nil
+}
@@ -0,0 +1,371 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmDoctor is the command name.
+	CmdNmDoctor cli.CmdName = "doctor"
+)
+
+// The smallest terminal the warp shell is usable in.
+const (
+	doctorMinCols = 20
+	doctorMinRows = 5
+)
+
+// doctorMaxClockSkew is the difference between the local clock and the clock
+// of warpd beyond which the local clock is reported off.
+const doctorMaxClockSkew = time.Minute
+
+func init() {
+	cli.Registrar[CmdNmDoctor] = NewDoctor
+}
+
+// Check statuses, only failures making the command fail.
+const (
+	checkPass = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// doctorCheck is the result of a check run by the doctor command, along with
+// the hint to fix it if it did not pass.
+type doctorCheck struct {
+	name   string
+	status string
+	detail string
+	hint   string
+}
+
+// Doctor checks the local environment and the connection to warpd, reporting
+// the problems found with a hint to fix each.
+type Doctor struct {
+	// ping holds the flags resolved to reach warpd, unless parsing them
+	// failed with parseErr, which is reported as a failed check.
+	ping     *Ping
+	parseErr error
+
+	checks []doctorCheck
+}
+
+// NewDoctor constructs and initializes the command.
+func NewDoctor() cli.Command {
+	return &Doctor{
+		ping: &Ping{},
+	}
+}
+
+// Name returns the command name.
+func (c *Doctor) Name() cli.CmdName {
+	return CmdNmDoctor
+}
+
+// Help prints out the help message for the command.
+func (c *Doctor) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp doctor\n")
+	out.Normf("\n")
+	out.Normf("  Checks that warp can run here: that it runs in a terminal of a usable size,\n")
+	out.Normf("  that the warpd address resolves and accepts connections, that warpd speaks\n")
+	out.Normf("  a protocol compatible with this client and that the local clock agrees with\n")
+	out.Normf("  warpd's. Each check is reported with a hint to fix it if it did not pass.\n")
+	out.Normf("  Exits with a non-zero code if warpd can't be used, terminal and clock\n")
+	out.Normf("  problems only being reported as warnings (so that it can run in CI).\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Normf("  The flags of `warp ping` to reach warpd (see `warp help ping`).\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp doctor\n")
+	out.Valuf("  warp doctor --address=localhost:4242\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Doctor) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	c.parseErr = c.ping.Parse(ctx, args, flags)
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Doctor) Execute(
+	ctx context.Context,
+) error {
+	c.checkTerminal(ctx)
+	c.checkWarpd(ctx)
+
+	failed, warned := 0, 0
+	for _, check := range c.checks {
+		switch check.status {
+		case checkPass:
+			out.Valuf("[%-4s] ", check.status)
+		case checkWarn:
+			warned++
+			out.Warnf("[%-4s] ", check.status)
+		case checkFail:
+			failed++
+			out.Errof("[%-4s] ", check.status)
+		default:
+			out.Normf("[%-4s] ", check.status)
+		}
+		out.Boldf("%s", check.name)
+		out.Normf(": %s\n", check.detail)
+		if check.hint != "" && check.status != checkPass {
+			out.Normf("       %s\n", check.hint)
+		}
+	}
+
+	if failed > 0 {
+		return errors.Trace(
+			errors.Newf("%d check(s) failed, warp can't be used.", failed),
+		)
+	}
+	if warned > 0 {
+		out.Warnf("\n%d warning(s), warp may not work as expected.\n", warned)
+	} else {
+		out.Normf("\nAll checks passed.\n")
+	}
+	return nil
+}
+
+// report records the result of a check.
+func (c *Doctor) report(
+	name string,
+	status string,
+	hint string,
+	format string,
+	v ...interface{},
+) {
+	c.checks = append(c.checks, doctorCheck{
+		name:   name,
+		status: status,
+		detail: fmt.Sprintf(format, v...),
+		hint:   hint,
+	})
+}
+
+// checkTerminal checks that stdin and stdout are terminals and that the
+// terminal is large enough. Problems are warnings as warp can stream warps
+// without a terminal (see Connect).
+func (c *Doctor) checkTerminal(
+	ctx context.Context,
+) {
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !terminal.IsTerminal(stdin) || !terminal.IsTerminal(stdout) {
+		c.report("Terminal", checkWarn,
+			"Run warp from an interactive terminal to open or attach to "+
+				"warps (connect streams warps read-only without one).",
+			"stdin or stdout is not a terminal",
+		)
+		c.report("Terminal size", checkSkip, "", "no terminal")
+		return
+	}
+	c.report("Terminal", checkPass, "", "stdin and stdout are terminals")
+
+	size, err := terminalSize(stdin)
+	if err != nil {
+		c.report("Terminal size", checkWarn,
+			"Check that the terminal reports its size (stty size).",
+			"%v", err,
+		)
+		return
+	}
+	if size.Cols < doctorMinCols || size.Rows < doctorMinRows {
+		c.report("Terminal size", checkWarn,
+			"Enlarge the terminal window (or its pane), or check stty size.",
+			"%dx%d is too small (minimum: %dx%d)",
+			size.Cols, size.Rows, doctorMinCols, doctorMinRows,
+		)
+		return
+	}
+	c.report("Terminal size", checkPass, "", "%dx%d", size.Cols, size.Rows)
+}
+
+// checkWarpd checks that the warpd address resolves and accepts connections,
+// that warpd speaks a compatible protocol and that the local clock agrees with
+// its clock. The checks depending on a failed one are skipped.
+func (c *Doctor) checkWarpd(
+	ctx context.Context,
+) {
+	skip := func(names ...string) {
+		for _, name := range names {
+			c.report(name, checkSkip, "", "previous check failed")
+		}
+	}
+
+	if c.parseErr != nil {
+		c.report("Configuration", checkFail,
+			"Fix the flag or environment variable reported (see `warp "+
+				"help ping`), the address being host:port or "+
+				warp.UnixAddressPrefix+"<path>.",
+			"%v", c.parseErr,
+		)
+		skip("Address", "Connection", "Protocol", "Clock")
+		return
+	}
+	c.report("Configuration", checkPass, "", "warpd at %s", c.ping.address)
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	if !c.checkAddress(ctx) {
+		skip("Connection", "Protocol", "Clock")
+		return
+	}
+
+	conn, err := c.ping.dial(ctx)
+	if err != nil {
+		hint := "Check that warpd is running and listening on that address."
+		if !c.ping.noTLS {
+			hint += " If it runs without TLS, set --no_tls or " +
+				"$WARPD_NO_TLS, otherwise check --ca and the local clock."
+		}
+		c.report("Connection", checkFail, hint, "%v", err)
+		skip("Protocol", "Clock")
+		return
+	}
+	defer conn.Close()
+	c.report("Connection", checkPass, "", "connected to %s", c.ping.address)
+
+	reply, latency, err := c.ping.handshake(ctx, cancel, conn)
+	if err != nil {
+		c.report("Protocol", checkFail,
+			"Check that the address is the one of warpd (and not of another "+
+				"service) and that warpd is up to date.",
+			"%v", err,
+		)
+		skip("Clock")
+		return
+	}
+	// The local time at which warpd replied is estimated as the middle of
+	// the handshake.
+	local := time.Now().Add(-latency / 2)
+	c.checkProtocol(ctx, reply)
+	c.checkClock(ctx, reply, local)
+}
+
+// checkAddress checks that the warpd address (or the proxy it is reached
+// through) resolves, returning whether it does. Unix socket addresses are
+// checked to exist.
+func (c *Doctor) checkAddress(
+	ctx context.Context,
+) bool {
+	address := c.ping.address
+	if strings.HasPrefix(address, warp.UnixAddressPrefix) {
+		path := strings.TrimPrefix(address, warp.UnixAddressPrefix)
+		if _, err := os.Stat(path); err != nil {
+			c.report("Address", checkFail,
+				"Check that warpd is running and listening on that socket.",
+				"%v", err,
+			)
+			return false
+		}
+		c.report("Address", checkPass, "", "socket %s exists", path)
+		return true
+	}
+
+	name := "warpd"
+	if c.ping.proxy != nil {
+		name, address = "proxy", c.ping.proxy.Host
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		c.report("Address", checkFail,
+			"Check the spelling of the address and the DNS configuration.",
+			"%s host %s does not resolve: %v", name, host, err,
+		)
+		return false
+	}
+	c.report("Address", checkPass, "",
+		"%s host %s resolves to %s", name, host, strings.Join(addrs, ", "),
+	)
+	return true
+}
+
+// checkProtocol checks that warpd speaks a protocol version supported by
+// this client (see cli.CheckProtocolVersion).
+func (c *Doctor) checkProtocol(
+	ctx context.Context,
+	reply *warp.PingReply,
+) {
+	switch {
+	case reply.ProtocolVersion == 0:
+		c.report("Protocol", checkWarn,
+			"Upgrade warpd.",
+			"warpd v%s predates protocol versioning (client protocol "+
+				"version: %d)",
+			reply.Version, warp.ProtocolVersion,
+		)
+	case reply.ProtocolVersion < warp.MinProtocolVersion:
+		c.report("Protocol", checkFail,
+			"Upgrade warpd, or use a client compatible with it.",
+			"warpd v%s is too old for this client (protocol version %d, "+
+				"supported: %d to %d)",
+			reply.Version, reply.ProtocolVersion,
+			warp.MinProtocolVersion, warp.ProtocolVersion,
+		)
+	case reply.ProtocolVersion < warp.ProtocolVersion:
+		c.report("Protocol", checkWarn,
+			"Upgrade warpd to use all the features of this client.",
+			"warpd v%s speaks protocol version %d (client protocol "+
+				"version: %d)",
+			reply.Version, reply.ProtocolVersion, warp.ProtocolVersion,
+		)
+	default:
+		c.report("Protocol", checkPass, "",
+			"warpd v%s speaks protocol version %d",
+			reply.Version, reply.ProtocolVersion,
+		)
+	}
+}
+
+// checkClock checks that the local clock, at the estimated time local at
+// which warpd replied, is within doctorMaxClockSkew of warpd's.
+func (c *Doctor) checkClock(
+	ctx context.Context,
+	reply *warp.PingReply,
+	local time.Time,
+) {
+	if reply.Time.IsZero() {
+		c.report("Clock", checkSkip, "", "warpd does not report its time")
+		return
+	}
+	skew := local.Sub(reply.Time)
+	if skew > doctorMaxClockSkew || skew < -doctorMaxClockSkew {
+		c.report("Clock", checkWarn,
+			"Synchronize the local clock (with NTP for example): TLS "+
+				"certificates may be rejected and times misreported.",
+			"the local clock is off by %s from warpd's",
+			skew.Round(time.Second),
+		)
+		return
+	}
+	c.report("Clock", checkPass, "",
+		"within %s of warpd's", doctorMaxClockSkew,
+	)
+}
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// alternateScreenSequences switch the terminal to (h) or from (l) the
+// alternate screen, used by full-screen applications.
+var alternateScreenSequences = map[string]bool{
+	"\x1b[?1049h": true, "\x1b[?1049l": false,
+	"\x1b[?1047h": true, "\x1b[?1047l": false,
+	"\x1b[?47h": true, "\x1b[?47l": false,
+}
+
+// localEcho predicts the echo of the input of the connect client, displaying
+// typed characters before the warp output echoes them. Predictions are
+// reconciled with the warp output which remains authoritative: echoed
+// characters that were predicted are not displayed twice, and predictions
+// contradicted by the output are erased.
+//
+// Only printable ASCII characters are predicted and only once the warp echoed
+// the previous prediction or, at the start of a line, the first character
+// typed, so that input that is not echoed (passwords) is never displayed.
+// Nothing is predicted while the warp is in a full-screen application.
+type localEcho struct {
+	w io.Writer
+
+	// pending are the characters predicted and displayed but not echoed yet.
+	pending []byte
+	// sent are the characters sent without being predicted, one of which
+	// must be echoed for predictions to start.
+	sent []byte
+	// confirmed indicates that the warp currently echoes the input.
+	confirmed  bool
+	fullscreen bool
+
+	mutex *sync.Mutex
+}
+
+// newLocalEcho constructs a localEcho writing to w.
+func newLocalEcho(
+	w io.Writer,
+) *localEcho {
+	return &localEcho{
+		w:       w,
+		pending: []byte{},
+		sent:    []byte{},
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Input displays the predicted echo of input data sent to the warp.
+func (e *localEcho) Input(
+	data []byte,
+) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	echo := []byte{}
+	for _, b := range data {
+		if b < 0x20 || b > 0x7e {
+			// Control characters (Enter, Backspace,...) end predictions until
+			// the warp echoes input again.
+			e.confirmed = false
+			e.sent = e.sent[:0]
+			continue
+		}
+		if !e.confirmed || e.fullscreen {
+			e.sent = append(e.sent, b)
+			continue
+		}
+		echo = append(echo, b)
+	}
+	if len(echo) > 0 {
+		e.pending = append(e.pending, echo...)
+		e.w.Write(echo)
+	}
+}
+
+// Write reconciles the warp output with the pending predictions and displays
+// it.
+func (e *localEcho) Write(
+	data []byte,
+) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for seq, fullscreen := range alternateScreenSequences {
+		if bytes.Contains(data, []byte(seq)) {
+			e.fullscreen = fullscreen
+		}
+	}
+
+	i := 0
+	for i < len(data) && i < len(e.pending) && data[i] == e.pending[i] {
+		i++
+	}
+
+	switch {
+	case len(e.pending) == 0:
+		// If the output echoed the first character sent without being
+		// predicted, the next ones can be.
+		if len(e.sent) > 0 && len(data) > 0 {
+			e.confirmed = data[0] == e.sent[0]
+			e.sent = e.sent[:0]
+		}
+		return e.w.Write(data)
+	case i == len(data):
+		// The output echoed (part of) the predictions already displayed.
+		e.pending = e.pending[i:]
+		return len(data), nil
+	case i == len(e.pending):
+		e.pending = e.pending[:0]
+		if _, err := e.w.Write(data[i:]); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	default:
+		// The output contradicts the predictions not echoed yet: erase them
+		// before displaying it.
+		erase := bytes.Repeat([]byte("\b"), len(e.pending)-i)
+		erase = append(erase, []byte("\x1b[K")...)
+		e.pending = e.pending[:0]
+		e.confirmed = false
+		if _, err := e.w.Write(append(erase, data[i:]...)); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+}
+
+// Reset drops the pending predictions, when the session is lost.
+func (e *localEcho) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.pending = e.pending[:0]
+	e.sent = e.sent[:0]
+	e.confirmed = false
+}
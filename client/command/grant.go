@@ -0,0 +1,152 @@
+package command
+
+import (
+	"context"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmGrant is the command name.
+	CmdNmGrant cli.CmdName = "grant"
+)
+
+func init() {
+	cli.Registrar[CmdNmGrant] = NewGrant
+}
+
+// Grant hands the keyboard of a warp opened with a write lock to a client, or
+// frees it.
+type Grant struct {
+	usernameOrToken string
+}
+
+// NewGrant constructs and initializes the command.
+func NewGrant() cli.Command {
+	return &Grant{}
+}
+
+// Name returns the command name.
+func (c *Grant) Name() cli.CmdName {
+	return CmdNmGrant
+}
+
+// Help prints out the help message for the command.
+func (c *Grant) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp grant [<username_or_token>]\n")
+	out.Normf("\n")
+	out.Normf("  Hands the keyboard of the current warp to a client authorized to write, if\n")
+	out.Normf("  the warp was opened with ")
+	out.Boldf("--write_lock")
+	out.Normf(". Only the client holding the keyboard\n")
+	out.Normf("  can write to the warp. If no user is specified, the keyboard is freed and\n")
+	out.Normf("  can be requested by clients.\n")
+	out.Normf("\n")
+	out.Normf("  If the username of a user is ambiguous (multiple users connnected with the\n")
+	out.Normf("  same username), you must use the associated user token, as returned by the\n")
+	out.Boldf("  state")
+	out.Normf(" command.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  username_or_token\n")
+	out.Normf("    The username or token of a connected user.\n")
+	out.Valuf("    guest_JpJP50EIas9cOfwo goofy\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp grant goofy\n")
+	out.Valuf("  warp grant\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Grant) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) > 0 {
+		c.usernameOrToken = args[0]
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Grant) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	args := []string{}
+	if c.usernameOrToken != "" {
+		result, err := cli.RunLocalCommand(ctx, warp.Command{
+			Type: warp.CmdTpState,
+			Args: []string{},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if result.Disconnected {
+			return errors.Trace(
+				errors.Newf(
+					"The warp is currently disconnected. No client is " +
+						"connected to it.",
+				),
+			)
+		}
+
+		for _, u := range result.SessionState.Users {
+			if !u.Hosting {
+				if u.Username == c.usernameOrToken ||
+					u.Token == c.usernameOrToken {
+					args = append(args, u.Token)
+				}
+			}
+		}
+
+		if len(args) == 0 {
+			return errors.Trace(
+				errors.Newf(
+					"Username or token not found: %s. Use `warp state` to "+
+						"retrieve a list of currently connected warp clients.",
+					c.usernameOrToken,
+				),
+			)
+		} else if len(args) > 1 {
+			return errors.Trace(
+				errors.Newf(
+					"Username ambiguous, please provide a user token " +
+						"instead. Warp clients user tokens can be retrieved " +
+						"with `warp state`.",
+				),
+			)
+		}
+	}
+
+	_, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpGrant,
+		Args: args,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(args) == 0 {
+		out.Normf("Keyboard freed.\n")
+	} else {
+		out.Normf("Keyboard granted to: ")
+		out.Valuf("%s\n", args[0])
+	}
+
+	return nil
+}
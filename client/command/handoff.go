@@ -0,0 +1,155 @@
+package command
+
+import (
+	"context"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmHandoff is the command name.
+	CmdNmHandoff cli.CmdName = "handoff"
+)
+
+func init() {
+	cli.Registrar[CmdNmHandoff] = NewHandoff
+}
+
+// Handoff hands off the warp to a connected client, making it the new host.
+type Handoff struct {
+	usernameOrToken string
+}
+
+// NewHandoff constructs and initializes the command.
+func NewHandoff() cli.Command {
+	return &Handoff{}
+}
+
+// Name returns the command name.
+func (c *Handoff) Name() cli.CmdName {
+	return CmdNmHandoff
+}
+
+// Help prints out the help message for the command.
+func (c *Handoff) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp handoff <username_or_token>\n")
+	out.Normf("\n")
+	out.Normf("  Nominates a connected client to take over the current warp as its host.\n")
+	out.Normf("  The client takes over by running ")
+	out.Boldf("warp open <id>")
+	out.Normf(" from its machine: its shell\n")
+	out.Normf("  replaces yours and you are demoted to a read-only client, without\n")
+	out.Normf("  disconnecting the other clients. All clients are reset to read-only.\n")
+	out.Normf("\n")
+	out.Normf("  If you disconnect before the takeover, the warp is kept open for a short\n")
+	out.Normf("  while to let the nominated client take over.\n")
+	out.Normf("\n")
+	out.Normf("  If the username of a user is ambiguous (multiple users connnected with the\n")
+	out.Normf("  same username), you must use the associated user token, as returned by the\n")
+	out.Boldf("  state")
+	out.Normf(" command.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  username_or_token\n")
+	out.Normf("    The username or token of a connected user.\n")
+	out.Valuf("    guest_JpJP50EIas9cOfwo goofy\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp handoff goofy\n")
+	out.Valuf("  warp handoff guest_JpJP50EIas9cOfwo\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Handoff) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Username or token required."),
+		)
+	} else {
+		c.usernameOrToken = args[0]
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Handoff) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	result, err := cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpState,
+		Args: []string{},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if result.Disconnected {
+		return errors.Trace(
+			errors.Newf(
+				"The warp is currently disconnected. No client is connected " +
+					"to it.",
+			),
+		)
+	}
+
+	args := []string{}
+	for _, u := range result.SessionState.Users {
+		if !u.Hosting {
+			if u.Username == c.usernameOrToken ||
+				u.Token == c.usernameOrToken {
+				args = append(args, u.Token)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf(
+				"Username or token not found: %s. Use `warp state` to "+
+					"retrieve a list of currently connected warp clients.",
+				c.usernameOrToken,
+			),
+		)
+	} else if len(args) > 1 {
+		return errors.Trace(
+			errors.Newf(
+				"Username ambiguous, please provide a user token instead. " +
+					"Warp clients user tokens can be retrieved with " +
+					"`warp state`.",
+			),
+		)
+	}
+
+	result, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpHandoff,
+		Args: args,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	out.Normf("Handoff pending: ")
+	out.Valuf("%s\n", args[0])
+	out.Normf("The client was asked to run: ")
+	out.Boldf("warp open %s\n", result.SessionState.Warp)
+	out.Normf("\n")
+
+	return nil
+}
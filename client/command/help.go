@@ -58,10 +58,26 @@ func (c *Help) Help(
 	out.Normf("    Creates a new warp.\n")
 	out.Valuf("    warp open\n")
 	out.Normf("\n")
-	out.Boldf("  connect <id>\n")
+	out.Boldf("  connect [<id>]\n")
 	out.Normf("    Connects to an existing warp.\n")
 	out.Valuf("    warp connect goofy-dev\n")
 	out.Normf("\n")
+	out.Boldf("  attach <id>\n")
+	out.Normf("    Attaches your terminal to a warp opened with `open --detach`.\n")
+	out.Valuf("    warp attach goofy-dev\n")
+	out.Normf("\n")
+	out.Boldf("  list\n")
+	out.Normf("    Lists the warps served by warpd (if enabled on warpd).\n")
+	out.Valuf("    warp list\n")
+	out.Normf("\n")
+	out.Boldf("  ping\n")
+	out.Normf("    Checks that warpd is reachable and compatible with this client.\n")
+	out.Valuf("    warp ping\n")
+	out.Normf("\n")
+	out.Boldf("  doctor\n")
+	out.Normf("    Checks the terminal and the connection to warpd, with hints to fix them.\n")
+	out.Valuf("    warp doctor\n")
+	out.Normf("\n")
 	out.Boldf("  state\n")
 	out.Normf("    Displays the state of the current warp (in-warp only).\n")
 	out.Valuf("    warp state\n")
@@ -74,6 +90,59 @@ func (c *Help) Help(
 	out.Normf("    Revokes write access to one or all clients (in-warp only).\n")
 	out.Valuf("    warp revoke\n")
 	out.Normf("\n")
+	out.Boldf("  disconnect <username_or_token>\n")
+	out.Normf("    Disconnects a client from the warp (in-warp only).\n")
+	out.Valuf("    warp disconnect goofy\n")
+	out.Normf("\n")
+	out.Boldf("  handoff <username_or_token>\n")
+	out.Normf("    Hands off the warp to a connected client (in-warp only).\n")
+	out.Valuf("    warp handoff goofy\n")
+	out.Normf("\n")
+	out.Boldf("  grant [<username_or_token>]\n")
+	out.Normf("    Hands the keyboard to a client or frees it (in-warp only).\n")
+	out.Valuf("    warp grant goofy\n")
+	out.Normf("\n")
+	out.Boldf("  pause [--hold] [--hide_output]\n")
+	out.Normf("    Blocks the input of the clients until resumed (in-warp only).\n")
+	out.Valuf("    warp pause\n")
+	out.Normf("\n")
+	out.Boldf("  resume\n")
+	out.Normf("    Resumes a paused warp (in-warp only).\n")
+	out.Valuf("    warp resume\n")
+	out.Normf("\n")
+	out.Boldf("  pane <label> --command=<command>\n")
+	out.Normf("    Shares a command as an additional read-only pane of your warp.\n")
+	out.Valuf("    warp pane tests --command=\"make watch\"\n")
+	out.Normf("\n")
+	out.Boldf("  chat <message>\n")
+	out.Normf("    Sends a chat message to all participants (in-warp only).\n")
+	out.Valuf("    warp chat hello everyone\n")
+	out.Normf("\n")
+	out.Boldf("  play <file>\n")
+	out.Normf("    Replays a session recorded with `open --record`.\n")
+	out.Valuf("    warp play goofy-dev.cast\n")
+	out.Normf("\n")
+	out.Boldf("  version\n")
+	out.Normf("    Displays the version of warp.\n")
+	out.Valuf("    warp version --json\n")
+	out.Normf("\n")
+	out.Normf("Global flags:\n")
+	out.Boldf("  --quiet\n")
+	out.Normf("    Only prints warnings and errors, for use in scripts. The output of the\n")
+	out.Normf("    warps is not affected.\n")
+	out.Valuf("    warp connect goofy-dev --quiet\n")
+	out.Normf("\n")
+	out.Normf("Environment:\n")
+	out.Boldf("  $%s\n", cli.EnvKeepAlive)
+	out.Normf("    Interval of the TCP keepalive probes sent to warpd (defaults to %s,\n", warp.DefaultKeepAlive)
+	out.Normf("    disabled if negative).\n")
+	out.Valuf("    %s=10s\n", cli.EnvKeepAlive)
+	out.Boldf("  $%s\n", cli.EnvStreamWindow)
+	out.Normf("    Receive window in bytes of the channels to warpd (defaults to %d).\n", warp.DefaultStreamWindow)
+	out.Normf("    The warp output is received at most one window per round-trip: larger\n")
+	out.Normf("    windows speed up bulk output over high latency links.\n")
+	out.Valuf("    %s=4194304\n", cli.EnvStreamWindow)
+	out.Normf("\n")
 }
 
 // Parse parses the arguments passed to the command.
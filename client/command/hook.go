@@ -0,0 +1,132 @@
+package command
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/out"
+)
+
+// maxHookExecs bounds the number of hook commands running concurrently.
+// Events occurring while the limit is reached are skipped.
+const maxHookExecs = 4
+
+// Environment variables passed to hook commands.
+const (
+	hookEnvWarp     = "WARP_ID"
+	hookEnvEvent    = "WARP_EVENT"
+	hookEnvUsername = "WARP_USERNAME"
+	hookEnvUser     = "WARP_USER"
+)
+
+// execHooks runs the commands configured by the host when users join or leave
+// the warp, the client-side analog of the hooks of warpd. Commands are run
+// with `/bin/sh -c` in the background, without access to the terminal, with
+// the event described by the WARP_* environment variables.
+type execHooks struct {
+	onJoin  string
+	onLeave string
+	warp    string
+	// self is the user token of the host, whose sessions are not reported.
+	self string
+
+	sem chan struct{}
+}
+
+// newExecHooks constructs execHooks running onJoin and onLeave (skipped if
+// empty) for the users joining and leaving warp w.
+func newExecHooks(
+	onJoin string,
+	onLeave string,
+	w string,
+	self string,
+) *execHooks {
+	return &execHooks{
+		onJoin:  onJoin,
+		onLeave: onLeave,
+		warp:    w,
+		self:    self,
+		sem:     make(chan struct{}, maxHookExecs),
+	}
+}
+
+// Update runs the hooks for the users that joined or left between two states
+// of the warp.
+func (h *execHooks) Update(
+	ctx context.Context,
+	before map[string]warp.User,
+	after map[string]warp.User,
+) {
+	for token, u := range after {
+		if _, ok := before[token]; !ok && token != h.self {
+			h.run(ctx, h.onJoin, "join", u)
+		}
+	}
+	for token, u := range before {
+		if _, ok := after[token]; !ok && token != h.self {
+			h.run(ctx, h.onLeave, "leave", u)
+		}
+	}
+}
+
+// run runs command in the background for event caused by user u, unless
+// maxHookExecs commands are running already.
+func (h *execHooks) run(
+	ctx context.Context,
+	command string,
+	event string,
+	u warp.User,
+) {
+	if command == "" {
+		return
+	}
+	select {
+	case h.sem <- struct{}{}:
+	default:
+		out.Warnf(
+			"\r\n[warp] Skipped the %s hook: %d hooks running already.\r\n",
+			event, maxHookExecs,
+		)
+		return
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	// Usernames and tokens are chosen by the clients: they are restricted to
+	// characters harmless if the command expands them unquoted.
+	cmd.Env = append(os.Environ(),
+		hookEnvWarp+"="+sanitizeHookValue(h.warp),
+		hookEnvEvent+"="+event,
+		hookEnvUsername+"="+sanitizeHookValue(u.Username),
+		hookEnvUser+"="+sanitizeHookValue(u.Token),
+	)
+	// The command runs in its own process group so that it does not receive
+	// the signals sent to the host terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	go func() {
+		defer func() { <-h.sem }()
+		if err := cmd.Run(); err != nil {
+			out.Warnf("\r\n[warp] The %s hook failed: %v\r\n", event, err)
+		}
+	}()
+}
+
+// sanitizeHookValue replaces the characters of value other than ASCII
+// letters, digits and `.-_@+` with `_`.
+func sanitizeHookValue(
+	value string,
+) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(".-_@+", r):
+			return r
+		}
+		return '_'
+	}, value)
+}
@@ -0,0 +1,124 @@
+package command
+
+import (
+	"context"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmPause is the command name.
+	CmdNmPause cli.CmdName = "pause"
+)
+
+func init() {
+	cli.Registrar[CmdNmPause] = NewPause
+}
+
+// Pause pauses the current warp, blocking the input of the clients until it
+// is resumed.
+type Pause struct {
+	hold       bool
+	hideOutput bool
+}
+
+// NewPause constructs and initializes the command.
+func NewPause() cli.Command {
+	return &Pause{}
+}
+
+// Name returns the command name.
+func (c *Pause) Name() cli.CmdName {
+	return CmdNmPause
+}
+
+// Help prints out the help message for the command.
+func (c *Pause) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp pause [--hold] [--hide_output]\n")
+	out.Normf("\n")
+	out.Normf("  Pauses the current warp until you run ")
+	out.Boldf("warp resume")
+	out.Normf(": the input of the clients is\n")
+	out.Normf("  dropped (your own input, including from your sessions connected with\n")
+	out.Boldf("  warp connect")
+	out.Normf(", is unaffected). Clients are notified that the warp is paused.\n")
+	out.Normf("  Pausing a paused warp updates its options.\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --hold\n")
+	out.Normf("    Hold the input of the clients (up to 64KiB) and write it to the warp\n")
+	out.Normf("    once resumed instead of dropping it.\n")
+	out.Boldf("  --hide_output\n")
+	out.Normf("    Don't forward the output of the warp to the clients either, e.g. to\n")
+	out.Normf("    type something private. It is not replayed to them once resumed, so\n")
+	out.Normf("    their screen may be out of sync until it is redrawn.\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp pause\n")
+	out.Valuf("  warp pause --hide_output\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Pause) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if _, ok := flags["hold"]; ok {
+		c.hold = true
+	}
+	if _, ok := flags["hide_output"]; ok {
+		c.hideOutput = true
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Pause) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	args := []string{}
+	if c.hold {
+		args = append(args, warp.PauseArgHold)
+	}
+	if c.hideOutput {
+		args = append(args, warp.PauseArgOutput)
+	}
+
+	_, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpPause,
+		Args: args,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	out.Normf("Warp paused: the input of the clients is ")
+	if c.hold {
+		out.Valuf("held")
+	} else {
+		out.Valuf("dropped")
+	}
+	if c.hideOutput {
+		out.Normf(" and the output is ")
+		out.Valuf("hidden")
+	}
+	out.Normf(" until you run ")
+	out.Boldf("warp resume")
+	out.Normf(".\n")
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// errPickCancelled is returned by pickWarp if the user cancelled.
+var errPickCancelled = errors.Newf("No warp selected.")
+
+// pickWarp lets the user select one of warps with the arrow keys (or j/k) and
+// Enter, returning its ID. q, Esc or Ctrl-C cancel the selection. The terminal
+// is in raw mode while the menu is displayed.
+func pickWarp(
+	warps []warp.WarpSummary,
+) (string, error) {
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return "", errors.Trace(
+			errors.Newf("Warp ID required (not running in a terminal)."),
+		)
+	}
+
+	warps = append([]warp.WarpSummary{}, warps...)
+	sort.Slice(warps, func(i, j int) bool {
+		return warps[i].CreatedAt.After(warps[j].CreatedAt)
+	})
+
+	old, err := terminal.MakeRaw(stdin)
+	if err != nil {
+		return "", errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+		)
+	}
+	defer terminal.Restore(stdin, old)
+
+	out.Boldf("Select a warp (arrows to move, Enter to connect, q to quit):\r\n")
+	selected := 0
+	renderWarps(warps, selected, false)
+
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return "", errors.Trace(errPickCancelled)
+			}
+			return "", errors.Trace(err)
+		}
+		input := buf[:n]
+		for len(input) > 0 {
+			switch {
+			case hasPrefix(input, "\x1b[A"), hasPrefix(input, "\x1bOA"):
+				input = input[3:]
+				if selected > 0 {
+					selected--
+				}
+			case hasPrefix(input, "\x1b[B"), hasPrefix(input, "\x1bOB"):
+				input = input[3:]
+				if selected < len(warps)-1 {
+					selected++
+				}
+			case input[0] == 'k':
+				input = input[1:]
+				if selected > 0 {
+					selected--
+				}
+			case input[0] == 'j':
+				input = input[1:]
+				if selected < len(warps)-1 {
+					selected++
+				}
+			case input[0] == '\r' || input[0] == '\n':
+				return warps[selected].Warp, nil
+			case input[0] == 'q' || input[0] == 0x03 ||
+				(input[0] == 0x1b && len(input) == 1):
+				return "", errors.Trace(errPickCancelled)
+			default:
+				input = input[1:]
+			}
+		}
+		renderWarps(warps, selected, true)
+	}
+}
+
+// hasPrefix returns whether data starts with prefix.
+func hasPrefix(
+	data []byte,
+	prefix string,
+) bool {
+	return len(data) >= len(prefix) && string(data[:len(prefix)]) == prefix
+}
+
+// renderWarps displays the warps to pick from, highlighting the selected one.
+// If redraw is true, the list previously displayed is overwritten.
+func renderWarps(
+	warps []warp.WarpSummary,
+	selected int,
+	redraw bool,
+) {
+	if redraw {
+		fmt.Printf("\x1b[%dA\r\x1b[J", len(warps))
+	}
+	for i, w := range warps {
+		// Usernames are self-asserted and displayed in the terminal.
+		host := w.Host
+		if warp.ValidateUsername(host) != nil {
+			host = "?"
+		}
+		line := fmt.Sprintf(
+			"%s  host: %s  clients: %d  size: %dx%d",
+			w.Warp, host, w.ClientCount, w.WindowSize.Cols, w.WindowSize.Rows,
+		)
+		// Older warpd don't send the age of warps.
+		if w.Age > 0 {
+			line += fmt.Sprintf("  age: %s", w.Age.Round(time.Second))
+		}
+		if i == selected {
+			out.Valuf("> %s\r\n", line)
+		} else {
+			out.Normf("  %s\r\n", line)
+		}
+	}
+}
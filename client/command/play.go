@@ -0,0 +1,247 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/cast"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmPlay is the command name.
+	CmdNmPlay cli.CmdName = "play"
+)
+
+func init() {
+	cli.Registrar[CmdNmPlay] = NewPlay
+}
+
+// Play replays a recorded session to the local terminal.
+type Play struct {
+	path      string
+	speed     float64
+	idleLimit time.Duration
+
+	paused bool
+}
+
+// NewPlay constructs and initializes the command.
+func NewPlay() cli.Command {
+	return &Play{
+		speed: 1.0,
+	}
+}
+
+// Name returns the command name.
+func (c *Play) Name() cli.CmdName {
+	return CmdNmPlay
+}
+
+// Help prints out the help message for the command.
+func (c *Play) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp play <file>\n")
+	out.Normf("\n")
+	out.Normf("  Replays a session recorded with `warp open --record` (or any asciinema v2\n")
+	out.Normf("  cast file) to your terminal. Press space to pause or resume, `.` to step\n")
+	out.Normf("  through output while paused and `q` or Ctrl-C to exit.\n")
+	out.Normf("\n")
+	out.Normf("Arguments:\n")
+	out.Boldf("  file\n")
+	out.Normf("    The cast file to replay.\n")
+	out.Valuf("    goofy-dev.cast\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --speed=<multiplier>\n")
+	out.Normf("    Playback speed multiplier (default: 1).\n")
+	out.Valuf("    --speed=2\n")
+	out.Boldf("  --idle_limit=<duration>\n")
+	out.Normf("    Cap pauses between outputs to <duration> (default: no limit).\n")
+	out.Valuf("    --idle_limit=2s\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp play goofy-dev.cast\n")
+	out.Valuf("  warp play goofy-dev.cast --speed=2 --idle_limit=1s\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Play) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if len(args) == 0 {
+		return errors.Trace(
+			errors.Newf("Cast file required."),
+		)
+	}
+	c.path = args[0]
+
+	var err error
+	if s, ok := flags["speed"]; ok {
+		c.speed, err = strconv.ParseFloat(s, 64)
+		if err != nil || c.speed <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid speed: %s", s),
+			)
+		}
+	}
+	if l, ok := flags["idle_limit"]; ok {
+		c.idleLimit, err = time.ParseDuration(l)
+		if err != nil || c.idleLimit <= 0 {
+			return errors.Trace(
+				errors.Newf("Invalid idle limit: %s", l),
+			)
+		}
+	}
+
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Play) Execute(
+	ctx context.Context,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to open cast file: %v.", err),
+		)
+	}
+	defer f.Close()
+
+	r, err := cast.NewReader(f)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to read cast file: %v.", err),
+		)
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return errors.Trace(
+			errors.Newf("Not running in a terminal."),
+		)
+	}
+	old, err := terminal.MakeRaw(stdin)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+		)
+	}
+	// Restores the terminal once we're done.
+	defer func() {
+		terminal.Restore(stdin, old)
+		fmt.Printf("\n")
+	}()
+
+	// Update the terminal size.
+	if h := r.Header(); h.Width > 0 && h.Height > 0 {
+		fmt.Printf("\033[8;%d;%dt", h.Height, h.Width)
+	}
+
+	// Forward playback controls, exiting on `q` or Ctrl-C.
+	keyC := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				break
+			}
+			if buf[0] == 'q' || buf[0] == ctrlC {
+				break
+			}
+			select {
+			case keyC <- buf[0]:
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+
+	var last time.Duration
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Trace(
+				errors.Newf("Failed to read cast file: %v.", err),
+			)
+		}
+		if ev.Type != "o" {
+			continue
+		}
+
+		delay := ev.Time - last
+		last = ev.Time
+		if c.idleLimit > 0 && delay > c.idleLimit {
+			delay = c.idleLimit
+		}
+		if !c.wait(ctx, time.Duration(float64(delay)/c.speed), keyC) {
+			return nil
+		}
+
+		os.Stdout.Write([]byte(ev.Data))
+	}
+
+	return nil
+}
+
+// wait waits for delay to elapse, pausing and resuming on space. While paused
+// `.` skips the rest of the delay. It returns false if ctx is done.
+func (c *Play) wait(
+	ctx context.Context,
+	delay time.Duration,
+	keyC <-chan byte,
+) bool {
+	for {
+		if c.paused {
+			select {
+			case <-ctx.Done():
+				return false
+			case k := <-keyC:
+				switch k {
+				case ' ':
+					c.paused = false
+				case '.':
+					return true
+				}
+			}
+			continue
+		}
+
+		start := time.Now()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+			return true
+		case k := <-keyC:
+			timer.Stop()
+			delay -= time.Since(start)
+			if k == ' ' {
+				c.paused = true
+			}
+		}
+	}
+}
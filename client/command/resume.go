@@ -0,0 +1,80 @@
+package command
+
+import (
+	"context"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmResume is the command name.
+	CmdNmResume cli.CmdName = "resume"
+)
+
+func init() {
+	cli.Registrar[CmdNmResume] = NewResume
+}
+
+// Resume resumes the current warp if it was paused.
+type Resume struct{}
+
+// NewResume constructs and initializes the command.
+func NewResume() cli.Command {
+	return &Resume{}
+}
+
+// Name returns the command name.
+func (c *Resume) Name() cli.CmdName {
+	return CmdNmResume
+}
+
+// Help prints out the help message for the command.
+func (c *Resume) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp resume\n")
+	out.Normf("\n")
+	out.Normf("  Resumes the current warp, paused with ")
+	out.Boldf("warp pause")
+	out.Normf(". The input of the clients\n")
+	out.Normf("  held while it was paused, if any, is written to the warp.\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp resume\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Resume) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Resume) Execute(
+	ctx context.Context,
+) error {
+	err := cli.CheckEnvWarp(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = cli.RunLocalCommand(ctx, warp.Command{
+		Type: warp.CmdTpResume,
+		Args: []string{},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	out.Normf("Warp resumed.\n")
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package command
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// maxCSILength bounds the size of the CSI sequences buffered while waiting for
+// their final byte. Longer sequences are dropped.
+const maxCSILength = 256
+
+// safeViewState is the state of the safeView parser.
+type safeViewState int
+
+const (
+	svGround safeViewState = iota
+	// svC1 follows a 0xc2 byte, which starts the UTF-8 encoding of the C1
+	// controls.
+	svC1
+	svEscape
+	svEscapeIntermediate
+	svCSI
+	// svCSIDiscard drops a CSI sequence too long to be buffered.
+	svCSIDiscard
+	svOSC
+	svOSCEscape
+	// svString drops the content of DCS, SOS, PM and APC strings (and of OSC
+	// sequences too long to be buffered) until their terminator.
+	svString
+	svStringEscape
+)
+
+// safeViewCSIFinals are the final bytes of the CSI sequences passed through:
+// SGR, cursor movement, erasing, scrolling and modes. Other sequences (device
+// status and attributes reports, window manipulation, ...) are dropped, in
+// particular those making the terminal answer on its input.
+const safeViewCSIFinals = "@ABCDEFGHIJKLMPSTXZ`abdefghlmrsu"
+
+// safeViewEscFinals are the final bytes of the escape sequences without
+// intermediate passed through: save and restore cursor, index, next line,
+// reverse index, keypad modes and reset.
+const safeViewEscFinals = "78DEM=>c"
+
+// safeViewEscIntermediates are the intermediate bytes of the escape sequences
+// passed through: character set designations and line attributes.
+const safeViewEscIntermediates = "()*+#"
+
+// safeView filters the warp output for untrusted warps, passing through text
+// and the escape sequences needed by common applications (colors, cursor
+// movement, alternate screen, ...) while dropping those that could confuse or
+// exploit the local terminal: DCS, SOS, PM and APC strings, OSC sequences
+// (except window titles, sanitized as in titleSync), CSI sequences that make
+// the terminal report on its input, C0 controls other than the usual
+// formatting ones and C1 controls.
+//
+// The parser is a state machine, so sequences may be split across writes.
+// Some applications relying on dropped sequences (hyperlinks, clipboard
+// access, terminal queries) don't render or behave as on the host.
+type safeView struct {
+	w io.Writer
+
+	state safeViewState
+	// seq holds the sequence being parsed.
+	seq []byte
+
+	mutex *sync.Mutex
+}
+
+// newSafeView constructs a safeView writing to w.
+func newSafeView(
+	w io.Writer,
+) *safeView {
+	return &safeView{
+		w:     w,
+		state: svGround,
+		seq:   []byte{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Reset drops the sequence being parsed, if any, as the warp output starts
+// over on reconnection.
+func (v *safeView) Reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.state = svGround
+	v.seq = v.seq[:0]
+}
+
+// Write implements the io.Writer interface.
+func (v *safeView) Write(
+	p []byte,
+) (int, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		out = v.feed(out, b)
+	}
+
+	if len(out) > 0 {
+		if _, err := v.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// escape starts a new escape sequence, dropping the one being parsed. The lock
+// must be held.
+func (v *safeView) escape() {
+	v.state = svEscape
+	v.seq = append(v.seq[:0], 0x1b)
+}
+
+// feed parses b, appending the data to pass through to out. The lock must be
+// held.
+func (v *safeView) feed(
+	out []byte,
+	b byte,
+) []byte {
+	// CAN and SUB abort sequences and ESC starts a new one, whatever the
+	// state (except in OSC sequences and strings, where ESC may start ST).
+	switch {
+	case b == 0x18 || b == 0x1a:
+		v.state = svGround
+		return out
+	case b == 0x1b && v.state != svOSC && v.state != svString:
+		v.escape()
+		return out
+	}
+
+	switch v.state {
+	case svGround:
+		switch {
+		case b == 0xc2:
+			v.state = svC1
+		case b < 0x20:
+			// BEL, BS, HT, LF, VT, FF and CR.
+			if b >= 0x07 && b <= 0x0d {
+				out = append(out, b)
+			}
+		default:
+			out = append(out, b)
+		}
+
+	case svC1:
+		v.state = svGround
+		if b < 0x80 || b > 0x9f {
+			out = append(out, 0xc2)
+			out = v.feed(out, b)
+		}
+
+	case svEscape:
+		switch {
+		case b == '[':
+			v.state = svCSI
+			v.seq = append(v.seq, b)
+		case b == ']':
+			v.state = svOSC
+			v.seq = append(v.seq, b)
+		case b == 'P' || b == 'X' || b == '^' || b == '_':
+			v.state = svString
+		case strings.IndexByte(safeViewEscIntermediates, b) >= 0:
+			v.state = svEscapeIntermediate
+			v.seq = append(v.seq, b)
+		case strings.IndexByte(safeViewEscFinals, b) >= 0:
+			v.state = svGround
+			out = append(out, 0x1b, b)
+		default:
+			v.state = svGround
+		}
+
+	case svEscapeIntermediate:
+		v.state = svGround
+		if b >= 0x30 && b <= 0x7e {
+			out = append(out, v.seq...)
+			out = append(out, b)
+		}
+
+	case svCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			v.state = svGround
+			if safeCSI(v.seq[2:], b) {
+				out = append(out, v.seq...)
+				out = append(out, b)
+			}
+		case b >= 0x20 && b <= 0x3f:
+			v.seq = append(v.seq, b)
+			if len(v.seq) > maxCSILength {
+				v.state = svCSIDiscard
+			}
+		default:
+			// Controls within sequences are dropped.
+		}
+
+	case svCSIDiscard:
+		if b >= 0x40 && b <= 0x7e {
+			v.state = svGround
+		}
+
+	case svOSC:
+		switch {
+		case b == 0x07:
+			v.state = svGround
+			out = v.osc(out)
+		case b == 0x1b:
+			v.state = svOSCEscape
+		default:
+			v.seq = append(v.seq, b)
+			if len(v.seq) > maxOSCLength {
+				v.state = svString
+			}
+		}
+
+	case svOSCEscape:
+		if b == '\\' {
+			v.state = svGround
+			out = v.osc(out)
+		} else {
+			v.escape()
+			out = v.feed(out, b)
+		}
+
+	case svString:
+		if b == 0x1b {
+			v.state = svStringEscape
+		}
+
+	case svStringEscape:
+		if b == '\\' {
+			v.state = svGround
+		} else {
+			v.escape()
+			out = v.feed(out, b)
+		}
+	}
+
+	return out
+}
+
+// osc appends the OSC sequence parsed to out if it sets the window title,
+// sanitized. The lock must be held.
+func (v *safeView) osc(
+	out []byte,
+) []byte {
+	if title, ok := parseTitle(v.seq[2:]); ok {
+		out = append(out, "\x1b]2;"+title+"\x07"...)
+	}
+	return out
+}
+
+// safeCSI returns whether the CSI sequence with parameters params (and
+// intermediate bytes) and final byte final is passed through. Sequences with
+// intermediate bytes are dropped, as are private sequences other than DEC
+// private modes (most of them being queries).
+func safeCSI(
+	params []byte,
+	final byte,
+) bool {
+	for _, b := range params {
+		if b < 0x30 {
+			return false
+		}
+	}
+	if len(params) > 0 && params[0] >= 0x3c {
+		return params[0] == '?' && (final == 'h' || final == 'l')
+	}
+	return strings.IndexByte(safeViewCSIFinals, final) >= 0
+}
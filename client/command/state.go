@@ -2,6 +2,8 @@ package command
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/client"
@@ -92,6 +94,63 @@ func PrintSessionState(
 		out.Valuf(
 			"%dx%d\n", state.WindowSize.Cols, state.WindowSize.Rows,
 		)
+		if state.RateLimit > 0 {
+			out.Normf("  Client rate limit: ")
+			out.Valuf(
+				"%d B/s (burst %d B)\n", state.RateLimit, state.RateBurst,
+			)
+		}
+		if !state.CreatedAt.IsZero() {
+			out.Normf("  Created: ")
+			out.Valuf(
+				"%s (%s ago)\n",
+				state.CreatedAt.Local().Format(time.RFC1123),
+				time.Since(state.CreatedAt).Round(time.Second),
+			)
+		}
+		if !state.ExpiresAt.IsZero() {
+			out.Normf("  Expires: ")
+			out.Valuf(
+				"%s (in %s)\n",
+				state.ExpiresAt.Local().Format(time.RFC1123),
+				time.Until(state.ExpiresAt).Round(time.Second),
+			)
+		}
+		if state.WriteLock {
+			out.Normf("  Keyboard: ")
+			if u, ok := state.Users[state.WriteHolder]; ok {
+				out.Valuf("%s", u.Username)
+			} else {
+				out.Valuf("free")
+			}
+			if len(state.WriteRequests) > 0 {
+				usernames := []string{}
+				for _, token := range state.WriteRequests {
+					usernames = append(usernames, state.Users[token].Username)
+				}
+				out.Normf(" (requested by ")
+				out.Valuf("%s", strings.Join(usernames, ", "))
+				out.Normf(")")
+			}
+			out.Normf("\n")
+		}
+		if state.Paused {
+			out.Normf("  Paused: ")
+			if state.PausedHold {
+				out.Valuf("input held")
+			} else {
+				out.Valuf("input dropped")
+			}
+			if state.PausedOutput {
+				out.Normf(", ")
+				out.Valuf("output hidden")
+			}
+			out.Normf("\n")
+		}
+		if len(state.Panes) > 0 {
+			out.Normf("  Panes: ")
+			out.Valuf("%s\n", strings.Join(state.Panes, ", "))
+		}
 	}
 	out.Normf("  Status: ")
 	if disconnected {
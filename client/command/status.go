@@ -0,0 +1,453 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp"
+)
+
+// defaultStatusKey is the key toggling the status bar of the connect client,
+// sent as 0x1e by a terminal in raw mode.
+const defaultStatusKey = "ctrl-^"
+
+// statusRefreshInterval is the interval at which the status bar is refreshed.
+const statusRefreshInterval = time.Second
+
+// statusState is the state of the statusBar output parser.
+type statusState int
+
+const (
+	stGround statusState = iota
+	stEscape
+	stCSI
+	// stString skips OSC sequences and DCS, SOS, PM and APC strings until
+	// their terminator.
+	stString
+	stStringEscape
+)
+
+// statusBar displays a one-line status bar on the last row of the local
+// terminal, below the warp: the warp ID, the mode of the user, the number of
+// participants, the latency to warpd and the data transferred.
+//
+// The scrolling region of the terminal is restricted to the rows above the
+// bar. The warp output goes through the statusBar so that scrolling regions
+// set by the warp are kept above the bar, and the bar is redrawn when the warp
+// erases the screen. The bar is hidden while the warp is in the alternate
+// screen (full-screen applications), the row being left blank. It is drawn
+// by saving and restoring the cursor (DECSC/DECRC), which clobbers the cursor
+// saved by the warp if it is drawn in between.
+type statusBar struct {
+	w io.Writer
+
+	// shown is whether the bar is displayed, as toggled by the user.
+	// altScreen indicates that the warp output is in the alternate screen.
+	shown     bool
+	altScreen bool
+	// rows and cols are the size of the local terminal.
+	rows int
+	cols int
+
+	state statusState
+	// seq holds the CSI sequence being parsed.
+	seq []byte
+	// dirty indicates that the bar must be redrawn once the output parsed is
+	// back to ground state. drawn is the bar last drawn.
+	dirty bool
+	drawn string
+
+	warp      string
+	mode      string
+	paused    bool
+	users     int
+	connected bool
+	latency   time.Duration
+	in        int64
+	out       int64
+
+	mutex *sync.Mutex
+}
+
+// newStatusBar constructs a statusBar writing to w. It is displayed once its
+// size is set with Resize.
+func newStatusBar(
+	w io.Writer,
+) *statusBar {
+	return &statusBar{
+		w:     w,
+		shown: true,
+		state: stGround,
+		seq:   []byte{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// SetWarp sets the ID of the warp displayed.
+func (s *statusBar) SetWarp(
+	warp string,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.warp = warp
+}
+
+// Shown returns whether the bar is displayed, in which case it takes the last
+// row of the terminal.
+func (s *statusBar) Shown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shown
+}
+
+// Toggle shows or hides the bar, returning whether it is shown.
+func (s *statusBar) Toggle() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.shown {
+		s.write(s.clear() + "\x1b7\x1b[r\x1b8")
+		s.shown = false
+	} else {
+		s.shown = true
+		if !s.altScreen {
+			s.write(s.region())
+			s.dirty = true
+			s.refresh()
+		}
+	}
+	return s.shown
+}
+
+// Resize sets the size of the local terminal, restricting the scrolling
+// region and redrawing the bar accordingly.
+func (s *statusBar) Resize(
+	rows int,
+	cols int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rows = rows
+	s.cols = cols
+	if s.shown && !s.altScreen {
+		s.write(s.region())
+		s.dirty = true
+		s.refresh()
+	}
+}
+
+// Update updates the mode of user, the number of participants and whether the
+// warp is paused from a state of the warp.
+func (s *statusBar) Update(
+	st warp.State,
+	user string,
+	readOnly bool,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.mode = "RO"
+	if u, ok := st.Users[user]; ok &&
+		u.Mode&warp.ModeShellWrite != 0 && !readOnly {
+		s.mode = "RW"
+	}
+	s.users = len(st.Users)
+	s.paused = st.Paused
+	s.refresh()
+}
+
+// SetLatency sets the latency to warpd, connected being false while
+// reconnecting.
+func (s *statusBar) SetLatency(
+	latency time.Duration,
+	connected bool,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latency = latency
+	s.connected = connected
+	s.refresh()
+}
+
+// AddIn accounts for n bytes of output received from the warp.
+func (s *statusBar) AddIn(
+	n int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.in += int64(n)
+}
+
+// AddOut accounts for n bytes of input sent to the warp.
+func (s *statusBar) AddOut(
+	n int,
+) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.out += int64(n)
+}
+
+// Reset resets the parser, as the warp output starts over on reconnection.
+func (s *statusBar) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = stGround
+	s.seq = s.seq[:0]
+}
+
+// Close erases the bar and restores the scrolling region of the terminal.
+func (s *statusBar) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.shown {
+		s.write(s.clear() + "\x1b7\x1b[r\x1b8")
+		s.shown = false
+	}
+}
+
+// Write implements the io.Writer interface.
+func (s *statusBar) Write(
+	p []byte,
+) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		out = s.feed(out, b)
+	}
+	if s.dirty && s.state == stGround && s.visible() {
+		s.drawn = s.draw()
+		out = append(out, s.drawn...)
+		s.dirty = false
+	}
+
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// feed parses b, appending the data to write to out. The lock must be held.
+func (s *statusBar) feed(
+	out []byte,
+	b byte,
+) []byte {
+	switch s.state {
+	case stGround:
+		if b == 0x1b {
+			s.state = stEscape
+		}
+		return append(out, b)
+
+	case stEscape:
+		switch {
+		case b == '[':
+			s.state = stCSI
+			s.seq = s.seq[:0]
+			return out
+		case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+			s.state = stString
+		case b == 'c':
+			// A reset restores the full scrolling region.
+			s.state = stGround
+			out = append(out, b)
+			if s.shown {
+				out = append(out, s.region()...)
+				s.dirty = true
+			}
+			return out
+		case b != 0x1b:
+			s.state = stGround
+		}
+		return append(out, b)
+
+	case stCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			s.state = stGround
+			return s.csi(out, b)
+		case b == 0x1b || b == 0x18 || b == 0x1a || len(s.seq) >= maxCSILength:
+			// The sequence is passed through untouched.
+			s.state = stGround
+			out = append(out, "\x1b["...)
+			out = append(out, s.seq...)
+			return s.feed(out, b)
+		default:
+			s.seq = append(s.seq, b)
+			return out
+		}
+
+	case stString:
+		switch b {
+		case 0x07, 0x18, 0x1a:
+			s.state = stGround
+		case 0x1b:
+			s.state = stStringEscape
+		}
+		return append(out, b)
+
+	case stStringEscape:
+		if b == '\\' {
+			s.state = stGround
+			return append(out, b)
+		}
+		// The string is aborted by the escape sequence starting.
+		s.state = stEscape
+		return s.feed(out, b)
+	}
+
+	return out
+}
+
+// csi appends the CSI sequence parsed with final byte final to out, tracking
+// the alternate screen and keeping the scrolling regions set above the bar.
+// The lock must be held.
+func (s *statusBar) csi(
+	out []byte,
+	final byte,
+) []byte {
+	params := string(s.seq)
+	switch {
+	case final == 'r' && s.shown && s.rows > 1 && isNumeric(params):
+		top, bottom := "1", ""
+		if p := strings.SplitN(params, ";", 2); len(p) == 2 {
+			top, bottom = p[0], p[1]
+		} else if p[0] != "" {
+			top = p[0]
+		}
+		if b, err := strconv.Atoi(bottom); err != nil || b == 0 || b >= s.rows {
+			bottom = strconv.Itoa(s.rows - 1)
+		}
+		return append(out, fmt.Sprintf("\x1b[%s;%sr", top, bottom)...)
+
+	case (final == 'h' || final == 'l') && strings.HasPrefix(params, "?"):
+		alt := false
+		for _, m := range strings.Split(params[1:], ";") {
+			if m == "47" || m == "1047" || m == "1049" {
+				alt = true
+			}
+		}
+		if alt {
+			s.altScreen = final == 'h'
+			out = append(out, "\x1b["...)
+			out = append(out, s.seq...)
+			out = append(out, final)
+			// Full-screen applications may reset the scrolling region on
+			// exit, the bar being redrawn as well.
+			if !s.altScreen && s.shown {
+				out = append(out, s.region()...)
+				s.dirty = true
+			}
+			return out
+		}
+
+	case final == 'J' && (params == "" || params == "0" ||
+		params == "2" || params == "3"):
+		s.dirty = true
+	}
+
+	out = append(out, "\x1b["...)
+	out = append(out, s.seq...)
+	return append(out, final)
+}
+
+// isNumeric returns whether params are numeric parameters.
+func isNumeric(
+	params string,
+) bool {
+	return strings.Trim(params, "0123456789;") == ""
+}
+
+// visible returns whether the bar is currently displayed. The lock must be
+// held.
+func (s *statusBar) visible() bool {
+	return s.shown && !s.altScreen && s.rows > 1
+}
+
+// refresh redraws the bar if visible and changed (or dirty), or marks it dirty
+// to redraw it once the output is back to ground state. The lock must be held.
+func (s *statusBar) refresh() {
+	if !s.visible() {
+		return
+	}
+	bar := s.draw()
+	if bar == s.drawn && !s.dirty {
+		return
+	}
+	if s.state != stGround {
+		s.dirty = true
+		return
+	}
+	s.write(bar)
+	s.drawn = bar
+	s.dirty = false
+}
+
+// write writes data to the terminal, ignoring errors. The lock must be held.
+func (s *statusBar) write(
+	data string,
+) {
+	if s.rows > 1 {
+		s.w.Write([]byte(data))
+	}
+}
+
+// region returns the sequence restricting the scrolling region above the bar.
+// The lock must be held.
+func (s *statusBar) region() string {
+	return fmt.Sprintf("\x1b7\x1b[1;%dr\x1b8", s.rows-1)
+}
+
+// clear returns the sequence erasing the bar. The lock must be held.
+func (s *statusBar) clear() string {
+	return fmt.Sprintf("\x1b7\x1b[%d;1H\x1b[2K\x1b8", s.rows)
+}
+
+// draw returns the sequence drawing the bar. The lock must be held.
+func (s *statusBar) draw() string {
+	latency := "reconnecting"
+	if s.connected {
+		latency = fmt.Sprintf(
+			"latency %s", s.latency.Round(10*time.Microsecond),
+		)
+	}
+	mode := s.mode
+	if s.paused {
+		mode += " (paused)"
+	}
+	line := fmt.Sprintf(
+		" warp %s | %s | %d users | %s | in %s out %s",
+		s.warp, mode, s.users, latency, formatBytes(s.in), formatBytes(s.out),
+	)
+	if len(line) > s.cols {
+		line = line[:s.cols]
+	} else {
+		line += strings.Repeat(" ", s.cols-len(line))
+	}
+	return fmt.Sprintf("\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", s.rows, line)
+}
+
+// formatBytes formats a number of bytes for display.
+func formatBytes(
+	n int64,
+) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,83 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+// splitSuspend removes the suspend key from input data, returning whether it
+// was pressed. The input surrounding it is forwarded as is.
+func (c *Connect) splitSuspend(
+	data []byte,
+) ([]byte, bool) {
+	if c.suspendKey == 0 || bytes.IndexByte(data, c.suspendKey) < 0 {
+		return data, false
+	}
+	return bytes.Replace(data, []byte{c.suspendKey}, nil, -1), true
+}
+
+// suspend suspends the client as Ctrl-Z would suspend a program run from the
+// local shell (in raw mode, the terminal sends Ctrl-Z to the warp instead).
+// The local terminal is restored before the process stops and, once resumed
+// (fg), put back in raw mode and resized to the warp window size, which may
+// have changed in the meantime. Output received while suspended is displayed
+// on resume. An error is returned if the terminal can't be put back in raw
+// mode.
+func (c *Connect) suspend(
+	ctx context.Context,
+) error {
+	stdin := int(os.Stdin.Fd())
+
+	// The status bar and the title are restored as on exit.
+	shown := c.status != nil && c.status.Shown()
+	if shown {
+		c.status.Toggle()
+	}
+	if c.title != nil {
+		os.Stdout.WriteString(popTitleSequence)
+	}
+	out.Statf("\r\n[warp] Suspended, run fg to resume.\r\n")
+	if err := terminal.Restore(stdin, c.termState); err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to restore the terminal: %v.", err),
+		)
+	}
+
+	// The process stops here until it is continued (SIGCONT).
+	if err := syscall.Kill(os.Getpid(), syscall.SIGSTOP); err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to suspend: %v.", err),
+		)
+	}
+
+	// The shell may have changed the terminal attributes while suspended, so
+	// raw mode is entered again rather than restored.
+	if _, err := terminal.MakeRaw(stdin); err != nil {
+		return errors.Trace(
+			errors.Newf("Unable to put terminal in raw mode: %v.", err),
+		)
+	}
+	if c.title != nil {
+		os.Stdout.WriteString(pushTitleSequence)
+	}
+	if shown {
+		c.status.Toggle()
+		c.resizeStatus()
+	}
+	out.Statf("[warp] Resumed warp: %s\r\n", c.warp)
+
+	// The terminal may have been resized locally, and the warp remotely.
+	if c.fit {
+		c.sendFitSize(ctx)
+	} else if ss := c.Session(); ss != nil {
+		c.resizeTerminal(ss.WindowSize())
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package command
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxOSCLength bounds the size of the OSC sequences buffered while
+	// waiting for their terminator. Longer sequences are passed through.
+	maxOSCLength = 4096
+	// maxTitleLength is the maximum length in bytes of the titles applied.
+	maxTitleLength = 256
+)
+
+const (
+	// pushTitleSequence saves the terminal title on the terminal title stack
+	// and popTitleSequence restores it.
+	pushTitleSequence = "\x1b[22;0t"
+	popTitleSequence  = "\x1b[23;0t"
+)
+
+// titleSync intercepts the OSC sequences setting the terminal title in the
+// warp output and applies the titles to the local terminal itself: titles are
+// stripped of control characters and bounded, and the title the terminal had
+// before connecting is restored on exit (see Connect.Execute). Other sequences
+// are passed through untouched.
+//
+// Sequences may be split across writes, incomplete sequences being buffered
+// until their terminator is received.
+type titleSync struct {
+	w io.Writer
+
+	// buf holds the incomplete escape sequence ending the data written.
+	buf []byte
+
+	mutex *sync.Mutex
+}
+
+// newTitleSync constructs a titleSync writing to w.
+func newTitleSync(
+	w io.Writer,
+) *titleSync {
+	return &titleSync{
+		w:     w,
+		buf:   []byte{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Reset drops the incomplete sequence buffered, if any, as the warp output
+// starts over on reconnection.
+func (t *titleSync) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.buf = t.buf[:0]
+}
+
+// Write implements the io.Writer interface.
+func (t *titleSync) Write(
+	p []byte,
+) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	data := append(t.buf, p...)
+	t.buf = []byte{}
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		j := bytes.IndexByte(data[i:], 0x1b)
+		if j < 0 {
+			out = append(out, data[i:]...)
+			break
+		}
+		out = append(out, data[i:i+j]...)
+		i += j
+		if i+1 == len(data) {
+			t.buf = append(t.buf, data[i:]...)
+			break
+		}
+		if data[i+1] != ']' {
+			out = append(out, data[i])
+			i++
+			continue
+		}
+		end, length := oscTerminator(data[i+2:])
+		if end < 0 {
+			if len(data)-i > maxOSCLength {
+				out = append(out, data[i:]...)
+			} else {
+				t.buf = append(t.buf, data[i:]...)
+			}
+			break
+		}
+		seq := data[i : i+2+end+length]
+		if title, ok := parseTitle(data[i+2 : i+2+end]); ok {
+			out = append(out, "\x1b]2;"+title+"\x07"...)
+		} else {
+			out = append(out, seq...)
+		}
+		i += len(seq)
+	}
+
+	if len(out) > 0 {
+		if _, err := t.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// oscTerminator returns the index and length of the terminator (BEL or ST) of
+// the OSC sequence whose content starts data, or -1 if it is not received yet.
+func oscTerminator(
+	data []byte,
+) (int, int) {
+	for i, b := range data {
+		switch {
+		case b == 0x07:
+			return i, 1
+		case b == 0x1b && i+1 < len(data) && data[i+1] == '\\':
+			return i, 2
+		}
+	}
+	return -1, 0
+}
+
+// parseTitle returns the sanitized title set by the content of an OSC
+// sequence, if it sets the window title (OSC 0 or 2).
+func parseTitle(
+	content []byte,
+) (string, bool) {
+	s := strings.SplitN(string(content), ";", 2)
+	if len(s) != 2 || (s[0] != "0" && s[0] != "2") {
+		return "", false
+	}
+	title := strings.Map(func(r rune) rune {
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, s[1])
+	if len(title) > maxTitleLength {
+		title = strings.ToValidUTF8(title[:maxTitleLength], "")
+	}
+	return title, true
+}
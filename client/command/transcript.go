@@ -0,0 +1,210 @@
+package command
+
+import (
+	"bufio"
+	"os"
+	"sync"
+
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+// transcriptBufferSize is the number of writes buffered by a transcript before
+// it starts dropping them.
+const transcriptBufferSize = 1024
+
+// transcriptState is the state of the transcript escape sequences stripper.
+type transcriptState int
+
+const (
+	trGround transcriptState = iota
+	trEscape
+	trCSI
+	// trString skips OSC sequences and DCS, SOS, PM and APC strings until
+	// their terminator.
+	trString
+	trStringEscape
+)
+
+// transcript tees the warp output to a file. Writes are handed to a background
+// goroutine so that a slow disk never blocks the output to the terminal: they
+// are dropped once its buffer is full.
+//
+// If strip is set, escape sequences, carriage returns and the C0 controls
+// other than tabs and line feeds are removed, leaving a plain text transcript
+// of the warp. The stripper is a state machine, so sequences may be split
+// across writes.
+type transcript struct {
+	file  *os.File
+	strip bool
+	state transcriptState
+
+	dataC chan []byte
+	doneC chan struct{}
+	err   error
+
+	// dropping is set while writes are dropped, to warn once per burst.
+	dropping bool
+	closed   bool
+	mutex    *sync.Mutex
+}
+
+// newTranscript creates the file at path and returns a transcript writing the
+// warp output to it.
+func newTranscript(
+	path string,
+	strip bool,
+) (*transcript, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	t := &transcript{
+		file:  f,
+		strip: strip,
+		state: trGround,
+		dataC: make(chan []byte, transcriptBufferSize),
+		doneC: make(chan struct{}),
+		mutex: &sync.Mutex{},
+	}
+	go t.run()
+
+	return t, nil
+}
+
+// Write implements the io.Writer interface. It never blocks nor fails, data
+// being dropped if the transcript is lagging behind or closed.
+func (t *transcript) Write(
+	p []byte,
+) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return len(p), nil
+	}
+
+	// The data is copied as the caller may reuse p.
+	select {
+	case t.dataC <- append([]byte{}, p...):
+		t.dropping = false
+	default:
+		if !t.dropping {
+			t.dropping = true
+			out.Warnf("\r\n[warp] Output file is lagging behind, dropping output.\r\n")
+		}
+	}
+	return len(p), nil
+}
+
+// Close flushes the pending data and closes the file. It returns the first
+// error encountered while writing the file, if any.
+func (t *transcript) Close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.dataC)
+	t.mutex.Unlock()
+
+	<-t.doneC
+	if err := t.file.Close(); err != nil && t.err == nil {
+		t.err = errors.Trace(err)
+	}
+	return t.err
+}
+
+// run writes data to the file until dataC is closed.
+func (t *transcript) run() {
+	defer close(t.doneC)
+	w := bufio.NewWriter(t.file)
+
+	for data := range t.dataC {
+		if t.err != nil {
+			continue
+		}
+		if t.strip {
+			plain := make([]byte, 0, len(data))
+			for _, b := range data {
+				plain = t.feed(plain, b)
+			}
+			data = plain
+		}
+		if _, err := w.Write(data); err != nil {
+			t.err = errors.Trace(err)
+			continue
+		}
+		// Flush once the backlog is drained to keep the file current without
+		// a syscall per write.
+		if len(t.dataC) == 0 {
+			if err := w.Flush(); err != nil {
+				t.err = errors.Trace(err)
+			}
+		}
+	}
+
+	if t.err == nil {
+		if err := w.Flush(); err != nil {
+			t.err = errors.Trace(err)
+		}
+	}
+}
+
+// feed parses b, appending the plain text to out. It is only called by run.
+func (t *transcript) feed(
+	out []byte,
+	b byte,
+) []byte {
+	switch t.state {
+	case trGround:
+		switch {
+		case b == 0x1b:
+			t.state = trEscape
+		case b == '\t' || b == '\n' || b >= 0x20 && b != 0x7f:
+			out = append(out, b)
+		}
+
+	case trEscape:
+		switch {
+		case b == '[':
+			t.state = trCSI
+		case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+			t.state = trString
+		case b >= 0x20 && b <= 0x2f:
+			// Intermediate bytes, up to the final byte of the sequence.
+		case b != 0x1b:
+			t.state = trGround
+		}
+
+	case trCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			t.state = trGround
+		case b == 0x18 || b == 0x1a:
+			t.state = trGround
+		case b == 0x1b:
+			t.state = trEscape
+		}
+
+	case trString:
+		switch b {
+		case 0x07, 0x18, 0x1a:
+			t.state = trGround
+		case 0x1b:
+			t.state = trStringEscape
+		}
+
+	case trStringEscape:
+		if b == '\\' {
+			t.state = trGround
+		} else {
+			// The string is aborted by the escape sequence starting.
+			t.state = trEscape
+			out = t.feed(out, b)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,94 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+const (
+	// CmdNmVersion is the command name.
+	CmdNmVersion cli.CmdName = "version"
+)
+
+func init() {
+	cli.Registrar[CmdNmVersion] = NewVersion
+}
+
+// Version prints the version of the warp client.
+type Version struct {
+	json bool
+}
+
+// NewVersion constructs and initializes the command.
+func NewVersion() cli.Command {
+	return &Version{}
+}
+
+// Name returns the command name.
+func (c *Version) Name() cli.CmdName {
+	return CmdNmVersion
+}
+
+// Help prints out the help message for the command.
+func (c *Version) Help(
+	ctx context.Context,
+) {
+	out.Normf("\nUsage: ")
+	out.Boldf("warp version\n")
+	out.Normf("\n")
+	out.Normf("  Displays the version of warp, the version of the protocol it speaks with\n")
+	out.Normf("  warpd, the git commit it was built from and the Go version used to build it.\n")
+	out.Normf("\n")
+	out.Normf("Flags:\n")
+	out.Boldf("  --json\n")
+	out.Normf("    Output a single JSON object, suitable for scripts.\n")
+	out.Normf("\n")
+	out.Normf("Examples:\n")
+	out.Valuf("  warp version\n")
+	out.Valuf("  warp version --json\n")
+	out.Normf("\n")
+}
+
+// Parse parses the arguments passed to the command.
+func (c *Version) Parse(
+	ctx context.Context,
+	args []string,
+	flags map[string]string,
+) error {
+	if _, ok := flags["json"]; ok {
+		c.json = true
+	}
+	return nil
+}
+
+// Execute the command or return a human-friendly error.
+func (c *Version) Execute(
+	ctx context.Context,
+) error {
+	info := cli.RetrieveBuildInfo()
+
+	if c.json {
+		raw, err := json.Marshal(info)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// Printed without formatting to remain parseable.
+		fmt.Println(string(raw))
+		return nil
+	}
+
+	out.Boldf("warp v%s\n", info.Version)
+	out.Normf("  Protocol: ")
+	out.Valuf("%d\n", info.ProtocolVersion)
+	out.Normf("  Commit: ")
+	out.Valuf("%s\n", info.Commit)
+	out.Normf("  Go: ")
+	out.Valuf("%s\n", info.GoVersion)
+
+	return nil
+}
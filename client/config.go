@@ -34,7 +34,8 @@ func ConfigPath(
 		return nil, errors.Trace(err)
 	}
 
-	err = os.MkdirAll(filepath.Dir(path), 0777)
+	// The config holds the user secret.
+	err = os.MkdirAll(filepath.Dir(path), 0700)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -51,9 +52,19 @@ func RetrieveConfig(
 		return nil, errors.Trace(err)
 	}
 
-	if _, err := os.Stat(*path); os.IsNotExist(err) {
+	info, err := os.Stat(*path)
+	if os.IsNotExist(err) {
 		return nil, nil
 	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Configs generated by previous versions were readable by all users.
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(*path, 0600); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
 
 	raw, err := ioutil.ReadFile(*path)
 	if err != nil {
@@ -91,7 +102,7 @@ func GenerateConfig(
 		return nil, errors.Trace(err)
 	}
 
-	err = ioutil.WriteFile(*path, formatted, 0644)
+	err = ioutil.WriteFile(*path, formatted, 0600)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -0,0 +1,538 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+// dialTimeout bounds the time spent establishing the connection to warpd,
+// including the TLS handshake, so that a misconfigured client (TLS against a
+// plaintext warpd or the reverse) errors instead of hanging forever.
+const dialTimeout = 10 * time.Second
+
+const (
+	// defaultWait is the time DialWait waits for warpd when the `wait` flag
+	// is passed without a duration.
+	defaultWait = time.Minute
+	// maxWaitBackoff bounds the delay between two attempts of DialWait.
+	maxWaitBackoff = 5 * time.Second
+)
+
+// EnvKeepAlive is the env variable from which the interval of the TCP
+// keepalive probes sent to warpd is read (warp.DefaultKeepAlive if not set,
+// disabled if negative).
+var EnvKeepAlive = "WARP_KEEPALIVE"
+
+// keepAlive returns the interval of the TCP keepalive probes sent to warpd.
+func keepAlive() (time.Duration, error) {
+	k := os.Getenv(EnvKeepAlive)
+	if k == "" {
+		return warp.DefaultKeepAlive, nil
+	}
+	d, err := time.ParseDuration(k)
+	if err != nil {
+		return 0, errors.Trace(
+			errors.Newf("Invalid %s: %s", EnvKeepAlive, k),
+		)
+	}
+	return d, nil
+}
+
+// EnvStreamWindow is the env variable from which the receive window in bytes
+// of the session channels is read (warp.DefaultStreamWindow if not set).
+var EnvStreamWindow = "WARP_STREAM_WINDOW"
+
+// EnvCodec is the env variable from which the wire encoding of the session
+// messages is read (warp.GobCodec if not set). It must match the codec warpd
+// is configured with.
+var EnvCodec = "WARPD_CODEC"
+
+// ResolveCodec returns the wire encoding of the session messages.
+func ResolveCodec() (warp.Codec, error) {
+	c, err := warp.ParseCodec(os.Getenv(EnvCodec))
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Invalid %s: %v", EnvCodec, err),
+		)
+	}
+	return c, nil
+}
+
+// streamWindow returns the receive window of the session channels.
+func streamWindow() (uint32, error) {
+	w := os.Getenv(EnvStreamWindow)
+	if w == "" {
+		return warp.DefaultStreamWindow, nil
+	}
+	n, err := strconv.ParseUint(w, 10, 32)
+	if err != nil || n < warp.DefaultStreamWindow {
+		return 0, errors.Trace(
+			errors.Newf(
+				"Invalid %s: %s (minimum %d)",
+				EnvStreamWindow, w, warp.DefaultStreamWindow,
+			),
+		)
+	}
+	return uint32(n), nil
+}
+
+// ResolveAddress returns the address of warpd to connect to ([ip]:port or
+// unix:path). The `address` flag takes precedence over the WARPD_ADDRESS env
+// variable which takes precedence over warp.DefaultAddress.
+func ResolveAddress(
+	ctx context.Context,
+	flags map[string]string,
+) (string, error) {
+	address := warp.DefaultAddress
+	if os.Getenv("WARPD_ADDRESS") != "" {
+		address = os.Getenv("WARPD_ADDRESS")
+	}
+	if a, ok := flags["address"]; ok {
+		address = a
+	}
+
+	if strings.HasPrefix(address, warp.UnixAddressPrefix) {
+		if strings.TrimPrefix(address, warp.UnixAddressPrefix) == "" {
+			return "", errors.Trace(
+				errors.Newf("Malformed warpd address %s: empty path", address),
+			)
+		}
+		return address, nil
+	}
+
+	normalized, err := warp.NormalizeAddress(address)
+	if err != nil {
+		return "", errors.Trace(
+			errors.Newf("Invalid warpd address: %v", err),
+		)
+	}
+
+	return normalized, nil
+}
+
+// ResolveProxy returns the URL of the HTTP proxy through which warpd at address
+// is reached, or nil if it is reached directly. The `proxy` flag takes
+// precedence over the HTTPS_PROXY env variable (HTTP_PROXY if TLS is disabled)
+// and NO_PROXY; it can be set to `none` to connect directly. Unix addresses
+// and localhost are never proxied.
+func ResolveProxy(
+	ctx context.Context,
+	flags map[string]string,
+	address string,
+	noTLS bool,
+) (*url.URL, error) {
+	if strings.HasPrefix(address, warp.UnixAddressPrefix) {
+		return nil, nil
+	}
+
+	var proxy *url.URL
+	if p, ok := flags["proxy"]; ok {
+		if p == "none" {
+			return nil, nil
+		}
+		if !strings.Contains(p, "://") {
+			p = "http://" + p
+		}
+		u, err := url.Parse(p)
+		if err != nil || u.Host == "" {
+			return nil, errors.Trace(
+				errors.Newf("Invalid proxy URL: %s", flags["proxy"]),
+			)
+		}
+		proxy = u
+	} else {
+		scheme := "https"
+		if noTLS {
+			scheme = "http"
+		}
+		u, err := http.ProxyFromEnvironment(&http.Request{
+			URL: &url.URL{Scheme: scheme, Host: address},
+		})
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Invalid proxy URL in environment: %v", err),
+			)
+		}
+		if u == nil {
+			return nil, nil
+		}
+		proxy = u
+	}
+
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return nil, errors.Trace(
+			errors.Newf(
+				"Unsupported proxy scheme %s (only HTTP proxies are "+
+					"supported): %s",
+				proxy.Scheme, proxy.Redacted(),
+			),
+		)
+	}
+	return proxy, nil
+}
+
+// dialProxy establishes a tunnel to address through the HTTP proxy at proxy
+// with the CONNECT method, authenticating with the user info of the proxy URL
+// if any.
+func dialProxy(
+	ctx context.Context,
+	proxy *url.URL,
+	address string,
+) (net.Conn, error) {
+	port := proxy.Port()
+	if port == "" {
+		port = "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := dialTCP(ctx, "proxy", net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Trace(
+				errors.Newf("TLS handshake with proxy failed: %v", err),
+			)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString(
+				[]byte(proxy.User.Username()+":"+password),
+			),
+		)
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Failed to send CONNECT to proxy: %v", err),
+		)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Failed to read CONNECT reply from proxy: %v", err),
+		)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf(
+				"Proxy %s refused to connect to warpd at %s: %s",
+				proxy.Host, address, res.Status,
+			),
+		)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Data sent by warpd right after the reply may have been buffered.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first reads are served by a buffered
+// reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements the io.Reader interface.
+func (c *bufferedConn) Read(
+	b []byte,
+) (int, error) {
+	return c.r.Read(b)
+}
+
+// lookupHost resolves the host of TCP addresses.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// dialTCP resolves the host of address and dials the resulting addresses in
+// order, returning the first connection established (see warp.TuneConn for
+// the socket options set on it). peer names what is dialed in errors.
+func dialTCP(
+	ctx context.Context,
+	peer string,
+	address string,
+) (net.Conn, error) {
+	keepAlive, err := keepAlive()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ips := []string{host}
+	if host != "" && net.ParseIP(host) == nil {
+		resolveCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		ips, err = lookupHost(resolveCtx, host)
+		cancel()
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Failed to resolve %s: %v", host, err),
+			)
+		}
+	}
+
+	failures := []string{}
+	for _, ip := range ips {
+		a := net.JoinHostPort(ip, port)
+		conn, err := (&net.Dialer{Timeout: dialTimeout}).DialContext(
+			ctx, "tcp", a,
+		)
+		if err == nil {
+			if err := warp.TuneConn(conn, keepAlive); err != nil {
+				conn.Close()
+				return nil, errors.Trace(
+					errors.Newf("Failed to set socket options: %v", err),
+				)
+			}
+			return conn, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", a, err))
+	}
+	return nil, errors.Trace(
+		errors.Newf(
+			"Failed to connect to %s at %s (%s)",
+			peer, address, strings.Join(failures, ", "),
+		),
+	)
+}
+
+// ResolveClientCert loads the client certificate presented to warpd instances
+// requiring one, from the files passed as the `cert` and `key` flags (defaulting
+// to the WARPD_CERT and WARPD_KEY env variables). It returns nil if none is
+// configured.
+func ResolveClientCert(
+	ctx context.Context,
+	flags map[string]string,
+) (*tls.Certificate, error) {
+	certFile := os.Getenv("WARPD_CERT")
+	if c, ok := flags["cert"]; ok {
+		certFile = c
+	}
+	keyFile := os.Getenv("WARPD_KEY")
+	if k, ok := flags["key"]; ok {
+		keyFile = k
+	}
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.Trace(
+			errors.Newf("A client certificate requires both --cert and --key."),
+		)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to load client certificate %s: %v", certFile, err),
+		)
+	}
+	return &cert, nil
+}
+
+// TLSConfig builds the TLS configuration used to connect to warpd. If caFile is
+// not empty, the server certificate is verified against the CA certificates it
+// contains instead of the system roots. cert, if not nil, is the client
+// certificate presented to warpd (see ResolveClientCert).
+func TLSConfig(
+	ctx context.Context,
+	insecure bool,
+	caFile string,
+	cert *tls.Certificate,
+) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	if caFile != "" {
+		raw, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Failed to read CA file %s: %v", caFile, err),
+			)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, errors.Trace(
+				errors.Newf("No valid certificate found in CA file: %s", caFile),
+			)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// Dial opens a connection to warpd at address. The connection is established
+// over TLS unless tlsConfig is nil, and tunneled through the HTTP proxy at
+// proxy unless it is nil (see ResolveProxy). If the host of a TCP address
+// resolves to multiple addresses, they are tried in order until one succeeds;
+// the address actually dialed (or the address of the proxy) is available as
+// the RemoteAddr of the returned connection.
+func Dial(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	proxy *url.URL,
+) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, warp.UnixAddressPrefix) {
+		network = "unix"
+	}
+
+	var conn net.Conn
+	var err error
+	if network == "unix" {
+		conn, err = (&net.Dialer{Timeout: dialTimeout}).DialContext(
+			ctx, network, strings.TrimPrefix(address, warp.UnixAddressPrefix),
+		)
+	} else if proxy != nil {
+		conn, err = dialProxy(ctx, proxy, address)
+	} else {
+		conn, err = dialTCP(ctx, "warpd", address)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	config := tlsConfig.Clone()
+	// The server name can't be derived from a unix socket path, it must be
+	// set explicitly or verification skipped.
+	if config.ServerName == "" && network == "tcp" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf(
+				"TLS handshake with warpd failed (is it serving TLS?): %v",
+				err,
+			),
+		)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// ParseWait parses the `wait` flag: the time to wait for warpd to be reachable
+// before giving up (defaultWait if passed without a duration, 0 if not passed
+// in which case dialing fails fast).
+func ParseWait(
+	flags map[string]string,
+) (time.Duration, error) {
+	w, ok := flags["wait"]
+	if !ok {
+		return 0, nil
+	}
+	if w == "true" {
+		return defaultWait, nil
+	}
+	wait, err := time.ParseDuration(w)
+	if err != nil || wait <= 0 {
+		return 0, errors.Trace(
+			errors.Newf("Invalid wait duration: %s", w),
+		)
+	}
+	return wait, nil
+}
+
+// DialWait is Dial retrying with exponential backoff until it succeeds, for up
+// to wait, so that warp can be started before warpd is up. It returns the last
+// error if warpd is still unreachable after wait, or as soon as ctx is
+// canceled. A single line is printed the first time an attempt fails. It is
+// Dial if wait is 0.
+func DialWait(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	proxy *url.URL,
+	wait time.Duration,
+) (net.Conn, error) {
+	if wait <= 0 {
+		return Dial(ctx, address, tlsConfig, proxy)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		conn, err := Dial(waitCtx, address, tlsConfig, proxy)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt == 0 {
+			out.Warnf("[warp] Waiting for warpd at %s...\r\n", address)
+		}
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return nil, errors.Trace(ctx.Err())
+			}
+			return nil, errors.Trace(
+				errors.Newf("Gave up waiting for warpd after %s: %v", wait, err),
+			)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxWaitBackoff {
+			backoff = maxWaitBackoff
+		}
+	}
+}
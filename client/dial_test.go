@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// resolveTo makes hosts resolve to ips for the duration of the test.
+func resolveTo(
+	t *testing.T,
+	ips ...string,
+) {
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return ips, nil
+	}
+	t.Cleanup(func() {
+		lookupHost = net.DefaultResolver.LookupHost
+	})
+}
+
+func TestDialTCPFallsBack(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// Nothing listens on the first address.
+	resolveTo(t, "::1", "127.0.0.1")
+	conn, err := dialTCP(
+		context.Background(), "warpd", net.JoinHostPort("warpd.test", port),
+	)
+	if err != nil {
+		t.Fatalf("dialTCP: %v", err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().String(), ln.Addr().String(); got != want {
+		t.Fatalf("RemoteAddr: got %s, want %s", got, want)
+	}
+}
+
+func TestDialTCPAllFail(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	resolveTo(t, "::1", "127.0.0.1")
+	_, err = dialTCP(
+		context.Background(), "warpd", net.JoinHostPort("warpd.test", port),
+	)
+	if err == nil {
+		t.Fatalf("dialTCP: got nil, want an error")
+	}
+	// Each address tried is reported.
+	for _, ip := range []string{"[::1]", "127.0.0.1"} {
+		if !strings.Contains(err.Error(), ip+":"+port) {
+			t.Fatalf("dialTCP: %q does not report %s", err, ip)
+		}
+	}
+}
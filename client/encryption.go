@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/e2e"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// RetrieveDataKey derives the key used to encrypt the data of a warp end to
+// end from the passphrase passed with the `passphrase` flag or set in
+// $WARP_PASSPHRASE. It returns nil if no passphrase was provided.
+func RetrieveDataKey(
+	w string,
+	flags map[string]string,
+) ([]byte, error) {
+	passphrase := os.Getenv(warp.EnvWarpPassphrase)
+	if p, ok := flags["passphrase"]; ok {
+		passphrase = p
+	}
+	if passphrase == "" {
+		return nil, nil
+	}
+	key, err := e2e.DeriveKey(passphrase, w)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to derive the encryption key: %v", err),
+		)
+	}
+	return key, nil
+}
+
+// CheckDataKey checks that the data key of a client (nil if it has none)
+// matches the end-to-end encryption of the warp, as received in a state sent
+// by warpd.
+func CheckDataKey(
+	state warp.State,
+	key []byte,
+) error {
+	switch {
+	case len(state.E2ECheck) == 0 && key != nil:
+		return errors.Trace(
+			errors.Newf(
+				"The warp is not encrypted end to end, but a passphrase " +
+					"was provided.",
+			),
+		)
+	case len(state.E2ECheck) > 0 && key == nil:
+		return errors.Trace(
+			errors.Newf(
+				"The warp is encrypted end to end, its passphrase must be "+
+					"provided with --passphrase or $%s.",
+				warp.EnvWarpPassphrase,
+			),
+		)
+	case len(state.E2ECheck) > 0 && !e2e.Verify(key, state.E2ECheck):
+		return errors.Trace(
+			errors.Newf("Wrong passphrase for the end-to-end encryption."),
+		)
+	}
+	return nil
+}
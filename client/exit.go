@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Exit codes of the warp command. Errors reported by warpd that scripts may
+// want to react to are mapped to distinct exit codes.
+const (
+	// ExitError is the exit code for all other errors.
+	ExitError = 1
+	// ExitWarpUnknown is the exit code when the warp does not exist.
+	ExitWarpUnknown = 3
+	// ExitWarpFull is the exit code when the warp reached its maximum number
+	// of clients.
+	ExitWarpFull = 4
+	// ExitAccessDenied is the exit code when warpd refused the session
+	// credentials or the warp secret, or the host denied the request to join.
+	ExitAccessDenied = 5
+	// ExitShellFailed is the exit code when the warp ended because the host
+	// shell exited with a non-zero status.
+	ExitShellFailed = 6
+	// ExitDisconnected is the exit code when warpd disconnected the
+	// participant from the warp (kicked by the host, too slow or replaced by
+	// another session).
+	ExitDisconnected = 7
+	// ExitWarpEnded is the exit code when the warp ended for another reason
+	// than the host shell exiting (host disconnected or handed off, warp
+	// expired or idle, warpd shutting down).
+	ExitWarpEnded = 8
+	// ExitConnectionLost is the exit code when the connection to warpd was
+	// lost unexpectedly (and could not be reestablished).
+	ExitConnectionLost = 9
+)
+
+// ErrConnectionLost is the code of the errors returned when the connection to
+// warpd was lost unexpectedly (warp.DisconnectUnknown).
+const ErrConnectionLost errors.Code = "connection_lost"
+
+// WarpdError is an error reported by warpd over the error channel of a
+// session.
+type WarpdError struct {
+	Code       errors.Code
+	Message    string
+	ExitStatus int
+}
+
+// NewWarpdError creates a WarpdError from a warp.Error received from warpd.
+func NewWarpdError(
+	e warp.Error,
+) *WarpdError {
+	return &WarpdError{
+		Code:       e.Code,
+		Message:    e.Message,
+		ExitStatus: e.ExitStatus,
+	}
+}
+
+// Reason returns the reason of the disconnection if warpd reported an
+// intentional one, warp.DisconnectUnknown otherwise.
+func (e *WarpdError) Reason() warp.DisconnectReason {
+	return warp.DisconnectReasonOf(e.Code)
+}
+
+// Error implements the error interface.
+func (e *WarpdError) Error() string {
+	if r := e.Reason(); r != warp.DisconnectUnknown {
+		return fmt.Sprintf("Disconnected (%s): %s", r, e.Message)
+	}
+	return fmt.Sprintf("Received %s: %s", e.Code, e.Message)
+}
+
+// ErrorCode implements the errors.CodedError interface.
+func (e *WarpdError) ErrorCode() errors.Code {
+	return e.Code
+}
+
+// ExitCode returns the exit code of the warp command for err.
+func ExitCode(
+	err error,
+) int {
+	code := errors.CodeOf(err)
+	switch code {
+	case warp.ErrWarpUnknown:
+		return ExitWarpUnknown
+	case warp.ErrWarpFull:
+		return ExitWarpFull
+	case warp.ErrAuthorizationFailed, warp.ErrAccessDenied, warp.ErrJoinDenied,
+		warp.ErrClientCertRequired:
+		return ExitAccessDenied
+	case warp.ErrShellExited:
+		return ExitShellFailed
+	case ErrConnectionLost:
+		return ExitConnectionLost
+	}
+	switch warp.DisconnectReasonOf(code) {
+	case warp.DisconnectKicked, warp.DisconnectTooSlow,
+		warp.DisconnectReplaced:
+		return ExitDisconnected
+	case warp.DisconnectHostExited, warp.DisconnectHandedOff,
+		warp.DisconnectExpired, warp.DisconnectServerShutdown:
+		return ExitWarpEnded
+	}
+	return ExitError
+}
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	for code, want := range map[errors.Code]int{
+		warp.ErrWarpUnknown:        ExitWarpUnknown,
+		warp.ErrWarpFull:           ExitWarpFull,
+		warp.ErrAccessDenied:       ExitAccessDenied,
+		warp.ErrShellExited:        ExitShellFailed,
+		warp.ErrDisconnectedByHost: ExitDisconnected,
+		warp.ErrClientTooSlow:      ExitDisconnected,
+		warp.ErrSessionReplaced:    ExitDisconnected,
+		warp.ErrHostDisconnected:   ExitWarpEnded,
+		warp.ErrHostHandedOff:      ExitWarpEnded,
+		warp.ErrWarpExpired:        ExitWarpEnded,
+		warp.ErrWarpIdle:           ExitWarpEnded,
+		warp.ErrServerShutdown:     ExitWarpEnded,
+		ErrConnectionLost:          ExitConnectionLost,
+		warp.ErrInternal:           ExitError,
+	} {
+		// Errors reported by warpd are traced as they are returned.
+		err := errors.Trace(NewWarpdError(warp.Error{Code: code}))
+		if got := ExitCode(err); got != want {
+			t.Errorf("ExitCode(%s): got %d, want %d", code, got, want)
+		}
+	}
+	if got := ExitCode(errors.Newf("failure")); got != ExitError {
+		t.Errorf("ExitCode(uncoded): got %d, want %d", got, ExitError)
+	}
+	if ExitDisconnected != 7 || ExitWarpEnded != 8 || ExitConnectionLost != 9 {
+		t.Errorf(
+			"exit codes: got %d, %d, %d, want 7, 8, 9",
+			ExitDisconnected, ExitWarpEnded, ExitConnectionLost,
+		)
+	}
+}
+
+func TestWarpdErrorReason(t *testing.T) {
+	err := NewWarpdError(warp.Error{
+		Code:    warp.ErrSessionReplaced,
+		Message: "You connected to this warp from another session.",
+	})
+	if err.Reason() != warp.DisconnectReplaced {
+		t.Fatalf("Reason: got %q, want %q", err.Reason(), warp.DisconnectReplaced)
+	}
+	want := "Disconnected (replaced): You connected to this warp from another session."
+	if err.Error() != want {
+		t.Fatalf("Error: got %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,282 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/kr/pty"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// PTY is the terminal shared by a warp host: it runs the shell (or command)
+// whose output is read and to which the host and authorized clients input is
+// written. The default implementation, ExecPTY, runs the shell in a pty;
+// other implementations allow swapping the source of the warp (PipePTY for
+// in-memory pipes, TeePTY,...).
+type PTY interface {
+	io.ReadWriteCloser
+	// Start starts the shell with the environment env and the initial window
+	// size.
+	Start(
+		ctx context.Context,
+		shell *Shell,
+		env []string,
+		size warp.Size,
+	) error
+	// Resize sets the window size of the terminal and notifies the shell.
+	Resize(
+		size warp.Size,
+	) error
+	// Wait blocks until the shell exits.
+	Wait() error
+}
+
+// ExitStatus returns the exit status of a shell given the error returned by
+// Wait. As for shells, it is 128 plus the signal number if the shell was killed
+// by a signal.
+func ExitStatus(
+	err error,
+) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return e.ExitCode()
+	}
+	return 1
+}
+
+// ExecPTY is a PTY running the shell as a process attached to a pty.
+type ExecPTY struct {
+	cmd  *exec.Cmd
+	file *os.File
+}
+
+// NewExecPTY constructs an ExecPTY.
+func NewExecPTY() PTY {
+	return &ExecPTY{}
+}
+
+// Start starts the shell process attached to a new pty.
+func (p *ExecPTY) Start(
+	ctx context.Context,
+	shell *Shell,
+	env []string,
+	size warp.Size,
+) error {
+	p.cmd = exec.Command(shell.Command, shell.Args...)
+	p.cmd.Env = env
+
+	file, err := pty.Start(p.cmd)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	p.file = file
+
+	if size.Rows > 0 && size.Cols > 0 {
+		if err := p.Resize(size); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// Resize sets the pty size and signals the shell process.
+func (p *ExecPTY) Resize(
+	size warp.Size,
+) error {
+	if err := setsize(p.file, size.Rows, size.Cols); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to set the pty size: %v", err),
+		)
+	}
+	if err := syscall.Kill(p.cmd.Process.Pid, syscall.SIGWINCH); err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to signal SIGWINCH: %v", err),
+		)
+	}
+	return nil
+}
+
+// Read reads the shell output from the pty.
+func (p *ExecPTY) Read(
+	b []byte,
+) (int, error) {
+	return p.file.Read(b)
+}
+
+// Write writes input to the shell through the pty.
+func (p *ExecPTY) Write(
+	b []byte,
+) (int, error) {
+	return p.file.Write(b)
+}
+
+// Close closes the pty, which hangs up the shell.
+func (p *ExecPTY) Close() error {
+	return p.file.Close()
+}
+
+// Wait waits for the shell process to exit.
+func (p *ExecPTY) Wait() error {
+	return p.cmd.Wait()
+}
+
+// PipePTY is a PTY running no shell but backed by in-memory pipes, whose shell
+// end is driven programmatically (see Shell), e.g. to exercise warps in tests.
+type PipePTY struct {
+	inR  *io.PipeReader
+	inW  *io.PipeWriter
+	outR *io.PipeReader
+	outW *io.PipeWriter
+
+	mutex *sync.Mutex
+	size  warp.Size
+	// doneC is closed once the PTY is closed or its shell end exits.
+	doneC    chan struct{}
+	doneOnce *sync.Once
+}
+
+// NewPipePTY constructs a PipePTY.
+func NewPipePTY() *PipePTY {
+	p := &PipePTY{
+		mutex:    &sync.Mutex{},
+		doneC:    make(chan struct{}),
+		doneOnce: &sync.Once{},
+	}
+	p.inR, p.inW = io.Pipe()
+	p.outR, p.outW = io.Pipe()
+	return p
+}
+
+// Start records the initial window size. The shell and its environment are
+// ignored.
+func (p *PipePTY) Start(
+	ctx context.Context,
+	shell *Shell,
+	env []string,
+	size warp.Size,
+) error {
+	return p.Resize(size)
+}
+
+// Resize records the window size.
+func (p *PipePTY) Resize(
+	size warp.Size,
+) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.size = size
+	return nil
+}
+
+// Size returns the window size last set.
+func (p *PipePTY) Size() warp.Size {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// Read reads the output written to the shell end. It returns io.EOF once the
+// shell end exited.
+func (p *PipePTY) Read(
+	b []byte,
+) (int, error) {
+	return p.outR.Read(b)
+}
+
+// Write writes input to the shell end, blocking until it is read.
+func (p *PipePTY) Write(
+	b []byte,
+) (int, error) {
+	return p.inW.Write(b)
+}
+
+// Close closes the PTY, which hangs up the shell end.
+func (p *PipePTY) Close() error {
+	p.inW.Close()
+	p.outR.Close()
+	p.done()
+	return nil
+}
+
+// Wait waits for the PTY to be closed or its shell end to exit.
+func (p *PipePTY) Wait() error {
+	<-p.doneC
+	return nil
+}
+
+// Shell returns the shell end of the PTY, from which the input written to the
+// PTY is read and to which its output is written. Closing it exits the shell.
+func (p *PipePTY) Shell() io.ReadWriteCloser {
+	return pipeShell{p}
+}
+
+// done marks the PTY as done.
+func (p *PipePTY) done() {
+	p.doneOnce.Do(func() {
+		close(p.doneC)
+	})
+}
+
+// pipeShell is the shell end of a PipePTY.
+type pipeShell struct {
+	p *PipePTY
+}
+
+// Read reads the input written to the PTY.
+func (s pipeShell) Read(
+	b []byte,
+) (int, error) {
+	return s.p.inR.Read(b)
+}
+
+// Write writes output, read from the PTY.
+func (s pipeShell) Write(
+	b []byte,
+) (int, error) {
+	return s.p.outW.Write(b)
+}
+
+// Close exits the shell, ending the output of the PTY.
+func (s pipeShell) Close() error {
+	s.p.outW.Close()
+	s.p.inR.Close()
+	s.p.done()
+	return nil
+}
+
+type winsize struct {
+	ws_row    uint16
+	ws_col    uint16
+	ws_xpixel uint16
+	ws_ypixel uint16
+}
+
+// setsize sets the window size of the pty f.
+func setsize(
+	f *os.File,
+	rows int,
+	cols int,
+) error {
+	ws := winsize{ws_row: uint16(rows), ws_col: uint16(cols)}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		f.Fd(),
+		syscall.TIOCSWINSZ,
+		uintptr(unsafe.Pointer(&ws)),
+	)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
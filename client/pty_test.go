@@ -0,0 +1,88 @@
+package cli_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/plex"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestPipePTYDataPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	size := warp.Size{Rows: 24, Cols: 80}
+	host, err := s.OpenHost(ctx, "pipe", "alice", warp.HostUpdate{
+		WindowSize: size,
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	p := cli.NewPipePTY()
+	if err := p.Start(ctx, nil, nil, size); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer p.Close()
+	if p.Size() != size {
+		t.Fatalf("Size: got %v, want %v", p.Size(), size)
+	}
+
+	// The shell echoes its input.
+	shell := p.Shell()
+	go io.Copy(shell, shell)
+
+	// The PTY is piped to the host session as warp open does.
+	outputC := make(chan struct{})
+	go func() {
+		plex.Run(ctx, func(data []byte) {
+			host.Write(data)
+		}, p)
+		close(outputC)
+	}()
+	go plex.Run(ctx, func(data []byte) {
+		p.Write(data)
+	}, host)
+
+	c, err := s.Connect(ctx, "pipe", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if err := host.Authorize(ctx, c.User); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		return c.State().Users[c.User].Mode&warp.ModeShellWrite != 0
+	})
+
+	// The input of the client reaches the shell, whose output reaches the
+	// client.
+	if _, err := c.Write([]byte("echo hello\r")); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	if _, err := c.ReadUntil("echo hello\r", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell exiting ends the output of the PTY.
+	shell.Close()
+	select {
+	case <-outputC:
+	case <-time.After(testTimeout):
+		t.Fatalf("PTY output not ended once the shell exited")
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+}
@@ -2,19 +2,35 @@ package cli
 
 import (
 	"context"
-	"encoding/gob"
+	"io"
 	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/compress"
+	"github.com/spolu/warp/lib/e2e"
 	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/frame"
+)
+
+// heartbeatInterval and heartbeatThreshold control the pings sent to warpd to
+// detect a dead connection: the session is torn down after heartbeatThreshold
+// consecutive failed pings.
+const (
+	heartbeatInterval  = 5 * time.Second
+	heartbeatThreshold = 3
 )
 
 // Session represents a session to warpd as part of a client or a host. All
 // methods are thread-safe except the Decode* methods.
+//
+// Writes to the data and update channels are serialized by dedicated locks
+// rather than the session lock, so that a write blocked on an unresponsive
+// warpd doesn't prevent tearing down the session (which unblocks it).
 type Session struct {
 	session warp.Session
 
@@ -26,19 +42,54 @@ type Session struct {
 	mux  *yamux.Session
 
 	stateC  net.Conn
-	stateR  *gob.Decoder
+	stateR  warp.Decoder
 	updateC net.Conn
-	updateW *gob.Encoder
+	updateW warp.Encoder
 	errorC  net.Conn
-	errorR  *gob.Decoder
+	errorR  warp.Decoder
 	dataC   net.Conn
+	dataR   io.Reader
+	dataW   io.Writer
+
+	compression bool
+	readOnly    bool
+	dataSetup   bool
+	// sequenced requests the data received to be framed with sequence numbers
+	// from resumeFrom (see warp.SessionHello). frames, if not nil, reads the
+	// frames once warpd accepted it.
+	sequenced  bool
+	resumeFrom uint64
+	frames     *frame.Reader
+	// dataKey, if not nil, is the key used to encrypt the data channel end to
+	// end.
+	dataKey []byte
 
 	state *WarpState
 
-	tornDown bool
-	cancel   func()
-
-	mutex *sync.Mutex
+	// latency is the round-trip time of the last heartbeat ping. pings is
+	// the number of successful pings and pingTotal the sum of their
+	// round-trip times.
+	latency   time.Duration
+	pings     int
+	pingTotal time.Duration
+
+	// wireIn and wireOut count the bytes read from and written to the data
+	// channel as sent over the connection (after compression and encryption).
+	// They are updated atomically.
+	wireIn  int64
+	wireOut int64
+
+	// tornDownC is closed when the session is torn down, exactly once
+	// through tearDownOnce. heartbeatDoneC is closed once the heartbeat
+	// goroutine returned.
+	tornDownC      chan struct{}
+	heartbeatDoneC chan struct{}
+	tearDownOnce   *sync.Once
+	cancel         func()
+
+	writeMutex  *sync.Mutex
+	updateMutex *sync.Mutex
+	mutex       *sync.Mutex
 }
 
 // NewSession sets up a session, opens the associated channels and return a
@@ -49,15 +100,27 @@ func NewSession(
 	w string,
 	sessionType warp.SessionType,
 	username string,
+	compression bool,
+	readOnly bool,
+	sequenced bool,
+	resumeFrom uint64,
 	cancel func(),
 	conn net.Conn,
 ) (*Session, error) {
+	streamWindow, err := streamWindow()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	codec, err := ResolveCodec()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	mux, err := yamux.Client(conn, &yamux.Config{
 		AcceptBacklog:          256,
 		EnableKeepAlive:        true,
 		KeepAliveInterval:      2 * time.Second,
 		ConnectionWriteTimeout: 10 * time.Second,
-		MaxStreamWindowSize:    256 * 1024,
+		MaxStreamWindowSize:    streamWindow,
 		LogOutput:              ioutil.Discard,
 	})
 	if err != nil {
@@ -71,9 +134,20 @@ func NewSession(
 		warp:        w,
 		sessionType: sessionType,
 		username:    username,
+		compression: compression,
+		readOnly:    readOnly,
+		sequenced:   sequenced,
+		resumeFrom:  resumeFrom,
 		conn:        conn,
 		mux:         mux,
 		cancel:      cancel,
+
+		tornDownC:      make(chan struct{}),
+		heartbeatDoneC: make(chan struct{}),
+		tearDownOnce:   &sync.Once{},
+
+		writeMutex:  &sync.Mutex{},
+		updateMutex: &sync.Mutex{},
 		mutex:       &sync.Mutex{},
 	}
 
@@ -85,7 +159,7 @@ func NewSession(
 			errors.Newf("State channel open error: %v", err),
 		)
 	}
-	ss.stateR = gob.NewDecoder(ss.stateC)
+	ss.stateR = codec.NewDecoder(ss.stateC)
 
 	// Open update channel updateC.
 	ss.updateC, err = mux.Open()
@@ -95,7 +169,7 @@ func NewSession(
 			errors.Newf("Update channel open error: %v", err),
 		)
 	}
-	ss.updateW = gob.NewEncoder(ss.updateC)
+	ss.updateW = codec.NewEncoder(ss.updateC)
 
 	// Send initial SessionHello.
 	hello := warp.SessionHello{
@@ -104,6 +178,13 @@ func NewSession(
 		Version:  warp.Version,
 		Type:     ss.sessionType,
 		Username: ss.username,
+
+		ProtocolVersion: warp.ProtocolVersion,
+
+		Compression: ss.compression,
+		ReadOnly:    ss.readOnly,
+		Sequenced:   ss.sequenced,
+		ResumeFrom:  ss.resumeFrom,
 	}
 	if err := ss.updateW.Encode(hello); err != nil {
 		ss.TearDown()
@@ -120,7 +201,7 @@ func NewSession(
 			errors.Newf("Error channel open error: %v", err),
 		)
 	}
-	ss.errorR = gob.NewDecoder(ss.errorC)
+	ss.errorR = codec.NewDecoder(ss.errorC)
 
 	// Open data channel dataC.
 	ss.dataC, err = mux.Open()
@@ -130,34 +211,164 @@ func NewSession(
 			errors.Newf("Data channel open error: %v", err),
 		)
 	}
+	ss.dataR = &countingReader{r: ss.dataC, n: &ss.wireIn}
+	ss.dataW = &countingWriter{w: ss.dataC, n: &ss.wireOut}
 
 	// Setup warp state.
 	ss.state = NewWarpState(hello)
 
+	go ss.heartbeat()
+
 	return ss, nil
 }
 
+// heartbeat pings warpd every heartbeatInterval until the session is torn
+// down, tearing it down after heartbeatThreshold consecutive failed pings.
+func (ss *Session) heartbeat() {
+	defer close(ss.heartbeatDoneC)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	// Measure the latency right away, failures being handled by the
+	// heartbeats.
+	ss.ping()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ss.tornDownC:
+			return
+		}
+		if err := ss.ping(); err != nil {
+			missed++
+			if missed >= heartbeatThreshold {
+				ss.TearDown()
+				return
+			}
+		} else {
+			missed = 0
+		}
+	}
+}
+
+// ping pings warpd, recording the round-trip time as the latency of the
+// session. The time is measured here as yamux only starts its timer once the
+// ping is sent, reporting close to 0 if the reply arrives in the meantime.
+func (ss *Session) ping() error {
+	start := time.Now()
+	if _, err := ss.mux.Ping(); err != nil {
+		return err
+	}
+	ss.mutex.Lock()
+	ss.latency = time.Since(start)
+	ss.pings++
+	ss.pingTotal += ss.latency
+	ss.mutex.Unlock()
+	return nil
+}
+
+// Latency returns the round-trip time to warpd measured by the last heartbeat
+// ping (0 until the first one returns).
+func (ss *Session) Latency() time.Duration {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.latency
+}
+
+// PingStats returns the number of successful heartbeat pings and the sum of
+// their round-trip times.
+func (ss *Session) PingStats() (int, time.Duration) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.pings, ss.pingTotal
+}
+
+// WireStats returns the number of bytes read from and written to the data
+// channel over the connection, after compression and encryption.
+func (ss *Session) WireStats() (int64, int64) {
+	return atomic.LoadInt64(&ss.wireIn), atomic.LoadInt64(&ss.wireOut)
+}
+
+// countingReader counts the bytes read from r in n, atomically.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+// Read implements the io.Reader interface.
+func (c *countingReader) Read(
+	p []byte,
+) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to w in n, atomically.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+// Write implements the io.Writer interface.
+func (c *countingWriter) Write(
+	p []byte,
+) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
 // Command methods
 
-// DataC returns the data channel. Using the dataC is not thread-safe and
-// should happen from only one go routine for reading only. Writing should go
+// DataC returns the data channel reader. Using the dataC is not thread-safe
+// and should happen from only one go routine for reading only, after the first
+// state update was applied (as it sets up the data channel). Writing should go
 // through thread-safe WriteDataC.
-func (ss *Session) DataC() net.Conn {
+func (ss *Session) DataC() io.Reader {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.dataR
+}
+
+// DataFrames returns the reader of the sequenced frames of the data channel,
+// nil if the data received is not sequenced, in which case it is read from
+// DataC. It is set once the first state update was applied and is subject to
+// the same constraints as DataC.
+func (ss *Session) DataFrames() *frame.Reader {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.frames
+}
+
+// ResumeFrom returns the offset in the output of the host shell from which the
+// session requested to resume it, 0 if none.
+func (ss *Session) ResumeFrom() uint64 {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
-	return ss.dataC
+	return ss.resumeFrom
 }
 
 // WriteData writes to dataC in a thread-safe way, checking that the session is
-// not torn down.
+// not torn down. The session is torn down if the write fails, as its data
+// channel is then unusable, and the error returned.
 func (ss *Session) WriteDataC(
 	data []byte,
-) {
+) error {
 	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	if !ss.tornDown {
-		ss.dataC.Write(data)
+	dataW := ss.dataW
+	ss.mutex.Unlock()
+
+	ss.writeMutex.Lock()
+	defer ss.writeMutex.Unlock()
+	if !ss.TornDown() && !ss.readOnly {
+		if _, err := dataW.Write(data); err != nil {
+			ss.TearDown()
+			return errors.Trace(err)
+		}
 	}
+	return nil
 }
 
 // Warp returns the session warp token.
@@ -200,16 +411,72 @@ func (ss *Session) SetMode(
 	return ss.state.SetMode(user, mode)
 }
 
-// UpdateState updates the session state with a received warp.State.
+// SetDataKey sets the key used to encrypt the data channel end to end. It
+// must be called before the first state is received.
+func (ss *Session) SetDataKey(
+	key []byte,
+) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.dataKey = key
+}
+
+// UpdateState updates the session state with a received warp.State. The first
+// state received sets up the data channel, enabling compression and sequencing
+// if they were requested and accepted by warpd and end-to-end encryption if a
+// data key was set.
 func (ss *Session) UpdateState(
 	state warp.State,
 	hosting bool,
 ) error {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
+	if !ss.dataSetup {
+		ss.dataSetup = true
+		if ss.compression && state.Compression {
+			ss.dataR = compress.NewReader(ss.dataR)
+			ss.dataW = compress.NewWriter(ss.dataW)
+		}
+		if ss.sequenced && state.Sequenced {
+			// warpd does not sequence the data of warps encrypted end to
+			// end, which is read as a stream.
+			if ss.dataKey != nil {
+				return errors.Trace(
+					errors.Newf("Sequenced data can't be encrypted end to end"),
+				)
+			}
+			ss.frames = frame.NewReader(ss.dataR)
+		}
+		if ss.dataKey != nil {
+			if err := ss.setupEncryption(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
 	return ss.state.Update(state, hosting)
 }
 
+// setupEncryption wraps the data channel to encrypt it end to end, the host
+// and clients each decrypting the data sent by the other. The session lock
+// must be held.
+func (ss *Session) setupEncryption() error {
+	in, out := e2e.Host, e2e.Client
+	if ss.sessionType == warp.SsTpHost {
+		in, out = e2e.Client, e2e.Host
+	}
+	r, err := e2e.NewReader(ss.dataR, ss.dataKey, in)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w, err := e2e.NewWriter(ss.dataW, ss.dataKey, out)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ss.dataR = r
+	ss.dataW = w
+	return nil
+}
+
 // HostCanReceiverWrite retruns whether the host can receive write from any
 // shell client.
 func (ss *Session) HostCanReceiveWrite() bool {
@@ -232,33 +499,64 @@ func (ss *Session) Modes() map[string]warp.Mode {
 	return ss.state.Modes()
 }
 
-// TornDown returns the session tornDown value.
+// TornDown returns whether the session was torn down.
 func (ss *Session) TornDown() bool {
-	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	return ss.tornDown
+	select {
+	case <-ss.tornDownC:
+		return true
+	default:
+		return false
+	}
 }
 
-// TearDown tears down a session, closing and reclaiming channels.
+// TearDown tears down a session, closing and reclaiming channels. It is safe
+// to call concurrently and more than once. The session context is canceled
+// before the channels get closed, so that the session goroutines see the
+// cancellation rather than errors on the channels.
 func (ss *Session) TearDown() {
-	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	if !ss.tornDown {
-		ss.tornDown = true
+	ss.tearDownOnce.Do(func() {
+		close(ss.tornDownC)
 		ss.cancel()
 		// Closes stateC, updateC, errorC, dataC, mux and conn.
 		ss.mux.Close()
-	}
+	})
 }
 
-// SendHostUpdate is used to safely concurrently sending host updates.
-func (ss *Session) SendHostUpdate(
+// Close lets warpd know that the session is closing on purpose, so that its
+// end is not taken for a lost connection, and tears it down. The signal is
+// only sent by host and shell client sessions not torn down yet.
+func (ss *Session) Close(
 	ctx context.Context,
-	update warp.HostUpdate,
+) {
+	switch ss.sessionType {
+	case warp.SsTpHost:
+		ss.SendHostUpdate(ctx, warp.HostUpdate{
+			Warp:    ss.warp,
+			From:    ss.session,
+			Closing: true,
+		})
+	case warp.SsTpShellClient:
+		ss.SendClientUpdate(ctx, warp.ClientUpdate{
+			Warp:    ss.warp,
+			From:    ss.session,
+			Closing: true,
+		})
+	}
+	ss.TearDown()
+}
+
+// Wait waits for the goroutines of a session torn down to return.
+func (ss *Session) Wait() {
+	<-ss.heartbeatDoneC
+}
+
+// encodeUpdate sends an update to warpd unless the session is torn down.
+func (ss *Session) encodeUpdate(
+	update interface{},
 ) error {
-	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	if !ss.tornDown {
+	ss.updateMutex.Lock()
+	defer ss.updateMutex.Unlock()
+	if !ss.TornDown() {
 		if err := ss.updateW.Encode(update); err != nil {
 			return errors.Trace(err)
 		}
@@ -266,6 +564,30 @@ func (ss *Session) SendHostUpdate(
 	return nil
 }
 
+// SendHostUpdate is used to safely concurrently sending host updates.
+func (ss *Session) SendHostUpdate(
+	ctx context.Context,
+	update warp.HostUpdate,
+) error {
+	return ss.encodeUpdate(update)
+}
+
+// SendClientUpdate is used to safely concurrently sending client updates.
+func (ss *Session) SendClientUpdate(
+	ctx context.Context,
+	update warp.ClientUpdate,
+) error {
+	return ss.encodeUpdate(update)
+}
+
+// SendPaneUpdate is used to safely concurrently sending pane updates.
+func (ss *Session) SendPaneUpdate(
+	ctx context.Context,
+	update warp.PaneUpdate,
+) error {
+	return ss.encodeUpdate(update)
+}
+
 //
 // Non thread-safe methods.
 //
@@ -293,3 +615,35 @@ func (ss *Session) DecodeState(
 	}
 	return &st, nil
 }
+
+// DiscardState reads and discards the stateC until it gets closed, once states
+// can't be decoded from it anymore, so that warpd does not block sending them.
+// This method is not thread-safe.
+func (ss *Session) DiscardState(
+	ctx context.Context,
+) {
+	io.Copy(ioutil.Discard, ss.stateC)
+}
+
+// DecodeWarps attempts to decode a list of warp summaries from the stateC (list
+// sessions only). This method is not thread-safe.
+func (ss *Session) DecodeWarps(
+	ctx context.Context,
+) ([]warp.WarpSummary, error) {
+	var warps []warp.WarpSummary
+	if err := ss.stateR.Decode(&warps); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return warps, nil
+}
+
+// DecodePingReply decodes the reply of warpd to a ping session.
+func (ss *Session) DecodePingReply(
+	ctx context.Context,
+) (*warp.PingReply, error) {
+	var reply warp.PingReply
+	if err := ss.stateR.Decode(&reply); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &reply, nil
+}
@@ -3,12 +3,16 @@ package cli
 import (
 	"context"
 	"os"
+	"strings"
 
 	"github.com/spolu/warp/lib/errors"
 )
 
+// Shell represents the command spawned in the pty of a warp along with its
+// arguments.
 type Shell struct {
 	Command string
+	Args    []string
 }
 
 // retrieveShell retrieves the current shell for the user using the following
@@ -35,7 +39,99 @@ func DetectShell(
 
 	shell := Shell{
 		Command: command,
+		Args:    []string{"-l"},
 	}
 
 	return &shell, nil
 }
+
+// ParseShell parses a command line into a Shell. Arguments are split on
+// whitespace, honoring single quotes, double quotes and backslash escapes as a
+// POSIX shell would (without any expansion).
+func ParseShell(
+	ctx context.Context,
+	command string,
+) (*Shell, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(args) == 0 {
+		return nil, errors.Trace(
+			errors.Newf("Empty command."),
+		)
+	}
+
+	shell := Shell{
+		Command: args[0],
+		Args:    args[1:],
+	}
+
+	return &shell, nil
+}
+
+// splitCommand splits a command line into arguments.
+func splitCommand(
+	command string,
+) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			// Within double quotes, backslash only escapes a few characters.
+			if quote == '"' && !strings.ContainsRune("\\\"$`", r) {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.Trace(
+			errors.Newf("Trailing backslash in command: %s", command),
+		)
+	}
+	if quote != 0 {
+		return nil, errors.Trace(
+			errors.Newf("Unterminated quote in command: %s", command),
+		)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -106,6 +107,18 @@ func (s *Srv) handle(
 		result = s.executeAuthorize(ctx, cmd)
 	case warp.CmdTpRevoke:
 		result = s.executeRevoke(ctx, cmd)
+	case warp.CmdTpDisconnect:
+		result = s.executeDisconnect(ctx, cmd)
+	case warp.CmdTpChat:
+		result = s.executeChat(ctx, cmd)
+	case warp.CmdTpHandoff:
+		result = s.executeHandoff(ctx, cmd)
+	case warp.CmdTpGrant:
+		result = s.executeGrant(ctx, cmd)
+	case warp.CmdTpPause:
+		result = s.executePause(ctx, cmd)
+	case warp.CmdTpResume:
+		result = s.executeResume(ctx, cmd)
 	default:
 		result.Error.Code = "command_unknown"
 		result.Error.Message = fmt.Sprintf(
@@ -195,10 +208,9 @@ func (s *Srv) executeAuthorize(
 	}
 
 	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
-		Warp:       s.session.Warp(),
-		From:       s.session.Session(),
-		WindowSize: s.session.WindowSize(),
-		Modes:      s.session.Modes(),
+		Warp:  s.session.Warp(),
+		From:  s.session.Session(),
+		Modes: s.session.Modes(),
 	}); err != nil {
 		return warp.CommandResult{
 			Type: warp.CmdTpAuthorize,
@@ -257,14 +269,72 @@ func (s *Srv) executeRevoke(
 		}
 	}
 
+	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:  s.session.Warp(),
+		From:  s.session.Session(),
+		Modes: s.session.Modes(),
+	}); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpRevoke,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to apply update to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpRevoke,
+	}
+}
+
+// executeDisconnect executes the *disconnect* command.
+func (s *Srv) executeDisconnect(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpDisconnect,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	if len(cmd.Args) != 1 {
+		return warp.CommandResult{
+			Type: warp.CmdTpDisconnect,
+			Error: warp.Error{
+				Code:    "user_token_required",
+				Message: "User token to disconnect is required.",
+			},
+		}
+	}
+
+	if _, err := s.session.GetMode(cmd.Args[0]); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpDisconnect,
+			Error: warp.Error{
+				Code:    "user_unknown",
+				Message: err.Error() + ".",
+			},
+		}
+	}
+
 	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
 		Warp:       s.session.Warp(),
 		From:       s.session.Session(),
-		WindowSize: s.session.WindowSize(),
 		Modes:      s.session.Modes(),
+		Disconnect: cmd.Args,
 	}); err != nil {
 		return warp.CommandResult{
-			Type: warp.CmdTpRevoke,
+			Type: warp.CmdTpDisconnect,
 			Error: warp.Error{
 				Code:    "update_failed",
 				Message: "Failed to apply update to warp.",
@@ -274,6 +344,287 @@ func (s *Srv) executeRevoke(
 
 	// NO-OP State is automatically appended to all results.
 	return warp.CommandResult{
-		Type: warp.CmdTpRevoke,
+		Type: warp.CmdTpDisconnect,
+	}
+}
+
+// executeChat executes the *chat* command.
+func (s *Srv) executeChat(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpChat,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	text := strings.Join(cmd.Args, " ")
+	if strings.TrimSpace(text) == "" {
+		return warp.CommandResult{
+			Type: warp.CmdTpChat,
+			Error: warp.Error{
+				Code:    "message_required",
+				Message: "Chat message is required.",
+			},
+		}
+	}
+
+	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp: s.session.Warp(),
+		From: s.session.Session(),
+		Chat: text,
+	}); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpChat,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to send chat message to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpChat,
+	}
+}
+
+// executeHandoff executes the *handoff* command.
+func (s *Srv) executeHandoff(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpHandoff,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	if len(cmd.Args) != 1 {
+		return warp.CommandResult{
+			Type: warp.CmdTpHandoff,
+			Error: warp.Error{
+				Code:    "user_token_required",
+				Message: "User token to hand off the warp to is required.",
+			},
+		}
+	}
+
+	if _, err := s.session.GetMode(cmd.Args[0]); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpHandoff,
+			Error: warp.Error{
+				Code:    "user_unknown",
+				Message: err.Error() + ".",
+			},
+		}
+	}
+
+	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:    s.session.Warp(),
+		From:    s.session.Session(),
+		Modes:   s.session.Modes(),
+		Handoff: cmd.Args[0],
+	}); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpHandoff,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to apply update to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpHandoff,
+	}
+}
+
+// executeGrant executes the *grant* command. The keyboard is freed if no user
+// token is passed.
+func (s *Srv) executeGrant(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpGrant,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	if !s.session.ProtocolState().WriteLock {
+		return warp.CommandResult{
+			Type: warp.CmdTpGrant,
+			Error: warp.Error{
+				Code:    "write_lock_disabled",
+				Message: "The warp was not opened with a write lock.",
+			},
+		}
+	}
+
+	up := warp.HostUpdate{
+		Warp:  s.session.Warp(),
+		From:  s.session.Session(),
+		Modes: s.session.Modes(),
+	}
+	if len(cmd.Args) == 0 {
+		up.WriteRelease = true
+	} else {
+		mode, err := s.session.GetMode(cmd.Args[0])
+		if err != nil {
+			return warp.CommandResult{
+				Type: warp.CmdTpGrant,
+				Error: warp.Error{
+					Code:    "user_unknown",
+					Message: err.Error() + ".",
+				},
+			}
+		}
+		if *mode&warp.ModeShellWrite == 0 {
+			return warp.CommandResult{
+				Type: warp.CmdTpGrant,
+				Error: warp.Error{
+					Code: "user_unauthorized",
+					Message: "The user is not authorized to write, " +
+						"authorize it first.",
+				},
+			}
+		}
+		up.WriteGrant = cmd.Args[0]
+	}
+
+	if err := s.session.SendHostUpdate(ctx, up); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpGrant,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to apply update to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpGrant,
+	}
+}
+
+// executePause executes the *pause* command, with the options passed as
+// arguments.
+func (s *Srv) executePause(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpPause,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	up := warp.HostUpdate{
+		Warp:  s.session.Warp(),
+		From:  s.session.Session(),
+		Modes: s.session.Modes(),
+		Pause: true,
+	}
+	for _, arg := range cmd.Args {
+		switch arg {
+		case warp.PauseArgHold:
+			up.PauseHold = true
+		case warp.PauseArgOutput:
+			up.PauseOutput = true
+		default:
+			return warp.CommandResult{
+				Type: warp.CmdTpPause,
+				Error: warp.Error{
+					Code:    "argument_invalid",
+					Message: fmt.Sprintf("Invalid pause option %s.", arg),
+				},
+			}
+		}
+	}
+
+	if err := s.session.SendHostUpdate(ctx, up); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpPause,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to apply update to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpPause,
+	}
+}
+
+// executeResume executes the *resume* command.
+func (s *Srv) executeResume(
+	ctx context.Context,
+	cmd warp.Command,
+) warp.CommandResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.session == nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpResume,
+			Error: warp.Error{
+				Code:    "disconnected",
+				Message: "The warp is currently disconnected.",
+			},
+		}
+	}
+
+	if err := s.session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:   s.session.Warp(),
+		From:   s.session.Session(),
+		Modes:  s.session.Modes(),
+		Resume: true,
+	}); err != nil {
+		return warp.CommandResult{
+			Type: warp.CmdTpResume,
+			Error: warp.Error{
+				Code:    "update_failed",
+				Message: "Failed to apply update to warp.",
+			},
+		}
+	}
+
+	// NO-OP State is automatically appended to all results.
+	return warp.CommandResult{
+		Type: warp.CmdTpResume,
 	}
 }
@@ -0,0 +1,169 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// TeePTY is a PTY sharing the contents of a file (typically a fifo) or of the
+// standard input instead of running a shell, a one-way broadcast of the output
+// of a program already running. The input written to it is discarded and its
+// window size is left to the program writing to it. It "exits" (with status
+// 0) once the end of its source is reached.
+type TeePTY struct {
+	path string
+
+	mutex *sync.Mutex
+	file  *os.File
+	// doneC is closed once the source is exhausted or the PTY closed.
+	doneC    chan struct{}
+	doneOnce *sync.Once
+}
+
+// NewTeePTY constructs a TeePTY reading from the file at path, or from the
+// standard input if path is `-`.
+func NewTeePTY(
+	path string,
+) PTY {
+	return &TeePTY{
+		path:     path,
+		mutex:    &sync.Mutex{},
+		doneC:    make(chan struct{}),
+		doneOnce: &sync.Once{},
+	}
+}
+
+// Start checks that the source exists. Files are only opened on the first
+// read as opening a fifo blocks until a writer opens it. The shell and its
+// environment are ignored.
+func (p *TeePTY) Start(
+	ctx context.Context,
+	shell *Shell,
+	env []string,
+	size warp.Size,
+) error {
+	if p.path == "-" {
+		p.file = os.Stdin
+		return nil
+	}
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fi.IsDir() {
+		return errors.Trace(
+			errors.Newf("%s is a directory", p.path),
+		)
+	}
+	return nil
+}
+
+// Resize is a no-op as there is no terminal to resize.
+func (p *TeePTY) Resize(
+	size warp.Size,
+) error {
+	return nil
+}
+
+// source returns the file read from, opening it if needed.
+func (p *TeePTY) source() (*os.File, error) {
+	p.mutex.Lock()
+	file := p.file
+	p.mutex.Unlock()
+	if file != nil {
+		return file, nil
+	}
+
+	// The lock is not held while opening as it may block (fifo).
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.doneC:
+		file.Close()
+		return nil, io.EOF
+	default:
+	}
+	p.file = file
+	return file, nil
+}
+
+// Read reads the contents of the source, translating newlines to CRLF as a
+// pty would, so that they render in the terminals of the clients (in raw
+// mode). The PTY is done once it returns an error (io.EOF at the end of the
+// source).
+func (p *TeePTY) Read(
+	b []byte,
+) (int, error) {
+	file, err := p.source()
+	if err != nil {
+		p.done()
+		return 0, err
+	}
+	// Only half of b is read so that it fits the translated contents (b
+	// must be at least 2 bytes long).
+	n, err := file.Read(b[:len(b)/2])
+	if err != nil {
+		p.done()
+	}
+	return translateNewlines(b, n), err
+}
+
+// translateNewlines translates in place the newlines of the first n bytes of b
+// to CRLF, returning the length of the result. b must have room for it.
+func translateNewlines(
+	b []byte,
+	n int,
+) int {
+	m := n + bytes.Count(b[:n], []byte{'\n'})
+	for i, j := n-1, m-1; i >= 0; i-- {
+		b[j] = b[i]
+		j--
+		if b[i] == '\n' {
+			b[j] = '\r'
+			j--
+		}
+	}
+	return m
+}
+
+// Write discards the input, the source being read-only.
+func (p *TeePTY) Write(
+	b []byte,
+) (int, error) {
+	return len(b), nil
+}
+
+// Close closes the source.
+func (p *TeePTY) Close() error {
+	p.done()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.file != nil {
+		return p.file.Close()
+	}
+	return nil
+}
+
+// Wait waits for the source to be exhausted.
+func (p *TeePTY) Wait() error {
+	<-p.doneC
+	return nil
+}
+
+// done marks the PTY as done.
+func (p *TeePTY) done() {
+	p.doneOnce.Do(func() {
+		close(p.doneC)
+	})
+}
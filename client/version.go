@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/out"
+)
+
+// BuildInfo describes the build of the warp client.
+type BuildInfo struct {
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	// Commit is the git commit the client was built from (suffixed with
+	// `-dirty` if the tree had local modifications), `unknown` if the build
+	// did not record it.
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// RetrieveBuildInfo returns the BuildInfo of the running client.
+func RetrieveBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:         warp.Version,
+		ProtocolVersion: warp.ProtocolVersion,
+		Commit:          "unknown",
+		GoVersion:       runtime.Version(),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	modified := false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if modified && info.Commit != "unknown" {
+		info.Commit += "-dirty"
+	}
+	return info
+}
+
+// CheckProtocolVersion checks the protocol version negotiated with warpd, as
+// received in a state it sent. It errors if warpd is too old to be supported
+// and warns if it is older than the client.
+func CheckProtocolVersion(
+	state warp.State,
+) error {
+	switch {
+	case state.ProtocolVersion == 0:
+		// warpd predates the negotiation, it is given the benefit of the
+		// doubt.
+		out.Warnf(
+			"[warp] warpd predates protocol versioning (client protocol "+
+				"version: %d), consider upgrading it.\r\n",
+			warp.ProtocolVersion,
+		)
+	case state.ProtocolVersion < warp.MinProtocolVersion:
+		return errors.Trace(
+			errors.Newf(
+				"warpd v%s is too old for this client (protocol version %d, "+
+					"supported: %d to %d).",
+				state.Version, state.ProtocolVersion,
+				warp.MinProtocolVersion, warp.ProtocolVersion,
+			),
+		)
+	case state.ProtocolVersion < warp.ProtocolVersion:
+		out.Warnf(
+			"[warp] warpd v%s speaks protocol version %d (client protocol "+
+				"version: %d), consider upgrading it.\r\n",
+			state.Version, state.ProtocolVersion, warp.ProtocolVersion,
+		)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"time"
+
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
 )
@@ -13,6 +15,24 @@ type WarpState struct {
 
 	windowSize warp.Size
 	users      map[string]UserState
+
+	rateLimit int
+	rateBurst int
+
+	createdAt time.Time
+	expiresAt time.Time
+
+	writeLock     bool
+	writeHolder   string
+	writeRequests []string
+
+	accessRequests []string
+
+	paused       bool
+	pausedHold   bool
+	pausedOutput bool
+
+	panes []string
 }
 
 // UserState represents the state of a user as seen client-side.
@@ -72,9 +92,40 @@ func (w *WarpState) Update(
 		)
 	}
 
-	w.windowSize = state.WindowSize
+	size, err := state.WindowSize.Sanitize()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w.windowSize = size
+	w.rateLimit = state.RateLimit
+	w.rateBurst = state.RateBurst
+	w.createdAt = state.CreatedAt
+	w.expiresAt = state.ExpiresAt
+	w.writeLock = state.WriteLock
+	w.writeHolder = state.WriteHolder
+	w.writeRequests = append([]string{}, state.WriteRequests...)
+	w.accessRequests = append([]string{}, state.AccessRequests...)
+	w.paused = state.Paused
+	w.pausedHold = state.PausedHold
+	w.pausedOutput = state.PausedOutput
+
+	// Pane labels are displayed to the user.
+	for _, label := range state.Panes {
+		if err := warp.ValidatePaneLabel(label); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.panes = append([]string{}, state.Panes...)
 
 	for token, user := range state.Users {
+		if err := warp.ValidateUsername(user.Username); err != nil {
+			return errors.Trace(err)
+		}
+		if !user.Mode.Valid() {
+			return errors.Trace(
+				errors.Newf("Invalid user mode: %s %d", token, user.Mode),
+			)
+		}
 		if token != user.Token {
 			return errors.Trace(
 				errors.Newf(
@@ -112,7 +163,9 @@ func (w *WarpState) Update(
 			userState := w.users[token]
 			userState.username = user.Username
 			if !hosting {
+				// The host may change if the warp is handed off.
 				userState.mode = user.Mode
+				userState.hosting = user.Hosting
 			}
 			w.users[token] = userState
 		}
@@ -180,6 +233,22 @@ func (w *WarpState) ProtocolState() warp.State {
 		Warp:       w.token,
 		WindowSize: w.windowSize,
 		Users:      map[string]warp.User{},
+		RateLimit:  w.rateLimit,
+		RateBurst:  w.rateBurst,
+		CreatedAt:  w.createdAt,
+		ExpiresAt:  w.expiresAt,
+
+		WriteLock:     w.writeLock,
+		WriteHolder:   w.writeHolder,
+		WriteRequests: append([]string{}, w.writeRequests...),
+
+		AccessRequests: append([]string{}, w.accessRequests...),
+
+		Paused:       w.paused,
+		PausedHold:   w.pausedHold,
+		PausedOutput: w.pausedOutput,
+
+		Panes: append([]string{}, w.panes...),
 	}
 
 	for token, user := range w.users {
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/spolu/warp"
+)
+
+// decodeState round trips state through gob, as received over the wire.
+func decodeState(
+	t *testing.T,
+	state warp.State,
+) warp.State {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var st warp.State
+	if err := gob.NewDecoder(buf).Decode(&st); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return st
+}
+
+func newTestWarpState() *WarpState {
+	return NewWarpState(warp.SessionHello{
+		Warp:     "test",
+		From:     warp.Session{Token: "session", User: "bob"},
+		Type:     warp.SsTpShellClient,
+		Username: "bob",
+	})
+}
+
+func TestUpdateRejectsInvalidState(t *testing.T) {
+	users := func(u warp.User) map[string]warp.User {
+		return map[string]warp.User{u.Token: u}
+	}
+	for name, state := range map[string]warp.State{
+		"negative window size": {
+			WindowSize: warp.Size{Rows: -24, Cols: 80},
+		},
+		"empty username": {
+			Users: users(warp.User{Token: "alice"}),
+		},
+		"escape in username": {
+			Users: users(warp.User{
+				Token: "alice", Username: "alice\x1b]0;pwned\x07",
+			}),
+		},
+		"unknown mode": {
+			Users: users(warp.User{
+				Token: "alice", Username: "alice", Mode: 1 << 42,
+			}),
+		},
+		"user token mismatch": {
+			Users: map[string]warp.User{
+				"alice": {Token: "mallory", Username: "alice"},
+			},
+		},
+		"warp token mismatch": {
+			Warp: "other",
+		},
+	} {
+		if state.Warp == "" {
+			state.Warp = "test"
+		}
+		w := newTestWarpState()
+		if err := w.Update(decodeState(t, state), false); err == nil {
+			t.Errorf("%s: Update succeeded, want an error", name)
+		}
+	}
+}
+
+func TestUpdateClampsWindowSize(t *testing.T) {
+	w := newTestWarpState()
+	err := w.Update(decodeState(t, warp.State{
+		Warp:       "test",
+		WindowSize: warp.Size{Rows: 1 << 40, Cols: 1 << 40},
+		Users: map[string]warp.User{
+			"bob": {Token: "bob", Username: "bob", Mode: warp.ModeShellRead},
+		},
+	}), false)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	want := warp.Size{Rows: warp.MaxWindowRows, Cols: warp.MaxWindowCols}
+	if w.windowSize != want {
+		t.Fatalf("window size: got %v, want %v", w.windowSize, want)
+	}
+}
+
+func TestUpdateHostRejectsUnexpectedModes(t *testing.T) {
+	w := NewWarpState(warp.SessionHello{
+		Warp:     "test",
+		From:     warp.Session{Token: "session", User: "alice"},
+		Type:     warp.SsTpHost,
+		Username: "alice",
+	})
+	// warpd is not trusted with modes: a new user can't join with write
+	// access, nor as a second host.
+	for name, user := range map[string]warp.User{
+		"write mode": {
+			Token: "bob", Username: "bob",
+			Mode: warp.ModeShellRead | warp.ModeShellWrite,
+		},
+		"hosting": {
+			Token: "bob", Username: "bob", Mode: warp.ModeShellRead,
+			Hosting: true,
+		},
+	} {
+		err := w.Update(decodeState(t, warp.State{
+			Warp: "test",
+			Users: map[string]warp.User{
+				"alice": {
+					Token: "alice", Username: "alice",
+					Mode: warp.DefaultHostMode, Hosting: true,
+				},
+				"bob": user,
+			},
+		}), true)
+		if err == nil {
+			t.Errorf("%s: Update succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package warp
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+//
+// Wire Encoding
+//
+
+// Encoder encodes the messages sent over a session channel (State, HostUpdate,
+// ClientUpdate, Error, ...).
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder decodes the messages received over a session channel.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// Codec is the wire encoding of the messages exchanged over the state, update
+// and error channels of sessions. An encoder or decoder is created per channel
+// as codecs may keep state across messages (gob sends each type once). warp
+// and warpd must be configured with the same codec.
+type Codec interface {
+	// Name is the name of the codec, as passed to ParseCodec.
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// gobCodec encodes messages with encoding/gob, which frames them itself.
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+func (gobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
+
+// GobCodec is the default codec. It is Go specific but kept as the default so
+// that existing deployments keep working.
+var GobCodec Codec = gobCodec{}
+
+// MaxFrameSize is the maximum size in bytes of a message encoded by a
+// FramedCodec, bounding the memory allocated to receive it.
+const MaxFrameSize = 16 * 1024 * 1024
+
+// FramedCodec is a codec sending each message marshaled independently as a
+// frame prefixed by its length (4 bytes, big endian), which makes it easy to
+// implement for clients written in other languages. Any message-oriented
+// encoding (msgpack, protobuf, ...) can be plugged in as a FramedCodec.
+type FramedCodec struct {
+	name      string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+// NewFramedCodec constructs a FramedCodec named name out of the marshal and
+// unmarshal functions of a message encoding.
+func NewFramedCodec(
+	name string,
+	marshal func(v interface{}) ([]byte, error),
+	unmarshal func(data []byte, v interface{}) error,
+) *FramedCodec {
+	return &FramedCodec{
+		name:      name,
+		marshal:   marshal,
+		unmarshal: unmarshal,
+	}
+}
+
+// Name implements Codec.
+func (c *FramedCodec) Name() string {
+	return c.name
+}
+
+// NewEncoder implements Codec.
+func (c *FramedCodec) NewEncoder(w io.Writer) Encoder {
+	return &frameEncoder{codec: c, w: w}
+}
+
+// NewDecoder implements Codec.
+func (c *FramedCodec) NewDecoder(r io.Reader) Decoder {
+	return &frameDecoder{codec: c, r: r}
+}
+
+// frameEncoder writes length-prefixed frames.
+type frameEncoder struct {
+	codec *FramedCodec
+	w     io.Writer
+}
+
+// Encode marshals v and writes it as a single frame.
+func (e *frameEncoder) Encode(v interface{}) error {
+	data, err := e.codec.marshal(v)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(data) > MaxFrameSize {
+		return errors.Trace(
+			errors.Newf(
+				"Frame too large: %d bytes (max: %d)",
+				len(data), MaxFrameSize,
+			),
+		)
+	}
+	// The length and the message are written at once so that a frame is
+	// never interleaved with another one.
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	if _, err := e.w.Write(frame); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// frameDecoder reads length-prefixed frames.
+type frameDecoder struct {
+	codec *FramedCodec
+	r     io.Reader
+}
+
+// Decode reads the next frame and unmarshals it into v.
+func (d *frameDecoder) Decode(v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		// io.EOF is returned as is between frames.
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return errors.Trace(
+			errors.Newf(
+				"Frame too large: %d bytes (max: %d)",
+				size, MaxFrameSize,
+			),
+		)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return errors.Trace(err)
+	}
+	if err := d.codec.unmarshal(data, v); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// JSONCodec encodes messages as length-prefixed JSON frames, readable by
+// clients written in any language.
+var JSONCodec Codec = NewFramedCodec("json", json.Marshal, json.Unmarshal)
+
+// Codecs are the codecs available by name.
+var Codecs = map[string]Codec{
+	GobCodec.Name():  GobCodec,
+	JSONCodec.Name(): JSONCodec,
+}
+
+// ParseCodec returns the codec named name (GobCodec if empty).
+func ParseCodec(
+	name string,
+) (Codec, error) {
+	if name == "" {
+		return GobCodec, nil
+	}
+	c, ok := Codecs[name]
+	if !ok {
+		names := []string{}
+		for n := range Codecs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Trace(
+			errors.Newf(
+				"Unknown codec %s (available: %s)",
+				name, strings.Join(names, ", "),
+			),
+		)
+	}
+	return c, nil
+}
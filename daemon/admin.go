@@ -0,0 +1,267 @@
+package daemon
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// adminTimeout bounds the exchange of an admin request and its response.
+const adminTimeout = 5 * time.Second
+
+// defaultAdminSocketMode is the permissions of the admin socket if none are
+// configured: only the user running warpd can query it.
+const defaultAdminSocketMode = 0600
+
+//
+// Admin Protocol
+//
+// The admin protocol lets local tools (see wrpctl) query a running warpd over
+// a unix socket, separate from the warp protocol: each connection carries one
+// gob encoded AdminRequest answered by an AdminResponse.
+//
+
+// AdminRequestType is the type of an admin request.
+type AdminRequestType string
+
+const (
+	// AdminRqTpStatus retrieves the status of warpd.
+	AdminRqTpStatus AdminRequestType = "status"
+)
+
+// AdminRequest is a request sent to the admin socket of warpd.
+type AdminRequest struct {
+	Type AdminRequestType
+}
+
+// AdminResponse is the response to an AdminRequest. Error is set if the
+// request failed, Status for AdminRqTpStatus requests otherwise.
+type AdminResponse struct {
+	Error  warp.Error
+	Status *AdminStatus
+}
+
+// AdminStatus is a snapshot of the status of warpd.
+type AdminStatus struct {
+	Version         string
+	ProtocolVersion int
+	StartedAt       time.Time
+	// Uptime is measured by warpd with its monotonic clock.
+	Uptime           time.Duration
+	ClientCount      int
+	ConnectionErrors int64
+	// BytesToClients and BytesToHost are the bytes forwarded by the warps
+	// currently open.
+	BytesToClients uint64
+	BytesToHost    uint64
+	// Warps are the warps currently open, oldest first.
+	Warps []AdminWarpStatus
+}
+
+// AdminWarpStatus is the status of a warp served by warpd.
+type AdminWarpStatus struct {
+	Warp         string
+	Host         string
+	UserCount    int
+	SessionCount int
+	WindowSize   warp.Size
+	Age          time.Duration
+	// Idle is the time elapsed since the last activity on the warp.
+	Idle           time.Duration
+	BytesToClients uint64
+	BytesToHost    uint64
+	Paused         bool
+}
+
+// FetchAdminStatus retrieves the status of the warpd whose admin socket is at
+// path.
+func FetchAdminStatus(
+	ctx context.Context,
+	path string,
+) (*AdminStatus, error) {
+	conn, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to connect to the admin socket: %v", err),
+		)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	if err := gob.NewEncoder(conn).Encode(AdminRequest{
+		Type: AdminRqTpStatus,
+	}); err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to send admin request: %v", err),
+		)
+	}
+	var res AdminResponse
+	if err := gob.NewDecoder(conn).Decode(&res); err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to receive admin response: %v", err),
+		)
+	}
+	if res.Error.Code != "" {
+		return nil, errors.Trace(
+			errors.Newf("%s", res.Error.Message),
+		)
+	}
+	if res.Status == nil {
+		return nil, errors.Trace(
+			errors.Newf("Missing status in admin response"),
+		)
+	}
+	return res.Status, nil
+}
+
+// adminStatus computes the status of the warp. It acquires the warp lock.
+func (w *Warp) adminStatus(
+	ctx context.Context,
+) AdminWarpStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return AdminWarpStatus{
+		Warp:           w.token,
+		Host:           w.host.UserState.username,
+		UserCount:      len(w.clients),
+		SessionCount:   len(w.clientSessions()),
+		WindowSize:     w.windowSize,
+		Age:            time.Since(w.createdAt),
+		Idle:           time.Since(w.lastActivity),
+		BytesToClients: atomic.LoadUint64(&w.bytesToClients),
+		BytesToHost:    atomic.LoadUint64(&w.bytesToHost),
+		Paused:         w.paused,
+	}
+}
+
+// adminStatus computes the status of the server.
+func (s *Srv) adminStatus(
+	ctx context.Context,
+) *AdminStatus {
+	// Snapshot the warps under the server lock and release it right away.
+	s.mutex.Lock()
+	warps := make([]*Warp, 0, len(s.warps))
+	for _, w := range s.warps {
+		warps = append(warps, w)
+	}
+	s.mutex.Unlock()
+
+	st := &AdminStatus{
+		Version:          warp.Version,
+		ProtocolVersion:  warp.ProtocolVersion,
+		StartedAt:        s.startedAt,
+		Uptime:           time.Since(s.startedAt),
+		ClientCount:      int(atomic.LoadInt64(&s.metrics.clients)),
+		ConnectionErrors: atomic.LoadInt64(&s.metrics.connectionErrors),
+		Warps:            []AdminWarpStatus{},
+	}
+	for _, w := range warps {
+		ws := w.adminStatus(ctx)
+		st.BytesToClients += ws.BytesToClients
+		st.BytesToHost += ws.BytesToHost
+		st.Warps = append(st.Warps, ws)
+	}
+	sort.Slice(st.Warps, func(i, j int) bool {
+		return st.Warps[i].Age > st.Warps[j].Age
+	})
+	return st
+}
+
+// runAdmin starts serving the admin protocol on the configured admin socket.
+func (s *Srv) runAdmin(
+	ctx context.Context,
+) error {
+	path := s.config.AdminSocket
+	// Remove the socket left by a previous warpd if any. The socket is
+	// removed when the listener gets closed.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return errors.Trace(
+				errors.Newf("Admin socket error: %v", err),
+			)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Admin listen error: %v", err),
+		)
+	}
+	mode := s.config.AdminSocketMode
+	if mode == 0 {
+		mode = defaultAdminSocketMode
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return errors.Trace(
+			errors.Newf("Admin socket error: %v", err),
+		)
+	}
+
+	s.mutex.Lock()
+	s.adminListener = ln
+	s.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Serving admin: socket=%s mode=%#o",
+		path, mode,
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !s.isShuttingDown() {
+					logging.Logf(ctx, "Admin server error: error=%v", err)
+				}
+				return
+			}
+			go s.handleAdmin(ctx, conn)
+		}
+	}()
+
+	return nil
+}
+
+// handleAdmin answers the admin request received on conn.
+func (s *Srv) handleAdmin(
+	ctx context.Context,
+	conn net.Conn,
+) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	var req AdminRequest
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		logging.Logf(ctx,
+			"Error receiving admin request: error=%v",
+			err,
+		)
+		return
+	}
+
+	res := AdminResponse{}
+	switch req.Type {
+	case AdminRqTpStatus:
+		res.Status = s.adminStatus(ctx)
+	default:
+		res.Error = warp.Error{
+			Code:    "request_unknown",
+			Message: "Invalid admin request: " + string(req.Type),
+		}
+	}
+
+	if err := gob.NewEncoder(conn).Encode(res); err != nil {
+		logging.Logf(ctx,
+			"Error sending admin response: error=%v",
+			err,
+		)
+	}
+}
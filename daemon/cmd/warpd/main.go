@@ -2,32 +2,147 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
+	"regexp"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/daemon"
 	"github.com/spolu/warp/lib/errors"
 	"github.com/spolu/warp/lib/logging"
+	"github.com/spolu/warp/lib/plex"
 )
 
 var lstFlag string
 var prfFlag string
 var crtFlag string
 var keyFlag string
+var ccaFlag string
+var lsFlag bool
+var sbkFlag int
+var cmpFlag bool
+var hbiFlag time.Duration
+var hbtFlag int
+var idlFlag time.Duration
+var mxcFlag int
+var mxwFlag int
+var lgfFlag string
+var mtrFlag string
+var hltFlag string
+var gtwFlag string
+var hstFlag time.Duration
+var kpaFlag time.Duration
+var sckFlag string
+var sdtFlag time.Duration
+var rtlFlag int
+var rtbFlag int
+var bfsFlag int
+var cqsFlag int
+var swnFlag int
+var stwFlag time.Duration
+var cdcFlag string
+var abfFlag time.Duration
+var abmFlag time.Duration
+var admFlag string
+var crlFlag int
+var crwFlag time.Duration
+var crbFlag bool
+var lfiFlag string
+var lfsFlag int64
+var lfbFlag int
+var cmlFlag string
+var cmrFlag string
 
 func init() {
 	flag.StringVar(&lstFlag, "listen",
-		":4242", "Address to listen on ([ip]:port), default: `:4242`")
+		":4242", "Comma-separated addresses to listen on ([ip]:port or unix:path), default: `:4242`")
+	flag.StringVar(&sckFlag, "socket_mode",
+		"", "Permissions of the unix socket in octal (e.g. 0660)")
 	flag.StringVar(&prfFlag, "cpuprofile",
 		"", "Enalbe CPU profiling and write to specified file")
 	flag.StringVar(&crtFlag, "cert",
 		"", "Use the specified cert file to accetpt connections over TLS")
 	flag.StringVar(&keyFlag, "key",
 		"", "Use the specified key file to accept connections over TLS")
+	flag.StringVar(&ccaFlag, "client_ca",
+		"", "CA certificates file clients must present a certificate signed by (requires -cert and -key)")
+	flag.BoolVar(&lsFlag, "list",
+		false, "Allow clients to list served warps (exposes warp IDs)")
+	flag.IntVar(&sbkFlag, "scrollback",
+		256*1024, "Bytes of output replayed to late joiners (0 to disable)")
+	flag.BoolVar(&cmpFlag, "compression",
+		true, "Compress data channels of clients requesting it")
+	flag.DurationVar(&hbiFlag, "heartbeat",
+		10*time.Second, "Interval at which sessions are pinged (0 to disable)")
+	flag.IntVar(&hbtFlag, "heartbeat_threshold",
+		3, "Missed pings after which a session is disconnected")
+	flag.DurationVar(&idlFlag, "idle_timeout",
+		0, "Close warps idle for longer than this duration (0 to disable)")
+	flag.IntVar(&mxwFlag, "max_warps",
+		0, "Maximum number of warps served concurrently (0 for no limit)")
+	flag.IntVar(&mxcFlag, "max_clients",
+		0, "Maximum number of client sessions per warp (0 for no limit)")
+	flag.DurationVar(&hstFlag, "handshake_timeout",
+		10*time.Second, "Time given to new connections to complete their handshake")
+	flag.DurationVar(&kpaFlag, "keepalive",
+		warp.DefaultKeepAlive, "Interval of TCP keepalive probes on connections (negative to disable)")
+	flag.StringVar(&admFlag, "admin_socket",
+		"", "Path of the unix socket serving the status to wrpctl (owner-only, disabled if empty)")
+	flag.StringVar(&mtrFlag, "metrics",
+		"", "Address to serve Prometheus metrics on ([ip]:port, disabled if empty)")
+	flag.StringVar(&hltFlag, "health",
+		"", "Address to serve the /healthz and /livez probes on ([ip]:port, disabled if empty)")
+	flag.StringVar(&gtwFlag, "gateway",
+		"", "Address to serve the WebSocket gateway viewing warps read-only at /warp/<id> on ([ip]:port, disabled if empty)")
+	flag.StringVar(&lgfFlag, "log_format",
+		"", "Log format: `text` or `json` (defaults to $WARP_LOG_FORMAT or text)")
+	flag.StringVar(&lfiFlag, "log_file",
+		"", "Write logs to the specified file instead of stderr")
+	flag.Int64Var(&lfsFlag, "log_max_size",
+		100*1024*1024, "Size in bytes at which the log file is rotated")
+	flag.IntVar(&lfbFlag, "log_backups",
+		5, "Number of rotated log files kept")
+	flag.StringVar(&cmlFlag, "command_log",
+		"", "Log the commands typed into warps by their clients to the specified file (owner-only, disabled if empty)")
+	flag.StringVar(&cmrFlag, "command_log_redact",
+		daemon.DefaultCommandRedaction, "Regexp of the parts of the commands masked in the command log (its first group if any, nothing masked if empty)")
+	flag.DurationVar(&sdtFlag, "shutdown_timeout",
+		10*time.Second, "Time given to warps to disconnect on SIGINT/SIGTERM")
+	flag.IntVar(&rtlFlag, "client_rate_limit",
+		0, "Bytes per second forwarded from each client to the host (0 for no limit)")
+	flag.IntVar(&rtbFlag, "client_rate_burst",
+		0, "Burst in bytes allowed above the client rate limit (defaults to the limit)")
+	flag.IntVar(&bfsFlag, "buffer_size",
+		plex.DefaultBufferSize, "Size in bytes of the buffers used to forward session data")
+	flag.IntVar(&cqsFlag, "client_queue_size",
+		daemon.DefaultClientQueueSize, "Chunks of output queued per client before it is disconnected as too slow")
+	flag.IntVar(&swnFlag, "stream_window",
+		warp.DefaultStreamWindow, "Receive window in bytes of session channels (bounds throughput per round-trip)")
+	flag.DurationVar(&stwFlag, "state_window",
+		50*time.Millisecond, "Window within which state changes are coalesced into a single broadcast (0 to disable)")
+	flag.StringVar(&cdcFlag, "codec",
+		"gob", "Wire encoding of session messages: `gob` or `json` (clients must set $WARPD_CODEC accordingly)")
+	flag.DurationVar(&abfFlag, "accept_backoff",
+		5*time.Millisecond, "Delay before accepting again after a temporary accept error, doubled on consecutive errors")
+	flag.DurationVar(&abmFlag, "accept_backoff_max",
+		time.Second, "Maximum delay before accepting again after temporary accept errors")
+	flag.IntVar(&crlFlag, "conn_rate_limit",
+		0, "Connections accepted from each source IP per window (0 for no limit)")
+	flag.DurationVar(&crwFlag, "conn_rate_window",
+		time.Minute, "Window over which the connection rate limit applies")
+	flag.BoolVar(&crbFlag, "conn_rate_limit_loopback",
+		false, "Apply the connection rate limit to loopback addresses too")
 
 	if fl := log.Flags(); fl&log.Ltime != 0 {
 		log.SetFlags(fl | log.Lmicroseconds)
@@ -53,19 +168,218 @@ func main() {
 		}()
 	}
 
+	switch lgfFlag {
+	case "":
+	case string(logging.FormatText), string(logging.FormatJSON):
+		logging.SetFormat(logging.Format(lgfFlag))
+	default:
+		log.Fatal(errors.Details(
+			errors.Newf("Invalid log format: %s", lgfFlag),
+		))
+	}
+
+	if lfiFlag != "" {
+		f, err := logging.NewRotatingFile(lfiFlag, lfsFlag, lfbFlag)
+		if err != nil {
+			log.Fatal(errors.Details(err))
+		}
+		defer f.Close()
+		logging.SetOutput(f)
+	}
+
+	if rtlFlag < 0 || rtbFlag < 0 {
+		log.Fatal(errors.Details(
+			errors.Newf("Invalid client rate limit: %d (burst %d)", rtlFlag, rtbFlag),
+		))
+	}
+
+	if bfsFlag <= 0 {
+		log.Fatal(errors.Details(
+			errors.Newf("Invalid buffer size: %d", bfsFlag),
+		))
+	}
+
+	if cqsFlag <= 0 {
+		log.Fatal(errors.Details(
+			errors.Newf("Invalid client queue size: %d", cqsFlag),
+		))
+	}
+
+	if swnFlag < warp.DefaultStreamWindow || swnFlag > math.MaxUint32 {
+		log.Fatal(errors.Details(
+			errors.Newf(
+				"Invalid stream window: %d (minimum %d)",
+				swnFlag, warp.DefaultStreamWindow,
+			),
+		))
+	}
+
+	if stwFlag < 0 {
+		log.Fatal(errors.Details(
+			errors.Newf("Invalid state window: %s", stwFlag),
+		))
+	}
+
+	codec, err := warp.ParseCodec(cdcFlag)
+	if err != nil {
+		log.Fatal(errors.Details(err))
+	}
+
+	if abfFlag <= 0 || abmFlag < abfFlag {
+		log.Fatal(errors.Details(
+			errors.Newf(
+				"Invalid accept backoff: %s (maximum %s)", abfFlag, abmFlag,
+			),
+		))
+	}
+
+	if crlFlag < 0 || crwFlag <= 0 {
+		log.Fatal(errors.Details(
+			errors.Newf(
+				"Invalid connection rate limit: %d (window %s)", crlFlag, crwFlag,
+			),
+		))
+	}
+
+	var commandLog io.Writer
+	var redactCommand func(string) string
+	if cmlFlag != "" {
+		f, err := os.OpenFile(
+			cmlFlag, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600,
+		)
+		if err != nil {
+			log.Fatal(errors.Details(errors.Trace(err)))
+		}
+		defer f.Close()
+		commandLog = f
+		// The file may have been created with looser permissions.
+		if err := f.Chmod(0600); err != nil {
+			log.Fatal(errors.Details(errors.Trace(err)))
+		}
+		if cmrFlag != "" {
+			re, err := regexp.Compile(cmrFlag)
+			if err != nil {
+				log.Fatal(errors.Details(
+					errors.Newf("Invalid command log redaction: %v", err),
+				))
+			}
+			redactCommand = daemon.RegexpRedactor(re)
+		}
+	}
+
+	addresses := []string{}
+	for _, a := range strings.Split(lstFlag, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			log.Fatal(errors.Details(
+				errors.Newf("Invalid listen addresses: %s", lstFlag),
+			))
+		}
+		addresses = append(addresses, a)
+	}
+
 	ctx := context.Background()
 
-	srv := daemon.NewSrv(
-		ctx,
-		lstFlag,
-		crtFlag,
-		keyFlag,
+	var tlsConfig *tls.Config
+	if crtFlag != "" && keyFlag != "" {
+		var err error
+		tlsConfig, err = daemon.TLSConfig(ctx, crtFlag, keyFlag)
+		if err != nil {
+			log.Fatal(errors.Details(err))
+		}
+	}
+
+	var clientCAs *x509.CertPool
+	if ccaFlag != "" {
+		if tlsConfig == nil {
+			log.Fatal(errors.Details(
+				errors.Newf("Client certificates (-client_ca) require TLS (-cert and -key)"),
+			))
+		}
+		var err error
+		clientCAs, err = daemon.ClientCAs(ctx, ccaFlag)
+		if err != nil {
+			log.Fatal(errors.Details(err))
+		}
+	}
+
+	var socketMode uint64
+	if sckFlag != "" {
+		var err error
+		socketMode, err = strconv.ParseUint(sckFlag, 8, 32)
+		if err != nil {
+			log.Fatal(errors.Details(
+				errors.Newf("Invalid socket mode %s: %v", sckFlag, err),
+			))
+		}
+	}
+
+	srv := daemon.NewSrv(ctx, daemon.Config{
+		Addresses:          addresses,
+		SocketMode:         os.FileMode(socketMode),
+		TLSConfig:          tlsConfig,
+		ClientCAs:          clientCAs,
+		EnableList:         lsFlag,
+		ScrollbackSize:     sbkFlag,
+		Compression:        cmpFlag,
+		HeartbeatInterval:  hbiFlag,
+		HeartbeatThreshold: hbtFlag,
+		IdleTimeout:        idlFlag,
+		MaxWarps:           mxwFlag,
+		MaxClients:         mxcFlag,
+		MetricsAddress:     mtrFlag,
+		HealthAddress:      hltFlag,
+		GatewayAddress:     gtwFlag,
+		HandshakeTimeout:   hstFlag,
+		KeepAlive:          kpaFlag,
+		ClientRateLimit:    rtlFlag,
+		ClientRateBurst:    rtbFlag,
+		BufferSize:         bfsFlag,
+		ClientQueueSize:    cqsFlag,
+		StreamWindow:       swnFlag,
+		StateWindow:        stwFlag,
+		Codec:              codec,
+		AcceptBackoff:      abfFlag,
+		AcceptBackoffMax:   abmFlag,
+		AdminSocket:        admFlag,
+		CommandLog:         commandLog,
+		RedactCommand:      redactCommand,
+
+		ConnRateLimit:         crlFlag,
+		ConnRateWindow:        crwFlag,
+		ConnRateLimitLoopback: crbFlag,
+	})
+
+	logging.Logf(ctx,
+		"Started warpd: version=%s protocol=%d",
+		warp.Version, warp.ProtocolVersion,
 	)
 
-	logging.Logf(ctx, "Started warpd: version=%s", warp.Version)
+	// Gracefully shut down on SIGINT or SIGTERM. A second signal exits
+	// immediately.
+	doneC := make(chan struct{})
+	sigC := make(chan os.Signal, 2)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigC
+		logging.Logf(ctx, "Received signal: signal=%s", sig)
+		go func() {
+			<-sigC
+			log.Fatal("Forced exit.")
+		}()
 
-	err := srv.Run(ctx)
+		sdCtx, cancel := context.WithTimeout(ctx, sdtFlag)
+		defer cancel()
+		if err := srv.Shutdown(sdCtx); err != nil {
+			logging.Logf(ctx, "Shutdown error: error=%v", err)
+		}
+		close(doneC)
+	}()
+
+	err = srv.Run(ctx)
 	if err != nil {
 		log.Fatal(errors.Details(err))
 	}
+
+	<-doneC
+	logging.Logf(ctx, "Stopped warpd")
 }
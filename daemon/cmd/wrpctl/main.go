@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// EnvAdminSocket is the env variable from which the path of the admin socket
+// is read if the `-socket` flag is not set.
+const EnvAdminSocket = "WARPD_ADMIN_SOCKET"
+
+var sckFlag string
+
+func init() {
+	flag.StringVar(&sckFlag, "socket",
+		os.Getenv(EnvAdminSocket), "Path of the admin socket of warpd, as passed to its -admin_socket (defaults to $WARPD_ADMIN_SOCKET)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: wrpctl [flags] status\n\n")
+		fmt.Fprintf(os.Stderr, "Queries a running warpd over its admin socket.\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  status\tPrints the uptime and traffic of warpd and its open warps.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 || flag.Arg(0) != "status" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if sckFlag == "" {
+		fail(errors.Newf("Missing admin socket: set `-socket` or $%s", EnvAdminSocket))
+	}
+
+	st, err := daemon.FetchAdminStatus(context.Background(), sckFlag)
+	if err != nil {
+		fail(err)
+	}
+	printStatus(st)
+}
+
+// fail prints err and exits.
+func fail(
+	err error,
+) {
+	fmt.Fprintf(os.Stderr, "[Error] %s\n", err.Error())
+	os.Exit(1)
+}
+
+// printStatus prints the status of warpd followed by a table of its warps.
+func printStatus(
+	st *daemon.AdminStatus,
+) {
+	fmt.Printf("Version:    %s (protocol %d)\n", st.Version, st.ProtocolVersion)
+	fmt.Printf("Started:    %s (up %s)\n",
+		st.StartedAt.Local().Format(time.RFC1123), st.Uptime.Round(time.Second),
+	)
+	fmt.Printf("Warps:      %d\n", len(st.Warps))
+	fmt.Printf("Clients:    %d\n", st.ClientCount)
+	fmt.Printf("Errors:     %d\n", st.ConnectionErrors)
+	fmt.Printf("Traffic:    %s to clients, %s to hosts\n",
+		formatBytes(st.BytesToClients), formatBytes(st.BytesToHost),
+	)
+	if len(st.Warps) == 0 {
+		return
+	}
+
+	fmt.Printf("\n")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "WARP\tHOST\tUSERS\tSESSIONS\tSIZE\tAGE\tIDLE\tTO CLIENTS\tTO HOST\tSTATUS\n")
+	for _, w := range st.Warps {
+		status := "running"
+		if w.Paused {
+			status = "paused"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%dx%d\t%s\t%s\t%s\t%s\t%s\n",
+			w.Warp, w.Host, w.UserCount, w.SessionCount,
+			w.WindowSize.Cols, w.WindowSize.Rows,
+			w.Age.Round(time.Second), w.Idle.Round(time.Second),
+			formatBytes(w.BytesToClients), formatBytes(w.BytesToHost),
+			status,
+		)
+	}
+	tw.Flush()
+}
+
+// formatBytes formats a number of bytes for display.
+func formatBytes(
+	n uint64,
+) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spolu/warp/lib/logging"
+)
+
+// DefaultCommandRedaction is the default pattern of the command logging
+// redaction of warpd: anything following a password, secret or token keyword
+// on a command line is masked (see RegexpRedactor).
+const DefaultCommandRedaction = `(?i)(?:pass(?:word|wd|phrase)?|secret|token)[^\s=:]*[\s=:]+(.*)`
+
+// commandLogNotice is prepended to the banner of the warps whose commands are
+// logged, so that their clients are told when they join.
+const commandLogNotice = "The commands typed into this warp are logged by warpd."
+
+// maxCommandLength bounds the length in bytes of the command lines logged.
+// Input beyond it is dropped until the end of the line.
+const maxCommandLength = 4096
+
+// redactedMask replaces the parts of the command lines masked by
+// RegexpRedactor.
+const redactedMask = "[REDACTED]"
+
+// RegexpRedactor returns a redaction function (see Config.RedactCommand)
+// masking the parts of command lines matched by re: its first capturing group
+// if it has one, the whole match otherwise.
+func RegexpRedactor(
+	re *regexp.Regexp,
+) func(string) string {
+	return func(line string) string {
+		matches := re.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			return line
+		}
+		redacted := ""
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if start == end {
+				continue
+			}
+			redacted += line[last:start] + redactedMask
+			last = end
+		}
+		return redacted + line[last:]
+	}
+}
+
+// commandLog writes the command lines typed into warps to the command log
+// configured, redacted. It is shared by all the warps of warpd.
+type commandLog struct {
+	w      io.Writer
+	redact func(string) string
+
+	mutex *sync.Mutex
+}
+
+// newCommandLog constructs a commandLog writing to w, applying redact (if not
+// nil) to each line.
+func newCommandLog(
+	w io.Writer,
+	redact func(string) string,
+) *commandLog {
+	return &commandLog{
+		w:      w,
+		redact: redact,
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Log writes the command line typed by the client of session ss. The line is
+// not logged if the redaction function panics, as it may not be safe to.
+func (l *commandLog) Log(
+	ctx context.Context,
+	ss *Session,
+	line string,
+) {
+	if l.redact != nil {
+		var ok bool
+		line, ok = l.safeRedact(ctx, line)
+		if !ok {
+			line = redactedMask
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := fmt.Fprintf(l.w,
+		"time=%s warp=%s user=%s username=%s command=%q\n",
+		time.Now().UTC().Format(time.RFC3339), ss.warp, ss.session.User,
+		ss.username, line,
+	)
+	if err != nil {
+		logging.Warnf(ctx,
+			"Command log error: session=%s error=%v",
+			ss.ToString(), err,
+		)
+	}
+}
+
+// safeRedact applies the redaction function to line, recovering (and logging)
+// a panic.
+func (l *commandLog) safeRedact(
+	ctx context.Context,
+	line string,
+) (redacted string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Warnf(ctx, "Command redaction panicked: panic=%v", r)
+			redacted, ok = "", false
+		}
+	}()
+	return l.redact(line), true
+}
+
+// Escape sequences parsing states of commandLine.
+const (
+	clGround = iota
+	clEscape
+	clCSI
+	clSS3
+)
+
+// commandLine assembles the command lines typed by a client from its input,
+// which arrives in arbitrary chunks (often a byte at a time). Lines end with a
+// carriage return (or newline). Line editing is approximated: backspace
+// deletes the last character, Ctrl-U and Ctrl-C discard the line, and escape
+// sequences (arrow keys, ...) and other control characters are dropped, so
+// what is logged is what was typed, not necessarily what the shell ran (shell
+// history and completion are not applied).
+type commandLine struct {
+	buf   []byte
+	state int
+	// truncated is set once the line exceeded maxCommandLength.
+	truncated bool
+}
+
+// Feed feeds input data to the line, returning the lines completed, empty ones
+// excluded.
+func (c *commandLine) Feed(
+	data []byte,
+) []string {
+	lines := []string{}
+	for _, b := range data {
+		switch c.state {
+		case clEscape:
+			switch b {
+			case '[':
+				c.state = clCSI
+			case 'O':
+				c.state = clSS3
+			default:
+				c.state = clGround
+			}
+			continue
+		case clCSI:
+			if b >= 0x40 && b <= 0x7e {
+				c.state = clGround
+			}
+			continue
+		case clSS3:
+			c.state = clGround
+			continue
+		}
+
+		switch {
+		case b == 0x1b:
+			c.state = clEscape
+		case b == '\r' || b == '\n':
+			if line := strings.TrimSpace(string(c.buf)); line != "" {
+				lines = append(lines, line)
+			}
+			c.reset()
+		case b == 0x7f || b == 0x08:
+			// Delete the last character, which may be multi-byte.
+			if len(c.buf) > 0 && !c.truncated {
+				_, size := utf8.DecodeLastRune(c.buf)
+				c.buf = c.buf[:len(c.buf)-size]
+			}
+		case b == 0x15 || b == 0x03:
+			c.reset()
+		case b < 0x20 && b != '\t':
+		default:
+			if len(c.buf) >= maxCommandLength {
+				c.truncated = true
+			} else {
+				c.buf = append(c.buf, b)
+			}
+		}
+	}
+	return lines
+}
+
+// reset discards the line being assembled.
+func (c *commandLine) reset() {
+	c.buf = c.buf[:0]
+	c.truncated = false
+}
+
+// logCommands logs the command lines completed by the input data of the
+// client of session ss, if command logging is enabled. The input of warps
+// encrypted end to end is ciphertext and is never logged.
+func (w *Warp) logCommands(
+	ctx context.Context,
+	ss *Session,
+	data []byte,
+) {
+	if w.commands == nil || len(w.e2eCheck) > 0 {
+		return
+	}
+	// The input of a session is received by a single goroutine.
+	if ss.commandLine == nil {
+		ss.commandLine = &commandLine{}
+	}
+	for _, line := range ss.commandLine.Feed(data) {
+		w.commands.Log(ctx, ss, line)
+	}
+}
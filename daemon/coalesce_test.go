@@ -0,0 +1,77 @@
+package daemon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+)
+
+// resizes is the number of rapid state changes made by TestStateCoalescing.
+const resizes = 100
+
+func TestStateCoalescing(t *testing.T) {
+	for _, tc := range []struct {
+		window time.Duration
+		// max is the maximum number of states received for the changes.
+		max int
+	}{
+		{0, resizes},
+		{50 * time.Millisecond, resizes / 10},
+	} {
+		ctx := context.Background()
+		s := warptest.NewServer(t, daemon.Config{StateWindow: tc.window})
+
+		host, err := s.OpenHost(ctx, "coalesce", "alice", warp.HostUpdate{
+			WindowSize: warp.Size{Rows: 24, Cols: 80},
+		})
+		if err != nil {
+			t.Fatalf("OpenHost: %v", err)
+		}
+		c, err := s.Connect(ctx, "coalesce", "bob")
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+		warptest.WaitFor(t, testTimeout, func() bool {
+			_, ok := host.State().Users[c.User]
+			return ok
+		})
+		// Let the broadcast of the client joining go out.
+		time.Sleep(2 * tc.window)
+		before := c.States()
+
+		var size warp.Size
+		for i := 0; i < resizes; i++ {
+			size = warp.Size{Rows: 24 + i, Cols: 80}
+			err := host.Session.SendHostUpdate(ctx, warp.HostUpdate{
+				Warp:       "coalesce",
+				From:       host.Session.Session(),
+				WindowSize: size,
+			})
+			if err != nil {
+				t.Fatalf("SendHostUpdate: %v", err)
+			}
+		}
+		warptest.WaitFor(t, testTimeout, func() bool {
+			return c.State().WindowSize == size
+		})
+
+		if n := c.States() - before; n > tc.max {
+			t.Errorf(
+				"window %s: %d changes broadcast in %d states, want at most %d",
+				tc.window, resizes, n, tc.max,
+			)
+		} else {
+			t.Logf(
+				"window %s: %d changes broadcast in %d states",
+				tc.window, resizes, n,
+			)
+		}
+
+		c.Close()
+		host.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestCompressionNegotiation(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		server, client bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		name := fmt.Sprintf("server=%t/client=%t", tc.server, tc.client)
+		t.Run(name, func(t *testing.T) {
+			s := warptest.NewServer(t, daemon.Config{Compression: tc.server})
+			s.Compression = tc.client
+
+			host, err := s.OpenHost(ctx, "compressed", "alice",
+				warp.HostUpdate{WindowSize: warp.Size{Rows: 24, Cols: 80}},
+			)
+			if err != nil {
+				t.Fatalf("OpenHost: %v", err)
+			}
+			defer host.Close()
+			c, err := s.Connect(ctx, "compressed", "bob")
+			if err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			defer c.Close()
+
+			// The data flows either way, compressed only if both sides
+			// requested it.
+			output := strings.Repeat("\x1b[32mINFO\x1b[0m all good\r\n", 100)
+			output += "done"
+			if _, err := host.Write([]byte(output)); err != nil {
+				t.Fatalf("host Write: %v", err)
+			}
+			got, err := c.ReadUntil("done", testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != output {
+				t.Fatalf("client received %q, want %q", got, output)
+			}
+			wire, _ := c.Session.WireStats()
+			compressed := wire < int64(len(output))
+			if compressed != (tc.server && tc.client) {
+				t.Fatalf(
+					"Received %d bytes over the wire for %d bytes of output",
+					wire, len(output),
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultConnRateWindow is the window over which the connections of each
+// source IP are counted if ConnRateLimit is set without a window.
+const defaultConnRateWindow = time.Minute
+
+// connWindow counts the connections of a source IP in the current window.
+type connWindow struct {
+	start time.Time
+	count int
+	// throttled is set once a connection was rejected in the window, so that
+	// throttled IPs are logged once per window.
+	throttled bool
+}
+
+// connLimiter limits the rate of the connections accepted from each source IP
+// to limit per window, blunting brute-force attempts against warp secrets.
+// Windows are fixed, starting with the first connection of an IP, and windows
+// elapsed are swept at most once per window so that memory is bounded by the
+// IPs seen over the last two windows.
+type connLimiter struct {
+	limit    int
+	window   time.Duration
+	loopback bool
+
+	ips       map[string]*connWindow
+	lastSweep time.Time
+
+	mutex *sync.Mutex
+}
+
+// newConnLimiter constructs a connLimiter accepting up to limit connections per
+// source IP and window. Loopback addresses are exempted unless loopback is set.
+func newConnLimiter(
+	limit int,
+	window time.Duration,
+	loopback bool,
+) *connLimiter {
+	if window == 0 {
+		window = defaultConnRateWindow
+	}
+	return &connLimiter{
+		limit:     limit,
+		window:    window,
+		loopback:  loopback,
+		ips:       map[string]*connWindow{},
+		lastSweep: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Allow counts a connection from addr and returns whether it is accepted, and
+// if not, whether it is the first rejected from its IP in the current window.
+// Connections from addresses other than TCP ones (unix sockets) are always
+// accepted.
+func (l *connLimiter) Allow(
+	addr net.Addr,
+) (bool, bool) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || (!l.loopback && tcp.IP.IsLoopback()) {
+		return true, false
+	}
+	ip := tcp.IP.String()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= l.window {
+		for k, w := range l.ips {
+			if now.Sub(w.start) >= l.window {
+				delete(l.ips, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.ips[ip]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &connWindow{start: now}
+		l.ips[ip] = w
+	}
+	w.count++
+	if w.count <= l.limit {
+		return true, false
+	}
+	first := !w.throttled
+	w.throttled = true
+	return false, first
+}
@@ -0,0 +1,129 @@
+package daemon_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestClientCannotForgeHostUpdates(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "forged", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	mallory, err := s.Connect(ctx, "forged", "mallory")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer mallory.Close()
+	bob, err := s.Connect(ctx, "forged", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer bob.Close()
+
+	// A malicious client sends host control updates over its own session,
+	// granting itself write access, disconnecting another client and
+	// pausing the warp. They are decoded as a client update, the host
+	// control fields being dropped.
+	forged := warp.HostUpdate{
+		Warp: "forged",
+		From: mallory.Session.Session(),
+		Modes: map[string]warp.Mode{
+			mallory.User: warp.ModeShellRead | warp.ModeShellWrite,
+		},
+		Disconnect: []string{bob.User},
+		Pause:      true,
+		MaxClients: 1,
+	}
+	if err := mallory.Session.SendHostUpdate(ctx, forged); err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+	// Updates are handled in order: once the access request that follows is
+	// pending, the forged update was handled.
+	err = mallory.Session.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp:          "forged",
+		From:          mallory.Session.Session(),
+		AccessRequest: true,
+	})
+	if err != nil {
+		t.Fatalf("SendClientUpdate: %v", err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		return len(host.State().AccessRequests) == 1
+	})
+	checkUntouched := func() {
+		t.Helper()
+		st := host.State()
+		if mode := st.Users[mallory.User].Mode; mode != warp.ModeShellRead {
+			t.Fatalf("forged mode granted: got %d, want %d", mode, warp.ModeShellRead)
+		}
+		if st.Paused {
+			t.Fatalf("warp paused by a forged update")
+		}
+		if _, err := host.Write([]byte("still here\r\n")); err != nil {
+			t.Fatalf("host Write: %v", err)
+		}
+		if _, err := bob.ReadUntil("still here", testTimeout); err != nil {
+			t.Fatalf("client disconnected by a forged update: %v", err)
+		}
+	}
+	checkUntouched()
+
+	// Impersonating the host session gets the malicious client dropped.
+	forged.From = host.Session.Session()
+	if err := mallory.Session.SendHostUpdate(ctx, forged); err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+	werr, ok := errors.Cause(mallory.Err()).(*cli.WarpdError)
+	if !ok || werr.Code != warp.ErrInternal {
+		t.Fatalf("client error: got %v, want %s", mallory.Err(), warp.ErrInternal)
+	}
+	checkUntouched()
+}
+
+func TestSecondHostRejected(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "taken", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	// A session claiming to host the warp without being nominated by its
+	// host is rejected, the warp being left untouched.
+	_, err = s.OpenHost(ctx, "taken", "mallory", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	werr, ok := errors.Cause(err).(*cli.WarpdError)
+	if !ok || werr.Code != warp.ErrWarpInUse {
+		t.Fatalf("OpenHost: got %v, want %s", err, warp.ErrWarpInUse)
+	}
+
+	c, err := s.Connect(ctx, "taken", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	for _, user := range c.State().Users {
+		if user.Hosting && user.Token != host.User {
+			t.Fatalf("warp hosted by %s, want %s", user.Token, host.User)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+)
+
+func TestFanOutDropsFailedClient(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "fan-out", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	dead, err := s.Connect(ctx, "fan-out", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	c, err := s.Connect(ctx, "fan-out", "carol")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	// The connection of a client dies without notice. Its user is kept in
+	// the warp for it to reconnect, but warpd stops writing to it.
+	dead.Close()
+
+	for _, line := range []string{"first\r\n", "second\r\n"} {
+		if _, err := host.Write([]byte(line)); err != nil {
+			t.Fatalf("host Write: %v", err)
+		}
+		if _, err := c.ReadUntil(line, testTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := host.State().Users[c.User]; !ok {
+		t.Fatalf("healthy client dropped along with the failed one")
+	}
+}
+
+func TestStalledClientDoesNotStallWarp(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "stalled", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	c, err := s.Connect(ctx, "stalled", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	// The stalled client joins but never reads its state nor its data.
+	stalled, err := s.Dial(ctx, "stalled", warp.SsTpShellClient, "mallory")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer stalled.Close()
+	err = stalled.Session.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp: "stalled",
+		From: stalled.Session.Session(),
+	})
+	if err != nil {
+		t.Fatalf("SendClientUpdate: %v", err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		_, ok := host.State().Users[stalled.User]
+		return ok
+	})
+
+	readC := make(chan error, 1)
+	go func() {
+		_, err := c.ReadUntil("done\r\n", testTimeout)
+		readC <- err
+	}()
+
+	// Resizes broadcast enough states to fill the channel of the stalled
+	// client, interleaved with output.
+	var size warp.Size
+	for i := 0; i < 2000; i++ {
+		size = warp.Size{Rows: 1 + i/10, Cols: 80 + i%10}
+		err := host.Session.SendHostUpdate(ctx, warp.HostUpdate{
+			Warp:       "stalled",
+			From:       host.Session.Session(),
+			WindowSize: size,
+		})
+		if err != nil {
+			t.Fatalf("SendHostUpdate: %v", err)
+		}
+		if i%100 == 0 {
+			if _, err := fmt.Fprintf(host, "line %d\r\n", i); err != nil {
+				t.Fatalf("host Write: %v", err)
+			}
+			// The healthy sessions keep up with the states.
+			warptest.WaitFor(t, testTimeout, func() bool {
+				return c.State().WindowSize == size &&
+					host.State().WindowSize == size
+			})
+		}
+	}
+	if _, err := host.Write([]byte("done\r\n")); err != nil {
+		t.Fatalf("host Write: %v", err)
+	}
+
+	if err := <-readC; err != nil {
+		t.Fatal(err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		return c.State().WindowSize == size
+	})
+}
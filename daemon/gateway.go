@@ -0,0 +1,324 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/token"
+	"github.com/spolu/warp/lib/websocket"
+)
+
+// gatewayPathPrefix prefixes the path of the gateway requests, followed by the
+// ID of the warp to view (`/warp/goofy-dev`).
+const gatewayPathPrefix = "/warp/"
+
+// gatewayUsername is the username of the gateway viewers that don't provide
+// one.
+const gatewayUsername = "web"
+
+// errWarpEncrypted is the code of the error sent to gateway viewers of warps
+// encrypted end to end, which the gateway can't decrypt.
+const errWarpEncrypted errors.Code = "warp_encrypted"
+
+// gatewayMessage is the JSON message sent to gateway viewers as a text frame,
+// the warp data being sent as binary frames. Its type is `size` when the warp
+// window size changes (starting with the initial size) and `error` before the
+// connection is closed by warpd.
+type gatewayMessage struct {
+	Type    string      `json:"type"`
+	Cols    int         `json:"cols,omitempty"`
+	Rows    int         `json:"rows,omitempty"`
+	Code    errors.Code `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// sendGatewayMessage sends m to the gateway viewer ws.
+func sendGatewayMessage(
+	ws *websocket.Conn,
+	m gatewayMessage,
+) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ws.WriteMessage(websocket.OpText, data); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// runGateway starts serving the WebSocket gateway on the configured gateway
+// address.
+func (s *Srv) runGateway(
+	ctx context.Context,
+) error {
+	address, err := warp.NormalizeAddress(s.config.GatewayAddress)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Invalid gateway address: %v", err),
+		)
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Gateway listen error: %v", err),
+		)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(gatewayPathPrefix, func(
+		w http.ResponseWriter,
+		r *http.Request,
+	) {
+		s.serveGateway(ctx, w, r)
+	})
+	srv := &http.Server{Handler: mux}
+
+	s.mutex.Lock()
+	s.gatewayServer = srv
+	s.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Serving gateway: address=%s",
+		ln.Addr().String(),
+	)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.Logf(ctx, "Gateway server error: error=%v", err)
+		}
+	}()
+
+	return nil
+}
+
+// serveGateway upgrades a gateway request to a WebSocket connection streaming
+// the warp whose ID is in the path to the browser, read-only. The warp secret
+// and the username of the viewer are passed as the `secret` and `username`
+// query parameters, so the gateway should be served behind TLS.
+func (s *Srv) serveGateway(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	id := strings.TrimPrefix(r.URL.Path, gatewayPathPrefix)
+	if !warp.WarpRegexp.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		username = gatewayUsername
+	}
+	if err := warp.ValidateUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Gateway viewers are subject to the rate limit of the connections as
+	// they can present warp secrets as well.
+	if s.connLimiter != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			if ok, first := s.connLimiter.Allow(addr); !ok {
+				atomic.AddInt64(&s.metrics.connectionsThrottled, 1)
+				if first {
+					logging.Warnf(ctx,
+						"Throttling connections: listener=gateway remote=%s "+
+							"limit=%d window=%s",
+						r.RemoteAddr, s.connLimiter.limit, s.connLimiter.window,
+					)
+				}
+				http.Error(w, "Too many connections", http.StatusTooManyRequests)
+				return
+			}
+		}
+	}
+
+	// The in-process session is encoded as sessions opened by the client
+	// package, whatever the codec warpd is configured with.
+	codec, err := cli.ResolveCodec()
+	if err != nil {
+		logging.Logf(ctx, "Gateway error: error=%v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logging.Logf(ctx,
+			"Gateway upgrade error: remote=%s error=%v",
+			r.RemoteAddr, err,
+		)
+		return
+	}
+	defer ws.Close()
+
+	logging.Logf(ctx,
+		"Gateway viewer connected: remote=%s warp=%s username=%s",
+		r.RemoteAddr, id, username,
+	)
+	err = s.viewWarp(ctx, ws, id, r.URL.Query().Get("secret"), username, codec)
+	if err != nil {
+		logging.Logf(ctx,
+			"Gateway viewer error: remote=%s warp=%s error=%v",
+			r.RemoteAddr, id, err,
+		)
+	} else {
+		logging.Logf(ctx,
+			"Gateway viewer disconnected: remote=%s warp=%s",
+			r.RemoteAddr, id,
+		)
+	}
+}
+
+// viewWarp joins the warp id as a read-only shell client, through an
+// in-process connection handled as any other, and streams its data to the
+// gateway viewer ws until either side disconnects. Input from the viewer is
+// ignored.
+func (s *Srv) viewWarp(
+	ctx context.Context,
+	ws *websocket.Conn,
+	id string,
+	secret string,
+	username string,
+	codec warp.Codec,
+) error {
+	srvConn, cliConn := net.Pipe()
+	go func() {
+		if err := s.handle(ctx, "gateway", srvConn, codec); err != nil &&
+			errors.CodeOf(err) == errors.CodeNone {
+			atomic.AddInt64(&s.metrics.connectionErrors, 1)
+			logging.Logf(ctx,
+				"Error handling gateway connection: warp=%s error=%v",
+				id, err,
+			)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	session := warp.Session{
+		Token:  token.New("session"),
+		User:   token.New("guest"),
+		Secret: token.RandStr(),
+	}
+	ss, err := cli.NewSession(
+		ctx, session, id, warp.SsTpShellClient, username,
+		false, true, false, 0, cancel, cliConn,
+	)
+	if err != nil {
+		cancel()
+		cliConn.Close()
+		return errors.Trace(err)
+	}
+	defer ss.TearDown()
+
+	if err := ss.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp:       id,
+		From:       session,
+		WarpSecret: secret,
+	}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// sendError forwards the error sent by warpd, if any, once the session
+	// ended.
+	sendError := func() {
+		if e, err := ss.DecodeError(ctx); err == nil {
+			sendGatewayMessage(ws, gatewayMessage{
+				Type:    "error",
+				Code:    e.Code,
+				Message: e.Message,
+			})
+		}
+	}
+	// encrypted checks whether the warp data is encrypted end to end.
+	encrypted := func(st *warp.State) bool {
+		if len(st.E2ECheck) == 0 {
+			return false
+		}
+		sendGatewayMessage(ws, gatewayMessage{
+			Type:    "error",
+			Code:    errWarpEncrypted,
+			Message: "The warp is encrypted end to end and can't be viewed in a browser.",
+		})
+		return true
+	}
+
+	st, err := ss.DecodeState(ctx)
+	if err != nil {
+		sendError()
+		return errors.Trace(
+			errors.Newf("Failed to receive initial state: %v", err),
+		)
+	}
+	if encrypted(st) {
+		return errors.Trace(errors.Newf("Warp encrypted end to end"))
+	}
+	if err := ss.UpdateState(*st, false); err != nil {
+		return errors.Trace(err)
+	}
+	size := ss.WindowSize()
+	if err := sendGatewayMessage(ws, gatewayMessage{
+		Type: "size", Cols: size.Cols, Rows: size.Rows,
+	}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Forward the warp window size changes, and the error ending the
+	// session.
+	stateDoneC := make(chan struct{})
+	go func() {
+		defer close(stateDoneC)
+		defer ss.TearDown()
+		for {
+			st, err := ss.DecodeState(ctx)
+			if err != nil {
+				sendError()
+				return
+			}
+			if encrypted(st) {
+				return
+			}
+			if err := ss.UpdateState(*st, false); err != nil {
+				return
+			}
+			if s := ss.WindowSize(); s != size {
+				size = s
+				if err := sendGatewayMessage(ws, gatewayMessage{
+					Type: "size", Cols: size.Cols, Rows: size.Rows,
+				}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Viewers are read-only, their messages are only read to detect when
+	// they disconnect.
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				ss.TearDown()
+				return
+			}
+		}
+	}()
+
+	plex.RunBuffered(ctx, func(data []byte) {
+		if err := ws.WriteMessage(websocket.OpBinary, data); err != nil {
+			ss.TearDown()
+		}
+	}, ss.DataC(), s.config.BufferSize)
+	ss.TearDown()
+	<-stateDoneC
+
+	return nil
+}
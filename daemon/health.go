@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// isReady returns whether the server is ready to serve warps: all its accept
+// loops are running and it is not shutting down. It acquires the server lock.
+func (s *Srv) isReady() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.shuttingDown &&
+		s.accepting > 0 && s.accepting == len(s.listeners)
+}
+
+// serveHealthz is the readiness probe: it responds 200 while the server
+// accepts connections and 503 otherwise, in particular during a graceful
+// shutdown so that load balancers drain the node.
+func (s *Srv) serveHealthz(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	w.Header().Set("Content-Type", "text/plain")
+	if !s.isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready\n")
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// serveLivez is the liveness probe: it responds 200 as long as warpd is
+// running, including while it drains its warps during a graceful shutdown.
+func (s *Srv) serveLivez(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "ok\n")
+}
+
+// runHealth starts serving the health probes on the configured health
+// address. The server is closed once Shutdown returns, so that readiness
+// reports the shutdown while warps are drained.
+func (s *Srv) runHealth(
+	ctx context.Context,
+) error {
+	address, err := warp.NormalizeAddress(s.config.HealthAddress)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Invalid health address: %v", err),
+		)
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Health listen error: %v", err),
+		)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/livez", s.serveLivez)
+	srv := &http.Server{Handler: mux}
+
+	s.mutex.Lock()
+	s.healthServer = srv
+	s.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Serving health probes: address=%s",
+		ln.Addr().String(),
+	)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.Logf(ctx, "Health server error: error=%v", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/logging"
+)
+
+// Event describes a warp lifecycle event passed to Hooks.
+type Event struct {
+	// Warp is the ID of the warp.
+	Warp string
+	// Username is the (self-asserted) username of the session causing the
+	// event: the host for warp events, the client for client events.
+	Username string
+	// User is the user token of that session.
+	User string
+	// Time is the time at which the event occurred.
+	Time time.Time
+	// RemoteAddr is the remote address of that session.
+	RemoteAddr string
+	// Reason is the reason for which that session ended, for ClientLeft and
+	// WarpClosed events: warp.DisconnectClosed if it left on purpose and
+	// warp.DisconnectUnknown if its connection was lost.
+	Reason warp.DisconnectReason
+}
+
+// Hooks are functions called on warp lifecycle events to integrate warpd with
+// external systems. Nil hooks are skipped, the zero value being a no-op.
+//
+// Hooks are called asynchronously in their own goroutine so that a slow hook
+// does not stall warpd, and may therefore be called concurrently and out of
+// order (Event.Time orders them). A panicking hook is recovered and logged.
+type Hooks struct {
+	// WarpCreated is called when a host opens a new warp. It is not called
+	// when a warp is taken over by another host.
+	WarpCreated func(Event)
+	// ClientJoined is called when a shell client session joins a warp.
+	ClientJoined func(Event)
+	// ClientLeft is called when a shell client session that joined a warp
+	// leaves it.
+	ClientLeft func(Event)
+	// WarpClosed is called when a warp is closed, with its last host.
+	WarpClosed func(Event)
+}
+
+// newEvent returns the event caused by session ss now.
+func newEvent(
+	ss *Session,
+) Event {
+	return Event{
+		Warp:       ss.warp,
+		Username:   ss.username,
+		User:       ss.session.User,
+		Time:       time.Now(),
+		RemoteAddr: ss.conn.RemoteAddr().String(),
+	}
+}
+
+// fire calls hook asynchronously with the event caused by session ss, if hook
+// is not nil.
+func fire(
+	ctx context.Context,
+	name string,
+	hook func(Event),
+	ss *Session,
+) {
+	if hook == nil {
+		return
+	}
+	fireEvent(ctx, name, hook, newEvent(ss))
+}
+
+// fireEvent calls hook asynchronously with ev, if hook is not nil.
+func fireEvent(
+	ctx context.Context,
+	name string,
+	hook func(Event),
+	ev Event,
+) {
+	if hook == nil {
+		return
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logging.Logf(ctx,
+					"Hook panicked: hook=%s warp=%s panic=%v",
+					name, ev.Warp, r,
+				)
+			}
+		}()
+		hook(ev)
+	}()
+}
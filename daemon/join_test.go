@@ -0,0 +1,61 @@
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/errors"
+)
+
+// TestJoinRacingHost has clients join warps while their host opens and closes
+// them, so that they join while the warp is being created or torn down.
+func TestJoinRacingHost(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	for i := 0; i < 20; i++ {
+		w := fmt.Sprintf("racing-%d", i)
+
+		wg := &sync.WaitGroup{}
+		errC := make(chan error, 16)
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				for k := 0; k < 4; k++ {
+					c, err := s.Connect(ctx, w, fmt.Sprintf("user%d", j))
+					if err != nil {
+						// The warp is not created yet or already closed.
+						werr, ok := errors.Cause(err).(*cli.WarpdError)
+						if !ok || (werr.Code != warp.ErrWarpUnknown &&
+							werr.Code != warp.ErrHostDisconnected) {
+							errC <- err
+						}
+						continue
+					}
+					c.Close()
+				}
+			}(j)
+		}
+
+		host, err := s.OpenHost(ctx, w, "alice", warp.HostUpdate{
+			WindowSize: warp.Size{Rows: 24, Cols: 80},
+		})
+		if err != nil {
+			t.Fatalf("OpenHost: %v", err)
+		}
+		host.Close()
+
+		wg.Wait()
+		close(errC)
+		for err := range errC {
+			t.Errorf("Connect: %v", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// metrics holds the server-wide counters and gauges exposed on the metrics
+// endpoint. They are updated atomically so that updating them never requires
+// the server lock.
+type metrics struct {
+	warps            int64
+	clients          int64
+	connectionErrors int64
+	// connectionsThrottled is the number of connections closed by the
+	// connection rate limiter.
+	connectionsThrottled int64
+	// sessionsDropped is the number of host and client sessions that ended
+	// without warpd disconnecting them or them signaling they were closing.
+	sessionsDropped int64
+}
+
+// warpMetrics holds the per-warp counters. It is embedded first in Warp to
+// guarantee the 64-bit alignment required by atomic operations.
+type warpMetrics struct {
+	// bytesToClients is the number of bytes of host data forwarded to client
+	// sessions (counted once per session).
+	bytesToClients uint64
+	// bytesToHost is the number of bytes of client data forwarded to the host.
+	bytesToHost uint64
+}
+
+// serveMetrics writes the server metrics in the Prometheus text exposition
+// format. Per-warp metrics are labeled with the warp ID, so the metrics
+// endpoint must not be exposed publicly.
+func (s *Srv) serveMetrics(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// Snapshot the warps under the server lock and release it right away.
+	s.mutex.Lock()
+	warps := make([]*Warp, 0, len(s.warps))
+	for _, wp := range s.warps {
+		warps = append(warps, wp)
+	}
+	s.mutex.Unlock()
+	sort.Slice(warps, func(i, j int) bool {
+		return warps[i].token < warps[j].token
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP warpd_warps Number of open warps.\n")
+	fmt.Fprintf(w, "# TYPE warpd_warps gauge\n")
+	fmt.Fprintf(w, "warpd_warps %d\n",
+		atomic.LoadInt64(&s.metrics.warps))
+
+	fmt.Fprintf(w, "# HELP warpd_clients Number of connected client sessions.\n")
+	fmt.Fprintf(w, "# TYPE warpd_clients gauge\n")
+	fmt.Fprintf(w, "warpd_clients %d\n",
+		atomic.LoadInt64(&s.metrics.clients))
+
+	fmt.Fprintf(w, "# HELP warpd_connection_errors_total Connections that ended with an error.\n")
+	fmt.Fprintf(w, "# TYPE warpd_connection_errors_total counter\n")
+	fmt.Fprintf(w, "warpd_connection_errors_total %d\n",
+		atomic.LoadInt64(&s.metrics.connectionErrors))
+
+	fmt.Fprintf(w, "# HELP warpd_connections_throttled_total Connections closed by the per-IP rate limit.\n")
+	fmt.Fprintf(w, "# TYPE warpd_connections_throttled_total counter\n")
+	fmt.Fprintf(w, "warpd_connections_throttled_total %d\n",
+		atomic.LoadInt64(&s.metrics.connectionsThrottled))
+
+	fmt.Fprintf(w, "# HELP warpd_sessions_dropped_total Host and client sessions whose connection was lost.\n")
+	fmt.Fprintf(w, "# TYPE warpd_sessions_dropped_total counter\n")
+	fmt.Fprintf(w, "warpd_sessions_dropped_total %d\n",
+		atomic.LoadInt64(&s.metrics.sessionsDropped))
+
+	fmt.Fprintf(w, "# HELP warpd_warp_bytes_total Bytes forwarded per warp and direction.\n")
+	fmt.Fprintf(w, "# TYPE warpd_warp_bytes_total counter\n")
+	for _, wp := range warps {
+		fmt.Fprintf(w,
+			"warpd_warp_bytes_total{warp=%q,direction=\"to_clients\"} %d\n",
+			wp.token, atomic.LoadUint64(&wp.bytesToClients),
+		)
+		fmt.Fprintf(w,
+			"warpd_warp_bytes_total{warp=%q,direction=\"to_host\"} %d\n",
+			wp.token, atomic.LoadUint64(&wp.bytesToHost),
+		)
+	}
+}
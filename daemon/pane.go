@@ -0,0 +1,244 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/logging"
+	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/token"
+)
+
+// maxPanes is the maximum number of panes a warp shares in addition to the
+// host shell.
+const maxPanes = 8
+
+// pane is a pane shared by the host in addition to its shell: the output of
+// another command, sent by a pane session (`warp pane`) and viewed read-only by
+// the shell clients that selected it.
+type pane struct {
+	label   string
+	session *Session
+
+	// scrollback is the last output of the pane. It is ciphertext if the warp
+	// is encrypted end to end.
+	scrollback []byte
+}
+
+// paneLabels returns the labels of the panes, sorted. The warp lock must be
+// held.
+func (w *Warp) paneLabels() []string {
+	labels := []string{}
+	for label := range w.panes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// paneSessions returns the sessions of the panes. The warp lock must be held.
+func (w *Warp) paneSessions() []*Session {
+	sessions := []*Session{}
+	for _, p := range w.panes {
+		sessions = append(sessions, p.session)
+	}
+	return sessions
+}
+
+// paneScrollback returns the scrollback of the pane labeled label, the one of
+// the host shell if label is empty or unknown. The warp lock must be held.
+func (w *Warp) paneScrollback(
+	label string,
+) []byte {
+	if p, ok := w.panes[label]; ok {
+		return p.scrollback
+	}
+	return w.scrollback
+}
+
+// rcvPaneData handles the output of pane p, queueing it for the shell client
+// sessions viewing it.
+func (w *Warp) rcvPaneData(
+	ctx context.Context,
+	p *pane,
+	data []byte,
+) {
+	w.mutex.Lock()
+	w.lastActivity = time.Now()
+	// As for the host shell, the output of a warp paused with its output
+	// hidden is only sent to the host's own sessions.
+	hidden := w.paused && w.pauseOutput
+	if !hidden {
+		p.scrollback = w.appendScrollback(p.scrollback, data)
+	}
+	slow := []*Session{}
+	for _, s := range w.clientSessions() {
+		if s.pane != p.label || s.bannerPending || s.ctx.Err() != nil {
+			continue
+		}
+		if hidden && s.session.User != w.host.UserState.token {
+			continue
+		}
+		if !w.queueOutput(s, data, 0) {
+			slow = append(slow, s)
+		}
+	}
+	w.mutex.Unlock()
+
+	w.disconnectSlow(ctx, slow)
+}
+
+// selectPane switches the shell client session ss to the pane labeled label
+// (the host shell if empty), replaying its scrollback. Unknown panes are
+// ignored as they may have been closed in the meantime. It acquires the warp
+// lock.
+func (w *Warp) selectPane(
+	ctx context.Context,
+	ss *Session,
+	label string,
+) {
+	w.mutex.Lock()
+	if _, ok := w.panes[label]; label != "" && !ok {
+		w.mutex.Unlock()
+		logging.Logf(ctx,
+			"Unknown pane from client update: session=%s pane=%s",
+			ss.ToString(), label,
+		)
+		return
+	}
+	if ss.pane == label {
+		w.mutex.Unlock()
+		return
+	}
+	ss.pane = label
+	slow := []*Session{}
+	if !ss.bannerPending {
+		tail := w.scrollbackTail(w.paneScrollback(label))
+		if len(tail) > 0 && !w.queueOutput(ss, tail, w.paneOffset(label)) {
+			slow = append(slow, ss)
+		}
+	}
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Pane selected: session=%s pane=%q",
+		ss.ToString(), label,
+	)
+	w.disconnectSlow(ctx, slow)
+}
+
+// handlePane is responsible for handling the SsTpPane sessions. It adds the
+// pane labeled label to the warp, if opened by the host user, and forwards its
+// output until the session ends. The shell clients viewing the pane are then
+// switched back to the host shell.
+func (w *Warp) handlePane(
+	ctx context.Context,
+	ss *Session,
+	label string,
+) error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		w.rejectClosed(ctx, ss)
+		return errors.WithCode(
+			errors.Newf("Pane error: warp closed: session=%s", ss.ToString()),
+			warp.ErrHostDisconnected,
+		)
+	}
+	if ss.session.User != w.host.UserState.token ||
+		!token.Equal(ss.session.Secret, w.host.UserState.secret) {
+		w.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrAuthorizationFailed,
+			"Only the host of the warp can share panes.",
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: not the host: session=%s", ss.ToString()),
+			warp.ErrAuthorizationFailed,
+		)
+	}
+	if _, ok := w.panes[label]; ok {
+		w.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrPaneInvalid,
+			fmt.Sprintf("The warp already shares a pane labeled %s.", label),
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: label in use: %s", label),
+			warp.ErrPaneInvalid,
+		)
+	}
+	if len(w.panes) >= maxPanes {
+		w.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrPaneInvalid,
+			fmt.Sprintf(
+				"The warp already shares the maximum number of panes (%d).",
+				maxPanes,
+			),
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: too many panes: %s", label),
+			warp.ErrPaneInvalid,
+		)
+	}
+	p := &pane{
+		label:   label,
+		session: ss,
+	}
+	w.panes[label] = p
+	w.mutex.Unlock()
+
+	// Update host, clients and panes (including the new pane, which sizes
+	// its terminal after the warp).
+	w.updateSessions(ctx)
+
+	logging.Logf(ctx,
+		"Pane session running: session=%s pane=%s",
+		ss.ToString(), label,
+	)
+
+	// Receive pane data. Panes are read-only, nothing is ever sent to them.
+	go func() {
+		plex.RunBuffered(ctx, func(data []byte) {
+			w.rcvPaneData(ctx, p, data)
+		}, ss.dataR, w.bufferSize)
+		ss.TearDown()
+	}()
+
+	<-ss.ctx.Done()
+
+	// Clean-up the pane, switching its viewers back to the host shell.
+	logging.Logf(ctx,
+		"Cleaning-up pane: session=%s pane=%s",
+		ss.ToString(), label,
+	)
+	w.mutex.Lock()
+	if w.panes[label] == p {
+		delete(w.panes, label)
+	}
+	slow := []*Session{}
+	for _, s := range w.clientSessions() {
+		if s.pane != label {
+			continue
+		}
+		s.pane = ""
+		if s.bannerPending {
+			continue
+		}
+		tail := w.scrollbackTail(w.scrollback)
+		if len(tail) > 0 && !w.queueOutput(s, tail, w.outputOffset) {
+			slow = append(slow, s)
+		}
+	}
+	w.mutex.Unlock()
+
+	w.disconnectSlow(ctx, slow)
+	w.updateSessions(ctx)
+
+	return nil
+}
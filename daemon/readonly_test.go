@@ -0,0 +1,82 @@
+package daemon_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+)
+
+func TestClientsJoinReadOnly(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "read-only", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	c, err := s.Connect(ctx, "read-only", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	warptest.WaitFor(t, testTimeout, func() bool {
+		_, ok := host.State().Users[c.User]
+		return ok
+	})
+	for name, conn := range map[string]*warptest.Conn{"host": host, "client": c} {
+		if mode := conn.State().Users[c.User].Mode; mode != warp.ModeShellRead {
+			t.Fatalf("%s: client mode: got %d, want %d", name, mode, warp.ModeShellRead)
+		}
+	}
+
+	// Asking for write access does not grant it, the input of the client
+	// being dropped until the host authorizes it.
+	err = c.Session.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp:          "read-only",
+		From:          c.Session.Session(),
+		AccessRequest: true,
+	})
+	if err != nil {
+		t.Fatalf("SendClientUpdate: %v", err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		return len(host.State().AccessRequests) == 1
+	})
+	if mode := c.State().Users[c.User].Mode; mode != warp.ModeShellRead {
+		t.Fatalf("client mode after request: got %d, want %d", mode, warp.ModeShellRead)
+	}
+	if _, err := c.Write([]byte("dropped\r")); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	// Leave warpd the time to drop the input before the client is
+	// authorized, the data and update channels being independent.
+	time.Sleep(100 * time.Millisecond)
+
+	// The host promotes the client with a mode update.
+	if err := host.Authorize(ctx, c.User); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	warptest.WaitFor(t, testTimeout, func() bool {
+		return c.State().Users[c.User].Mode&warp.ModeShellWrite != 0
+	})
+	if _, err := c.Write([]byte("written\r")); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	data, err := host.ReadUntil("written\r", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "dropped") {
+		t.Fatalf("host received the input of a read-only client: %q", data)
+	}
+}
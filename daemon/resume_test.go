@@ -0,0 +1,206 @@
+package daemon_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/token"
+)
+
+// sequencedFrame is a frame received by a sequenced shell client session.
+type sequencedFrame struct {
+	seq  uint64
+	data string
+}
+
+// connectSequenced joins the warp w as a shell client of the user of session,
+// requesting the output of the host shell to be sequenced and resumed from
+// offset from. It returns the channel of the frames received.
+func connectSequenced(
+	t *testing.T,
+	s *warptest.Server,
+	w string,
+	session warp.Session,
+	from uint64,
+) (*cli.Session, chan sequencedFrame) {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := net.Dial("tcp", s.Address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ss, err := cli.NewSession(
+		ctx, session, w, warp.SsTpShellClient, "bob",
+		false, false, true, from, func() {}, conn,
+	)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(ss.TearDown)
+	if err := ss.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp: w,
+		From: ss.Session(),
+	}); err != nil {
+		t.Fatalf("SendClientUpdate: %v", err)
+	}
+	st, err := ss.DecodeState(ctx)
+	if err != nil {
+		t.Fatalf("DecodeState: %v", err)
+	}
+	if err := ss.UpdateState(*st, false); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	fr := ss.DataFrames()
+	if fr == nil {
+		t.Fatalf("data not sequenced")
+	}
+	go ss.DiscardState(ctx)
+
+	frameC := make(chan sequencedFrame)
+	go func() {
+		defer close(frameC)
+		for {
+			seq, data, err := fr.Next()
+			if err != nil {
+				return
+			}
+			frameC <- sequencedFrame{seq, string(data)}
+		}
+	}()
+	return ss, frameC
+}
+
+// readOutput reads the frames of the output of the host shell received until
+// offset end, checking that they follow one another. It returns the offset of
+// the start of the output read.
+func readOutput(
+	t *testing.T,
+	frameC chan sequencedFrame,
+	end uint64,
+) (uint64, string) {
+	t.Helper()
+	var start, at uint64
+	output := ""
+	for output == "" || at < end {
+		select {
+		case f, ok := <-frameC:
+			if !ok {
+				t.Fatalf("session torn down at offset %d", at)
+			}
+			if f.seq == 0 || f.data == "" {
+				continue
+			}
+			from := f.seq - uint64(len(f.data))
+			if output == "" {
+				start = from
+			} else if from != at {
+				t.Fatalf("frame from offset %d, want %d", from, at)
+			}
+			output += f.data
+			at = f.seq
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out at offset %d waiting for offset %d", at, end)
+		}
+	}
+	if at != end {
+		t.Fatalf("output read up to offset %d, want %d", at, end)
+	}
+	return start, output
+}
+
+func TestResumeOutput(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{ScrollbackSize: 64})
+
+	host, err := s.OpenHost(ctx, "resume", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	// output is the output of the host shell written so far.
+	output := ""
+	write := func(data string) uint64 {
+		t.Helper()
+		if _, err := host.Write([]byte(data)); err != nil {
+			t.Fatalf("host Write: %v", err)
+		}
+		output += data
+		return uint64(len(output))
+	}
+	check := func(
+		frameC chan sequencedFrame,
+		end uint64,
+	) uint64 {
+		t.Helper()
+		start, got := readOutput(t, frameC, end)
+		if want := output[start:end]; got != want {
+			t.Fatalf("output from offset %d: got %q, want %q", start, got, want)
+		}
+		return start
+	}
+
+	bob := warp.Session{
+		Token:  token.New("session"),
+		User:   token.New("guest"),
+		Secret: token.RandStr(),
+	}
+	ss, frameC := connectSequenced(t, s, "resume", bob, 0)
+	if start := check(frameC, write("one\r\n")); start != 0 {
+		t.Fatalf("output received from offset %d, want 0", start)
+	}
+	ss.TearDown()
+
+	// The output missed while disconnected is still in the scrollback.
+	end := write("two\r\n")
+	bob.Token = token.New("session")
+	ss, frameC = connectSequenced(t, s, "resume", bob, 5)
+	if start := check(frameC, end); start != 5 {
+		t.Fatalf("output resumed from offset %d, want 5", start)
+	}
+	ss.TearDown()
+
+	// The output missed is no longer in the scrollback, which is replayed
+	// instead.
+	for i := 0; i < 20; i++ {
+		write("line ...\r\n")
+	}
+	end = write("last\r\n")
+	// Wait for the output to be in the scrollback.
+	c, err := s.Connect(ctx, "resume", "dave")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.ReadUntil("last\r\n", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	bob.Token = token.New("session")
+	_, frameC = connectSequenced(t, s, "resume", bob, 10)
+	replayed := check(frameC, end)
+	if replayed <= 10 {
+		t.Fatalf("output replayed from offset %d, want after 10", replayed)
+	}
+
+	// New users have no output to resume, the offset requested being
+	// ignored.
+	carol := warp.Session{
+		Token:  token.New("session"),
+		User:   token.New("guest"),
+		Secret: token.RandStr(),
+	}
+	_, frameC = connectSequenced(t, s, "resume", carol, end-10)
+	if start := check(frameC, end); start != replayed {
+		t.Fatalf("new user output from offset %d, want %d", start, replayed)
+	}
+}
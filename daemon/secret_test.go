@@ -0,0 +1,68 @@
+package daemon_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/token"
+)
+
+func TestWarpSecret(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	// The hash is cheap to verify, the default cost being tested along with
+	// HashWarpSecret.
+	hash, err := token.HashSecret("hunter2", token.MinHashIterations)
+	if err != nil {
+		t.Fatalf("HashSecret: %v", err)
+	}
+	host, err := s.OpenHost(ctx, "secret", "alice", warp.HostUpdate{
+		WindowSize:     warp.Size{Rows: 24, Cols: 80},
+		WarpSecretHash: hash,
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	// join joins the warp presenting secret, returning the code of the error
+	// received, if any.
+	join := func(
+		secret string,
+	) string {
+		t.Helper()
+		c, err := s.Dial(ctx, "secret", warp.SsTpShellClient, "bob")
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer c.Close()
+		if err := c.Session.SendClientUpdate(ctx, warp.ClientUpdate{
+			Warp:       "secret",
+			From:       c.Session.Session(),
+			WarpSecret: secret,
+		}); err != nil {
+			t.Fatalf("SendClientUpdate: %v", err)
+		}
+		if _, err := c.Session.DecodeState(ctx); err == nil {
+			return ""
+		}
+		e, err := c.Session.DecodeError(ctx)
+		if err != nil {
+			t.Fatalf("DecodeError: %v", err)
+		}
+		return string(e.Code)
+	}
+
+	if code := join("hunter2"); code != "" {
+		t.Fatalf("right secret: got %s, want no error", code)
+	}
+	for _, secret := range []string{"", "hunter3", "Hunter2", hash} {
+		if code := join(secret); code != string(warp.ErrAccessDenied) {
+			t.Errorf("secret %q: got %q, want %s", secret, code, warp.ErrAccessDenied)
+		}
+	}
+}
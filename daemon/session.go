@@ -2,16 +2,19 @@ package daemon
 
 import (
 	"context"
-	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/compress"
 	"github.com/spolu/warp/lib/errors"
 	"github.com/spolu/warp/lib/logging"
+	"github.com/spolu/warp/lib/ratelimit"
 )
 
 // Session represents a client session connected to the warp.
@@ -27,28 +30,94 @@ type Session struct {
 	mux  *yamux.Session
 
 	stateC  net.Conn
-	stateW  *gob.Encoder
+	stateW  warp.Encoder
 	updateC net.Conn
-	updateR *gob.Decoder
+	updateR warp.Decoder
 	errorC  net.Conn
-	errorW  *gob.Encoder
+	errorW  warp.Encoder
 	dataC   net.Conn
+	dataR   io.Reader
+	dataW   io.Writer
 
-	tornDown bool
-	ctx      context.Context
-	cancel   func()
+	compression bool
+	readOnly    bool
+	// sequenced indicates that the data sent to the shell client is framed
+	// with sequence numbers, resumeFrom being the offset in the output of the
+	// host shell from which it resumes it (see warp.SessionHello).
+	sequenced  bool
+	resumeFrom uint64
+
+	// protocolVersion is the protocol version negotiated with the client.
+	protocolVersion int
+
+	// limiter, if not nil, throttles the data received from a shell client.
+	limiter *ratelimit.Limiter
+
+	// outputC queues the host data to send to a shell client so that a slow
+	// client does not stall the warp (see Warp.queueOutput).
+	outputC chan output
+
+	// windowSize is the terminal size reported by shell clients opting in for
+	// the warp to fit their terminal. It is protected by the warp lock.
+	windowSize warp.Size
+	// bannerPending indicates that the shell client did not acknowledge the
+	// warp banner yet and doesn't receive the warp data. It is protected by
+	// the warp lock.
+	bannerPending bool
+	// pane is the label of the pane viewed by a shell client session (empty
+	// for the host shell). It is protected by the warp lock.
+	pane string
+	// commandLine assembles the command lines typed by a shell client, if
+	// command logging is enabled (see Warp.logCommands).
+	commandLine *commandLine
+
+	// stateQueue queues the warp states to send to the session so that a
+	// slow peer does not stall the warp (see QueueState). stateSent indicates
+	// that the first state was sent, both being only accessed by sendStates
+	// once the session is set up.
+	stateQueue chan warp.State
+	stateSent  bool
+
+	// closing is set (atomically) once the peer signaled that it is closing
+	// the session on purpose. errorCode is the code of the first error sent
+	// to the peer, protected by the session lock along with updatesDoneC,
+	// closed once the updates of the peer stopped being received.
+	closing      int32
+	errorCode    errors.Code
+	updatesDoneC chan struct{}
+
+	// tornDownC is closed when the session is torn down, exactly once
+	// through tearDownOnce, and closedC once its channels are closed.
+	tornDownC    chan struct{}
+	closedC      chan struct{}
+	tearDownOnce *sync.Once
+	ctx          context.Context
+	cancel       func()
 
 	mutex *sync.Mutex
 }
 
+// stateQueueSize is the number of states queued for a session before it is
+// considered stalled.
+const stateQueueSize = 256
+
+// tearDownFlushDelay is the time given to the buffers of a session torn down
+// to flush before its channels get closed.
+const tearDownFlushDelay = 500 * time.Millisecond
+
 // NewSession sets up a session, opens the associated channels and return a
-// Session object.
+// Session object. The data channel is compressed if the client requested it
+// and allowCompression is true. The channels receive window is streamWindow
+// (warp.DefaultStreamWindow if 0). Messages are encoded with codec.
 func NewSession(
 	ctx context.Context,
 	cancel func(),
 	conn net.Conn,
+	allowCompression bool,
+	streamWindow int,
+	codec warp.Codec,
 ) (*Session, error) {
-	mux, err := yamux.Server(conn, nil)
+	mux, err := yamux.Server(conn, muxConfig(streamWindow))
 	if err != nil {
 		return nil, errors.Trace(
 			errors.Newf("Mux error: %v", err),
@@ -56,12 +125,14 @@ func NewSession(
 	}
 
 	ss := &Session{
-		conn:     conn,
-		mux:      mux,
-		tornDown: false,
-		ctx:      ctx,
-		cancel:   cancel,
-		mutex:    &sync.Mutex{},
+		conn:         conn,
+		mux:          mux,
+		tornDownC:    make(chan struct{}),
+		closedC:      make(chan struct{}),
+		tearDownOnce: &sync.Once{},
+		ctx:          ctx,
+		cancel:       cancel,
+		mutex:        &sync.Mutex{},
 	}
 
 	// Opens state channel stateC.
@@ -72,7 +143,7 @@ func NewSession(
 			errors.Newf("State channel open error: %v", err),
 		)
 	}
-	ss.stateW = gob.NewEncoder(ss.stateC)
+	ss.stateW = codec.NewEncoder(ss.stateC)
 
 	// Open update channel updateC.
 	ss.updateC, err = mux.Accept()
@@ -82,7 +153,7 @@ func NewSession(
 			errors.Newf("Update channel open error: %v", err),
 		)
 	}
-	ss.updateR = gob.NewDecoder(ss.updateC)
+	ss.updateR = codec.NewDecoder(ss.updateC)
 
 	var hello warp.SessionHello
 	if err := ss.updateR.Decode(&hello); err != nil {
@@ -91,14 +162,28 @@ func NewSession(
 			errors.Newf("Initial client update error: %v", err),
 		)
 	}
+	if err := warp.ValidateUsername(hello.Username); err != nil {
+		ss.TearDown()
+		return nil, errors.Trace(
+			errors.Newf("Invalid session hello: %v", err),
+		)
+	}
 	ss.session = hello.From
 	ss.warp = hello.Warp
 	ss.sessionType = hello.Type
 	ss.username = hello.Username
+	ss.compression = allowCompression && hello.Compression
+	ss.readOnly = hello.ReadOnly
+	ss.sequenced = hello.Sequenced && hello.Type == warp.SsTpShellClient
+	ss.resumeFrom = hello.ResumeFrom
+	ss.protocolVersion = warp.NegotiateProtocolVersion(hello.ProtocolVersion)
 
 	logging.Logf(ctx,
-		"Session hello received: session=%s type=%s username=%s",
-		ss.ToString(), hello.Type, hello.Username,
+		"Session hello received: session=%s type=%s username=%s "+
+			"version=%q protocol=%d compression=%t read_only=%t "+
+			"sequenced=%t",
+		ss.ToString(), hello.Type, hello.Username, hello.Version,
+		ss.protocolVersion, ss.compression, ss.readOnly, ss.sequenced,
 	)
 
 	// Opens error channel errorC.
@@ -109,7 +194,7 @@ func NewSession(
 			errors.Newf("Error channel open error: %v", err),
 		)
 	}
-	ss.errorW = gob.NewEncoder(ss.errorC)
+	ss.errorW = codec.NewEncoder(ss.errorC)
 
 	// Open data channel dataC.
 	ss.dataC, err = mux.Accept()
@@ -119,10 +204,58 @@ func NewSession(
 			errors.Newf("Data channel open error: %v", err),
 		)
 	}
+	ss.dataR = ss.dataC
+	ss.dataW = ss.dataC
+	if ss.compression {
+		ss.dataR = compress.NewReader(ss.dataC)
+		ss.dataW = compress.NewWriter(ss.dataC)
+	}
+
+	ss.stateQueue = make(chan warp.State, stateQueueSize)
+	go ss.sendStates(ctx)
 
 	return ss, nil
 }
 
+// muxConfig returns the configuration of the mux of sessions, the receive window
+// of their channels being streamWindow (warp.DefaultStreamWindow if 0).
+func muxConfig(
+	streamWindow int,
+) *yamux.Config {
+	// The mux logs its errors along with warpd's.
+	config := yamux.DefaultConfig()
+	config.LogOutput = logging.Writer()
+	if streamWindow > 0 {
+		config.MaxStreamWindowSize = uint32(streamWindow)
+	}
+	return config
+}
+
+// CheckProtocolVersion checks that the protocol version negotiated with the
+// client is supported, sending it a `protocol_incompatible` error otherwise.
+func (ss *Session) CheckProtocolVersion(
+	ctx context.Context,
+) error {
+	if ss.protocolVersion >= warp.MinProtocolVersion {
+		return nil
+	}
+	ss.SendError(ctx,
+		warp.ErrProtocolIncompatible,
+		fmt.Sprintf(
+			"Your version of warp is too old for this warpd (protocol "+
+				"version %d, supported: %d to %d), please upgrade.",
+			ss.protocolVersion, warp.MinProtocolVersion, warp.ProtocolVersion,
+		),
+	)
+	return errors.WithCode(
+		errors.Newf(
+			"Incompatible protocol version: session=%s protocol=%d",
+			ss.ToString(), ss.protocolVersion,
+		),
+		warp.ErrProtocolIncompatible,
+	)
+}
+
 // ToStering returns a string that identifies the session for logging.
 func (ss *Session) ToString() string {
 	return fmt.Sprintf(
@@ -130,20 +263,140 @@ func (ss *Session) ToString() string {
 	)
 }
 
-// TearDown tears down a session, closing and reclaiming channels.
+// TearDown tears down a session, closing and reclaiming channels. It is safe
+// to call concurrently and more than once. The session context is canceled
+// first so that the session goroutines stop, and the channels are closed
+// after tearDownFlushDelay (see Wait). TearDown does not take the session
+// lock, so that sessions blocked sending to an unresponsive peer (with the
+// lock held) can be torn down, closing the channels unblocking them.
 func (ss *Session) TearDown() {
-	ss.mutex.Lock()
-	defer ss.mutex.Unlock()
-	if !ss.tornDown {
-		ss.tornDown = true
+	ss.tearDownOnce.Do(func() {
+		close(ss.tornDownC)
 		ss.cancel()
 		go func() {
-			// Sleep for 500ms before killing the session to give a chance to
-			// the bufffers to flush.
-			time.Sleep(500 * time.Millisecond)
+			time.Sleep(tearDownFlushDelay)
 			// Closes stateC, updateC, errorC, dataC, mux and conn.
 			ss.mux.Close()
+			close(ss.closedC)
 		}()
+	})
+}
+
+// TornDown returns whether the session was torn down.
+func (ss *Session) TornDown() bool {
+	select {
+	case <-ss.tornDownC:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits for the channels of the session to be closed once it is torn
+// down.
+func (ss *Session) Wait() {
+	<-ss.closedC
+}
+
+// Heartbeat pings the peer every interval, tearing down the session after
+// threshold consecutive failed pings. This ensures that sessions (in particular
+// host sessions, along with their warp) are cleaned-up when a peer silently
+// vanishes. It returns when the session context is done. An interval of 0
+// disables heartbeats.
+func (ss *Session) Heartbeat(
+	ctx context.Context,
+	interval time.Duration,
+	threshold int,
+) {
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ss.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := ss.mux.Ping(); err != nil {
+			missed++
+			logging.Logf(ctx,
+				"Missed heartbeat: session=%s missed=%d error=%v",
+				ss.ToString(), missed, err,
+			)
+			if missed >= threshold {
+				ss.TearDown()
+				return
+			}
+		} else {
+			missed = 0
+		}
+	}
+}
+
+// QueueState queues a warp state to be sent to the session, returning false
+// if its queue is full as the peer stalled. States are sent in the order they
+// are queued, those queued for a session torn down being dropped.
+func (ss *Session) QueueState(
+	st warp.State,
+) bool {
+	if ss.TornDown() {
+		return true
+	}
+	select {
+	case ss.stateQueue <- st:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendStates sends the states queued for the session until it is torn down,
+// flushing the states still queued then (such as the last state of a warp
+// closing) before its channels are closed.
+func (ss *Session) sendStates(
+	ctx context.Context,
+) {
+	for {
+		select {
+		case st := <-ss.stateQueue:
+			ss.sendState(ctx, st)
+		case <-ss.ctx.Done():
+			for {
+				select {
+				case st := <-ss.stateQueue:
+					ss.sendState(ctx, st)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendState sends a warp state to the session, filling in the fields specific
+// to the session. It is only called by sendStates.
+func (ss *Session) sendState(
+	ctx context.Context,
+	st warp.State,
+) {
+	st.Compression = ss.compression
+	st.Sequenced = ss.sequenced
+	st.ProtocolVersion = ss.protocolVersion
+	// The banner is only sent in the first state.
+	if ss.stateSent {
+		st.Banner = ""
+		st.BannerAck = false
+	}
+	ss.stateSent = true
+	if err := ss.stateW.Encode(st); err != nil {
+		logging.Logf(ctx,
+			"Error sending session state: session=%s error=%v",
+			ss.ToString(), err,
+		)
 	}
 }
 
@@ -151,22 +404,48 @@ func (ss *Session) TearDown() {
 // on its end.
 func (ss *Session) SendError(
 	ctx context.Context,
-	code string,
+	code errors.Code,
 	message string,
+) {
+	ss.sendError(ctx, warp.Error{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// SendShellExit sends the exit status of the host shell to the client, as the
+// error ending its session.
+func (ss *Session) SendShellExit(
+	ctx context.Context,
+	status int,
+) {
+	ss.sendError(ctx, warp.Error{
+		Code: warp.ErrShellExited,
+		Message: fmt.Sprintf(
+			"The host shell exited with status %d.", status,
+		),
+		ExitStatus: status,
+	})
+}
+
+// sendError sends e over the error channel unless the session is torn down.
+func (ss *Session) sendError(
+	ctx context.Context,
+	e warp.Error,
 ) {
 	ss.mutex.Lock()
 	defer ss.mutex.Unlock()
-	if ss.tornDown {
+	if ss.TornDown() {
 		return
 	}
+	if ss.errorCode == errors.CodeNone {
+		ss.errorCode = e.Code
+	}
 	logging.Logf(ctx,
 		"Sending session error: session=%s code=%s message=%s",
-		ss.ToString(), code, message,
+		ss.ToString(), e.Code, e.Message,
 	)
-	if err := ss.errorW.Encode(warp.Error{
-		Code:    code,
-		Message: message,
-	}); err != nil {
+	if err := ss.errorW.Encode(e); err != nil {
 		logging.Logf(ctx,
 			"Error sending session error: session=%s error=%v",
 			ss.ToString(), err,
@@ -174,13 +453,71 @@ func (ss *Session) SendError(
 	}
 }
 
+// markClosing records that the peer signaled that it is closing the session on
+// purpose.
+func (ss *Session) markClosing() {
+	atomic.StoreInt32(&ss.closing, 1)
+}
+
+// receivingUpdates records that the updates of the peer are being received,
+// returning the function to call once they stop.
+func (ss *Session) receivingUpdates() func() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.updatesDoneC = make(chan struct{})
+	doneC := ss.updatesDoneC
+	return func() {
+		close(doneC)
+	}
+}
+
+// Departure returns the reason for which the session ended, once done:
+// warp.DisconnectClosed if the peer signaled it was closing it, the reason of
+// the error sent to the peer if it was disconnected on purpose, and
+// warp.DisconnectUnknown if the connection was lost. The signal of the peer
+// may still be pending when its channels get closed, so the updates are
+// drained before concluding to a lost connection.
+func (ss *Session) Departure() warp.DisconnectReason {
+	ss.mutex.Lock()
+	reason := warp.DisconnectReasonOf(ss.errorCode)
+	doneC := ss.updatesDoneC
+	ss.mutex.Unlock()
+
+	if atomic.LoadInt32(&ss.closing) == 1 {
+		return warp.DisconnectClosed
+	}
+	if reason != warp.DisconnectUnknown || doneC == nil {
+		return reason
+	}
+	<-doneC
+	if atomic.LoadInt32(&ss.closing) == 1 {
+		return warp.DisconnectClosed
+	}
+	return reason
+}
+
+// Replace tears down a session replaced by a new session of the same
+// participant, letting it know first. The error is sent asynchronously as the
+// warp lock may be held by the caller.
+func (ss *Session) Replace(
+	ctx context.Context,
+) {
+	go func() {
+		ss.SendError(ctx,
+			warp.ErrSessionReplaced,
+			"You connected to this warp from another session.",
+		)
+		ss.TearDown()
+	}()
+}
+
 // SendInternalError sends an internal error to the client which should trigger
 // a disconnection on its end.
 func (ss *Session) SendInternalError(
 	ctx context.Context,
 ) {
 	ss.SendError(ctx,
-		"internal_error",
+		warp.ErrInternal,
 		fmt.Sprintf(
 			"The warp experienced an internal error (session: %s).",
 			ss.ToString(),
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/lib/token"
+)
+
+// newSessionPair sets up a warpd session and the client session at the other
+// end of a loopback connection.
+func newSessionPair(
+	t *testing.T,
+) (*Session, *cli.Session) {
+	t.Helper()
+	ctx := context.Background()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	type result struct {
+		ss  *cli.Session
+		err error
+	}
+	clientC := make(chan result, 1)
+	go func() {
+		ss, err := cli.NewSession(
+			ctx, warp.Session{
+				Token:  token.New("session"),
+				User:   token.New("guest"),
+				Secret: token.RandStr(),
+			},
+			"teardown", warp.SsTpShellClient, "bob",
+			false, false, false, 0, func() {}, cc,
+		)
+		clientC <- result{ss, err}
+	}()
+
+	sctx, cancel := context.WithCancel(ctx)
+	ss, err := NewSession(sctx, cancel, sc, false, 0, warp.GobCodec)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	r := <-clientC
+	if r.err != nil {
+		t.Fatalf("cli.NewSession: %v", r.err)
+	}
+	return ss, r.ss
+}
+
+func TestSessionConcurrentTearDown(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		ss, cs := newSessionPair(t)
+
+		// Both ends are torn down from several goroutines while they are
+		// in use.
+		wg := &sync.WaitGroup{}
+		for j := 0; j < 4; j++ {
+			wg.Add(4)
+			go func() {
+				defer wg.Done()
+				ss.TearDown()
+			}()
+			go func() {
+				defer wg.Done()
+				ss.QueueState(warp.State{Warp: "teardown"})
+				ss.SendError(ctx, warp.ErrInternal, "torn down")
+				ss.dataW.Write([]byte("output"))
+			}()
+			go func() {
+				defer wg.Done()
+				cs.TearDown()
+			}()
+			go func() {
+				defer wg.Done()
+				cs.WriteDataC([]byte("input"))
+				cs.SendClientUpdate(ctx, warp.ClientUpdate{Warp: "teardown"})
+			}()
+		}
+		wg.Wait()
+
+		if !ss.TornDown() || !cs.TornDown() {
+			t.Fatalf("session not torn down")
+		}
+		// The channels get closed once, after the flush delay.
+		doneC := make(chan struct{})
+		go func() {
+			ss.Wait()
+			close(doneC)
+		}()
+		select {
+		case <-doneC:
+		case <-time.After(2 * tearDownFlushDelay):
+			t.Fatalf("session channels not closed after teardown")
+		}
+		ss.TearDown()
+		cs.TearDown()
+	}
+}
+
+func TestSessionReplace(t *testing.T) {
+	ctx := context.Background()
+	ss, cs := newSessionPair(t)
+	defer cs.TearDown()
+
+	ss.Replace(ctx)
+
+	// The error is received before the session gets torn down.
+	e, err := cs.DecodeError(ctx)
+	if err != nil {
+		t.Fatalf("DecodeError: %v", err)
+	}
+	if e.Code != warp.ErrSessionReplaced {
+		t.Fatalf("DecodeError: got %s, want %s", e.Code, warp.ErrSessionReplaced)
+	}
+	doneC := make(chan struct{})
+	go func() {
+		ss.Wait()
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+	case <-time.After(2 * tearDownFlushDelay):
+		t.Fatalf("replaced session not torn down")
+	}
+	if got := ss.Departure(); got != warp.DisconnectReplaced {
+		t.Fatalf("Departure: got %q, want %q", got, warp.DisconnectReplaced)
+	}
+}
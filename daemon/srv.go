@@ -3,20 +3,192 @@ package daemon
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spolu/warp"
 	"github.com/spolu/warp/lib/errors"
 	"github.com/spolu/warp/lib/logging"
 )
 
+// defaultHandshakeTimeout is the handshake timeout used if none is configured.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// defaultAcceptBackoff and defaultAcceptBackoffMax are the accept backoff
+// delays used if none are configured, as used by net/http.
+const (
+	defaultAcceptBackoff    = 5 * time.Millisecond
+	defaultAcceptBackoffMax = time.Second
+)
+
+// acceptLogInterval is the minimum interval between two logs of temporary
+// accept errors, the errors in between being counted.
+const acceptLogInterval = 10 * time.Second
+
+// shutdownPollInterval is the interval at which Shutdown checks whether all
+// warps have been cleaned-up.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Config represents the configuration of a warpd server.
+type Config struct {
+	// Addresses to listen on ([ip]:port or unix:path), connections accepted
+	// on any of them being handled alike.
+	Addresses []string
+	// Address to listen on, used if Addresses is empty. Kept for
+	// compatibility with single address configurations.
+	Address string
+	// SocketMode, if not 0, is applied to the unix socket when listening on
+	// one.
+	SocketMode os.FileMode
+	// TLSConfig, if not nil, is used to accept connections over TLS.
+	TLSConfig *tls.Config
+	// ClientCAs, if not nil, requires the sessions connecting over TLS to
+	// present a client certificate signed by one of these CAs (see
+	// authenticate). The common name of the certificate is then the
+	// username of the session, instead of the one it asserts. Connections
+	// not made over TLS (unix sockets, gateway) are not authenticated.
+	ClientCAs *x509.CertPool
+	// EnableList allows list sessions. As warp IDs are secret, list sessions
+	// are refused by default.
+	EnableList bool
+	// ScrollbackSize is the number of bytes of output each warp keeps to
+	// replay them to late joiners (0 disables the scrollback). The output of
+	// warps encrypted end to end is kept (and replayed) as ciphertext.
+	ScrollbackSize int
+	// Compression allows sessions to request compression of their data
+	// channel.
+	Compression bool
+	// HeartbeatInterval is the interval at which sessions are pinged (0
+	// disables heartbeats).
+	HeartbeatInterval time.Duration
+	// HeartbeatThreshold is the number of consecutive missed pings after
+	// which a session is torn down.
+	HeartbeatThreshold int
+	// IdleTimeout is the duration after which warps without activity are
+	// closed (0 disables it).
+	IdleTimeout time.Duration
+	// MaxWarps bounds the number of warps served concurrently, hosts opening
+	// new warps beyond it being rejected (0 for no limit).
+	MaxWarps int
+	// MaxClients bounds the number of client sessions per warp requested by
+	// hosts (0 for no limit).
+	MaxClients int
+	// HandshakeTimeout bounds the handshake of incoming connections (TLS
+	// handshake, session channels, hello and initial host update) so that
+	// clients that stall (or a plaintext client hitting a TLS listener) don't
+	// hold a connection open forever. Defaults to 10s if 0.
+	HandshakeTimeout time.Duration
+	// KeepAlive is the interval of the TCP keepalive probes sent on accepted
+	// connections so that dead peers are detected by the OS. Defaults to
+	// warp.DefaultKeepAlive if 0, keepalives being disabled if negative.
+	KeepAlive time.Duration
+	// MetricsAddress, if not empty, is the address on which Prometheus
+	// metrics are served over HTTP at /metrics. As they include warp IDs it
+	// should not be reachable publicly.
+	MetricsAddress string
+	// HealthAddress, if not empty, is the address on which health probes are
+	// served over HTTP for load balancers: /healthz responds 200 while warpd
+	// accepts connections and 503 once it is shutting down, /livez 200 as
+	// long as it runs.
+	HealthAddress string
+	// GatewayAddress, if not empty, is the address on which the WebSocket
+	// gateway is served over HTTP, letting browsers view warps read-only at
+	// /warp/<id> (see serveGateway).
+	GatewayAddress string
+	// ClientRateLimit, if not 0, is the rate in bytes per second at which the
+	// data of each client session is forwarded to the host. Clients exceeding
+	// it are throttled so that a single client can't saturate the host link.
+	ClientRateLimit int
+	// ClientRateBurst is the burst size in bytes allowed above
+	// ClientRateLimit. Defaults to ClientRateLimit if 0.
+	ClientRateBurst int
+	// BufferSize is the size in bytes of the buffers used to read the data
+	// channels of sessions. Data is forwarded as soon as it is read, larger
+	// buffers only help throughput on bulk output. Defaults to
+	// plex.DefaultBufferSize if 0.
+	BufferSize int
+	// ClientQueueSize is the number of chunks of host data queued for each
+	// client session. Clients that can't keep up and let their queue fill up
+	// are disconnected rather than slowing down the warp. Defaults to
+	// DefaultClientQueueSize if 0.
+	ClientQueueSize int
+	// StateWindow is the window within which the state changes of a warp
+	// (users joining or leaving, window size, modes, ...) are coalesced into
+	// a single state broadcast, so that busy warps don't flood their sessions
+	// with state messages. States are broadcast right away if 0.
+	StateWindow time.Duration
+	// StreamWindow is the receive window in bytes of the channels of sessions,
+	// bounding the throughput of data sent to warpd (in particular by hosts)
+	// per round-trip. Defaults to warp.DefaultStreamWindow if 0.
+	StreamWindow int
+	// Codec is the wire encoding of the messages exchanged with sessions.
+	// Clients must use the same codec. Defaults to warp.GobCodec if nil.
+	Codec warp.Codec
+	// AcceptBackoff is the delay before accepting connections again after a
+	// temporary accept error (e.g. file descriptors exhaustion), doubled on
+	// each consecutive error up to AcceptBackoffMax and reset once a
+	// connection is accepted. They default to 5ms and 1s if 0.
+	AcceptBackoff    time.Duration
+	AcceptBackoffMax time.Duration
+	// ConnRateLimit, if not 0, is the number of connections accepted from
+	// each source IP per ConnRateWindow (defaults to 1m if 0), connections
+	// beyond it being closed right away. It blunts brute-force attempts
+	// against warp secrets. Loopback addresses are exempted unless
+	// ConnRateLimitLoopback is set, as are unix sockets.
+	ConnRateLimit         int
+	ConnRateWindow        time.Duration
+	ConnRateLimitLoopback bool
+	// Hooks are called on warp lifecycle events (none by default).
+	Hooks Hooks
+	// CommandLog, if not nil, receives the command lines typed into the warps
+	// by their clients (see commandLine), for audit purposes. As they may be
+	// sensitive, commands are not logged by default, and clients are told
+	// through the warp banner when they are. The input of warps encrypted end
+	// to end is never logged.
+	CommandLog io.Writer
+	// RedactCommand, if not nil, is applied to each command line before it is
+	// written to CommandLog, e.g. to mask passwords (see RegexpRedactor).
+	RedactCommand func(line string) string
+	// AdminSocket, if not empty, is the path of the unix socket on which the
+	// admin protocol is served (see AdminRequest). AdminSocketMode is applied
+	// to it, defaulting to 0600 so that only the user running warpd can
+	// query it.
+	AdminSocket     string
+	AdminSocketMode os.FileMode
+}
+
 // Srv represents a running warpd server.
 type Srv struct {
-	address  string
-	certFile string
-	keyFile  string
+	metrics metrics
+
+	config Config
+
+	startedAt time.Time
+
+	// connLimiter, if not nil, limits the rate of connections per source IP.
+	connLimiter *connLimiter
+
+	listeners     []net.Listener
+	metricsServer *http.Server
+	healthServer  *http.Server
+	gatewayServer *http.Server
+	adminListener net.Listener
+	shuttingDown  bool
+	// accepting is the number of accept loops running.
+	accepting int
+
+	// commands, if not nil, logs the command lines typed into the warps.
+	commands *commandLog
 
 	warps map[string]*Warp
 	mutex *sync.Mutex
@@ -25,75 +197,378 @@ type Srv struct {
 // NewSrv constructs a Srv ready to start serving requests.
 func NewSrv(
 	ctx context.Context,
-	address string,
+	config Config,
+) *Srv {
+	s := &Srv{
+		startedAt: time.Now(),
+		config:    config,
+		warps:     map[string]*Warp{},
+		mutex:     &sync.Mutex{},
+	}
+	if s.config.Codec == nil {
+		s.config.Codec = warp.GobCodec
+	}
+	// Client certificates are verified during the TLS handshake if
+	// presented, their absence being reported to the sessions with a coded
+	// error once established (see authenticate).
+	if s.config.TLSConfig != nil && s.config.ClientCAs != nil {
+		s.config.TLSConfig = s.config.TLSConfig.Clone()
+		s.config.TLSConfig.ClientCAs = s.config.ClientCAs
+		s.config.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if config.ConnRateLimit > 0 {
+		s.connLimiter = newConnLimiter(
+			config.ConnRateLimit,
+			config.ConnRateWindow,
+			config.ConnRateLimitLoopback,
+		)
+	}
+	if config.CommandLog != nil {
+		s.commands = newCommandLog(config.CommandLog, config.RedactCommand)
+		logging.Warnf(ctx,
+			"Command logging enabled: the commands typed into warps are logged",
+		)
+	}
+	return s
+}
+
+// TLSConfig builds the TLS configuration used by warpd from a certificate and
+// key file.
+func TLSConfig(
+	ctx context.Context,
 	certFile string,
 	keyFile string,
-) *Srv {
-	return &Srv{
-		address:  address,
-		certFile: certFile,
-		keyFile:  keyFile,
-		warps:    map[string]*Warp{},
-		mutex:    &sync.Mutex{},
+) (*tls.Config, error) {
+	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		MinVersion:   tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP521, tls.CurveP384, tls.CurveP256,
+		},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+	}, nil
+}
+
+// ClientCAs loads the CA certificates client certificates are verified against
+// from caFile (see Config.ClientCAs).
+func ClientCAs(
+	ctx context.Context,
+	caFile string,
+) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Failed to read client CA file %s: %v", caFile, err),
+		)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.Trace(
+			errors.Newf("No valid certificate found in client CA file: %s", caFile),
+		)
+	}
+	return pool, nil
+}
+
+// addresses returns the addresses to listen on.
+func (s *Srv) addresses() []string {
+	if len(s.config.Addresses) > 0 {
+		return s.config.Addresses
+	}
+	if s.config.Address != "" {
+		return []string{s.config.Address}
 	}
+	return []string{}
 }
 
-// Run starts the server.
+// listen creates the listener for an address ([ip]:port or unix:path).
+func (s *Srv) listen(
+	ctx context.Context,
+	address string,
+) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, warp.UnixAddressPrefix) {
+		network = "unix"
+		address = strings.TrimPrefix(address, warp.UnixAddressPrefix)
+		// Remove the socket left by a previous warpd if any. The socket is
+		// removed when the listener gets closed.
+		if fi, err := os.Lstat(address); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	if network == "tcp" {
+		normalized, err := warp.NormalizeAddress(address)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		address = normalized
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if network == "unix" && s.config.SocketMode != 0 {
+		if err := os.Chmod(address, s.config.SocketMode); err != nil {
+			ln.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if s.config.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.config.TLSConfig)
+	}
+	return ln, nil
+}
+
+// Run starts the server, accepting connections on all the configured
+// addresses. It returns once the listeners are closed by Shutdown or as soon
+// as one of them fails, closing the others.
 func (s *Srv) Run(
 	ctx context.Context,
 ) error {
-	var ln net.Listener
+	if err := s.Listen(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	return s.Serve(ctx)
+}
+
+// Listen creates the listeners of all the configured addresses, without
+// accepting connections yet. Their actual addresses (e.g. when listening on
+// port 0) are then returned by Addrs.
+func (s *Srv) Listen(
+	ctx context.Context,
+) error {
+	addresses := s.addresses()
+	if len(addresses) == 0 {
+		return errors.Trace(errors.Newf("No address to listen on"))
+	}
 
-	if s.certFile != "" && s.keyFile != "" {
-		cer, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	listeners := []net.Listener{}
+	for _, address := range addresses {
+		ln, err := s.listen(ctx, address)
 		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
 			return errors.Trace(err)
 		}
+		listeners = append(listeners, ln)
+	}
 
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cer},
-			MinVersion:   tls.VersionTLS12,
-			CurvePreferences: []tls.CurveID{
-				tls.CurveP521, tls.CurveP384, tls.CurveP256,
-			},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		for _, ln := range listeners {
+			ln.Close()
 		}
+		return nil
+	}
+	s.listeners = listeners
+	s.mutex.Unlock()
 
-		ln, err = tls.Listen("tcp", s.address, tlsConfig)
-		if err != nil {
+	for i, ln := range listeners {
+		logging.Logf(ctx,
+			"Listening: listener=%s address=%s tls=%t",
+			addresses[i], ln.Addr().String(), s.config.TLSConfig != nil,
+		)
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the listeners created by Listen, in the
+// order of the configured addresses. It acquires the server lock.
+func (s *Srv) Addrs() []net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addrs := []net.Addr{}
+	for _, ln := range s.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Serve accepts connections on the listeners created by Listen. It returns
+// once they are closed by Shutdown or as soon as one of them fails, closing
+// the others.
+func (s *Srv) Serve(
+	ctx context.Context,
+) error {
+	s.mutex.Lock()
+	listeners := s.listeners
+	s.mutex.Unlock()
+	if len(listeners) == 0 {
+		// Shutdown was called before the server listened.
+		return nil
+	}
+	addresses := s.addresses()
+
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	defer closeAll()
+
+	if s.config.IdleTimeout > 0 {
+		go s.reapIdleWarps(ctx)
+	}
+
+	if s.config.MetricsAddress != "" {
+		if err := s.runMetrics(ctx); err != nil {
 			return errors.Trace(err)
 		}
-		logging.Logf(ctx,
-			"Listening: address=%s tls=true cert_file=%s key_file=%s",
-			s.address, s.certFile, s.keyFile)
-	} else {
-		var err error
-		ln, err = net.Listen("tcp", s.address)
-		if err != nil {
+	}
+
+	if s.config.HealthAddress != "" {
+		if err := s.runHealth(ctx); err != nil {
 			return errors.Trace(err)
 		}
-		logging.Logf(ctx, "Listening: address=%s tls=false", s.address)
 	}
-	defer ln.Close()
 
+	if s.config.GatewayAddress != "" {
+		if err := s.runGateway(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if s.config.AdminSocket != "" {
+		if err := s.runAdmin(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	errC := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		go func(label string, ln net.Listener) {
+			errC <- s.accept(ctx, label, ln)
+		}(addresses[i], ln)
+	}
+
+	var err error
+	for range listeners {
+		if e := <-errC; e != nil && err == nil {
+			err = e
+			closeAll()
+		}
+	}
+	return err
+}
+
+// accept runs the accept loop of a listener, labeled in logs by the address
+// it was created for. It returns nil once the listener is closed by Shutdown.
+func (s *Srv) accept(
+	ctx context.Context,
+	label string,
+	ln net.Listener,
+) error {
+	backoff, backoffMax := s.config.AcceptBackoff, s.config.AcceptBackoffMax
+	if backoff == 0 {
+		backoff = defaultAcceptBackoff
+	}
+	if backoffMax == 0 {
+		backoffMax = defaultAcceptBackoffMax
+	}
+
+	s.mutex.Lock()
+	s.accepting++
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.accepting--
+		s.mutex.Unlock()
+	}()
+
+	// delay is the current backoff delay, 0 after a successful accept.
+	// Temporary errors are logged at most once per acceptLogInterval,
+	// suppressed counting the errors not logged since.
+	var delay time.Duration
+	var lastLog time.Time
+	suppressed := 0
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			logging.Logf(ctx,
-				"Error accepting connection: remote=%s error=%v",
-				conn.RemoteAddr().String(), err,
+			// The listener was closed by Shutdown.
+			if s.isShuttingDown() {
+				return nil
+			}
+			// On error conn is nil, so there is no remote address to log.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = backoff
+				} else {
+					delay *= 2
+				}
+				if delay > backoffMax {
+					delay = backoffMax
+				}
+				if time.Since(lastLog) >= acceptLogInterval {
+					logging.Logf(ctx,
+						"Temporary error accepting connection: listener=%s "+
+							"retry=%s suppressed=%d error=%v",
+						label, delay, suppressed, err,
+					)
+					lastLog = time.Now()
+					suppressed = 0
+				} else {
+					suppressed++
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return errors.Trace(
+				errors.Newf("Listener error (%s): %v", label, err),
 			)
-			continue
+		}
+		delay = 0
+		if s.connLimiter != nil {
+			if ok, first := s.connLimiter.Allow(conn.RemoteAddr()); !ok {
+				atomic.AddInt64(&s.metrics.connectionsThrottled, 1)
+				if first {
+					logging.Warnf(ctx,
+						"Throttling connections: listener=%s remote=%s "+
+							"limit=%d window=%s",
+						label, conn.RemoteAddr().String(),
+						s.connLimiter.limit, s.connLimiter.window,
+					)
+				}
+				conn.Close()
+				continue
+			}
 		}
 		go func() {
-			err := s.handle(ctx, conn)
+			if err := warp.TuneConn(conn, s.config.KeepAlive); err != nil {
+				logging.Logf(ctx,
+					"Failed to set socket options: listener=%s remote=%s "+
+						"error=%v",
+					label, conn.RemoteAddr().String(), err,
+				)
+			}
+			err := s.handle(ctx, label, conn, s.config.Codec)
 			if err != nil {
+				atomic.AddInt64(&s.metrics.connectionErrors, 1)
+			}
+			if code := errors.CodeOf(err); code != errors.CodeNone {
+				// The session was rejected and notified of it.
+				logging.Logf(ctx,
+					"Rejected connection: remote=%s code=%s error=%v",
+					conn.RemoteAddr().String(), code, err,
+				)
+			} else if err != nil {
 				logging.Logf(ctx,
 					"Error handling connection: remote=%s error=%v",
 					conn.RemoteAddr().String(), err,
@@ -108,31 +583,219 @@ func (s *Srv) Run(
 	}
 }
 
-// handle an incoming connection.
+// runMetrics starts serving metrics on the configured metrics address.
+func (s *Srv) runMetrics(
+	ctx context.Context,
+) error {
+	address, err := warp.NormalizeAddress(s.config.MetricsAddress)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Invalid metrics address: %v", err),
+		)
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Metrics listen error: %v", err),
+		)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	srv := &http.Server{Handler: mux}
+
+	s.mutex.Lock()
+	s.metricsServer = srv
+	s.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Serving metrics: address=%s",
+		ln.Addr().String(),
+	)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logging.Logf(ctx, "Metrics server error: error=%v", err)
+		}
+	}()
+
+	return nil
+}
+
+// isShuttingDown returns whether Shutdown was called. It acquires the server
+// lock.
+func (s *Srv) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown gracefully stops the server: it stops accepting connections, closes
+// all warps with a `server_shutdown` error sent to their host and clients and
+// waits for them to be cleaned-up or for ctx to be done. Run returns once the
+// listeners are closed.
+func (s *Srv) Shutdown(
+	ctx context.Context,
+) error {
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.shuttingDown = true
+	listeners := s.listeners
+	metricsServer := s.metricsServer
+	healthServer := s.healthServer
+	gatewayServer := s.gatewayServer
+	adminListener := s.adminListener
+	warps := make([]*Warp, 0, len(s.warps))
+	for _, w := range s.warps {
+		warps = append(warps, w)
+	}
+	s.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Shutting down: warp_count=%d",
+		len(warps),
+	)
+
+	// Closing the listeners stops accepting connections (and removes the unix
+	// sockets if any).
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if adminListener != nil {
+		adminListener.Close()
+	}
+	// The gateway viewers are disconnected along with the warps.
+	if gatewayServer != nil {
+		gatewayServer.Close()
+	}
+	// The health server is kept until the warps are drained, readiness
+	// failing in the meantime.
+	if healthServer != nil {
+		defer healthServer.Close()
+	}
+
+	for _, w := range warps {
+		w.Close(ctx,
+			warp.ErrServerShutdown,
+			"The warpd serving this warp is shutting down.",
+		)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mutex.Lock()
+		remaining := len(s.warps)
+		s.mutex.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Trace(
+				errors.Newf(
+					"Shutdown interrupted with %d warps remaining: %v",
+					remaining, ctx.Err(),
+				),
+			)
+		case <-ticker.C:
+		}
+	}
+}
+
+// handle an incoming connection accepted by the listener labeled label,
+// whose messages are encoded with codec.
 func (s *Srv) handle(
 	ctx context.Context,
+	label string,
 	conn net.Conn,
+	codec warp.Codec,
 ) error {
 	logging.Logf(ctx,
-		"Handling new connection: remote=%s",
-		conn.RemoteAddr().String(),
+		"Handling new connection: listener=%s remote=%s local=%s",
+		label, conn.RemoteAddr().String(), conn.LocalAddr().String(),
 	)
 
+	// The deadline is cleared once the session is established, after the
+	// initial host update for hosts.
+	timeout := s.config.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	conn.SetDeadline(deadline)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return errors.Trace(
+				errors.Newf("TLS handshake error: %v", err),
+			)
+		}
+	}
+
 	// Create a new context for this client with its own cancelation function.
 	ctx, cancel := context.WithCancel(ctx)
 
-	ss, err := NewSession(ctx, cancel, conn)
+	ss, err := NewSession(
+		ctx, cancel, conn, s.config.Compression, s.config.StreamWindow, codec,
+	)
 	if err != nil {
+		cancel()
+		conn.Close()
+		if time.Now().After(deadline) {
+			return errors.Trace(
+				errors.Newf("Handshake timed out after %s: %v", timeout, err),
+			)
+		}
+		return errors.Trace(err)
+	}
+	// Close and reclaims all session related state, once the heartbeats
+	// stopped and the channels are closed.
+	heartbeatDoneC := make(chan struct{})
+	defer func() {
+		ss.TearDown()
+		<-heartbeatDoneC
+		ss.Wait()
+	}()
+
+	go func() {
+		defer close(heartbeatDoneC)
+		ss.Heartbeat(
+			ctx, s.config.HeartbeatInterval, s.config.HeartbeatThreshold,
+		)
+	}()
+
+	if err := ss.CheckProtocolVersion(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if err := s.authenticate(ctx, ss); err != nil {
 		return errors.Trace(err)
 	}
-	// Close and reclaims all session related state.
-	defer ss.TearDown()
+
+	// The handshake of hosts and panes ends with their initial update and the
+	// one of shell clients once their access to the warp is checked.
+	if ss.sessionType == warp.SsTpList || ss.sessionType == warp.SsTpPing {
+		conn.SetDeadline(time.Time{})
+	}
 
 	switch ss.sessionType {
 	case warp.SsTpHost:
-		err = s.handleHost(ctx, ss)
+		err = s.handleHost(ctx, ss, deadline)
 	case warp.SsTpShellClient:
-		err = s.handleShellClient(ctx, ss)
+		err = s.handleShellClient(ctx, ss, deadline)
+	case warp.SsTpList:
+		err = s.handleList(ctx, ss)
+	case warp.SsTpPing:
+		err = s.handlePing(ctx, ss)
+	case warp.SsTpPane:
+		err = s.handlePane(ctx, ss, deadline)
 	}
 	if err != nil {
 		return errors.Trace(err)
@@ -140,64 +803,292 @@ func (s *Srv) handle(
 	return nil
 }
 
+// authenticate checks that the session ss presented a client certificate if
+// warpd requires them, replacing its username by its verified identity, the
+// common name of the certificate, to be relied upon for access lists and logs.
+// Sessions without (valid) certificates are sent an ErrClientCertRequired
+// error.
+func (s *Srv) authenticate(
+	ctx context.Context,
+	ss *Session,
+) error {
+	tlsConn, ok := ss.conn.(*tls.Conn)
+	if !ok || s.config.ClientCAs == nil {
+		return nil
+	}
+	identity := ""
+	if state := tlsConn.ConnectionState(); len(state.VerifiedChains) > 0 {
+		identity = state.PeerCertificates[0].Subject.CommonName
+	}
+	if err := warp.ValidateUsername(identity); err != nil {
+		ss.SendError(ctx,
+			warp.ErrClientCertRequired,
+			"The warpd you attempted to connect to requires a client "+
+				"certificate signed by its CA and naming you (see --cert).",
+		)
+		return errors.WithCode(
+			errors.Newf(
+				"Client certificate required: session=%s identity=%q",
+				ss.ToString(), identity,
+			),
+			warp.ErrClientCertRequired,
+		)
+	}
+	logging.Logf(ctx,
+		"Session authenticated: session=%s identity=%s username=%s",
+		ss.ToString(), identity, ss.username,
+	)
+	ss.username = identity
+	return nil
+}
+
 // handleHost handles an host connecting, creating the warp if it does not
-// exists or erroring accordingly.
+// exists or erroring accordingly. The initial host update must be received
+// before the handshake deadline.
 func (s *Srv) handleHost(
 	ctx context.Context,
 	ss *Session,
+	deadline time.Time,
 ) error {
 	var initial warp.HostUpdate
 	if err := ss.updateR.Decode(&initial); err != nil {
+		if time.Now().After(deadline) {
+			return errors.Trace(
+				errors.Newf("Handshake timed out: %v", err),
+			)
+		}
 		ss.SendInternalError(ctx)
 		return errors.Trace(
 			errors.Newf("Initial host update error: %v", err),
 		)
 	}
+	// The session is established.
+	ss.conn.SetDeadline(time.Time{})
 	logging.Logf(ctx,
 		"Initial host update received: session=%s\n",
 		ss.ToString(),
 	)
 
+	if err := validateHostUpdate(&initial); err != nil {
+		ss.SendError(ctx,
+			warp.ErrUpdateInvalid,
+			fmt.Sprintf("The initial host update is invalid: %v.", err),
+		)
+		return errors.WithCode(
+			errors.Newf("Host error: invalid initial update: %v", err),
+			warp.ErrUpdateInvalid,
+		)
+	}
+
+	if !warp.WarpRegexp.MatchString(ss.warp) {
+		ss.SendError(ctx,
+			warp.ErrWarpInvalid,
+			fmt.Sprintf(
+				"The warp ID you attempted to open is invalid: %s.",
+				ss.warp,
+			),
+		)
+		return errors.WithCode(
+			errors.Newf("Host error: warp invalid: %s", ss.warp),
+			warp.ErrWarpInvalid,
+		)
+	}
+
 	s.mutex.Lock()
-	_, ok := s.warps[ss.warp]
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrServerShutdown,
+			"The warpd you attempted to open a warp on is shutting down.",
+		)
+		return errors.WithCode(
+			errors.Newf("Host error: server shutting down: %s", ss.warp),
+			warp.ErrServerShutdown,
+		)
+	}
+
+	w, ok := s.warps[ss.warp]
 
 	if ok {
 		s.mutex.Unlock()
+		// The warp is taken over if its host nominated this user.
+		if err := w.takeOver(ctx, ss, initial); err == nil {
+			if !w.runHost(ctx, ss) {
+				s.cleanUpWarp(ctx, ss, w)
+			}
+			return nil
+		}
 		ss.SendError(ctx,
-			"warp_in_use",
+			warp.ErrWarpInUse,
 			fmt.Sprintf(
 				"The warp you attempted to open is already in use: %s.",
 				ss.warp,
 			),
 		)
-		return errors.Trace(
+		return errors.WithCode(
 			errors.Newf("Host error: warp already in use: %s", ss.warp),
+			warp.ErrWarpInUse,
+		)
+	}
+
+	// The limit is checked under the lock the warp is registered with so that
+	// concurrent hosts can't exceed it.
+	if s.config.MaxWarps > 0 && len(s.warps) >= s.config.MaxWarps {
+		s.mutex.Unlock()
+		logging.Warnf(ctx,
+			"Server at capacity, warp rejected: session=%s max_warps=%d",
+			ss.ToString(), s.config.MaxWarps,
 		)
+		ss.SendError(ctx,
+			warp.ErrServerAtCapacity,
+			"The warpd you attempted to open a warp on is serving the "+
+				"maximum number of warps, try again later.",
+		)
+		return errors.WithCode(
+			errors.Newf("Host error: server at capacity: %s", ss.warp),
+			warp.ErrServerAtCapacity,
+		)
+	}
+
+	maxClients := initial.MaxClients
+	if s.config.MaxClients > 0 &&
+		(maxClients <= 0 || maxClients > s.config.MaxClients) {
+		maxClients = s.config.MaxClients
+	}
+
+	rateBurst := s.config.ClientRateBurst
+	if rateBurst <= 0 {
+		rateBurst = s.config.ClientRateLimit
+	}
+
+	queueSize := s.config.ClientQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultClientQueueSize
 	}
 
-	s.warps[ss.warp] = &Warp{
-		token:      ss.warp,
-		windowSize: initial.WindowSize,
-		host:       nil,
-		clients:    map[string]*UserState{},
-		data:       make(chan []byte),
-		mutex:      &sync.Mutex{},
+	// The host sessions are initialized as empty as the host session does not
+	// act as a client. Subsequent client sessions of the host user are added
+	// to them.
+	host := newHostState(ss, map[string]*Session{})
+
+	w = &Warp{
+		token:          ss.warp,
+		createdAt:      time.Now(),
+		lastActivity:   time.Now(),
+		windowSize:     initial.WindowSize,
+		scrollbackSize: s.config.ScrollbackSize,
+		rateLimit:      s.config.ClientRateLimit,
+		rateBurst:      rateBurst,
+		bufferSize:     s.config.BufferSize,
+		queueSize:      queueSize,
+		stateWindow:    s.config.StateWindow,
+		maxClients:     maxClients,
+		approval:       initial.Approval,
+		secretHash:     initial.WarpSecretHash,
+		writeLock:      initial.WriteLock,
+		e2eCheck:       initial.E2ECheck,
+		banner:         initial.Banner,
+		bannerAck:      initial.BannerAck,
+		allowUsers:     usernameSet(initial.AllowUsers),
+		denyUsers:      usernameSet(initial.DenyUsers),
+		hooks:          s.config.Hooks,
+		commands:       s.commands,
+		pending:        map[string]*pendingUser{},
+		panes:          map[string]*pane{},
+		host:           host,
+		clients:        map[string]*UserState{},
+		handoffC:       make(chan struct{}),
+		data:           make(chan []byte),
+		mutex:          &sync.Mutex{},
+	}
+	if initial.TTL > 0 {
+		w.expiresAt = time.Now().Add(initial.TTL)
+		w.expiry = time.AfterFunc(initial.TTL, func() {
+			s.expireWarp(ctx, w, initial.TTL)
+		})
 	}
+	s.warps[ss.warp] = w
 
 	s.mutex.Unlock()
 
-	s.warps[ss.warp].handleHost(ctx, ss)
+	atomic.AddInt64(&s.metrics.warps, 1)
+	if w.commands != nil && len(w.e2eCheck) == 0 {
+		logging.Logf(ctx,
+			"Logging commands: session=%s",
+			ss.ToString(),
+		)
+	}
+	fire(ctx, "warp_created", s.config.Hooks.WarpCreated, ss)
+	// The warp is left in place if it was handed off to another host session.
+	if !w.runHost(ctx, ss) {
+		s.cleanUpWarp(ctx, ss, w)
+	}
+
+	return nil
+}
 
-	// Clean-up warp.
+// cleanUpWarp removes the warp w of the host session ss once it is done.
+func (s *Srv) cleanUpWarp(
+	ctx context.Context,
+	ss *Session,
+	w *Warp,
+) {
+	exitStatus := "none"
+	if status, ok := w.ExitStatus(ctx); ok {
+		exitStatus = strconv.Itoa(status)
+	}
+	reason := ss.Departure()
+	if reason == warp.DisconnectUnknown {
+		atomic.AddInt64(&s.metrics.sessionsDropped, 1)
+	}
 	logging.Logf(ctx,
-		"Cleaning-up warp: session=%s",
-		ss.ToString(),
+		"Cleaning-up warp: session=%s exit_status=%s reason=%s",
+		ss.ToString(), exitStatus, reason,
 	)
+	if w.expiry != nil {
+		w.expiry.Stop()
+	}
 	s.mutex.Lock()
-	delete(s.warps, ss.warp)
+	// The warp is only removed once, its ID may be reused right after.
+	removed := s.warps[ss.warp] == w
+	if removed {
+		delete(s.warps, ss.warp)
+	}
 	s.mutex.Unlock()
+	if removed {
+		atomic.AddInt64(&s.metrics.warps, -1)
+		ev := newEvent(ss)
+		ev.Reason = reason
+		fireEvent(ctx, "warp_closed", s.config.Hooks.WarpClosed, ev)
+	}
+}
 
-	return nil
+// expireWarp closes a warp whose TTL elapsed. The warp is then cleaned up as
+// its host session ends. The timer may fire while the warp is being cleaned up
+// so the warp is only closed if it is still registered.
+func (s *Srv) expireWarp(
+	ctx context.Context,
+	w *Warp,
+	ttl time.Duration,
+) {
+	s.mutex.Lock()
+	registered := s.warps[w.token] == w
+	s.mutex.Unlock()
+	if !registered {
+		return
+	}
+
+	logging.Logf(ctx,
+		"Expiring warp: warp=%s ttl=%s",
+		w.token, ttl.Round(time.Second),
+	)
+	w.Close(ctx,
+		warp.ErrWarpExpired,
+		fmt.Sprintf(
+			"The warp expired at %s.",
+			w.expiresAt.UTC().Format(time.RFC1123),
+		),
+	)
 }
 
 // handleShellClient handles a client connecting, retrieving the required warp
@@ -205,26 +1096,224 @@ func (s *Srv) handleHost(
 func (s *Srv) handleShellClient(
 	ctx context.Context,
 	ss *Session,
+	deadline time.Time,
 ) error {
 	s.mutex.Lock()
-	_, ok := s.warps[ss.warp]
+	w, ok := s.warps[ss.warp]
 	s.mutex.Unlock()
 
 	if !ok {
 		// This error code (warp_unknown) is expected by brew for warp 0.0.3.
 		ss.SendError(ctx,
-			"warp_unknown",
+			warp.ErrWarpUnknown,
 			fmt.Sprintf(
 				"The warp you attempted to connect does not exist: %s.",
 				ss.warp,
 			),
 		)
-		return errors.Trace(
+		return errors.WithCode(
 			errors.Newf("Client error: warp unknown %s", ss.warp),
+			warp.ErrWarpUnknown,
 		)
 	}
 
-	s.warps[ss.warp].handleShellClient(ctx, ss)
+	if err := w.checkAccess(ctx, ss); err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.checkSecret(ctx, ss); err != nil {
+		if time.Now().After(deadline) {
+			return errors.Trace(
+				errors.Newf("Handshake timed out: %v", err),
+			)
+		}
+		return errors.Trace(err)
+	}
+	ss.conn.SetDeadline(time.Time{})
+
+	atomic.AddInt64(&s.metrics.clients, 1)
+	if w.handleShellClient(ctx, ss) {
+		atomic.AddInt64(&s.metrics.sessionsDropped, 1)
+	}
+	atomic.AddInt64(&s.metrics.clients, -1)
+
+	return nil
+}
+
+// handlePane handles the host user sharing a pane in its warp, erroring if
+// the warp does not exist. The initial pane update must be received before the
+// handshake deadline.
+func (s *Srv) handlePane(
+	ctx context.Context,
+	ss *Session,
+	deadline time.Time,
+) error {
+	var initial warp.PaneUpdate
+	if err := ss.updateR.Decode(&initial); err != nil {
+		if time.Now().After(deadline) {
+			return errors.Trace(
+				errors.Newf("Handshake timed out: %v", err),
+			)
+		}
+		ss.SendInternalError(ctx)
+		return errors.Trace(
+			errors.Newf("Initial pane update error: %v", err),
+		)
+	}
+	ss.conn.SetDeadline(time.Time{})
+
+	if initial.Warp != ss.warp || initial.From != ss.session {
+		ss.SendError(ctx,
+			warp.ErrUpdateInvalid,
+			"The initial pane update does not match the session.",
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: update mismatch: session=%s", ss.ToString()),
+			warp.ErrUpdateInvalid,
+		)
+	}
+	if err := warp.ValidatePaneLabel(initial.Label); err != nil {
+		ss.SendError(ctx,
+			warp.ErrPaneInvalid,
+			fmt.Sprintf("The pane is invalid: %v.", err),
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: %v", err),
+			warp.ErrPaneInvalid,
+		)
+	}
+
+	s.mutex.Lock()
+	w, ok := s.warps[ss.warp]
+	s.mutex.Unlock()
+	if !ok {
+		ss.SendError(ctx,
+			warp.ErrWarpUnknown,
+			fmt.Sprintf(
+				"The warp you attempted to share a pane in does not exist: %s.",
+				ss.warp,
+			),
+		)
+		return errors.WithCode(
+			errors.Newf("Pane error: warp unknown %s", ss.warp),
+			warp.ErrWarpUnknown,
+		)
+	}
+
+	if err := w.handlePane(ctx, ss, initial.Label); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// handleList handles a list session, sending the summaries of all the warps
+// currently served.
+func (s *Srv) handleList(
+	ctx context.Context,
+	ss *Session,
+) error {
+	if !s.config.EnableList {
+		ss.SendError(ctx,
+			warp.ErrListDisabled,
+			"Listing warps is disabled on this warpd.",
+		)
+		return errors.WithCode(
+			errors.Newf("List error: listing disabled"),
+			warp.ErrListDisabled,
+		)
+	}
+
+	// Snapshot the warps under the server lock so that we don't race with
+	// warps being created or cleaned-up.
+	s.mutex.Lock()
+	warps := make([]*Warp, 0, len(s.warps))
+	for _, w := range s.warps {
+		warps = append(warps, w)
+	}
+	s.mutex.Unlock()
+
+	summaries := make([]warp.WarpSummary, 0, len(warps))
+	for _, w := range warps {
+		summaries = append(summaries, w.Summary(ctx))
+	}
+
+	logging.Logf(ctx,
+		"Sending warp list: session=%s count=%d",
+		ss.ToString(), len(summaries),
+	)
+
+	if err := ss.stateW.Encode(summaries); err != nil {
+		return errors.Trace(
+			errors.Newf("List send error: %v", err),
+		)
+	}
 
 	return nil
 }
+
+// handlePing handles a ping session, replying with the version of warpd and
+// the protocol version negotiated with the client.
+func (s *Srv) handlePing(
+	ctx context.Context,
+	ss *Session,
+) error {
+	logging.Logf(ctx,
+		"Sending ping reply: session=%s",
+		ss.ToString(),
+	)
+
+	if err := ss.stateW.Encode(warp.PingReply{
+		Version:         warp.Version,
+		ProtocolVersion: ss.protocolVersion,
+		Time:            time.Now(),
+	}); err != nil {
+		return errors.Trace(
+			errors.Newf("Ping send error: %v", err),
+		)
+	}
+
+	return nil
+}
+
+// reapIdleWarps periodically closes the warps that have been idle for more than
+// the configured idle timeout.
+func (s *Srv) reapIdleWarps(
+	ctx context.Context,
+) {
+	ticker := time.NewTicker(s.config.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Snapshot the warps under the server lock. Warp locks are acquired
+		// after releasing it, as in handleList.
+		s.mutex.Lock()
+		warps := make([]*Warp, 0, len(s.warps))
+		for _, w := range s.warps {
+			warps = append(warps, w)
+		}
+		s.mutex.Unlock()
+
+		for _, w := range warps {
+			idle := time.Since(w.IdleSince(ctx))
+			if idle < s.config.IdleTimeout {
+				continue
+			}
+			logging.Logf(ctx,
+				"Reaping idle warp: warp=%s idle=%s",
+				w.token, idle,
+			)
+			w.Close(ctx,
+				warp.ErrWarpIdle,
+				fmt.Sprintf(
+					"The warp was closed after being idle for %s.",
+					s.config.IdleTimeout,
+				),
+			)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp/lib/logging"
+)
+
+// tempError is a temporary net.Error, as returned by Accept when the process
+// runs out of file descriptors.
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// faultyListener is a net.Listener returning the errors of errs, in order,
+// from its successive calls to Accept, nil entries returning a connection.
+// The times of the calls are recorded in calls.
+type faultyListener struct {
+	errs []error
+
+	accepts int
+	calls   []time.Time
+	mutex   *sync.Mutex
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.calls = append(l.calls, time.Now())
+	if l.accepts >= len(l.errs) {
+		return nil, errors.New("no more errors")
+	}
+	err := l.errs[l.accepts]
+	l.accepts++
+	if err != nil {
+		return nil, err
+	}
+	c, s := net.Pipe()
+	// The handshake fails on the closed connection.
+	s.Close()
+	return c, nil
+}
+
+func (l *faultyListener) Close() error { return nil }
+
+func (l *faultyListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestAcceptRetriesTemporaryErrors(t *testing.T) {
+	ctx := context.Background()
+	s := NewSrv(ctx, Config{
+		AcceptBackoff:    time.Millisecond,
+		AcceptBackoffMax: 4 * time.Millisecond,
+	})
+
+	ln := &faultyListener{
+		errs: []error{
+			tempError{}, tempError{}, nil, tempError{}, tempError{},
+			tempError{}, errors.New("use of closed network connection"),
+		},
+		mutex: &sync.Mutex{},
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.accept(ctx, "faulty", ln)
+	}()
+
+	select {
+	case err := <-errC:
+		if err == nil || !strings.Contains(err.Error(), "Listener error") {
+			t.Fatalf("accept: got %v, want a listener error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("accept did not return on a permanent error")
+	}
+
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	if ln.accepts != len(ln.errs) {
+		t.Fatalf("Accept calls: got %d, want %d", ln.accepts, len(ln.errs))
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	ctx := context.Background()
+	backoff, backoffMax := 10*time.Millisecond, 160*time.Millisecond
+	s := NewSrv(ctx, Config{
+		AcceptBackoff:    backoff,
+		AcceptBackoffMax: backoffMax,
+	})
+
+	logs := &lockedBuffer{}
+	output := logging.Writer()
+	logging.SetOutput(logs)
+	defer logging.SetOutput(output)
+
+	// The delays after the errors, in order, are 10ms, 20ms, 40ms, 80ms,
+	// 160ms, capped at 160ms, then reset to 10ms by the successful accept.
+	temp := tempError{}
+	ln := &faultyListener{
+		errs: []error{
+			temp, temp, temp, temp, temp, temp, nil, temp,
+			errors.New("use of closed network connection"),
+		},
+		mutex: &sync.Mutex{},
+	}
+	if err := s.accept(ctx, "faulty", ln); err == nil {
+		t.Fatalf("accept: got nil, want a listener error")
+	}
+
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	gap := func(i int) time.Duration {
+		return ln.calls[i+1].Sub(ln.calls[i])
+	}
+	// The delay doubles up to its maximum.
+	for i, want := range []time.Duration{
+		backoff, 2 * backoff, 4 * backoff, 8 * backoff, backoffMax, backoffMax,
+	} {
+		if d := gap(i); d < want || d > want+backoffMax/2 {
+			t.Errorf("delay after error %d: got %s, want %s", i, d, want)
+		}
+	}
+	// The delay is reset by a successful accept.
+	if d := gap(7); d < backoff || d > backoff+backoffMax/2 {
+		t.Errorf("delay after a successful accept: got %s, want %s", d, backoff)
+	}
+
+	// The burst of errors is logged once.
+	if n := strings.Count(logs.String(), "Temporary error accepting"); n != 1 {
+		t.Errorf("temporary errors logged %d times, want 1:\n%s", n, logs)
+	}
+}
+
+func TestAcceptReturnsOnShutdown(t *testing.T) {
+	ctx := context.Background()
+	s := NewSrv(ctx, Config{})
+
+	ln := &faultyListener{
+		errs:  []error{errors.New("use of closed network connection")},
+		mutex: &sync.Mutex{},
+	}
+	s.mutex.Lock()
+	s.shuttingDown = true
+	s.mutex.Unlock()
+
+	if err := s.accept(ctx, "faulty", ln); err != nil {
+		t.Fatalf("accept: got %v, want nil once shutting down", err)
+	}
+}
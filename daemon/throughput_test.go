@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+)
+
+// linkDelay is the one-way delay of the link emulated by delayedPipe in
+// benchmarks, for a 50ms round-trip.
+const linkDelay = 25 * time.Millisecond
+
+// delayedChunk is data relayed by delayedPipe, to be delivered at time at.
+type delayedChunk struct {
+	at   time.Time
+	data []byte
+}
+
+// relay copies src to dst, delivering data delay after it was read.
+func relay(
+	dst net.Conn,
+	src net.Conn,
+	delay time.Duration,
+) {
+	chunkC := make(chan delayedChunk, 4096)
+	go func() {
+		defer close(chunkC)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf)
+				chunkC <- delayedChunk{time.Now().Add(delay), data}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer dst.Close()
+		for c := range chunkC {
+			time.Sleep(time.Until(c.at))
+			if _, err := dst.Write(c.data); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// delayedPipe returns both ends of an in-memory connection delivering data
+// delay after it was written.
+func delayedPipe(
+	delay time.Duration,
+) (net.Conn, net.Conn) {
+	a, ar := net.Pipe()
+	br, b := net.Pipe()
+	relay(br, ar, delay)
+	relay(ar, br, delay)
+	return a, b
+}
+
+// BenchmarkDataChannel measures the throughput of the data sent by a client
+// to warpd over a 50ms round-trip, depending on the receive window of the
+// session channels. It generates the table of the README (Throughput).
+func BenchmarkDataChannel(b *testing.B) {
+	payload := make([]byte, 1024*1024)
+
+	for _, window := range []int{
+		warp.DefaultStreamWindow, 1024 * 1024, 4 * 1024 * 1024,
+	} {
+		b.Run(fmt.Sprintf("%dKiB", window/1024), func(b *testing.B) {
+			cc, sc := delayedPipe(linkDelay)
+			config := yamux.DefaultConfig()
+			config.LogOutput = ioutil.Discard
+			client, err := yamux.Client(cc, config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			server, err := yamux.Server(sc, muxConfig(window))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer server.Close()
+
+			dst, err := client.Open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Streams are only accepted once data was sent on them.
+			if _, err := dst.Write([]byte{0}); err != nil {
+				b.Fatal(err)
+			}
+			src, err := server.Accept()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := src.Read(make([]byte, 1)); err != nil {
+				b.Fatal(err)
+			}
+
+			total := int64(len(payload)) * int64(b.N)
+			doneC := make(chan error)
+			go func() {
+				_, err := io.CopyN(ioutil.Discard, src, total)
+				doneC <- err
+			}()
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dst.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-doneC; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package daemon_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/errors"
+)
+
+func TestHostInvalidInitialUpdate(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	for name, up := range map[string]warp.HostUpdate{
+		"negative window size": {
+			WindowSize: warp.Size{Rows: -1, Cols: 80},
+		},
+		"unknown mode": {
+			WindowSize: warp.Size{Rows: 24, Cols: 80},
+			Modes:      map[string]warp.Mode{"bob": 1 << 42},
+		},
+		"negative max clients": {
+			WindowSize: warp.Size{Rows: 24, Cols: 80},
+			MaxClients: -1,
+		},
+		"escape in allowed username": {
+			WindowSize: warp.Size{Rows: 24, Cols: 80},
+			AllowUsers: []string{"bob\x1b[2J"},
+		},
+		"unsalted secret hash": {
+			WindowSize:     warp.Size{Rows: 24, Cols: 80},
+			WarpSecretHash: "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+		},
+		"costly secret hash": {
+			WindowSize:     warp.Size{Rows: 24, Cols: 80},
+			WarpSecretHash: "pbkdf2-sha256$1000000000$salt$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+		},
+	} {
+		_, err := s.OpenHost(ctx, "invalid", "alice", up)
+		werr, ok := errors.Cause(err).(*cli.WarpdError)
+		if !ok || werr.Code != warp.ErrUpdateInvalid {
+			t.Errorf("%s: got %v, want %s", name, err, warp.ErrUpdateInvalid)
+		}
+	}
+}
+
+func TestHostWindowSizeClamped(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "clamped", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 1 << 40, Cols: 1 << 40},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	c, err := s.Connect(ctx, "clamped", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	want := warp.Size{Rows: warp.MaxWindowRows, Cols: warp.MaxWindowCols}
+	if got := c.State().WindowSize; got != want {
+		t.Fatalf("window size: got %v, want %v", got, want)
+	}
+}
+
+func TestClientInvalidUsername(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "username", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	for _, username := range []string{"", "bob\x1b]0;pwned\x07"} {
+		if c, err := s.Connect(ctx, "username", username); err == nil {
+			c.Close()
+			t.Errorf("Connect(%q) succeeded, want an error", username)
+		}
+	}
+}
+
+func TestHostInvalidUpdateDisconnects(t *testing.T) {
+	ctx := context.Background()
+	s := warptest.NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "update", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	c, err := s.Connect(ctx, "update", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	// An update granting an unknown mode closes the warp.
+	err = host.Session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:       "update",
+		From:       host.Session.Session(),
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+		Modes:      map[string]warp.Mode{c.User: 1 << 42},
+	})
+	if err != nil {
+		t.Fatalf("SendHostUpdate: %v", err)
+	}
+	werr, ok := errors.Cause(c.Err()).(*cli.WarpdError)
+	if !ok || werr.Code != warp.ErrHostDisconnected {
+		t.Fatalf("client error: got %v, want %s", c.Err(), warp.ErrHostDisconnected)
+	}
+	if c.State().Users[c.User].Mode&warp.ModeShellWrite != 0 {
+		t.Fatalf("client granted write access by an invalid update")
+	}
+}
@@ -0,0 +1,142 @@
+package daemon_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/daemon/warptest"
+	"github.com/spolu/warp/lib/token"
+)
+
+// rawSession is a session to warpd set up channel by channel, so that its
+// hello can be forged.
+type rawSession struct {
+	stateR  warp.Decoder
+	updateW warp.Encoder
+	errorR  warp.Decoder
+}
+
+// dialHello opens a host session to s for the warp w whose hello announces the
+// protocol version version.
+func dialHello(
+	t *testing.T,
+	s *warptest.Server,
+	w string,
+	version int,
+) *rawSession {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	mux, err := yamux.Client(conn, config)
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	t.Cleanup(func() {
+		mux.Close()
+	})
+
+	// Channels are opened in the order expected by warpd.
+	open := func() net.Conn {
+		c, err := mux.Open()
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return c
+	}
+	rs := &rawSession{}
+	rs.stateR = warp.GobCodec.NewDecoder(open())
+	rs.updateW = warp.GobCodec.NewEncoder(open())
+	if err := rs.updateW.Encode(warp.SessionHello{
+		Warp: w,
+		From: warp.Session{
+			Token:  token.New("session"),
+			User:   token.New("guest"),
+			Secret: token.RandStr(),
+		},
+		Version:         warp.Version,
+		Type:            warp.SsTpHost,
+		Username:        "alice",
+		ProtocolVersion: version,
+	}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	rs.errorR = warp.GobCodec.NewDecoder(open())
+	open()
+	return rs
+}
+
+func TestProtocolVersionTooOld(t *testing.T) {
+	s := warptest.NewServer(t, daemon.Config{})
+
+	for _, version := range []int{warp.MinProtocolVersion - 1, -1} {
+		rs := dialHello(t, s, "old", version)
+
+		errC := make(chan warp.Error, 1)
+		go func() {
+			var e warp.Error
+			if err := rs.errorR.Decode(&e); err == nil {
+				errC <- e
+			}
+			close(errC)
+		}()
+		select {
+		case e, ok := <-errC:
+			if !ok {
+				t.Fatalf("version %d: session closed without error", version)
+			}
+			if e.Code != warp.ErrProtocolIncompatible {
+				t.Fatalf(
+					"version %d: got error %s, want %s",
+					version, e.Code, warp.ErrProtocolIncompatible,
+				)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("version %d: no error received", version)
+		}
+	}
+}
+
+func TestProtocolVersionNewer(t *testing.T) {
+	s := warptest.NewServer(t, daemon.Config{})
+
+	// Newer clients are accepted, the version being negotiated down.
+	rs := dialHello(t, s, "newer", warp.ProtocolVersion+1)
+	if err := rs.updateW.Encode(warp.HostUpdate{
+		Warp:       "newer",
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	stC := make(chan warp.State, 1)
+	go func() {
+		var st warp.State
+		if err := rs.stateR.Decode(&st); err == nil {
+			stC <- st
+		}
+		close(stC)
+	}()
+	select {
+	case st, ok := <-stC:
+		if !ok {
+			t.Fatalf("session closed without state")
+		}
+		if st.ProtocolVersion != warp.ProtocolVersion {
+			t.Fatalf(
+				"ProtocolVersion: got %d, want %d",
+				st.ProtocolVersion, warp.ProtocolVersion,
+			)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no state received")
+	}
+}
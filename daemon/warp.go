@@ -1,23 +1,172 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/spolu/warp"
+	"github.com/spolu/warp/lib/e2e"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/frame"
 	"github.com/spolu/warp/lib/logging"
 	"github.com/spolu/warp/lib/plex"
+	"github.com/spolu/warp/lib/ratelimit"
+	"github.com/spolu/warp/lib/token"
 )
 
+// clientGracePeriod is the time a client that lost all its sessions is kept in
+// the warp, allowing it to reconnect and resume with the same mode.
+const clientGracePeriod = 30 * time.Second
+
+// scrollbackNewlineScan is the number of bytes scanned for a newline when
+// computing the scrollback replayed to late joiners.
+const scrollbackNewlineScan = 1024
+
+// handoffGracePeriod is the time a warp is kept alive after its host
+// disconnected while a handoff was pending, allowing the nominated user to take
+// over.
+const handoffGracePeriod = 30 * time.Second
+
+// DefaultClientQueueSize is the default number of chunks of host data queued
+// for each client session.
+const DefaultClientQueueSize = 256
+
+// pendingCheckInterval is the interval at which the connections of sessions
+// waiting for approval are checked, as nothing is read from them.
+const pendingCheckInterval = 500 * time.Millisecond
+
+// maxHeldInput is the maximum number of bytes of client input held while a
+// warp is paused, input beyond it being dropped.
+const maxHeldInput = 64 * 1024
+
 // Warp represents a pty served from a remote host attached to a token.
 type Warp struct {
+	warpMetrics
+
 	token string
+	// createdAt is set by warpd when the warp is registered. Ages are
+	// computed from it with the monotonic clock of warpd so that they are
+	// comparable across warps.
+	createdAt    time.Time
+	lastActivity time.Time
 
 	windowSize warp.Size
 
+	// scrollback is the last output of the host. It is ciphertext if the warp
+	// is encrypted end to end. outputOffset is the number of bytes of output
+	// of the host sent to clients since the warp was opened (excluding output
+	// hidden while paused), the scrollback being its last bytes.
+	scrollback     []byte
+	scrollbackSize int
+	outputOffset   uint64
+
+	// maxClients is the maximum number of client sessions (0 for no limit).
+	maxClients int
+
+	// rateLimit and rateBurst configure the limiter applied to the data of
+	// each client session (no limit if rateLimit is 0).
+	rateLimit int
+	rateBurst int
+
+	// bufferSize is the size of the buffers used to read session data.
+	bufferSize int
+
+	// queueSize is the number of chunks of host data queued for each client
+	// session.
+	queueSize int
+
+	// stateWindow is the window within which state changes are coalesced into
+	// a single broadcast (0 to broadcast each change right away), stateFlush
+	// being the timer of the pending broadcast, if any.
+	stateWindow time.Duration
+	stateFlush  *time.Timer
+
+	// expiresAt is the time at which the warp expires if it has a TTL, expiry
+	// being the timer closing it then.
+	expiresAt time.Time
+	expiry    *time.Timer
+
 	host    *HostState
 	clients map[string]*UserState
 
+	// approval requires the host to approve users before they join. Users
+	// waiting for approval are kept in pending.
+	approval bool
+	pending  map[string]*pendingUser
+
+	// secretHash, if not empty, is the hash of the secret clients must
+	// present to join the warp. The secret itself is never stored.
+	secretHash string
+
+	// e2eCheck, if not empty, indicates that the data of the warp is
+	// encrypted end to end. warpd relays it as is to the clients which verify
+	// their passphrase against it.
+	e2eCheck []byte
+
+	// allowUsers, if not empty, are the usernames allowed to join the warp
+	// and denyUsers the usernames denied, taking precedence (see
+	// checkAccess).
+	allowUsers map[string]bool
+	denyUsers  map[string]bool
+
+	// banner is displayed by clients when they join. If bannerAck is set,
+	// they only receive the warp data once they acknowledged it.
+	banner    string
+	bannerAck bool
+
+	// writeLock lets only writeHolder, the token of the client holding the
+	// keyboard, write to the warp. writeRequests are the tokens of the clients
+	// that requested it, oldest first.
+	writeLock     bool
+	writeHolder   string
+	writeRequests []string
+
+	// accessRequests are the tokens of the clients without write access that
+	// asked the host for it, oldest first.
+	accessRequests []string
+
+	// paused indicates that the host paused the warp: the input of the
+	// clients is held in heldInput (up to maxHeldInput bytes) if pauseHold is
+	// set, dropped otherwise, and the output is not forwarded to them if
+	// pauseOutput is set.
+	paused        bool
+	pauseHold     bool
+	pauseOutput   bool
+	heldInput     [][]byte
+	heldInputSize int
+
+	// panes are the panes shared by the host in addition to its shell, by
+	// label (see handlePane).
+	panes map[string]*pane
+
+	// shellExited indicates that the host reported its shell exited with
+	// exitStatus, clients being notified of it once the host disconnects.
+	shellExited bool
+	exitStatus  int
+
+	// closed is set once the host left for good and the sessions of the warp
+	// were cancelled. Sessions still joining the warp (which they retrieved
+	// from warpd before it was cleaned up) are rejected from then on.
+	closed bool
+
+	// handoff is the token of the user nominated by the host to take over the
+	// warp, if any. handoffC is closed (and replaced) on each takeover.
+	handoff  string
+	handoffC chan struct{}
+
+	// hooks are called on client events.
+	hooks Hooks
+
+	// commands, if not nil, logs the command lines typed by the clients.
+	commands *commandLog
+
 	data chan []byte
 
 	mutex *sync.Mutex
@@ -28,8 +177,14 @@ type Warp struct {
 type UserState struct {
 	token    string
 	username string
+	secret   string
 	mode     warp.Mode
 	sessions map[string]*Session
+	// reaper, if not nil, is the timer removing the client once it is left
+	// without session, reaps identifying it among the removals scheduled
+	// (see scheduleReap).
+	reaper *time.Timer
+	reaps  uint64
 }
 
 // User returns a warp.User from the current UserState.
@@ -51,6 +206,67 @@ type HostState struct {
 	session *Session
 }
 
+// newHostState returns the state of the host session ss, the other sessions of
+// the host user being sessions. The host is set along with the creation of
+// the warp, before it is registered, so that it is never nil.
+func newHostState(
+	ss *Session,
+	sessions map[string]*Session,
+) *HostState {
+	return &HostState{
+		UserState: UserState{
+			token:    ss.session.User,
+			username: ss.username,
+			secret:   ss.session.Secret,
+			mode:     warp.DefaultHostMode,
+			sessions: sessions,
+		},
+		session: ss,
+	}
+}
+
+// isHostSession returns whether ss is the current host session of the warp,
+// presenting the host credentials. Control updates affecting permissions or
+// the lifecycle of sessions are only accepted from it: a previous host handed
+// off is not trusted anymore even if its session is still being torn down.
+// The warp lock must be held.
+func (w *Warp) isHostSession(
+	ss *Session,
+) bool {
+	return w.host.session == ss &&
+		ss.session.User == w.host.UserState.token &&
+		token.Equal(ss.session.Secret, w.host.UserState.secret)
+}
+
+// pendingUser is a user waiting for the host approval to join the warp along
+// with its waiting sessions.
+type pendingUser struct {
+	UserState
+	// decidedC is closed once the host approved or denied the user.
+	decidedC chan struct{}
+	approved bool
+}
+
+// decide records the host decision for p and releases its waiting sessions.
+// The warp lock must be held.
+func (w *Warp) decide(
+	p *pendingUser,
+	approved bool,
+) {
+	p.approved = approved
+	close(p.decidedC)
+	delete(w.pending, p.token)
+	if approved {
+		w.clients[p.token] = &UserState{
+			token:    p.token,
+			username: p.username,
+			secret:   p.secret,
+			mode:     warp.DefaultUserMode,
+			sessions: map[string]*Session{},
+		}
+	}
+}
+
 // User returns a warp.User from the current HostState.
 func (h *HostState) User(
 	ctx context.Context,
@@ -70,11 +286,44 @@ func (w *Warp) State(
 ) warp.State {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
+	return w.state(ctx)
+}
+
+// state computes a warp.State from the current warp. The warp lock must be
+// held.
+func (w *Warp) state(
+	ctx context.Context,
+) warp.State {
 	state := warp.State{
 		Warp:       w.token,
-		WindowSize: w.windowSize,
+		WindowSize: w.renderSize(),
 		Users:      map[string]warp.User{},
+		Version:    warp.Version,
+	}
+	if w.rateLimit > 0 {
+		state.RateLimit = w.rateLimit
+		state.RateBurst = w.rateBurst
+	}
+	state.ExpiresAt = w.expiresAt
+	state.CreatedAt = w.createdAt
+	if w.writeLock {
+		state.WriteLock = true
+		state.WriteHolder = w.writeHolder
+		state.WriteRequests = append([]string{}, w.writeRequests...)
 	}
+	state.E2ECheck = w.e2eCheck
+	state.Banner = w.banner
+	state.BannerAck = w.bannerAck
+	if w.commands != nil && len(w.e2eCheck) == 0 {
+		state.Banner = strings.TrimSpace(commandLogNotice + "\n\n" + w.banner)
+	}
+	state.AccessRequests = append([]string{}, w.accessRequests...)
+	if w.paused {
+		state.Paused = true
+		state.PausedHold = w.pauseHold
+		state.PausedOutput = w.pauseOutput
+	}
+	state.Panes = w.paneLabels()
 
 	state.Users[w.host.session.session.User] = w.host.User(ctx)
 
@@ -85,12 +334,116 @@ func (w *Warp) State(
 	return state
 }
 
+// renderSize returns the window size of the warp: the host window size shrunk
+// to fit the terminals of the clients that reported their size. The warp lock
+// must be held.
+func (w *Warp) renderSize() warp.Size {
+	size := w.windowSize
+	for _, ss := range w.clientSessions() {
+		if ss.windowSize.Rows > 0 && ss.windowSize.Rows < size.Rows {
+			size.Rows = ss.windowSize.Rows
+		}
+		if ss.windowSize.Cols > 0 && ss.windowSize.Cols < size.Cols {
+			size.Cols = ss.windowSize.Cols
+		}
+	}
+	return size
+}
+
+// Summary computes a warp.WarpSummary from the current warp. It acquires the
+// warp lock.
+func (w *Warp) Summary(
+	ctx context.Context,
+) warp.WarpSummary {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return warp.WarpSummary{
+		Warp:        w.token,
+		Host:        w.host.UserState.username,
+		WindowSize:  w.windowSize,
+		ClientCount: len(w.clients),
+		CreatedAt:   w.createdAt,
+		Age:         time.Since(w.createdAt),
+	}
+}
+
+// IdleSince returns the time of the last activity on the warp (host data, host
+// update or authorized client data). It acquires the warp lock.
+func (w *Warp) IdleSince(
+	ctx context.Context,
+) time.Time {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.lastActivity
+}
+
+// Close sends an error to the host and all clients and tears down the host
+// session, which closes the warp for all clients.
+func (w *Warp) Close(
+	ctx context.Context,
+	code errors.Code,
+	message string,
+) {
+	w.mutex.Lock()
+	host := w.host
+	sessions := append(w.clientSessions(), w.pendingSessions()...)
+	sessions = append(sessions, w.paneSessions()...)
+	w.mutex.Unlock()
+
+	// Clients (including pending ones) are notified first so that they
+	// receive the reason for the closure rather than the host disconnection.
+	for _, c := range sessions {
+		c.SendError(ctx, code, message)
+	}
+	host.session.SendError(ctx, code, message)
+	host.session.TearDown()
+}
+
+// ExitStatus returns the exit status of the host shell and whether the host
+// reported it exited. It acquires the warp lock.
+func (w *Warp) ExitStatus(
+	ctx context.Context,
+) (int, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.exitStatus, w.shellExited
+}
+
+// isFull returns whether the warp reached its maximum number of client
+// sessions. Sessions of the host user are not counted and a session replacing
+// an existing one with the same token is always accepted. The warp lock must
+// be held.
+func (w *Warp) isFull(
+	ss *Session,
+) bool {
+	if w.maxClients <= 0 {
+		return false
+	}
+	if c, ok := w.clients[ss.session.User]; ok {
+		if _, ok := c.sessions[ss.session.Token]; ok {
+			return false
+		}
+	}
+	count := 0
+	for _, c := range w.clients {
+		count += len(c.sessions)
+	}
+	return count >= w.maxClients
+}
+
 // CientSessions return all connected sessions that are not the host session.
 func (w *Warp) CientSessions(
 	ctx context.Context,
 ) []*Session {
-	sessions := []*Session{}
 	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.clientSessions()
+}
+
+// clientSessions return all connected sessions that are not the host session.
+// The warp lock must be held.
+func (w *Warp) clientSessions() []*Session {
+	sessions := []*Session{}
 	for _, user := range w.clients {
 		for _, c := range user.sessions {
 			sessions = append(sessions, c)
@@ -100,40 +453,622 @@ func (w *Warp) CientSessions(
 	for _, c := range w.host.UserState.sessions {
 		sessions = append(sessions, c)
 	}
-	w.mutex.Unlock()
 	return sessions
 }
 
-// updateClientSessions updates all shell clients with the current warp state.
-func (w *Warp) updateClientSessions(
+// pendingSessions return all the sessions waiting for the host approval. The
+// warp lock must be held.
+func (w *Warp) pendingSessions() []*Session {
+	sessions := []*Session{}
+	for _, p := range w.pending {
+		for _, c := range p.sessions {
+			sessions = append(sessions, c)
+		}
+	}
+	return sessions
+}
+
+// appendScrollback appends host data to a scrollback buffer (the scrollback
+// of the warp or of a pane), returning it. The buffer is allowed to grow up to
+// twice its size before being trimmed to amortize copies. The warp lock must
+// be held.
+func (w *Warp) appendScrollback(
+	scrollback []byte,
+	data []byte,
+) []byte {
+	if w.scrollbackSize == 0 {
+		return scrollback
+	}
+	scrollback = append(scrollback, data...)
+	if len(scrollback) > 2*w.scrollbackSize {
+		scrollback = append(
+			[]byte{}, scrollback[len(scrollback)-w.scrollbackSize:]...,
+		)
+	}
+	return scrollback
+}
+
+// scrollbackTail returns the last scrollbackSize bytes of a scrollback buffer,
+// starting after a newline if one is found close to the cut or at least on a
+// UTF-8 character boundary, to avoid garbling the first paint of late
+// joiners. The warp lock must be held.
+func (w *Warp) scrollbackTail(
+	scrollback []byte,
+) []byte {
+	tail := scrollback
+	if len(tail) <= w.scrollbackSize {
+		return tail
+	}
+	tail = tail[len(tail)-w.scrollbackSize:]
+	// Ciphertext is cut anywhere, clients skip to the next frame.
+	if len(w.e2eCheck) > 0 {
+		return tail
+	}
+
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 && i < scrollbackNewlineScan {
+		return tail[i+1:]
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return tail
+}
+
+// output is a chunk of data queued for a shell client session. seq is the
+// offset of its end in the output of the host shell, 0 if it is not part of it
+// (see package frame).
+type output struct {
+	data []byte
+	seq  uint64
+}
+
+// replayScrollback sends the scrollback of the pane viewed by ss (the host
+// shell's by default) to a session joining the warp, before it receives live
+// host data (which requires the warp lock). Sessions resuming the output of
+// the host shell only receive the output they missed, if still in the
+// scrollback. The warp lock must be held.
+func (w *Warp) replayScrollback(
+	ctx context.Context,
+	ss *Session,
+) {
+	// The queue is empty as the session did not receive any data yet.
+	if ss.pane == "" && ss.sequenced && ss.resumeFrom > 0 {
+		// The scrollback holds the last bytes of the output of the host
+		// shell.
+		start := w.outputOffset - uint64(len(w.scrollback))
+		if ss.resumeFrom >= start && ss.resumeFrom <= w.outputOffset {
+			missed := w.scrollback[ss.resumeFrom-start:]
+			if len(missed) > 0 {
+				ss.outputC <- output{data: missed, seq: w.outputOffset}
+			}
+			logging.Logf(ctx,
+				"Session resumed: session=%s from=%d missed=%d",
+				ss.ToString(), ss.resumeFrom, len(missed),
+			)
+			return
+		}
+		logging.Logf(ctx,
+			"Session resume out of scrollback: session=%s from=%d "+
+				"scrollback_start=%d offset=%d",
+			ss.ToString(), ss.resumeFrom, start, w.outputOffset,
+		)
+	}
+	if tail := w.scrollbackTail(w.paneScrollback(ss.pane)); len(tail) > 0 {
+		ss.outputC <- output{data: tail, seq: w.paneOffset(ss.pane)}
+	}
+}
+
+// paneOffset returns the offset of the end of the output of the pane labeled
+// label sent to clients: the offset of the host shell output if label is
+// empty or unknown (see paneScrollback), 0 otherwise as the output of panes is
+// not sequenced. The warp lock must be held.
+func (w *Warp) paneOffset(
+	label string,
+) uint64 {
+	if _, ok := w.panes[label]; ok {
+		return 0
+	}
+	return w.outputOffset
+}
+
+// queueOutput queues host data to be sent to the shell client session ss,
+// ending at offset seq in the output of the host shell (0 if not part of
+// it), returning false if its queue is full. The warp lock must be held so
+// that data is queued in order.
+func (w *Warp) queueOutput(
+	ss *Session,
+	data []byte,
+	seq uint64,
+) bool {
+	select {
+	case ss.outputC <- output{data: data, seq: seq}:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendOutput sends the data queued for the shell client session ss until it is
+// torn down, flushing the data still queued then (such as the last output of a
+// shell that exited) until its channels are closed.
+func (w *Warp) sendOutput(
+	ctx context.Context,
+	ss *Session,
+) {
+	send := func(o output) bool {
+		data := o.data
+		if ss.sequenced {
+			data = frame.Encode(o.seq, o.data)
+		}
+		if _, err := ss.dataW.Write(data); err != nil {
+			return false
+		}
+		atomic.AddUint64(&w.bytesToClients, uint64(len(o.data)))
+		return true
+	}
+	for {
+		select {
+		case o := <-ss.outputC:
+			if !send(o) {
+				// If we fail to write to a session, send an internal error
+				// there and tear down the session. This will not impact the
+				// warp.
+				ss.SendInternalError(ctx)
+				ss.TearDown()
+				return
+			}
+		case <-ss.ctx.Done():
+			for {
+				select {
+				case o := <-ss.outputC:
+					if !send(o) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// ackBanner records that the client of ss acknowledged the warp banner,
+// replaying the scrollback to it before it receives live host data. It
+// acquires the warp lock.
+func (w *Warp) ackBanner(
+	ctx context.Context,
+	ss *Session,
+) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !ss.bannerPending {
+		return
+	}
+	ss.bannerPending = false
+	w.replayScrollback(ctx, ss)
+
+	logging.Logf(ctx,
+		"Banner acknowledged: session=%s",
+		ss.ToString(),
+	)
+}
+
+// updateSessions sends the current warp state to the host and all shell
+// clients. The state is computed and queued under the warp lock so that
+// concurrent updates (host resizes, clients joining) can't be delivered out of
+// order, leaving sessions with a stale state. If the warp has a state window,
+// the broadcast is deferred until the end of the window so that the changes
+// made in the meantime are sent along. It acquires the warp lock.
+func (w *Warp) updateSessions(
+	ctx context.Context,
+) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stateWindow <= 0 {
+		w.sendState(ctx, w.state(ctx))
+		return
+	}
+	if w.stateFlush == nil {
+		w.stateFlush = time.AfterFunc(w.stateWindow, func() {
+			w.flushState(ctx)
+		})
+	}
+}
+
+// flushState sends the current warp state right away if a broadcast is
+// pending. It acquires the warp lock.
+func (w *Warp) flushState(
+	ctx context.Context,
+) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stateFlush != nil {
+		w.sendState(ctx, w.state(ctx))
+	}
+}
+
+// sendState queues st to be sent to the host and all shell clients,
+// superseding the pending broadcast if any. The warp lock must be held.
+func (w *Warp) sendState(
 	ctx context.Context,
+	st warp.State,
 ) {
-	st := w.State(ctx)
-	sessions := w.CientSessions(ctx)
-	for _, ss := range sessions {
+	if w.stateFlush != nil {
+		w.stateFlush.Stop()
+		w.stateFlush = nil
+	}
+
+	// Pending users are only disclosed to the host.
+	hostSt := st
+	if len(w.pending) > 0 {
+		hostSt.Pending = map[string]warp.User{}
+		for token, p := range w.pending {
+			hostSt.Pending[token] = p.User(ctx)
+		}
+	}
+	// States are queued so that a stalled session does not block the warp
+	// while its lock is held. Stalled clients are disconnected as too slow,
+	// the host and panes being torn down as when their data can't be
+	// written.
+	stalled := []*Session{}
+	logging.Logf(ctx,
+		"Sending (host) state: session=%s cols=%d rows=%d",
+		w.host.session.ToString(), st.WindowSize.Cols, st.WindowSize.Rows,
+	)
+	if !w.host.session.QueueState(hostSt) {
+		stalled = append(stalled, w.host.session)
+	}
+
+	slow := []*Session{}
+	for _, ss := range w.clientSessions() {
 		logging.Logf(ctx,
 			"Sending (client) state: session=%s cols=%d rows=%d",
-			ss.ToString(), st.WindowSize.Rows, st.WindowSize.Cols,
+			ss.ToString(), st.WindowSize.Cols, st.WindowSize.Rows,
 		)
+		if !ss.QueueState(st) {
+			slow = append(slow, ss)
+		}
+	}
+
+	// Panes size their terminal after the warp window size.
+	for _, p := range w.panes {
+		if !p.session.QueueState(st) {
+			stalled = append(stalled, p.session)
+		}
+	}
 
-		ss.stateW.Encode(st)
+	if len(slow) > 0 || len(stalled) > 0 {
+		go func() {
+			w.disconnectSlow(ctx, slow)
+			for _, ss := range stalled {
+				logging.Logf(ctx,
+					"Session stalled: session=%s state_queue_size=%d",
+					ss.ToString(), stateQueueSize,
+				)
+				ss.SendInternalError(ctx)
+				ss.TearDown()
+			}
+		}()
 	}
 }
 
-// updateHost updates the host with the current warp state.
-func (w *Warp) updateHost(
+// relayChat sends a chat message from the user of ss to the host and all
+// shell clients along with the current state. Control characters are
+// stripped so that participants can't inject terminal escape sequences. It
+// acquires the warp lock.
+func (w *Warp) relayChat(
 	ctx context.Context,
+	ss *Session,
+	text string,
 ) {
-	if !w.host.session.tornDown {
-		st := w.State(ctx)
+	text = sanitizeChat(text)
+	if text == "" {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 
+	msg := warp.ChatMessage{
+		User: ss.session.User,
+		Text: text,
+		Time: time.Now(),
+	}
+	if ss.session.User == w.host.UserState.token {
+		msg.Username = w.host.UserState.username
+	} else if c, ok := w.clients[ss.session.User]; ok {
+		msg.Username = c.username
+	} else {
+		// The client was disconnected in the meantime.
+		return
+	}
+
+	logging.Logf(ctx,
+		"Relaying chat message: session=%s size=%d",
+		ss.ToString(), len(text),
+	)
+
+	st := w.state(ctx)
+	st.Chat = &msg
+	w.sendState(ctx, st)
+}
+
+// canWrite returns whether user is a client authorized to write, which may
+// therefore hold the keyboard. The warp lock must be held.
+func (w *Warp) canWrite(
+	user string,
+) bool {
+	c, ok := w.clients[user]
+	return ok && c.mode&warp.ModeShellWrite != 0
+}
+
+// grantWrite hands the keyboard to user, dropping its request if any. The warp
+// lock must be held.
+func (w *Warp) grantWrite(
+	user string,
+) {
+	w.writeHolder = user
+	w.withdrawWrite(user)
+}
+
+// writeRequest returns the index of the keyboard request of user, -1 if it
+// has none. The warp lock must be held.
+func (w *Warp) writeRequest(
+	user string,
+) int {
+	for i, u := range w.writeRequests {
+		if u == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// withdrawWrite drops the keyboard request of user if any, returning whether
+// it had one. The warp lock must be held.
+func (w *Warp) withdrawWrite(
+	user string,
+) bool {
+	i := w.writeRequest(user)
+	if i < 0 {
+		return false
+	}
+	w.writeRequests = append(w.writeRequests[:i:i], w.writeRequests[i+1:]...)
+	return true
+}
+
+// checkWriteLock frees the keyboard and drops the requests of clients that
+// left or are not authorized to write anymore, returning whether anything
+// changed. The warp lock must be held.
+func (w *Warp) checkWriteLock() bool {
+	changed := false
+	if w.writeHolder != "" && !w.canWrite(w.writeHolder) {
+		w.writeHolder = ""
+		changed = true
+	}
+	requests := []string{}
+	for _, user := range w.writeRequests {
+		if w.canWrite(user) {
+			requests = append(requests, user)
+		} else {
+			changed = true
+		}
+	}
+	w.writeRequests = requests
+	return changed
+}
+
+// updateWriteLock applies a keyboard request, release or grant received from
+// the client session ss and sends the resulting state. It acquires the warp
+// lock.
+func (w *Warp) updateWriteLock(
+	ctx context.Context,
+	ss *Session,
+	up warp.ClientUpdate,
+) {
+	w.mutex.Lock()
+	user := ss.session.User
+	changed := false
+	switch {
+	case !w.writeLock || !w.canWrite(user):
+		logging.Logf(ctx,
+			"Ignoring keyboard update: session=%s write_lock=%t",
+			ss.ToString(), w.writeLock,
+		)
+	case up.WriteRequest:
+		if w.writeHolder == "" {
+			w.grantWrite(user)
+			changed = true
+		} else if w.writeHolder != user && w.writeRequest(user) < 0 {
+			w.writeRequests = append(w.writeRequests, user)
+			changed = true
+		}
+	case up.WriteRelease:
+		if w.writeHolder == user {
+			w.writeHolder = ""
+			if len(w.writeRequests) > 0 {
+				w.grantWrite(w.writeRequests[0])
+			}
+			changed = true
+		} else {
+			changed = w.withdrawWrite(user)
+		}
+	case up.WriteGrant != "":
+		if w.writeHolder == user && w.canWrite(up.WriteGrant) {
+			w.grantWrite(up.WriteGrant)
+			changed = true
+		}
+	}
+	holder := w.writeHolder
+	w.mutex.Unlock()
+
+	if changed {
+		logging.Logf(ctx,
+			"Keyboard updated: session=%s holder=%s",
+			ss.ToString(), holder,
+		)
+		w.updateSessions(ctx)
+	}
+}
+
+// accessRequest returns the index of the write access request of user, -1 if
+// it has none. The warp lock must be held.
+func (w *Warp) accessRequest(
+	user string,
+) int {
+	for i, u := range w.accessRequests {
+		if u == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkAccessRequests drops the write access requests of clients that left,
+// lost all their sessions or were granted write access, returning whether
+// anything changed. The warp lock must be held.
+func (w *Warp) checkAccessRequests() bool {
+	changed := false
+	requests := []string{}
+	for _, user := range w.accessRequests {
+		c, ok := w.clients[user]
+		if ok && len(c.sessions) > 0 && c.mode&warp.ModeShellWrite == 0 {
+			requests = append(requests, user)
+		} else {
+			changed = true
+		}
+	}
+	w.accessRequests = requests
+	return changed
+}
+
+// requestAccess records the write access request received from the client
+// session ss and sends the resulting state to let the host grant or deny it.
+// It acquires the warp lock.
+func (w *Warp) requestAccess(
+	ctx context.Context,
+	ss *Session,
+) {
+	w.mutex.Lock()
+	user := ss.session.User
+	c, ok := w.clients[user]
+	requested := ok && c.mode&warp.ModeShellWrite == 0 &&
+		w.accessRequest(user) < 0
+	if requested {
+		w.accessRequests = append(w.accessRequests, user)
+	}
+	w.mutex.Unlock()
+
+	if !requested {
 		logging.Logf(ctx,
-			"Sending (host) state: session=%s cols=%d rows=%d",
-			w.host.session.ToString(), st.WindowSize.Rows, st.WindowSize.Cols,
+			"Ignoring write access request: session=%s",
+			ss.ToString(),
+		)
+		return
+	}
+	logging.Logf(ctx,
+		"Write access requested: session=%s",
+		ss.ToString(),
+	)
+	w.updateSessions(ctx)
+}
+
+// validateHostUpdate validates an host update received over the wire, clamping
+// its window size to sane bounds.
+func validateHostUpdate(
+	up *warp.HostUpdate,
+) error {
+	size, err := up.WindowSize.Sanitize()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	up.WindowSize = size
+	for user, mode := range up.Modes {
+		if !mode.Valid() {
+			return errors.Trace(
+				errors.Newf("Invalid mode for user %s: %d", user, mode),
+			)
+		}
+	}
+	if up.MaxClients < 0 {
+		return errors.Trace(
+			errors.Newf("Invalid max clients: %d", up.MaxClients),
+		)
+	}
+	if up.TTL < 0 {
+		return errors.Trace(
+			errors.Newf("Invalid TTL: %s", up.TTL),
+		)
+	}
+	if up.WarpSecretHash != "" {
+		if err := token.CheckSecretHash(up.WarpSecretHash); err != nil {
+			return errors.Trace(
+				errors.Newf("Invalid warp secret hash: %v", err),
+			)
+		}
+	}
+	if len(up.E2ECheck) != 0 && len(up.E2ECheck) != e2e.CheckSize {
+		return errors.Trace(
+			errors.Newf("Invalid end-to-end encryption check"),
+		)
+	}
+	for _, list := range [][]string{up.AllowUsers, up.DenyUsers} {
+		if len(list) > warp.MaxAccessListLength {
+			return errors.Trace(
+				errors.Newf("Invalid access list length: %d", len(list)),
+			)
+		}
+		for _, username := range list {
+			if err := warp.ValidateUsername(username); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if len(up.Banner) > warp.MaxBannerLength {
+		return errors.Trace(
+			errors.Newf("Invalid banner length: %d", len(up.Banner)),
 		)
+	}
+	up.Banner = sanitizeBanner(up.Banner)
+	return nil
+}
 
-		w.host.session.stateW.Encode(st)
+// sanitizeBanner strips control characters other than newlines and tabs from
+// text so that the host can't inject terminal escape sequences.
+func sanitizeBanner(
+	text string,
+) string {
+	clean := []rune{}
+	for _, r := range text {
+		if (unicode.IsControl(r) && r != '\n' && r != '\t') ||
+			r == utf8.RuneError {
+			continue
+		}
+		clean = append(clean, r)
 	}
+	return strings.TrimRight(string(clean), " \t\n")
+}
+
+// sanitizeChat strips control characters from text and truncates it to
+// warp.MaxChatLength bytes.
+func sanitizeChat(
+	text string,
+) string {
+	clean := []rune{}
+	size := 0
+	for _, r := range text {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			continue
+		}
+		if size+utf8.RuneLen(r) > warp.MaxChatLength {
+			break
+		}
+		size += utf8.RuneLen(r)
+		clean = append(clean, r)
+	}
+	return strings.TrimSpace(string(clean))
 }
 
 // rcvShellClientData handles incoming client data and commits it to the data
@@ -143,19 +1078,65 @@ func (w *Warp) rcvShellClientData(
 	ss *Session,
 	data []byte,
 ) {
+	if ss.readOnly {
+		return
+	}
+
 	var mode warp.Mode
 	w.mutex.Lock()
+	// Panes are read-only.
+	if ss.bannerPending || ss.pane != "" {
+		w.mutex.Unlock()
+		return
+	}
 	if ss.session.User == w.host.UserState.token {
 		mode = w.host.UserState.mode
 	} else {
 		if _, ok := w.clients[ss.session.User]; ok {
 			mode = w.clients[ss.session.User].mode
 		}
+		// Only the holder of the keyboard writes if the warp is locked.
+		if w.writeLock && ss.session.User != w.writeHolder {
+			mode &^= warp.ModeShellWrite
+		}
+	}
+	if mode&warp.ModeShellWrite != 0 {
+		w.lastActivity = time.Now()
+		// The input of the clients is held or dropped while the warp is
+		// paused, the host's own sessions being unaffected.
+		if w.paused && ss.session.User != w.host.UserState.token {
+			held := false
+			if w.pauseHold && w.heldInputSize+len(data) <= maxHeldInput {
+				w.heldInput = append(w.heldInput, data)
+				w.heldInputSize += len(data)
+				held = true
+			}
+			w.mutex.Unlock()
+			// Held input is logged as it reaches the host once resumed.
+			if held {
+				w.logCommands(ctx, ss, data)
+			}
+			return
+		}
 	}
 	w.mutex.Unlock()
 
 	if mode&warp.ModeShellWrite != 0 {
-		w.data <- data
+		w.logCommands(ctx, ss, data)
+		// Throttling blocks the client data loop, which in turn applies
+		// backpressure to the client.
+		if ss.limiter != nil {
+			if err := ss.limiter.Wait(ss.ctx, len(data)); err != nil {
+				return
+			}
+		}
+		// The host may be gone, in which case the client gets canceled.
+		select {
+		case w.data <- data:
+		case <-ss.ctx.Done():
+			return
+		}
+		atomic.AddUint64(&w.bytesToHost, uint64(len(data)))
 	}
 }
 
@@ -164,53 +1145,216 @@ func (w *Warp) rcvHostData(
 	ss *Session,
 	data []byte,
 ) {
-	sessions := w.CientSessions(ctx)
-	for _, s := range sessions {
-		// logging.Logf(ctx,
-		// 	"Sending data to session: session=%s size=%d",
-		// 	s.ToString(), len(data),
-		// )
-		_, err := s.dataC.Write(data)
-		if err != nil {
-			// If we fail to write to a session, send an internal error there
-			// and tear down the session. This will not impact the warp.
-			s.SendInternalError(ctx)
-			s.TearDown()
+	// Appending to the scrollback and queueing the data is atomic so that
+	// late joiners receive each byte exactly once. Queueing never blocks so
+	// that a slow client can't stall the warp.
+	w.mutex.Lock()
+	w.lastActivity = time.Now()
+	// The output of a warp paused with its output hidden is only sent to the
+	// host's own sessions and kept out of the scrollback.
+	hidden := w.paused && w.pauseOutput
+	// Hidden output is not part of the output of the host shell resumed by
+	// clients as it is not kept in the scrollback.
+	seq := uint64(0)
+	if !hidden {
+		w.scrollback = w.appendScrollback(w.scrollback, data)
+		w.outputOffset += uint64(len(data))
+		seq = w.outputOffset
+	}
+	slow := []*Session{}
+	for _, s := range w.clientSessions() {
+		// Sessions torn down are skipped until they are cleaned up.
+		if s.bannerPending || s.ctx.Err() != nil {
+			continue
+		}
+		if hidden && s.session.User != w.host.UserState.token {
+			continue
+		}
+		// Sessions viewing a pane receive its output instead.
+		if s.pane != "" {
+			continue
 		}
+		if !w.queueOutput(s, data, seq) {
+			slow = append(slow, s)
+		}
+	}
+	w.mutex.Unlock()
+
+	w.disconnectSlow(ctx, slow)
+}
+
+// disconnectSlow disconnects the client sessions whose queue is full, they may
+// reconnect to catch up from the scrollback.
+func (w *Warp) disconnectSlow(
+	ctx context.Context,
+	slow []*Session,
+) {
+	for _, s := range slow {
+		logging.Logf(ctx,
+			"Client too slow: session=%s queue_size=%d",
+			s.ToString(), w.queueSize,
+		)
+		s.SendError(ctx,
+			warp.ErrClientTooSlow,
+			"You were disconnected as you could not keep up with the output "+
+				"of the warp.",
+		)
+		s.TearDown()
+	}
+}
+
+// takeOver makes ss, opened by the user nominated with a host handoff, the new
+// host of the warp. The nominated user's sessions become the host user's
+// sessions and the previous host is demoted to a client with the default user
+// mode, as are all other clients since the new host is not aware of the modes
+// granted by its predecessor. The previous host session is torn down.
+func (w *Warp) takeOver(
+	ctx context.Context,
+	ss *Session,
+	initial warp.HostUpdate,
+) error {
+	w.mutex.Lock()
+	c, ok := w.clients[ss.session.User]
+	if w.handoff == "" || w.handoff != ss.session.User || !ok {
+		w.mutex.Unlock()
+		return errors.Trace(
+			errors.Newf("User not nominated: %s", ss.session.User),
+		)
+	}
+	if !token.Equal(ss.session.Secret, c.secret) {
+		w.mutex.Unlock()
+		return errors.Trace(
+			errors.Newf("User secret mismatch: %s", ss.session.User),
+		)
+	}
+
+	previous := w.host
+	w.stopReap(c)
+	delete(w.clients, c.token)
+	w.clients[previous.UserState.token] = &UserState{
+		token:    previous.UserState.token,
+		username: previous.UserState.username,
+		secret:   previous.UserState.secret,
+		mode:     warp.DefaultUserMode,
+		sessions: previous.UserState.sessions,
+	}
+	// The previous host user is reaped if it has no client session left.
+	w.scheduleReap(ctx, previous.UserState.token, clientGracePeriod)
+	for _, u := range w.clients {
+		u.mode = warp.DefaultUserMode
+	}
+	w.checkWriteLock()
+	w.checkAccessRequests()
+	w.host = newHostState(ss, c.sessions)
+	if initial.WindowSize != (warp.Size{}) {
+		w.windowSize = initial.WindowSize
+	}
+	w.banner = initial.Banner
+	w.bannerAck = initial.BannerAck
+	w.allowUsers = usernameSet(initial.AllowUsers)
+	w.denyUsers = usernameSet(initial.DenyUsers)
+	// The new host encrypts the data with its own passphrase, if any, so the
+	// scrollback may not be readable by the clients anymore.
+	if len(w.e2eCheck) > 0 || len(initial.E2ECheck) > 0 {
+		w.scrollback = nil
+	}
+	w.e2eCheck = initial.E2ECheck
+	w.lastActivity = time.Now()
+	w.handoff = ""
+	close(w.handoffC)
+	w.handoffC = make(chan struct{})
+	// The panes were shared by the previous host, they are cleaned up once
+	// their sessions are torn down.
+	panes := w.paneSessions()
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Warp handed off: session=%s previous=%s",
+		ss.ToString(), previous.session.ToString(),
+	)
+
+	// The previous host session may already be gone if it disconnected while
+	// the handoff was pending.
+	previous.session.SendError(ctx,
+		warp.ErrHostHandedOff,
+		fmt.Sprintf(
+			"You handed off the warp to %s.",
+			ss.username,
+		),
+	)
+	previous.session.TearDown()
+	for _, p := range panes {
+		p.SendError(ctx,
+			warp.ErrHostHandedOff,
+			fmt.Sprintf(
+				"You handed off the warp to %s.",
+				ss.username,
+			),
+		)
+		p.TearDown()
+	}
+
+	return nil
+}
+
+// awaitHandoff is called when the host session ss is done and returns whether
+// the warp was (or got) handed off to another host. If a handoff is pending,
+// it waits up to handoffGracePeriod for the nominated user to take over.
+func (w *Warp) awaitHandoff(
+	ctx context.Context,
+	ss *Session,
+) bool {
+	w.mutex.Lock()
+	if w.host.session != ss {
+		w.mutex.Unlock()
+		return true
+	}
+	if w.handoff == "" {
+		w.mutex.Unlock()
+		return false
+	}
+	handoffC := w.handoffC
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Host disconnected with a pending handoff: session=%s",
+		ss.ToString(),
+	)
+
+	select {
+	case <-handoffC:
+	case <-time.After(handoffGracePeriod):
+	}
+
+	// The takeover and the expiration of the handoff are decided under the
+	// warp lock so that the nominated user can't take over a warp being
+	// closed.
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.host.session != ss {
+		return true
 	}
+	w.handoff = ""
+	return false
 }
 
-// handleHost is responsible for handling the host session. It is in charge of:
+// runHost is responsible for handling the host session. It is in charge of:
 // - receiving and validating host update.
 // - multiplexing host data to shell clients.
 // - sending received (and authorized) data to the host session.
-func (w *Warp) handleHost(
+// It returns true if the warp was handed off to another host while running.
+func (w *Warp) runHost(
 	ctx context.Context,
 	ss *Session,
-) {
-	// Add the host.
-	w.mutex.Lock()
-	w.host = &HostState{
-		UserState: UserState{
-			token:    ss.session.User,
-			username: ss.username,
-			mode:     warp.DefaultHostMode,
-			// Initialize host sessions as empty as the current client is
-			// the host session and does not act as "client". Subsequent
-			// client session coming from the host would be added to this
-			// list.
-			sessions: map[string]*Session{},
-		},
-		session: ss,
-	}
-	w.mutex.Unlock()
-
+) bool {
 	// run state updates
+	updatesDone := ss.receivingUpdates()
 	go func() {
+		defer updatesDone()
 	STATELOOP:
 		for {
 			var st warp.HostUpdate
-			if err := w.host.session.updateR.Decode(&st); err != nil {
+			if err := ss.updateR.Decode(&st); err != nil {
 				logging.Logf(ctx,
 					"Error receiving host update: session=%s error=%v",
 					ss.ToString(), err,
@@ -218,12 +1362,20 @@ func (w *Warp) handleHost(
 				break STATELOOP
 			}
 
+			if err := validateHostUpdate(&st); err != nil {
+				logging.Logf(ctx,
+					"Invalid host update: session=%s error=%v",
+					ss.ToString(), err,
+				)
+				break STATELOOP
+			}
+
 			// Check that the warp token is the same.
 			if st.Warp != w.token {
 				logging.Logf(ctx,
 					"Host update warp mismatch: session=%s "+
-						"expected=% received=%s",
-					ss.ToString, w.token, st.Warp,
+						"expected=%s received=%s",
+					ss.ToString(), w.token, st.Warp,
 				)
 				break STATELOOP
 			}
@@ -232,35 +1384,201 @@ func (w *Warp) handleHost(
 			// protect against spoofing attempts.
 			if st.From.Token != ss.session.Token ||
 				st.From.User != ss.session.User ||
-				st.From.Secret != ss.session.Secret {
+				!token.Equal(st.From.Secret, ss.session.Secret) {
 				logging.Logf(ctx,
 					"Host credentials mismatch: session=%s",
-					ss.ToString,
+					ss.ToString(),
 				)
 				break STATELOOP
 			}
 
+			// The host is about to close its session, which must not be
+			// taken for a lost connection.
+			if st.Closing {
+				ss.markClosing()
+				logging.Logf(ctx,
+					"Host closing: session=%s",
+					ss.ToString(),
+				)
+				continue
+			}
+
 			w.mutex.Lock()
-			w.windowSize = st.WindowSize
+			if !w.isHostSession(ss) {
+				w.mutex.Unlock()
+				logging.Warnf(ctx,
+					"Host update rejected, not from the host session: "+
+						"session=%s",
+					ss.ToString(),
+				)
+				break STATELOOP
+			}
+			w.lastActivity = time.Now()
+			// Hosts send an update on each SIGWINCH, which may not change the
+			// warp window size. Don't broadcast a state if nothing changed.
+			before := w.renderSize()
+			if st.WindowSize != (warp.Size{}) {
+				w.windowSize = st.WindowSize
+			}
+			changed := w.renderSize() != before ||
+				len(st.Modes) > 0 || len(st.Disconnect) > 0 ||
+				len(st.Approve) > 0 || len(st.Deny) > 0 ||
+				len(st.DenyAccess) > 0
 			for user, mode := range st.Modes {
 				if _, ok := w.clients[user]; ok {
+					// Data received from the client is checked against its
+					// mode as it arrives so revocations apply immediately.
 					w.clients[user].mode = mode
 				} else {
+					// The user may have disconnected since the host computed
+					// its update, skip it.
 					logging.Logf(ctx,
 						"Unknown user from host update: session=%s user=%s",
 						ss.ToString(), user,
 					)
-					break STATELOOP
 				}
 			}
+			disconnected := []*Session{}
+			for _, user := range st.Disconnect {
+				if c, ok := w.clients[user]; ok {
+					for _, s := range c.sessions {
+						disconnected = append(disconnected, s)
+					}
+					w.stopReap(c)
+					delete(w.clients, user)
+				}
+			}
+			for _, user := range st.Approve {
+				if p, ok := w.pending[user]; ok {
+					w.decide(p, true)
+					// Approved users are reaped if their sessions went
+					// away in the meantime.
+					w.scheduleReap(ctx, user, clientGracePeriod)
+				}
+			}
+			for _, user := range st.Deny {
+				if p, ok := w.pending[user]; ok {
+					w.decide(p, false)
+				}
+			}
+			for _, user := range st.DenyAccess {
+				if i := w.accessRequest(user); i >= 0 {
+					w.accessRequests = append(
+						w.accessRequests[:i:i], w.accessRequests[i+1:]...,
+					)
+				}
+			}
+			// Granted or disconnected users' requests are settled.
+			w.checkAccessRequests()
+			if w.writeLock {
+				if st.WriteRelease && w.writeHolder != "" {
+					w.writeHolder = ""
+					changed = true
+				}
+				if w.canWrite(st.WriteGrant) {
+					w.grantWrite(st.WriteGrant)
+					changed = true
+				} else if st.WriteGrant != "" {
+					logging.Logf(ctx,
+						"Invalid keyboard grant from host update: "+
+							"session=%s user=%s",
+						ss.ToString(), st.WriteGrant,
+					)
+				}
+				// Clients may have been disconnected or revoked.
+				if w.checkWriteLock() {
+					changed = true
+				}
+			}
+			held := [][]byte{}
+			if st.Resume && w.paused {
+				w.paused = false
+				held, w.heldInput, w.heldInputSize = w.heldInput, nil, 0
+				changed = true
+				logging.Logf(ctx,
+					"Warp resumed: session=%s held_input=%d",
+					ss.ToString(), len(held),
+				)
+			} else if st.Pause {
+				if !w.paused || w.pauseHold != st.PauseHold ||
+					w.pauseOutput != st.PauseOutput {
+					changed = true
+				}
+				w.paused = true
+				w.pauseHold = st.PauseHold
+				w.pauseOutput = st.PauseOutput
+				if !w.pauseHold {
+					w.heldInput, w.heldInputSize = nil, 0
+				}
+				logging.Logf(ctx,
+					"Warp paused: session=%s hold=%t output=%t",
+					ss.ToString(), st.PauseHold, st.PauseOutput,
+				)
+			}
+			if st.ShellExited {
+				ss.markClosing()
+				w.shellExited = true
+				w.exitStatus = st.ExitStatus
+				logging.Logf(ctx,
+					"Host shell exited: session=%s status=%d",
+					ss.ToString(), st.ExitStatus,
+				)
+			}
+			nominee := ""
+			if c, ok := w.clients[st.Handoff]; ok {
+				w.handoff = st.Handoff
+				nominee = c.username
+			} else if st.Handoff != "" {
+				logging.Logf(ctx,
+					"Unknown handoff user from host update: session=%s user=%s",
+					ss.ToString(), st.Handoff,
+				)
+			}
 			w.mutex.Unlock()
 
+			// The input held while the warp was paused is written in order.
+			for _, data := range held {
+				select {
+				case w.data <- data:
+					atomic.AddUint64(&w.bytesToHost, uint64(len(data)))
+				case <-ss.ctx.Done():
+				}
+			}
+
+			for _, s := range disconnected {
+				logging.Logf(ctx,
+					"Disconnecting client: session=%s client=%s",
+					ss.ToString(), s.ToString(),
+				)
+				s.SendError(ctx,
+					warp.ErrDisconnectedByHost,
+					"You were disconnected by the warp host.",
+				)
+				s.TearDown()
+			}
+
 			logging.Logf(ctx,
 				"Received host update: session=%s cols=%d rows=%d",
-				ss.ToString(), st.WindowSize.Rows, st.WindowSize.Cols,
+				ss.ToString(), st.WindowSize.Cols, st.WindowSize.Rows,
 			)
 
-			w.updateClientSessions(ctx)
+			if changed {
+				w.updateSessions(ctx)
+			}
+			if st.Chat != "" {
+				w.relayChat(ctx, ss, st.Chat)
+			}
+			if nominee != "" {
+				logging.Logf(ctx,
+					"Handoff pending: session=%s user=%s",
+					ss.ToString(), st.Handoff,
+				)
+				w.relayChat(ctx, ss, fmt.Sprintf(
+					"Handing off this warp to %s. Run `warp open %s` to "+
+						"take over as host.",
+					nominee, w.token,
+				))
+			}
 		}
 		ss.SendInternalError(ctx)
 		ss.TearDown()
@@ -268,41 +1586,43 @@ func (w *Warp) handleHost(
 
 	// Receive host data.
 	go func() {
-		plex.Run(ctx, func(data []byte) {
+		plex.RunBuffered(ctx, func(data []byte) {
 			// logging.Logf(ctx,
 			// 	"Received data from host: session=%s size=%d",
 			// 	ss.ToString(), len(data),
 			// )
 			w.rcvHostData(ctx, ss, data)
-		}, ss.dataC)
+		}, ss.dataR, w.bufferSize)
 		ss.SendInternalError(ctx)
 		ss.TearDown()
 	}()
 
-	// Send data to host.
+	// Send data to host. The data channel outlives the host session if the
+	// warp is handed off.
 	go func() {
 	DATALOOP:
 		for {
-			buf, ok := <-w.data
+			var buf []byte
+			select {
+			case buf = <-w.data:
+			case <-ss.ctx.Done():
+				break DATALOOP
+			}
 			// logging.Logf(ctx,
 			// 	"Sending data to host: session=%s size=%d",
 			// 	ss.ToString(), len(buf),
 			// )
-			_, err := ss.dataC.Write(buf)
+			_, err := ss.dataW.Write(buf)
 			if err != nil {
 				break DATALOOP
 			}
-			if !ok {
-				break DATALOOP
-			}
 		}
 		ss.SendInternalError(ctx)
 		ss.TearDown()
 	}()
 
 	// Update host and clients (should be no client).
-	w.updateHost(ctx)
-	w.updateClientSessions(ctx)
+	w.updateSessions(ctx)
 
 	logging.Logf(ctx,
 		"Host session running: session=%s",
@@ -311,124 +1631,606 @@ func (w *Warp) handleHost(
 
 	<-ss.ctx.Done()
 
-	close(w.data)
+	if w.awaitHandoff(ctx, ss) {
+		return true
+	}
+
+	// w.data is not closed as client sessions may still be sending to it
+	// until they get canceled below.
 
-	// Cancel all clients.
+	// The last state changes are not lost if a broadcast is pending.
+	w.flushState(ctx)
+
+	// Cancel all clients, including pending ones, and panes.
 	logging.Logf(ctx,
 		"Cancelling all clients: session=%s",
 		ss.ToString(),
 	)
-	sessions := w.CientSessions(ctx)
+	w.mutex.Lock()
+	w.closed = true
+	for _, c := range w.clients {
+		w.stopReap(c)
+	}
+	sessions := append(w.clientSessions(), w.pendingSessions()...)
+	sessions = append(sessions, w.paneSessions()...)
+	shellExited, exitStatus := w.shellExited, w.exitStatus
+	w.mutex.Unlock()
+	// Clients are told whether the host left on purpose or lost its
+	// connection.
+	message := "The warp host disconnected."
+	if !shellExited && len(sessions) > 0 &&
+		ss.Departure() == warp.DisconnectUnknown {
+		message = "The warp host connection was lost."
+	}
 	for _, s := range sessions {
-		s.SendError(ctx,
-			"host_disconnected",
-			"The warp host disconnected.",
-		)
+		// The session ended cleanly if the host shell exited.
+		if shellExited {
+			s.SendShellExit(ctx, exitStatus)
+		} else {
+			s.SendError(ctx,
+				warp.ErrHostDisconnected,
+				message,
+			)
+		}
 		s.TearDown()
 	}
+
+	return false
+}
+
+// rejectClosed rejects the session ss joining the warp after it was closed, as
+// the sessions cancelled when the host left were.
+func (w *Warp) rejectClosed(
+	ctx context.Context,
+	ss *Session,
+) {
+	logging.Logf(ctx,
+		"Client error: warp closed: session=%s",
+		ss.ToString(),
+	)
+	ss.SendError(ctx,
+		warp.ErrHostDisconnected,
+		"The warp host disconnected.",
+	)
 }
 
 // handleShellClient is responsible for handling the SsTpShellClient sessions.
 // It is in charge of:
 // - receiving shell client data and passing it to the host if authorized.
+// It returns whether the session was dropped (its connection lost) once it had
+// joined the warp.
 func (w *Warp) handleShellClient(
 	ctx context.Context,
 	ss *Session,
-) {
+) bool {
+	if w.rateLimit > 0 {
+		ss.limiter = ratelimit.New(w.rateLimit, w.rateBurst)
+	}
+
+	if !w.awaitApproval(ctx, ss) {
+		return false
+	}
+
+	// The output of warps encrypted end to end is not sequenced as clients
+	// can't resume decrypting it in the middle of an encrypted frame.
+	if len(w.e2eCheck) > 0 {
+		ss.sequenced = false
+	}
+	ss.outputC = make(chan output, w.queueSize)
+
 	// Add the client.
 	w.mutex.Lock()
-	isHostSession := false
+	if w.closed {
+		w.mutex.Unlock()
+		w.rejectClosed(ctx, ss)
+		return false
+	}
 	if ss.session.User == w.host.UserState.token {
 		// Check that the host secret matches.
-		if ss.session.Secret != w.host.session.session.Secret {
+		if !token.Equal(ss.session.Secret, w.host.UserState.secret) {
 			ss.SendError(ctx,
-				"authorization_failed",
+				warp.ErrAuthorizationFailed,
 				"Session secret mismatch.",
 			)
 			w.mutex.Unlock()
-			return
+			return false
 		}
-		isHostSession = true
 		// If we have a session conflict, let's kill the old one.
 		if s, ok := w.host.UserState.sessions[ss.session.Token]; ok {
-			s.TearDown()
+			s.Replace(ctx)
 		}
 		w.host.UserState.sessions[ss.session.Token] = ss
 	} else {
+		if w.isFull(ss) {
+			ss.SendError(ctx,
+				warp.ErrWarpFull,
+				fmt.Sprintf(
+					"The warp you attempted to connect is full (max clients: %d).",
+					w.maxClients,
+				),
+			)
+			w.mutex.Unlock()
+			logging.Logf(ctx,
+				"Client error: warp full: session=%s max_clients=%d",
+				ss.ToString(), w.maxClients,
+			)
+			return false
+		}
 		if c, ok := w.clients[ss.session.User]; !ok {
+			// New users have no output of this warp to resume (its ID may
+			// have been reused since they last connected).
+			ss.resumeFrom = 0
 			w.clients[ss.session.User] = &UserState{
 				token:    ss.session.User,
 				username: ss.username,
+				secret:   ss.session.Secret,
 				mode:     warp.DefaultUserMode,
 				sessions: map[string]*Session{},
 			}
 		} else {
-			any := func() *Session {
-				for _, s := range c.sessions {
-					return s
-				}
-				return nil
-			}
-			// Check that the host secret matches.
-			if ss.session.Secret != any().session.Secret {
+			// Check that the user secret matches. The user may have no
+			// session if it is reconnecting within clientGracePeriod.
+			if !token.Equal(ss.session.Secret, c.secret) {
 				ss.SendError(ctx,
-					"authorization_failed",
+					warp.ErrAuthorizationFailed,
 					"Session secret mismatch.",
 				)
 				w.mutex.Unlock()
-				return
+				return false
 			}
+			w.stopReap(c)
 		}
 		// If we have a session conflict, let's kill the old one.
 		if s, ok := w.clients[ss.session.User].sessions[ss.session.Token]; ok {
-			s.TearDown()
+			s.Replace(ctx)
 		}
 		w.clients[ss.session.User].sessions[ss.session.Token] = ss
 	}
+	// Clients other than the host user receive the warp data once they
+	// acknowledged the banner, if required.
+	ss.bannerPending = w.bannerAck && w.banner != "" &&
+		ss.session.User != w.host.UserState.token
+	// Queue the initial state before any data so that the client knows the
+	// data channel settings (compression) before reading it. The queue of a
+	// new session can't be full.
+	ss.QueueState(w.state(ctx))
+	if !ss.bannerPending {
+		w.replayScrollback(ctx, ss)
+	}
 	w.mutex.Unlock()
 
+	// Send host data to the shell client.
+	go w.sendOutput(ctx, ss)
+
 	// Receive shell client data.
 	go func() {
-		plex.Run(ctx, func(data []byte) {
+		plex.RunBuffered(ctx, func(data []byte) {
 			// logging.Logf(ctx,
 			// 	"Received data from client: session=%s size=%d",
 			// 	ss.ToString(), len(data),
 			// )
 			w.rcvShellClientData(ctx, ss, data)
-		}, ss.dataC)
+		}, ss.dataR, w.bufferSize)
 		ss.SendInternalError(ctx)
 		ss.TearDown()
 	}()
 
+	// Receive shell client updates. Clients that don't fit the warp to their
+	// terminal never send any.
+	updatesDone := ss.receivingUpdates()
+	go func() {
+		defer updatesDone()
+		for {
+			var up warp.ClientUpdate
+			if err := ss.updateR.Decode(&up); err != nil {
+				break
+			}
+			if up.Warp != w.token ||
+				up.From.Token != ss.session.Token ||
+				up.From.User != ss.session.User ||
+				!token.Equal(up.From.Secret, ss.session.Secret) {
+				logging.Logf(ctx,
+					"Client update mismatch: session=%s",
+					ss.ToString(),
+				)
+				ss.SendInternalError(ctx)
+				ss.TearDown()
+				break
+			}
+
+			// The client is about to close its session, which must not be
+			// taken for a lost connection.
+			if up.Closing {
+				ss.markClosing()
+				logging.Logf(ctx,
+					"Client closing: session=%s",
+					ss.ToString(),
+				)
+				continue
+			}
+			if up.Chat != "" {
+				w.relayChat(ctx, ss, up.Chat)
+				continue
+			}
+			if up.WriteRequest || up.WriteRelease || up.WriteGrant != "" {
+				w.updateWriteLock(ctx, ss, up)
+				continue
+			}
+			if up.BannerAck {
+				w.ackBanner(ctx, ss)
+				continue
+			}
+			if up.AccessRequest {
+				w.requestAccess(ctx, ss)
+				continue
+			}
+			if up.SelectPane {
+				w.selectPane(ctx, ss, up.Pane)
+				continue
+			}
+
+			size, err := up.WindowSize.Sanitize()
+			if err != nil {
+				logging.Logf(ctx,
+					"Invalid client update: session=%s error=%v",
+					ss.ToString(), err,
+				)
+				ss.SendInternalError(ctx)
+				ss.TearDown()
+				break
+			}
+			up.WindowSize = size
+
+			w.mutex.Lock()
+			before := w.renderSize()
+			ss.windowSize = up.WindowSize
+			changed := w.renderSize() != before
+			w.mutex.Unlock()
+
+			logging.Logf(ctx,
+				"Received client update: session=%s cols=%d rows=%d",
+				ss.ToString(), up.WindowSize.Cols, up.WindowSize.Rows,
+			)
+
+			if changed {
+				w.updateSessions(ctx)
+			}
+		}
+	}()
+
 	// Update host and clients (including the new session).
-	w.updateHost(ctx)
-	w.updateClientSessions(ctx)
+	w.updateSessions(ctx)
 
 	logging.Logf(ctx,
 		"Client session running: session=%s",
 		ss.ToString(),
 	)
+	fire(ctx, "client_joined", w.hooks.ClientJoined, ss)
 
 	<-ss.ctx.Done()
 
 	// Clean-up client.
+	reason := ss.Departure()
 	logging.Logf(ctx,
-		"Cleaning-up client: session=%s",
-		ss.ToString(),
+		"Cleaning-up client: session=%s reason=%s",
+		ss.ToString(), reason,
 	)
+	ev := newEvent(ss)
+	ev.Reason = reason
+	fireEvent(ctx, "client_left", w.hooks.ClientLeft, ev)
 
 	w.mutex.Lock()
-	if isHostSession {
-		delete(w.host.sessions, ss.session.Token)
-	} else {
-		delete(w.clients[ss.session.User].sessions, ss.session.Token)
-		if len(w.clients[ss.session.User].sessions) == 0 {
-			delete(w.clients, ss.session.User)
+	// The session may have been replaced by a reconnecting session with the
+	// same token, in which case it must be left in place. Its user may also
+	// have become (or stopped being) the host user through a handoff.
+	if w.host.UserState.sessions[ss.session.Token] == ss {
+		delete(w.host.UserState.sessions, ss.session.Token)
+	}
+	// The client may have been removed if disconnected by the host.
+	if c, ok := w.clients[ss.session.User]; ok &&
+		c.sessions[ss.session.Token] == ss {
+		delete(c.sessions, ss.session.Token)
+	}
+	// Pending write access requests are dropped with the last session.
+	w.checkAccessRequests()
+	// Clients that lost their last session are kept for clientGracePeriod so
+	// that they can reconnect without losing their mode, unless they left on
+	// purpose.
+	if ss.session.User != w.host.UserState.token {
+		grace := clientGracePeriod
+		if reason == warp.DisconnectClosed {
+			grace = 0
 		}
+		w.scheduleReap(ctx, ss.session.User, grace)
 	}
 	w.mutex.Unlock()
 
 	// Update host and remaining clients
-	w.updateHost(ctx)
-	w.updateClientSessions(ctx)
+	w.updateSessions(ctx)
+
+	return reason == warp.DisconnectUnknown
+}
+
+// usernameSet returns the set of usernames of an access list.
+func usernameSet(
+	usernames []string,
+) map[string]bool {
+	set := map[string]bool{}
+	for _, username := range usernames {
+		set[username] = true
+	}
+	return set
+}
+
+// checkAccess checks the username of a shell client against the access lists
+// of the warp: usernames denied are rejected and, if the allow list is not
+// empty, only the usernames it contains are accepted. Sessions of the host
+// user are exempted.
+//
+// Usernames are self-asserted by clients: the access lists only prevent
+// honest users from joining by mistake. Warps must also be protected by a
+// secret (see checkSecret) to keep others out.
+func (w *Warp) checkAccess(
+	ctx context.Context,
+	ss *Session,
+) error {
+	w.mutex.Lock()
+	denied := w.denyUsers[ss.username] ||
+		(len(w.allowUsers) > 0 && !w.allowUsers[ss.username])
+	exempted := ss.session.User == w.host.UserState.token &&
+		token.Equal(ss.session.Secret, w.host.UserState.secret)
+	w.mutex.Unlock()
+
+	if !denied || exempted {
+		return nil
+	}
+
+	ss.SendError(ctx,
+		warp.ErrAccessDenied,
+		"You are not allowed to connect to this warp.",
+	)
+	return errors.WithCode(
+		errors.Newf("Client error: username not allowed: %s", ss.username),
+		warp.ErrAccessDenied,
+	)
+}
+
+// checkSecret checks the secret presented by a shell client in its first update
+// if the warp is protected by one. Sessions of the host user are exempted.
+func (w *Warp) checkSecret(
+	ctx context.Context,
+	ss *Session,
+) error {
+	w.mutex.Lock()
+	hash := w.secretHash
+	exempted := ss.session.User == w.host.UserState.token &&
+		token.Equal(ss.session.Secret, w.host.UserState.secret)
+	w.mutex.Unlock()
+
+	if hash == "" || exempted {
+		return nil
+	}
+
+	var up warp.ClientUpdate
+	if err := ss.updateR.Decode(&up); err != nil || up.WarpSecret == "" {
+		ss.SendError(ctx,
+			warp.ErrAccessDenied,
+			"The warp you attempted to connect requires a secret.",
+		)
+		return errors.WithCode(
+			errors.Newf("Client error: warp secret not received: %v", err),
+			warp.ErrAccessDenied,
+		)
+	}
+	if up.Warp != w.token ||
+		up.From.Token != ss.session.Token ||
+		up.From.User != ss.session.User ||
+		!token.Equal(up.From.Secret, ss.session.Secret) {
+		ss.SendInternalError(ctx)
+		return errors.Trace(
+			errors.Newf("Client error: client update mismatch"),
+		)
+	}
+	if ok, err := token.VerifySecret(up.WarpSecret, hash); err != nil || !ok {
+		ss.SendError(ctx,
+			warp.ErrAccessDenied,
+			"The warp secret you provided is invalid.",
+		)
+		return errors.WithCode(
+			errors.Newf("Client error: invalid warp secret"),
+			warp.ErrAccessDenied,
+		)
+	}
+
+	// The first update also carries the window size of clients fitting the
+	// warp to their terminal. The session is not part of the warp yet.
+	size, err := up.WindowSize.Sanitize()
+	if err != nil {
+		ss.SendInternalError(ctx)
+		return errors.Trace(err)
+	}
+	ss.windowSize = size
+
+	return nil
+}
+
+// awaitApproval holds a shell client session until the host approves or
+// denies its user, if the warp requires approval and the user is not already
+// a client. It returns whether the session can join the warp.
+func (w *Warp) awaitApproval(
+	ctx context.Context,
+	ss *Session,
+) bool {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		w.rejectClosed(ctx, ss)
+		return false
+	}
+	if !w.approval || ss.session.User == w.host.UserState.token {
+		w.mutex.Unlock()
+		return true
+	}
+	// Approved users may reconnect without approval (within
+	// clientGracePeriod). Their secret is checked when joining.
+	if _, ok := w.clients[ss.session.User]; ok {
+		w.mutex.Unlock()
+		return true
+	}
+	p, ok := w.pending[ss.session.User]
+	if !ok {
+		p = &pendingUser{
+			UserState: UserState{
+				token:    ss.session.User,
+				username: ss.username,
+				secret:   ss.session.Secret,
+				mode:     warp.DefaultUserMode,
+				sessions: map[string]*Session{},
+			},
+			decidedC: make(chan struct{}),
+		}
+		w.pending[ss.session.User] = p
+	} else if !token.Equal(ss.session.Secret, p.secret) {
+		w.mutex.Unlock()
+		ss.SendError(ctx,
+			warp.ErrAuthorizationFailed,
+			"Session secret mismatch.",
+		)
+		return false
+	}
+	// If we have a session conflict, let's kill the old one.
+	if s, ok := p.sessions[ss.session.Token]; ok {
+		s.Replace(ctx)
+	}
+	p.sessions[ss.session.Token] = ss
+	w.mutex.Unlock()
+
+	logging.Logf(ctx,
+		"Client awaiting approval: session=%s",
+		ss.ToString(),
+	)
+	w.updateSessions(ctx)
+
+	decided := false
+	ticker := time.NewTicker(pendingCheckInterval)
+	defer ticker.Stop()
+WAIT:
+	for {
+		select {
+		case <-p.decidedC:
+			decided = true
+			break WAIT
+		case <-ss.ctx.Done():
+			break WAIT
+		case <-ticker.C:
+			if ss.mux.IsClosed() {
+				ss.TearDown()
+				break WAIT
+			}
+		}
+	}
+
+	w.mutex.Lock()
+	if p.sessions[ss.session.Token] == ss {
+		delete(p.sessions, ss.session.Token)
+	}
+	// A pending user that lost all its sessions is removed from the pending
+	// users unless the host decided in the meantime.
+	withdrawn := false
+	select {
+	case <-p.decidedC:
+	default:
+		if len(p.sessions) == 0 && w.pending[p.token] == p {
+			delete(w.pending, p.token)
+			withdrawn = true
+		}
+	}
+	approved := p.approved
+	w.mutex.Unlock()
+
+	if withdrawn {
+		logging.Logf(ctx,
+			"Pending client withdrawn: session=%s",
+			ss.ToString(),
+		)
+		w.updateSessions(ctx)
+	}
+	if !decided {
+		return false
+	}
+	if !approved {
+		logging.Logf(ctx,
+			"Client denied: session=%s",
+			ss.ToString(),
+		)
+		ss.SendError(ctx,
+			warp.ErrJoinDenied,
+			"The warp host denied your request to join.",
+		)
+		return false
+	}
+	return true
+}
+
+// scheduleReap schedules the removal of the client user after grace, if it has
+// no session left by then, replacing the removal already scheduled if any. The
+// warp lock must be held.
+func (w *Warp) scheduleReap(
+	ctx context.Context,
+	user string,
+	grace time.Duration,
+) {
+	c, ok := w.clients[user]
+	if !ok || w.closed {
+		return
+	}
+	w.stopReap(c)
+	c.reaps++
+	reap := c.reaps
+	c.reaper = time.AfterFunc(grace, func() {
+		w.reapClient(ctx, c, reap)
+	})
+}
+
+// stopReap cancels the removal scheduled for client c, if any, as it
+// reconnected or is removed otherwise. The warp lock must be held.
+func (w *Warp) stopReap(
+	c *UserState,
+) {
+	if c.reaper != nil {
+		c.reaper.Stop()
+		c.reaper = nil
+	}
+}
+
+// reapClient removes client c if it has no session left, notifying the host
+// and remaining clients. It is called once the grace period of the removal
+// reap scheduled with scheduleReap elapsed.
+func (w *Warp) reapClient(
+	ctx context.Context,
+	c *UserState,
+	reap uint64,
+) {
+	user := c.token
+
+	w.mutex.Lock()
+	// The removal may have been cancelled or rescheduled (the client
+	// reconnecting or being replaced) while the timer fired.
+	reaped := w.clients[user] == c && c.reaper != nil && c.reaps == reap &&
+		len(c.sessions) == 0
+	if reaped {
+		c.reaper = nil
+		delete(w.clients, user)
+		w.checkWriteLock()
+		w.checkAccessRequests()
+	}
+	w.mutex.Unlock()
+
+	if reaped {
+		logging.Logf(ctx,
+			"Reaped client: warp=%s user=%s",
+			w.token, user,
+		)
+		w.updateSessions(ctx)
+	}
 }
@@ -0,0 +1,375 @@
+// Package warptest runs warpd in process and connects hosts and clients to it
+// programmatically, without terminals, to exercise warps end to end in tests.
+package warptest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/token"
+)
+
+// shutdownTimeout bounds the time given to warps to disconnect when a Server
+// is closed.
+const shutdownTimeout = 5 * time.Second
+
+// Server is a warpd server listening on an ephemeral port of the loopback
+// interface.
+type Server struct {
+	Srv *daemon.Srv
+	// Address is the address the server listens on.
+	Address string
+	// Compression requests the compression of the data channel of the
+	// sessions opened, which warpd enables if configured to.
+	Compression bool
+
+	doneC chan struct{}
+	once  *sync.Once
+}
+
+// NewServer starts a warpd server with config, overriding its addresses and
+// disabling TLS. The server is closed once t completes.
+func NewServer(
+	t testing.TB,
+	config daemon.Config,
+) *Server {
+	t.Helper()
+	ctx := context.Background()
+
+	config.Addresses = []string{"127.0.0.1:0"}
+	config.Address = ""
+	config.TLSConfig = nil
+
+	srv := daemon.NewSrv(ctx, config)
+	if err := srv.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start warpd: %v", err)
+	}
+
+	s := &Server{
+		Srv:     srv,
+		Address: srv.Addrs()[0].String(),
+		doneC:   make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	go func() {
+		srv.Serve(ctx)
+		close(s.doneC)
+	}()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Close shuts down the server, disconnecting all warps, and waits for it to
+// stop. It is safe to call multiple times.
+func (s *Server) Close() {
+	s.once.Do(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), shutdownTimeout,
+		)
+		defer cancel()
+		s.Srv.Shutdown(ctx)
+		<-s.doneC
+	})
+}
+
+// Conn is a session to the server, either hosting or connected to a warp. Its
+// Read method returns the data received from the warp and Write sends data to
+// it, the data channel being piped so that it can be consumed at the test's
+// pace.
+type Conn struct {
+	Session *cli.Session
+	// User is the user token of the session.
+	User string
+
+	dataR *io.PipeReader
+	buf   []byte
+
+	// states is the number of states received, updated atomically.
+	states int64
+
+	err   error
+	errC  chan struct{}
+	mutex *sync.Mutex
+}
+
+// OpenHost opens a warp as host with the given username.
+func (s *Server) OpenHost(
+	ctx context.Context,
+	w string,
+	username string,
+	initial warp.HostUpdate,
+) (*Conn, error) {
+	c, err := s.Dial(ctx, w, warp.SsTpHost, username)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	initial.Warp = w
+	initial.From = c.Session.Session()
+	if err := c.Session.SendHostUpdate(ctx, initial); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+	if err := c.start(ctx, true); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// Connect joins a warp as a shell client with the given username.
+func (s *Server) Connect(
+	ctx context.Context,
+	w string,
+	username string,
+) (*Conn, error) {
+	c, err := s.Dial(ctx, w, warp.SsTpShellClient, username)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := c.Session.SendClientUpdate(ctx, warp.ClientUpdate{
+		Warp: w,
+		From: c.Session.Session(),
+	}); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+	if err := c.start(ctx, false); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// Dial opens a session of type sessionType to the server for a new user,
+// without sending its first update. Unlike the sessions of OpenHost and
+// Connect, neither its state nor its data are read, so that tests can use it
+// as a stalled peer.
+func (s *Server) Dial(
+	ctx context.Context,
+	w string,
+	sessionType warp.SessionType,
+	username string,
+) (*Conn, error) {
+	conn, err := net.Dial("tcp", s.Address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	session := warp.Session{
+		Token:  token.New("session"),
+		User:   token.New("guest"),
+		Secret: token.RandStr(),
+	}
+	ss, err := cli.NewSession(
+		ctx, session, w, sessionType, username, s.Compression, false, false,
+		0, func() {}, conn,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	return &Conn{
+		Session: ss,
+		User:    session.User,
+		errC:    make(chan struct{}),
+		mutex:   &sync.Mutex{},
+	}, nil
+}
+
+// start waits for the first state of the session, then pipes its data and
+// keeps its state up to date until it is torn down.
+func (c *Conn) start(
+	ctx context.Context,
+	hosting bool,
+) error {
+	go func() {
+		if e, err := c.Session.DecodeError(ctx); err == nil {
+			c.mutex.Lock()
+			c.err = cli.NewWarpdError(*e)
+			c.mutex.Unlock()
+		}
+		close(c.errC)
+		c.Session.TearDown()
+	}()
+
+	st, err := c.Session.DecodeState(ctx)
+	if err != nil {
+		c.Close()
+		if werr := c.Err(); werr != nil {
+			return errors.Trace(werr)
+		}
+		return errors.Trace(err)
+	}
+	if err := c.Session.UpdateState(*st, hosting); err != nil {
+		c.Close()
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&c.states, 1)
+
+	go func() {
+		for {
+			st, err := c.Session.DecodeState(ctx)
+			if err != nil {
+				c.Session.DiscardState(ctx)
+				return
+			}
+			c.Session.UpdateState(*st, hosting)
+			atomic.AddInt64(&c.states, 1)
+		}
+	}()
+
+	r, w := io.Pipe()
+	c.dataR = r
+	go func() {
+		_, err := io.Copy(w, c.Session.DataC())
+		w.CloseWithError(err)
+		c.Session.TearDown()
+	}()
+
+	return nil
+}
+
+// Read reads the data received from the warp: the output of the host for
+// clients and the input of the clients authorized to write for hosts. It
+// returns io.EOF once the session is torn down.
+func (c *Conn) Read(
+	p []byte,
+) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.dataR.Read(p)
+}
+
+// Write sends data to the warp.
+func (c *Conn) Write(
+	p []byte,
+) (int, error) {
+	if c.Session.TornDown() {
+		return 0, io.ErrClosedPipe
+	}
+	if err := c.Session.WriteDataC(p); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(p), nil
+}
+
+// ReadUntil reads the data received from the warp until it contains s,
+// returning the data read up to and including s. The data following s is
+// returned by subsequent reads. It errors if s is not received within timeout
+// or the session is torn down before.
+func (c *Conn) ReadUntil(
+	s string,
+	timeout time.Duration,
+) (string, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		data := []byte{}
+		buf := make([]byte, 1024)
+		for {
+			if i := bytes.Index(data, []byte(s)); i >= 0 {
+				c.buf = append(data[i+len(s):], c.buf...)
+				resultC <- result{data: data[:i+len(s)]}
+				return
+			}
+			n, err := c.Read(buf)
+			data = append(data, buf[:n]...)
+			if err != nil {
+				resultC <- result{data: data, err: err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			return string(r.data), errors.Trace(
+				errors.Newf("Failed to read %q: %v", s, r.err),
+			)
+		}
+		return string(r.data), nil
+	case <-time.After(timeout):
+		// Closing the session ends the pending read.
+		c.Close()
+		return "", errors.Trace(
+			errors.Newf("Timed out after %s waiting for %q", timeout, s),
+		)
+	}
+}
+
+// Authorize grants write access to a user, for hosts.
+func (c *Conn) Authorize(
+	ctx context.Context,
+	user string,
+) error {
+	modes := c.Session.Modes()
+	modes[user] = warp.ModeShellRead | warp.ModeShellWrite
+	err := c.Session.SendHostUpdate(ctx, warp.HostUpdate{
+		Warp:  c.Session.Warp(),
+		From:  c.Session.Session(),
+		Modes: modes,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// State returns the current warp state as known by the session.
+func (c *Conn) State() warp.State {
+	return c.Session.ProtocolState()
+}
+
+// States returns the number of states received by the session.
+func (c *Conn) States() int {
+	return int(atomic.LoadInt64(&c.states))
+}
+
+// Err waits for the session to be torn down and returns the error sent by
+// warpd, if any.
+func (c *Conn) Err() error {
+	<-c.errC
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Close tears down the session.
+func (c *Conn) Close() {
+	c.Session.TearDown()
+}
+
+// pollInterval is the interval at which WaitFor evaluates its condition.
+const pollInterval = 10 * time.Millisecond
+
+// WaitFor waits up to timeout for cond to hold, failing t otherwise. It is
+// used to wait for the asynchronous effects of state updates.
+func WaitFor(
+	t testing.TB,
+	timeout time.Duration,
+	cond func() bool,
+) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met within %s", timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,73 @@
+package warptest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp"
+	"github.com/spolu/warp/client"
+	"github.com/spolu/warp/daemon"
+	"github.com/spolu/warp/lib/errors"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(t, daemon.Config{})
+
+	host, err := s.OpenHost(ctx, "round-trip", "alice", warp.HostUpdate{
+		WindowSize: warp.Size{Rows: 24, Cols: 80},
+	})
+	if err != nil {
+		t.Fatalf("OpenHost: %v", err)
+	}
+	defer host.Close()
+
+	c, err := s.Connect(ctx, "round-trip", "bob")
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Close()
+
+	// The host output is forwarded to the client.
+	if _, err := host.Write([]byte("hello from host\r\n")); err != nil {
+		t.Fatalf("host Write: %v", err)
+	}
+	if _, err := c.ReadUntil("hello from host", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client input reaches the host once it is authorized to write.
+	if err := host.Authorize(ctx, c.User); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	WaitFor(t, testTimeout, func() bool {
+		return c.State().Users[c.User].Mode&warp.ModeShellWrite != 0
+	})
+	if _, err := c.Write([]byte("ls\r")); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	if _, err := host.ReadUntil("ls\r", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is disconnected once the host leaves.
+	host.Close()
+	werr, ok := errors.Cause(c.Err()).(*cli.WarpdError)
+	if !ok || werr.Code != warp.ErrHostDisconnected {
+		t.Fatalf("client error: got %v, want %s", c.Err(), warp.ErrHostDisconnected)
+	}
+}
+
+func TestConnectUnknownWarp(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(t, daemon.Config{})
+
+	_, err := s.Connect(ctx, "unknown", "bob")
+	werr, ok := errors.Cause(err).(*cli.WarpdError)
+	if !ok || werr.Code != warp.ErrWarpUnknown {
+		t.Fatalf("Connect: got %v, want %s", err, warp.ErrWarpUnknown)
+	}
+}
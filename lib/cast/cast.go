@@ -0,0 +1,293 @@
+package cast
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// recorderBufferSize is the number of events buffered by a Recorder before it
+// starts dropping them.
+const recorderBufferSize = 1024
+
+// maxLineSize is the maximum size of a line read by a Reader.
+const maxLineSize = 1024 * 1024
+
+// Header is the header line of an asciinema v2 cast file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type event struct {
+	at   time.Duration
+	data []byte
+}
+
+// Recorder records terminal output to an asciinema v2 cast file. Events are
+// written by a background goroutine so that a slow disk never blocks the
+// caller: Record drops events once its buffer is full.
+type Recorder struct {
+	file   *os.File
+	start  time.Time
+	eventC chan event
+	doneC  chan struct{}
+	err    error
+
+	closed bool
+	mutex  *sync.Mutex
+}
+
+// NewRecorder creates the cast file at path, writes its header and returns a
+// Recorder ready to record output. The header version is forced to 2.
+func NewRecorder(
+	path string,
+	header Header,
+) (*Recorder, error) {
+	header.Version = 2
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+
+	r := &Recorder{
+		file:   f,
+		start:  time.Now(),
+		eventC: make(chan event, recorderBufferSize),
+		doneC:  make(chan struct{}),
+		mutex:  &sync.Mutex{},
+	}
+	go r.run()
+
+	return r, nil
+}
+
+// Record records data as an output event. It never blocks and returns false
+// if the event was dropped because the recorder is lagging behind or closed.
+func (r *Recorder) Record(
+	data []byte,
+) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return false
+	}
+	select {
+	case r.eventC <- event{at: time.Since(r.start), data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close flushes the pending events and closes the cast file. It returns the
+// first error encountered while writing the file, if any.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.eventC)
+	r.mutex.Unlock()
+
+	<-r.doneC
+	if err := r.file.Close(); err != nil && r.err == nil {
+		r.err = errors.Trace(err)
+	}
+	return r.err
+}
+
+// run writes events to the cast file until eventC is closed. Output bytes are
+// held back until they form complete UTF-8 sequences as events data must be
+// valid JSON strings.
+func (r *Recorder) run() {
+	defer close(r.doneC)
+	w := bufio.NewWriter(r.file)
+
+	var pending []byte
+	var at time.Duration
+	for ev := range r.eventC {
+		if r.err != nil {
+			continue
+		}
+		pending = append(pending, ev.data...)
+		at = ev.at
+
+		n := completeUTF8(pending)
+		if n > 0 {
+			if err := writeEvent(w, at, pending[:n]); err != nil {
+				r.err = errors.Trace(err)
+				continue
+			}
+			pending = append([]byte{}, pending[n:]...)
+		}
+		// Flush once the backlog is drained to keep the file current without
+		// a syscall per event.
+		if len(r.eventC) == 0 {
+			if err := w.Flush(); err != nil {
+				r.err = errors.Trace(err)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return
+	}
+	if len(pending) > 0 {
+		if err := writeEvent(w, at, pending); err != nil {
+			r.err = errors.Trace(err)
+			return
+		}
+	}
+	if err := w.Flush(); err != nil {
+		r.err = errors.Trace(err)
+	}
+}
+
+// writeEvent writes an output event line.
+func writeEvent(
+	w *bufio.Writer,
+	at time.Duration,
+	data []byte,
+) error {
+	// Timestamps are truncated to microseconds like asciinema does.
+	raw, err := json.Marshal([]interface{}{
+		float64(at/time.Microsecond) / 1e6, "o", string(data),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
+
+// completeUTF8 returns the length of the longest prefix of b that does not end
+// with an incomplete UTF-8 sequence.
+func completeUTF8(
+	b []byte,
+) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// Event is an event read from an asciinema v2 cast file.
+type Event struct {
+	// Time is the time of the event since the beginning of the recording.
+	Time time.Duration
+	// Type is the type of the event ("o" for output).
+	Type string
+	Data string
+}
+
+// Reader reads events from an asciinema v2 cast file.
+type Reader struct {
+	header  Header
+	scanner *bufio.Scanner
+}
+
+// NewReader reads the header of the cast file from r and returns a Reader
+// ready to read its events.
+func NewReader(
+	r io.Reader,
+) (*Reader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return nil, errors.Trace(errors.Newf("Empty cast file"))
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Malformed cast header: %v", err),
+		)
+	}
+	if header.Version != 2 {
+		return nil, errors.Trace(
+			errors.Newf("Unsupported cast version: %d", header.Version),
+		)
+	}
+
+	return &Reader{
+		header:  header,
+		scanner: scanner,
+	}, nil
+}
+
+// Header returns the header of the cast file.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next event of the cast file or io.EOF once all events have
+// been read. Blank lines are skipped.
+func (r *Reader) Next() (*Event, error) {
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var raw []json.RawMessage
+		if err := json.Unmarshal(line, &raw); err != nil || len(raw) != 3 {
+			return nil, errors.Trace(
+				errors.Newf("Malformed cast event: %s", string(line)),
+			)
+		}
+		var at float64
+		ev := Event{}
+		if err := json.Unmarshal(raw[0], &at); err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Malformed cast event time: %v", err),
+			)
+		}
+		if err := json.Unmarshal(raw[1], &ev.Type); err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Malformed cast event type: %v", err),
+			)
+		}
+		if err := json.Unmarshal(raw[2], &ev.Data); err != nil {
+			return nil, errors.Trace(
+				errors.Newf("Malformed cast event data: %v", err),
+			)
+		}
+		ev.Time = time.Duration(at * float64(time.Second))
+
+		return &ev, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return nil, io.EOF
+}
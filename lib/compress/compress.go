@@ -0,0 +1,49 @@
+package compress
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Writer compresses data written to it with flate, flushing after each write
+// so that interactive data (keystrokes, prompts) is never held back by the
+// compressor. It is safe for concurrent use.
+type Writer struct {
+	fw    *flate.Writer
+	mutex *sync.Mutex
+}
+
+// NewWriter returns a Writer compressing data to w.
+func NewWriter(
+	w io.Writer,
+) *Writer {
+	// flate.NewWriter only errors on invalid levels.
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return &Writer{
+		fw:    fw,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Write compresses and flushes p. It returns len(p) on success.
+func (w *Writer) Write(
+	p []byte,
+) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := w.fw.Write(p); err != nil {
+		return 0, err
+	}
+	if err := w.fw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewReader returns a reader decompressing data written by a Writer to r.
+func NewReader(
+	r io.Reader,
+) io.Reader {
+	return flate.NewReader(r)
+}
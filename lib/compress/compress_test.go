@@ -0,0 +1,146 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// logFile generates n lines of colored log output, as displayed by a `cat` of
+// an application log file.
+func logFile(
+	n int,
+) []byte {
+	r := rand.New(rand.NewSource(42))
+	levels := []string{
+		"\x1b[32mINFO\x1b[0m", "\x1b[33mWARN\x1b[0m", "\x1b[31mERROR\x1b[0m",
+	}
+	paths := []string{"/api/warps", "/api/users", "/healthz", "/metrics"}
+	buf := &bytes.Buffer{}
+	t := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		t = t.Add(time.Duration(r.Intn(1000)) * time.Millisecond)
+		fmt.Fprintf(buf,
+			"%s %s request: method=GET path=%s status=%d duration=%dms "+
+				"remote=10.0.%d.%d\r\n",
+			t.Format(time.RFC3339Nano), levels[r.Intn(len(levels))],
+			paths[r.Intn(len(paths))], 200+r.Intn(4)*100, r.Intn(500),
+			r.Intn(256), r.Intn(256),
+		)
+	}
+	return buf.Bytes()
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(
+	p []byte,
+) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := logFile(1000)
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	// Written in chunks of the size of the reads of a pty.
+	for i := 0; i < len(data); i += 1024 {
+		end := i + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		if n, err := w.Write(data[i:end]); err != nil || n != end-i {
+			t.Fatalf("Write: got (%d, %v), want (%d, nil)", n, err, end-i)
+		}
+	}
+
+	got, err := ioutil.ReadAll(NewReader(buf))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Round trip mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestKeystrokesAreNotBuffered(t *testing.T) {
+	r, pw := io.Pipe()
+	w := NewWriter(pw)
+	reader := NewReader(r)
+
+	for _, key := range []string{"l", "s", "\r"} {
+		// The pipe blocks until the data is read, the write returning once
+		// the compressor flushed it.
+		go w.Write([]byte(key))
+
+		readC := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 16)
+			n, _ := reader.Read(buf)
+			readC <- string(buf[:n])
+		}()
+		select {
+		case got := <-readC:
+			if got != key {
+				t.Fatalf("Read: got %q, want %q", got, key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Keystroke %q held back by the compressor", key)
+		}
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	data := logFile(20000)
+
+	cw := &countingWriter{}
+	w := NewWriter(cw)
+	for i := 0; i < len(data); i += 1024 {
+		end := i + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[i:end])
+	}
+
+	// Each write is flushed, which costs some ratio compared to compressing
+	// the log file at once.
+	ratio := float64(len(data)) / float64(cw.n)
+	t.Logf(
+		"Compressed %d bytes of log output to %d bytes: ratio %.2f",
+		len(data), cw.n, ratio,
+	)
+	if ratio < 2 {
+		t.Fatalf("Compression ratio too low: %.2f", ratio)
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	data := logFile(20000)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	var compressed int
+	for i := 0; i < b.N; i++ {
+		cw := &countingWriter{}
+		w := NewWriter(cw)
+		for j := 0; j < len(data); j += 1024 {
+			end := j + 1024
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[j:end])
+		}
+		compressed = cw.n
+	}
+	b.ReportMetric(float64(len(data))/float64(compressed), "ratio")
+}
@@ -0,0 +1,287 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Data is encrypted end to end with AES-256-GCM in frames:
+//
+//   magic (4) | length (2) | nonce (12) | sealed data (length)
+//
+// The magic and length are authenticated along with the direction of the
+// data, so that data sent by the host can't be replayed as data sent by
+// clients and conversely.
+//
+// warpd relays the data without being aware of the frames: a session may
+// start reading in the middle of one (late joiners, the scrollback being
+// trimmed) and data from different clients may be interleaved. Readers
+// resynchronize on the next frame that authenticates, dropping the bytes
+// before it. Frames are not numbered, so warpd can still drop, reorder or
+// replay them.
+
+// Direction is the direction of the data encrypted.
+type Direction byte
+
+const (
+	// Host is the direction of the data sent by the host to clients.
+	Host Direction = 'h'
+	// Client is the direction of the data sent by clients to the host.
+	Client Direction = 'c'
+)
+
+// keyIterations is the number of PBKDF2 iterations used to derive keys.
+const keyIterations = 100000
+
+// maxFrameData is the maximum size of the data sealed in a frame.
+const maxFrameData = 16 * 1024
+
+const (
+	nonceSize  = 12
+	tagSize    = 16
+	headerSize = 4 + 2 + nonceSize
+)
+
+var magic = []byte{0xe2, 0xe2, 'w', 'p'}
+
+// checkData is sealed by Check to let clients verify their passphrase.
+const checkData = "warp end-to-end encryption"
+
+// CheckSize is the size of the check value returned by Check.
+const CheckSize = nonceSize + len(checkData) + tagSize
+
+// DeriveKey derives the key of a warp from a passphrase. The warp ID is used
+// as salt so that the same passphrase yields different keys for different
+// warps.
+func DeriveKey(
+	passphrase string,
+	warp string,
+) ([]byte, error) {
+	key, err := pbkdf2.Key(
+		sha256.New, passphrase, []byte("warp-e2e:"+warp), keyIterations, 32,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return key, nil
+}
+
+// newAEAD returns the AEAD cipher for a key.
+func newAEAD(
+	key []byte,
+) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return aead, nil
+}
+
+// Check returns a value, sent through warpd, letting clients verify that
+// they derived the same key as the host. It does not reveal more about the
+// key than the data encrypted with it.
+func Check(
+	key []byte,
+) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return aead.Seal(nonce, nonce, []byte(checkData), []byte("check")), nil
+}
+
+// Verify returns whether check was computed by Check with the same key.
+func Verify(
+	key []byte,
+	check []byte,
+) bool {
+	aead, err := newAEAD(key)
+	if err != nil || len(check) != CheckSize {
+		return false
+	}
+	data, err := aead.Open(
+		nil, check[:nonceSize], check[nonceSize:], []byte("check"),
+	)
+	return err == nil && string(data) == checkData
+}
+
+// Writer encrypts data written to it in frames. Each call to Write results
+// in a single write to the underlying writer. It is safe for concurrent use.
+type Writer struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	direction Direction
+
+	mutex *sync.Mutex
+}
+
+// NewWriter returns a Writer encrypting data sent in a direction to w.
+func NewWriter(
+	w io.Writer,
+	key []byte,
+	direction Direction,
+) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Writer{
+		w:         w,
+		aead:      aead,
+		direction: direction,
+		mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// Write encrypts p and writes the resulting frames. It returns len(p) on
+// success.
+func (w *Writer) Write(
+	p []byte,
+) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	buf := []byte{}
+	for data := p; len(data) > 0; {
+		n := len(data)
+		if n > maxFrameData {
+			n = maxFrameData
+		}
+		header := make([]byte, headerSize)
+		copy(header, magic)
+		binary.BigEndian.PutUint16(header[4:], uint16(n+tagSize))
+		nonce := header[6:]
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		buf = append(buf, header...)
+		buf = w.aead.Seal(
+			buf, nonce, data[:n], additionalData(w.direction, header),
+		)
+		data = data[n:]
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Reader decrypts the frames read from an underlying reader, dropping the
+// data that does not authenticate.
+type Reader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	direction Direction
+
+	// raw is the data read but not decrypted yet and plain the data decrypted
+	// but not read yet.
+	raw   []byte
+	plain []byte
+	err   error
+
+	buf []byte
+}
+
+// NewReader returns a Reader decrypting data sent in a direction from r.
+func NewReader(
+	r io.Reader,
+	key []byte,
+	direction Direction,
+) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Reader{
+		r:         r,
+		aead:      aead,
+		direction: direction,
+		raw:       []byte{},
+		plain:     []byte{},
+		buf:       make([]byte, headerSize+maxFrameData+tagSize),
+	}, nil
+}
+
+// Read implements the io.Reader interface.
+func (r *Reader) Read(
+	p []byte,
+) (int, error) {
+	for len(r.plain) == 0 {
+		if r.decrypt() {
+			continue
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.r.Read(r.buf)
+		r.raw = append(r.raw, r.buf[:n]...)
+		r.err = err
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// decrypt decrypts the next complete frame of raw into plain and returns
+// whether it did, skipping the data preceding it.
+func (r *Reader) decrypt() bool {
+	for {
+		i := bytes.Index(r.raw, magic)
+		if i < 0 {
+			// Keep what could be the start of the magic.
+			if len(r.raw) >= len(magic) {
+				r.raw = r.raw[len(r.raw)-len(magic)+1:]
+			}
+			return false
+		}
+		r.raw = r.raw[i:]
+		if len(r.raw) < headerSize {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(r.raw[4:]))
+		if length <= tagSize || length > maxFrameData+tagSize {
+			r.raw = r.raw[1:]
+			continue
+		}
+		if len(r.raw) < headerSize+length {
+			return false
+		}
+		header := r.raw[:headerSize]
+		plain, err := r.aead.Open(
+			nil, header[6:], r.raw[headerSize:headerSize+length],
+			additionalData(r.direction, header),
+		)
+		if err != nil {
+			r.raw = r.raw[1:]
+			continue
+		}
+		r.raw = r.raw[headerSize+length:]
+		r.plain = plain
+		return true
+	}
+}
+
+// additionalData returns the data authenticated along with a frame.
+func additionalData(
+	direction Direction,
+	header []byte,
+) []byte {
+	return append([]byte{byte(direction)}, header[:6]...)
+}
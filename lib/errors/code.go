@@ -0,0 +1,38 @@
+package errors
+
+// Code is a machine-readable error code, letting callers react to an error
+// without matching its message.
+type Code string
+
+// CodeNone is the code of errors that don't carry one.
+const CodeNone Code = ""
+
+// CodedError is the error interface implemented by errors carrying a Code.
+type CodedError interface {
+	error
+	ErrorCode() Code
+}
+
+// WithCode attaches a code and a location to the error. The code is retrieved
+// with CodeOf, through any Trace wrapping it. If the error is nil, it returns
+// nil.
+func WithCode(other error, code Code) error {
+	if other == nil {
+		return nil
+	}
+	err := &wrap{
+		code:     code,
+		previous: other,
+	}
+	err.setLocation(1)
+	return err
+}
+
+// CodeOf returns the code carried by the error, the outermost one if several
+// were attached, or CodeNone if it carries none.
+func CodeOf(err error) Code {
+	if e, ok := err.(CodedError); ok {
+		return e.ErrorCode()
+	}
+	return CodeNone
+}
@@ -86,6 +86,9 @@ func ErrorStack(err error) []string {
 			if len(e.traceMessage) > 0 {
 				buff = append(buff, fmt.Sprintf(": %s", e.traceMessage)...)
 			}
+			if e.code != CodeNone {
+				buff = append(buff, fmt.Sprintf(" [code] %s", e.code)...)
+			}
 			err = e.previous
 		} else {
 			buff = append(buff, fmt.Sprintf("[error] ")...)
@@ -11,6 +11,7 @@ type wrap struct {
 	traceFile    string
 	traceLine    int
 	traceMessage string
+	code         Code
 	previous     error
 }
 
@@ -25,6 +26,15 @@ func (e *wrap) UserError() UserError {
 	}
 }
 
+// ErrorCode returns the code attached to the error, the outermost one if
+// several were attached.
+func (e *wrap) ErrorCode() Code {
+	if e.code != CodeNone {
+		return e.code
+	}
+	return CodeOf(e.previous)
+}
+
 // Cause returns the underlying error if not nil
 func (e *wrap) Cause() error {
 	switch e := e.previous.(type) {
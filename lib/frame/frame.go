@@ -0,0 +1,85 @@
+// Package frame implements the sequence-numbered frames of the data channel of
+// the shell client sessions opting for them, which let clients resume the
+// output of a warp where they left it when they reconnect.
+package frame
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Frames carry a chunk of data along with its position in the output of the
+// warp:
+//
+//   seq (8) | length (4) | data (length)
+//
+// seq is the offset, in the output of the host shell since the warp was
+// opened, of the end of data. It is 0 for data that is not part of that
+// output (the output of panes, or output hidden from clients), which doesn't
+// move the position of the client.
+
+// HeaderSize is the size of the header of frames.
+const HeaderSize = 8 + 4
+
+// MaxDataSize is the maximum size of the data of a frame accepted by readers.
+const MaxDataSize = 16 * 1024 * 1024
+
+// Encode returns the frame carrying data, ending at offset seq (0 if data is
+// not part of the output of the host shell).
+func Encode(
+	seq uint64,
+	data []byte,
+) []byte {
+	b := make([]byte, HeaderSize+len(data))
+	binary.BigEndian.PutUint64(b[0:8], seq)
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(data)))
+	copy(b[HeaderSize:], data)
+	return b
+}
+
+// Reader reads the frames written to a data channel.
+type Reader struct {
+	r      io.Reader
+	header [HeaderSize]byte
+}
+
+// NewReader returns a Reader reading frames from r.
+func NewReader(
+	r io.Reader,
+) *Reader {
+	return &Reader{
+		r: r,
+	}
+}
+
+// Next reads the next frame, returning its offset and data. It is not safe for
+// concurrent use.
+func (r *Reader) Next() (uint64, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return 0, nil, err
+	}
+	seq := binary.BigEndian.Uint64(r.header[0:8])
+	size := binary.BigEndian.Uint32(r.header[8:12])
+	if size > MaxDataSize {
+		return 0, nil, errors.Trace(
+			errors.Newf(
+				"Frame too large: %d bytes (max: %d)", size, MaxDataSize,
+			),
+		)
+	}
+	if seq != 0 && seq < uint64(size) {
+		return 0, nil, errors.Trace(
+			errors.Newf("Invalid frame offset: %d (size: %d)", seq, size),
+		)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return seq, data, nil
+}
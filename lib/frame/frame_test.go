@@ -0,0 +1,75 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	frames := []struct {
+		seq  uint64
+		data string
+	}{
+		{5, "hello"},
+		// The output of a pane, not part of the output of the host shell.
+		{0, "pane"},
+		{5, ""},
+		{12, " world\n"},
+	}
+
+	buf := &bytes.Buffer{}
+	for _, f := range frames {
+		buf.Write(Encode(f.seq, []byte(f.data)))
+	}
+
+	r := NewReader(buf)
+	for i, f := range frames {
+		seq, data, err := r.Next()
+		if err != nil {
+			t.Fatalf("frame %d: Next: %v", i, err)
+		}
+		if seq != f.seq || string(data) != f.data {
+			t.Fatalf(
+				"frame %d: got (%d, %q), want (%d, %q)",
+				i, seq, data, f.seq, f.data,
+			)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next after the last frame: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	header := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], MaxDataSize+1)
+	binary.BigEndian.PutUint32(header[8:12], MaxDataSize+1)
+
+	// The data is not read, nor allocated.
+	if _, _, err := NewReader(bytes.NewReader(header)).Next(); err == nil {
+		t.Fatalf("frame of %d bytes accepted", MaxDataSize+1)
+	}
+}
+
+func TestInvalidOffset(t *testing.T) {
+	// A frame can't end before the size of its data in the output.
+	b := Encode(3, []byte("hello"))
+	if _, _, err := NewReader(bytes.NewReader(b)).Next(); err == nil {
+		t.Fatalf("frame ending at 3 with 5 bytes of data accepted")
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	b := Encode(5, []byte("hello"))
+	for _, n := range []int{1, HeaderSize - 1, HeaderSize, len(b) - 1} {
+		_, _, err := NewReader(bytes.NewReader(b[:n])).Next()
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf(
+				"frame truncated to %d bytes: got %v, want %v",
+				n, err, io.ErrUnexpectedEOF,
+			)
+		}
+	}
+}
@@ -2,9 +2,59 @@ package logging
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Format is the format of the logs.
+type Format string
+
+const (
+	// FormatText logs human-readable lines through the log package.
+	FormatText Format = "text"
+	// FormatJSON logs single-line JSON objects with `ts`, `level` and `msg`
+	// fields along with structured key/values if any.
+	FormatJSON Format = "json"
+)
+
+var logFormat = FormatText
+var mutex = &sync.Mutex{}
+
+func init() {
+	if os.Getenv("WARP_LOG_FORMAT") == string(FormatJSON) {
+		logFormat = FormatJSON
+	}
+}
+
+// SetFormat sets the format of the logs. It defaults to FormatText unless the
+// WARP_LOG_FORMAT env variable is set to `json`.
+func SetFormat(f Format) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	logFormat = f
+}
+
+// SetOutput sets the destination of the logs, stderr by default.
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	log.SetOutput(w)
+}
+
+// Writer returns the destination of the logs.
+func Writer() io.Writer {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return log.Writer()
+}
+
 var silentKey = new(int)
 
 // SetSilent indicates that logs should not actually be omitted for this ctx
@@ -21,24 +71,89 @@ func Silent(ctx context.Context) bool {
 
 // Log shells out to log.Print if Silent is not set.
 func Log(c context.Context, v ...interface{}) {
-	if c != nil {
-		if !Silent(c) {
-			log.Print(v...)
-		}
-	} else {
-		log.Print(v...)
+	if c != nil && Silent(c) {
+		return
 	}
+	output("info", fmt.Sprint(v...), nil)
 }
 
 // Logf shells out to log.Printf if Silent is not set.
 func Logf(c context.Context, format string, v ...interface{}) {
-	if c != nil {
-		if !Silent(c) {
-			log.Printf(format, v...)
+	if c != nil && Silent(c) {
+		return
+	}
+	output("info", fmt.Sprintf(format, v...), nil)
+}
+
+// Warnf is Logf at warning level, for conditions operators should act upon.
+// In text format the message is prefixed with `Warning:`.
+func Warnf(c context.Context, format string, v ...interface{}) {
+	if c != nil && Silent(c) {
+		return
+	}
+	output("warn", fmt.Sprintf(format, v...), nil)
+}
+
+// Logkv logs structured key/values if Silent is not set. The `msg` key, if
+// present, is used as the message. In text format key/values are printed as
+// `key=value` sorted by key.
+func Logkv(c context.Context, kv map[string]interface{}) {
+	if c != nil && Silent(c) {
+		return
+	}
+	msg, _ := kv["msg"].(string)
+	fields := map[string]interface{}{}
+	for k, v := range kv {
+		if k != "msg" {
+			fields[k] = v
+		}
+	}
+	output("info", msg, fields)
+}
+
+// output writes a log entry at level in the current format.
+func output(level string, msg string, fields map[string]interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if logFormat != FormatJSON {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := []string{}
+		if level == "warn" {
+			parts = append(parts, "Warning:")
+		}
+		if msg != "" {
+			parts = append(parts, msg)
+		}
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, fields[k]))
 		}
-	} else {
-		log.Printf(format, v...)
+		log.Print(strings.Join(parts, " "))
+		return
+	}
+
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	// Messages of Logf calls often end with a newline.
+	entry["msg"] = strings.TrimRight(msg, "\n")
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		raw, _ = json.Marshal(map[string]interface{}{
+			"ts":    entry["ts"],
+			"level": "error",
+			"msg":   fmt.Sprintf("Unable to log entry: %v", err),
+		})
 	}
+	log.Writer().Write(append(raw, '\n'))
 }
 
 // PadRight right-pads a string.
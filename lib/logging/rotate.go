@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// RotatingFile is an io.Writer appending to a file that is rolled once it
+// reaches a maximum size: `<path>` is renamed `<path>.1`, `<path>.1` renamed
+// `<path>.2` and so on, keeping at most a given number of backups. It is safe
+// for concurrent use.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+
+	mutex *sync.Mutex
+}
+
+// NewRotatingFile opens (or creates) the file at path for appending, rolling
+// it when it reaches maxSize bytes and keeping backups rolled files.
+func NewRotatingFile(
+	path string,
+	maxSize int64,
+	backups int,
+) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, errors.Trace(
+			errors.Newf("Invalid log file max size: %d", maxSize),
+		)
+	}
+	if backups < 0 {
+		return nil, errors.Trace(
+			errors.Newf("Invalid log file backups: %d", backups),
+		)
+	}
+	f := &RotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+		mutex:   &sync.Mutex{},
+	}
+	if err := f.open(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+// open opens the file for appending. The lock must be held.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(
+		f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644,
+	)
+	if err != nil {
+		return errors.Trace(
+			errors.Newf("Failed to open log file %s: %v", f.path, err),
+		)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Trace(
+			errors.Newf("Failed to stat log file %s: %v", f.path, err),
+		)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate closes the file, shifts the backups and reopens a new file. The lock
+// must be held.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if f.backups == 0 {
+		os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i > 0; i-- {
+			os.Rename(
+				fmt.Sprintf("%s.%d", f.path, i),
+				fmt.Sprintf("%s.%d", f.path, i+1),
+			)
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+	return f.open()
+}
+
+// Write implements the io.Writer interface. The file is rolled before writing
+// p if p would make it exceed its maximum size, unless it is empty.
+func (f *RotatingFile) Write(
+	p []byte,
+) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, errors.Trace(errors.Newf("Log file closed: %s", f.path))
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file. Subsequent writes fail.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
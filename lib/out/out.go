@@ -22,18 +22,38 @@ func init() {
 	redBold = color.New(color.FgRed, color.Bold)
 }
 
+// quiet suppresses all messages but warnings and errors.
+var quiet bool
+
+// SetQuiet sets whether messages other than warnings and errors are
+// suppressed. It only affects the messages printed by this package, not the
+// data written directly to the terminal. It must be called before printing
+// any message.
+func SetQuiet(q bool) {
+	quiet = q
+}
+
 // Normf prints a normal message.
 func Normf(format string, v ...interface{}) {
+	if quiet {
+		return
+	}
 	fmt.Printf(format, v...)
 }
 
 // Boldf prints a bold message.
 func Boldf(format string, v ...interface{}) {
+	if quiet {
+		return
+	}
 	bold.PrintfFunc()(format, v...)
 }
 
 // Valuf prints an example message.
 func Valuf(format string, v ...interface{}) {
+	if quiet {
+		return
+	}
 	cyan.PrintfFunc()(format, v...)
 }
 
@@ -47,7 +67,10 @@ func Errof(format string, v ...interface{}) {
 	redBold.PrintfFunc()(format, v...)
 }
 
-// Statf prints an error message.
+// Statf prints a status message.
 func Statf(format string, v ...interface{}) {
+	if quiet {
+		return
+	}
 	magenta.PrintfFunc()(format, v...)
 }
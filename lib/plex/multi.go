@@ -0,0 +1,105 @@
+package plex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// WriteError is the error returned by one of the writers of a MultiWriter.
+type WriteError struct {
+	// Index is the index of the writer in the writers of the MultiWriter.
+	Index int
+	Err   error
+}
+
+// WriteErrors are the errors of the writers that failed during a write to a
+// MultiWriter.
+type WriteErrors []WriteError
+
+// Error implements the error interface.
+func (e WriteErrors) Error() string {
+	errs := []string{}
+	for _, err := range e {
+		errs = append(errs, fmt.Sprintf("writer %d: %v", err.Index, err.Err))
+	}
+	return strings.Join(errs, ", ")
+}
+
+// MultiWriter duplicates its writes to several writers. Unlike io.MultiWriter
+// a writer failing does not stop the others: it is dropped and the data keeps
+// being forwarded to the remaining writers. A short write counts as a failure.
+// It is safe for concurrent use.
+type MultiWriter struct {
+	writers []io.Writer
+	failed  []error
+
+	mutex *sync.Mutex
+}
+
+// NewMultiWriter returns a MultiWriter duplicating its writes to writers.
+func NewMultiWriter(
+	writers ...io.Writer,
+) *MultiWriter {
+	return &MultiWriter{
+		writers: writers,
+		failed:  make([]error, len(writers)),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Write writes p to the writers that have not failed yet. It returns len(p)
+// as long as at least one writer is left, along with WriteErrors if writers
+// failed during this write. Once all writers failed it returns 0 and
+// io.ErrClosedPipe.
+func (m *MultiWriter) Write(
+	p []byte,
+) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	errs := WriteErrors{}
+	healthy := 0
+	for i, w := range m.writers {
+		if m.failed[i] != nil {
+			continue
+		}
+		n, err := w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			m.failed[i] = err
+			errs = append(errs, WriteError{Index: i, Err: err})
+			continue
+		}
+		healthy++
+	}
+
+	if healthy == 0 {
+		if len(errs) > 0 {
+			return 0, errs
+		}
+		return 0, io.ErrClosedPipe
+	}
+	if len(errs) > 0 {
+		return len(p), errs
+	}
+	return len(p), nil
+}
+
+// Errors returns the errors of the writers that failed so far, in the order
+// of the writers.
+func (m *MultiWriter) Errors() WriteErrors {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	errs := WriteErrors{}
+	for i, err := range m.failed {
+		if err != nil {
+			errs = append(errs, WriteError{Index: i, Err: err})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,97 @@
+package plex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// failingWriter fails once it was written limit bytes, writing the part of the
+// data that fits.
+type failingWriter struct {
+	buf   bytes.Buffer
+	limit int
+	err   error
+}
+
+func (w *failingWriter) Write(
+	p []byte,
+) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		n := w.limit - w.buf.Len()
+		w.buf.Write(p[:n])
+		return n, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func TestMultiWriterDropsFailingWriter(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	healthy := &bytes.Buffer{}
+	failing := &failingWriter{limit: 8, err: errBroken}
+	m := NewMultiWriter(failing, healthy)
+
+	for i, chunk := range []string{"hello ", "world ", "again"} {
+		n, err := m.Write([]byte(chunk))
+		if n != len(chunk) {
+			t.Fatalf("Write %d: got n=%d, want %d", i, n, len(chunk))
+		}
+		// The failure is only reported by the write it happened during.
+		if i == 1 {
+			errs, ok := err.(WriteErrors)
+			if !ok || len(errs) != 1 || errs[0].Index != 0 ||
+				errs[0].Err != errBroken {
+				t.Fatalf("Write %d: got %v, want the failing writer error", i, err)
+			}
+		} else if err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+
+	if got := healthy.String(); got != "hello world again" {
+		t.Fatalf("healthy writer: got %q", got)
+	}
+	if got := failing.buf.String(); got != "hello wo" {
+		t.Fatalf("failing writer written to after failing: got %q", got)
+	}
+	if errs := m.Errors(); len(errs) != 1 || errs[0].Index != 0 {
+		t.Fatalf("Errors: got %v", errs)
+	}
+}
+
+func TestMultiWriterShortWrite(t *testing.T) {
+	healthy := &bytes.Buffer{}
+	// A short write without error counts as a failure.
+	short := &failingWriter{limit: 3}
+	m := NewMultiWriter(healthy, short)
+
+	_, err := m.Write([]byte("hello"))
+	errs, ok := err.(WriteErrors)
+	if !ok || len(errs) != 1 || errs[0].Index != 1 ||
+		errs[0].Err != io.ErrShortWrite {
+		t.Fatalf("Write: got %v, want a short write of writer 1", err)
+	}
+	if _, err := m.Write([]byte(" world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := healthy.String(); got != "hello world" {
+		t.Fatalf("healthy writer: got %q", got)
+	}
+}
+
+func TestMultiWriterAllFailed(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	m := NewMultiWriter(
+		&failingWriter{limit: 4, err: errBroken},
+		&failingWriter{limit: 2, err: errBroken},
+	)
+
+	n, err := m.Write([]byte("hello"))
+	if errs, ok := err.(WriteErrors); n != 0 || !ok || len(errs) != 2 {
+		t.Fatalf("Write: got (%d, %v), want (0, 2 write errors)", n, err)
+	}
+	if n, err := m.Write([]byte("hello")); n != 0 || err != io.ErrClosedPipe {
+		t.Fatalf("Write: got (%d, %v), want (0, %v)", n, err, io.ErrClosedPipe)
+	}
+}
@@ -3,30 +3,173 @@ package plex
 import (
 	"context"
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
-// Run pipes src to a funtion and aborts if the context gets canceled.
+// DefaultBufferSize is the size of the buffer used by Run. Reads return as
+// soon as data is available so a small buffer keeps keystroke latency low,
+// while larger buffers trade latency for throughput on bulk output.
+const DefaultBufferSize = 1024
+
+// deadliner is implemented by readers supporting read deadlines (net.Conn,
+// pollable *os.File such as a pty).
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Run pipes src to a funtion and aborts if the context gets canceled. It
+// returns promptly once the context is canceled even if a read is blocked:
+//   - if src supports read deadlines, the blocked read is interrupted.
+//   - if src is a file that doesn't (e.g. stdin which can't be closed without
+//     side effects), the read is left pending and handed off to the next Run
+//     reading the file, so that the input it returns is not lost.
+//   - otherwise, the read is left running in the background until it
+//     returns, its data being discarded.
+//
+// In all cases dst is not called with data read after the context got
+// canceled.
 func Run(
 	ctx context.Context,
 	dst func([]byte),
 	src io.Reader,
 ) {
-	buf := make([]byte, 1024)
-PLEXLOOP:
+	RunBuffered(ctx, dst, src, DefaultBufferSize)
+}
+
+// RunBuffered is Run reading src with a buffer of size bytes (DefaultBufferSize
+// if size is not positive). Partial reads are passed to dst immediately, the
+// buffer size only bounds the size of each chunk.
+func RunBuffered(
+	ctx context.Context,
+	dst func([]byte),
+	src io.Reader,
+	size int,
+) {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if f, ok := src.(*os.File); ok && f.SetReadDeadline(time.Time{}) != nil {
+		src = &handoffReader{ctx: ctx, f: f}
+	}
+
+	doneC := make(chan struct{})
+	go func() {
+		run(ctx, dst, src, size)
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+		return
+	case <-ctx.Done():
+	}
+
+	if d, ok := src.(deadliner); ok {
+		if err := d.SetReadDeadline(time.Now()); err == nil {
+			<-doneC
+			// Clear the deadline so that src can be read again.
+			d.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// run pipes src to dst until src errors or ctx gets canceled.
+func run(
+	ctx context.Context,
+	dst func([]byte),
+	src io.Reader,
+	size int,
+) {
+	buf := make([]byte, size)
 	for {
 		nr, err := src.Read(buf)
 		if nr > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
 			cpy := make([]byte, nr)
 			copy(cpy, buf)
 			dst(cpy)
 		}
 		if err != nil {
-			break
+			return
 		}
 		select {
 		case <-ctx.Done():
-			break PLEXLOOP
+			return
 		default:
 		}
 	}
 }
+
+// readResult is the result of a read of a file.
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// pendingReads holds the reads of the files read by handoffReaders, which are
+// left pending when their reader gets canceled.
+var pendingReads = struct {
+	*sync.Mutex
+	m map[*os.File]chan readResult
+}{
+	Mutex: &sync.Mutex{},
+	m:     map[*os.File]chan readResult{},
+}
+
+// handoffReader reads a file not supporting read deadlines until ctx is done.
+// Reads are made in the background: once ctx is done, Read returns while the
+// read of the file is pending, and the next handoffReader of the file returns
+// its result instead of reading the file concurrently. Reads of a file must
+// not be concurrent.
+type handoffReader struct {
+	ctx context.Context
+	f   *os.File
+}
+
+// Read implements io.Reader.
+func (r *handoffReader) Read(
+	p []byte,
+) (int, error) {
+	pendingReads.Lock()
+	resultC, ok := pendingReads.m[r.f]
+	if !ok {
+		resultC = make(chan readResult, 1)
+		pendingReads.m[r.f] = resultC
+		go func() {
+			buf := make([]byte, len(p))
+			n, err := r.f.Read(buf)
+			resultC <- readResult{data: buf[:n], err: err}
+		}()
+	}
+	pendingReads.Unlock()
+
+	select {
+	case res := <-resultC:
+		pendingReads.Lock()
+		defer pendingReads.Unlock()
+		if r.ctx.Err() != nil {
+			// Canceled concurrently, the result is left for the next read.
+			resultC <- res
+			return 0, r.ctx.Err()
+		}
+		n := copy(p, res.data)
+		if n < len(res.data) {
+			resultC <- readResult{data: res.data[n:], err: res.err}
+			return n, nil
+		}
+		delete(pendingReads.m, r.f)
+		return n, res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
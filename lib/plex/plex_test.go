@@ -0,0 +1,235 @@
+package plex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const testTimeout = 5 * time.Second
+
+// newStream opens a yamux stream over an in-memory connection, returning both
+// of its ends.
+func newStream(
+	t *testing.T,
+) (net.Conn, net.Conn) {
+	t.Helper()
+	cc, sc := net.Pipe()
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+
+	client, err := yamux.Client(cc, config)
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	server, err := yamux.Server(sc, config)
+	if err != nil {
+		t.Fatalf("Server: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	src, err := client.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Streams are only accepted once data was sent on them.
+	if _, err := src.Write([]byte{0}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	dst, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := dst.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return dst, src
+}
+
+// runAsync runs RunBuffered in the background, returning a channel closed once
+// it returned.
+func runAsync(
+	ctx context.Context,
+	dst func([]byte),
+	src interface{ Read([]byte) (int, error) },
+) chan struct{} {
+	doneC := make(chan struct{})
+	go func() {
+		RunBuffered(ctx, dst, src, 0)
+		close(doneC)
+	}()
+	return doneC
+}
+
+// waitDone waits for doneC to be closed, failing t otherwise.
+func waitDone(
+	t *testing.T,
+	doneC chan struct{},
+) {
+	t.Helper()
+	select {
+	case <-doneC:
+	case <-time.After(testTimeout):
+		t.Fatalf("RunBuffered did not return once canceled")
+	}
+}
+
+func TestRunCanceledMidCopy(t *testing.T) {
+	src, w := newStream(t)
+
+	// The peer writes until the copy gets canceled.
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var received, afterReturn int64
+	var returned int32
+	doneC := runAsync(ctx, func(data []byte) {
+		if atomic.LoadInt32(&returned) == 1 {
+			atomic.AddInt64(&afterReturn, 1)
+		}
+		atomic.AddInt64(&received, int64(len(data)))
+	}, src)
+
+	for atomic.LoadInt64(&received) < 64*1024 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	waitDone(t, doneC)
+	atomic.StoreInt32(&returned, 1)
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&afterReturn); n > 0 {
+		t.Fatalf("dst called %d times after RunBuffered returned", n)
+	}
+}
+
+func TestRunCanceledBlockedRead(t *testing.T) {
+	src, w := newStream(t)
+
+	// The transfer stalls midway, the copy being blocked reading.
+	if _, err := w.Write([]byte("first")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	dataC := make(chan []byte, 16)
+	doneC := runAsync(ctx, func(data []byte) {
+		dataC <- data
+	}, src)
+	if data := <-dataC; string(data) != "first" {
+		t.Fatalf("RunBuffered: got %q, want %q", data, "first")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The blocked read is interrupted.
+	cancel()
+	waitDone(t, doneC)
+
+	// The stream can be read again, without the data being lost.
+	if _, err := w.Write([]byte("second")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	runAsync(ctx, func(data []byte) {
+		dataC <- data
+	}, src)
+	select {
+	case data := <-dataC:
+		if string(data) != "second" {
+			t.Fatalf("RunBuffered: got %q, want %q", data, "second")
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("stream not readable after the copy was canceled")
+	}
+}
+
+func TestRunHandsOffPendingRead(t *testing.T) {
+	// A blocking pipe, which doesn't support read deadlines, like stdin.
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	r := os.NewFile(uintptr(fds[0]), "r")
+	w := os.NewFile(uintptr(fds[1]), "w")
+	defer r.Close()
+	defer w.Close()
+	if r.SetReadDeadline(time.Time{}) == nil {
+		t.Skip("pipe supports read deadlines")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceledC := make(chan []byte, 16)
+	doneC := runAsync(ctx, func(data []byte) {
+		canceledC <- data
+	}, r)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	waitDone(t, doneC)
+
+	// The input read by the pending read of the canceled run goes to the
+	// next run.
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	dataC := make(chan []byte, 16)
+	runAsync(ctx, func(data []byte) {
+		dataC <- data
+	}, r)
+	select {
+	case data := <-dataC:
+		if string(data) != "hello" {
+			t.Fatalf("RunBuffered: got %q, want %q", data, "hello")
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("input lost by the canceled run")
+	}
+	select {
+	case data := <-canceledC:
+		t.Fatalf("canceled run received %q", data)
+	default:
+	}
+}
+
+// BenchmarkRunBuffered measures the throughput of RunBuffered forwarding bulk
+// output depending on its buffer size.
+func BenchmarkRunBuffered(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	ctx := context.Background()
+
+	for _, size := range []int{512, DefaultBufferSize, 4096, 16384, 65536} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				n := 0
+				RunBuffered(ctx, func(data []byte) {
+					n += len(data)
+				}, bytes.NewReader(payload), size)
+				if n != len(payload) {
+					b.Fatalf("RunBuffered: got %d bytes, want %d", n, len(payload))
+				}
+			}
+		})
+	}
+}
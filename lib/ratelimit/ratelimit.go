@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Limiter is a token bucket limiting a byte stream to a rate (in bytes per
+// second) with bursts of up to burst bytes. It throttles rather than drops:
+// Wait blocks until the bytes can be let through.
+type Limiter struct {
+	rate  int
+	burst int
+
+	tokens float64
+	last   time.Time
+
+	mutex *sync.Mutex
+}
+
+// New creates a Limiter with a full bucket. The burst defaults to the rate if
+// it is not positive.
+func New(
+	rate int,
+	burst int,
+) *Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Rate returns the rate of the limiter in bytes per second.
+func (l *Limiter) Rate() int {
+	return l.rate
+}
+
+// Burst returns the burst size of the limiter in bytes.
+func (l *Limiter) Burst() int {
+	return l.burst
+}
+
+// Wait blocks until n bytes can be let through or ctx is done. Writes larger
+// than the burst are let through in burst-sized chunks. In the common case
+// (tokens available) it does not block nor allocate.
+func (l *Limiter) Wait(
+	ctx context.Context,
+	n int,
+) error {
+	for n > 0 {
+		chunk := n
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+		if delay := l.reserve(chunk); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Trace(ctx.Err())
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// reserve takes n tokens from the bucket, possibly going in debt, and returns
+// the time to wait for the debt to be repaid.
+func (l *Limiter) reserve(
+	n int,
+) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
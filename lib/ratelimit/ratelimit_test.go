@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// timeWait returns the time taken by l.Wait(ctx, n), failing t on error.
+func timeWait(
+	t *testing.T,
+	l *Limiter,
+	n int,
+) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if err := l.Wait(context.Background(), n); err != nil {
+		t.Fatalf("Wait(%d): %v", n, err)
+	}
+	return time.Since(start)
+}
+
+func TestBurst(t *testing.T) {
+	l := New(1000, 500)
+
+	// The bucket starts full.
+	if d := timeWait(t, l, 500); d > 20*time.Millisecond {
+		t.Fatalf("burst throttled: waited %s", d)
+	}
+}
+
+func TestDefaultBurst(t *testing.T) {
+	if l := New(1000, 0); l.Burst() != 1000 {
+		t.Fatalf("Burst: got %d, want %d", l.Burst(), 1000)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l := New(1000, 100)
+	timeWait(t, l, 100)
+
+	// 50 bytes are let through once the bucket refilled for 50ms.
+	if d := timeWait(t, l, 50); d < 40*time.Millisecond || d > time.Second {
+		t.Fatalf("empty bucket: waited %s, want about 50ms", d)
+	}
+
+	// The bucket refills up to its burst while idle.
+	time.Sleep(200 * time.Millisecond)
+	if d := timeWait(t, l, 100); d > 20*time.Millisecond {
+		t.Fatalf("refilled bucket: waited %s", d)
+	}
+}
+
+func TestChunksAboveBurst(t *testing.T) {
+	l := New(10000, 1000)
+
+	// The first chunk uses the burst, the next two wait 100ms each.
+	if d := timeWait(t, l, 3000); d < 180*time.Millisecond || d > time.Second {
+		t.Fatalf("3 chunks: waited %s, want about 200ms", d)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(10, 10)
+	timeWait(t, l, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err := l.Wait(ctx, 10)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Wait: got %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Wait returned %s after its context was canceled", d)
+	}
+}
+
+// BenchmarkWait measures the latency Wait adds to writes when tokens are
+// available, the common case.
+func BenchmarkWait(b *testing.B) {
+	ctx := context.Background()
+	l := New(1<<40, 1<<40)
+
+	b.ReportAllocs()
+	b.SetBytes(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := l.Wait(ctx, 1024); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package token
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Secrets
+
+// Secrets are hashed with PBKDF2-SHA256 (as the keys of lib/e2e) with a
+// random salt generated by RandStr. Hashes are encoded along with their
+// parameters:
+//
+//   pbkdf2-sha256$<iterations>$<salt>$<hash (base64)>
+//
+// so that the cost can be raised without invalidating the existing hashes.
+//
+// crypto/pbkdf2 requires Go 1.24 or later.
+
+const (
+	// DefaultHashIterations is the default number of PBKDF2 iterations of
+	// HashSecret, taking a few tens of milliseconds. Each iteration adds
+	// as much to the work of an attacker brute-forcing a stolen hash as to
+	// each verification.
+	DefaultHashIterations = 100000
+	// MinHashIterations and MaxHashIterations bound the number of
+	// iterations accepted by HashSecret and VerifySecret, the latter bounding
+	// the work a crafted hash can cause.
+	MinHashIterations = 1000
+	MaxHashIterations = 10000000
+
+	hashScheme = "pbkdf2-sha256"
+	hashLength = 32
+)
+
+// HashSecret hashes secret with a random salt and iterations PBKDF2 iterations
+// (DefaultHashIterations if 0), returning the encoded hash to be stored and
+// passed to VerifySecret.
+func HashSecret(
+	secret string,
+	iterations int,
+) (string, error) {
+	if iterations == 0 {
+		iterations = DefaultHashIterations
+	}
+	if iterations < MinHashIterations || iterations > MaxHashIterations {
+		return "", errors.Trace(
+			errors.Newf(
+				"Invalid hash iterations: %d (min: %d, max: %d)",
+				iterations, MinHashIterations, MaxHashIterations,
+			),
+		)
+	}
+	salt := RandStr()
+	hash, err := pbkdf2.Key(
+		sha256.New, secret, []byte(salt), iterations, hashLength,
+	)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf(
+		"%s$%d$%s$%s",
+		hashScheme, iterations, salt,
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// VerifySecret returns whether secret matches hash, as returned by HashSecret.
+// The hashes are compared in constant time. An error is returned if hash is
+// malformed.
+func VerifySecret(
+	secret string,
+	hash string,
+) (bool, error) {
+	iterations, salt, expected, err := parseSecretHash(hash)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	actual, err := pbkdf2.Key(
+		sha256.New, secret, []byte(salt), iterations, hashLength,
+	)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return subtle.ConstantTimeCompare(actual, expected) == 1, nil
+}
+
+// CheckSecretHash checks that hash is well formed (see HashSecret), without
+// the cost of a verification, to validate hashes received from peers.
+func CheckSecretHash(
+	hash string,
+) error {
+	_, _, _, err := parseSecretHash(hash)
+	return errors.Trace(err)
+}
+
+// parseSecretHash parses an encoded hash, returning its number of iterations,
+// its salt and the hash itself.
+func parseSecretHash(
+	hash string,
+) (int, string, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return 0, "", nil, errors.Trace(
+			errors.Newf("Malformed secret hash"),
+		)
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil ||
+		iterations < MinHashIterations || iterations > MaxHashIterations {
+		return 0, "", nil, errors.Trace(
+			errors.Newf("Invalid secret hash iterations: %s", parts[1]),
+		)
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) != hashLength {
+		return 0, "", nil, errors.Trace(
+			errors.Newf("Malformed secret hash"),
+		)
+	}
+	return iterations, parts[2], expected, nil
+}
+
+// Equal compares the secrets a and b in constant time (only their length may
+// leak), to be used instead of == when comparing secrets presented by peers.
+func Equal(
+	a string,
+	b string,
+) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
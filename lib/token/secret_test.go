@@ -0,0 +1,88 @@
+package token
+
+import (
+	"strings"
+	"testing"
+)
+
+// vectorHash is the PBKDF2-HMAC-SHA256 test vector of RFC 7914 (password
+// "Password", salt "NaCl", 80000 iterations) in the format of HashSecret, the
+// first 32 bytes of the derived key being kept.
+const vectorHash = "pbkdf2-sha256$80000$NaCl$TdzY9guYviGDDO5e8icB+WQaRBjQTAQUrv8Ih2s0q1Y"
+
+func TestVerifySecretVector(t *testing.T) {
+	if ok, err := VerifySecret("Password", vectorHash); err != nil || !ok {
+		t.Fatalf("VerifySecret: got (%t, %v), want (true, nil)", ok, err)
+	}
+	for _, secret := range []string{"", "password", "Password ", "Passwor"} {
+		if ok, err := VerifySecret(secret, vectorHash); err != nil || ok {
+			t.Errorf("VerifySecret(%q): got (%t, %v), want (false, nil)", secret, ok, err)
+		}
+	}
+}
+
+func TestHashSecret(t *testing.T) {
+	hash, err := HashSecret("hunter2", MinHashIterations)
+	if err != nil {
+		t.Fatalf("HashSecret: %v", err)
+	}
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$1000$") {
+		t.Fatalf("HashSecret: got %q, want the scheme and iterations first", hash)
+	}
+	if err := CheckSecretHash(hash); err != nil {
+		t.Fatalf("CheckSecretHash: %v", err)
+	}
+	if ok, err := VerifySecret("hunter2", hash); err != nil || !ok {
+		t.Fatalf("VerifySecret: got (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := VerifySecret("hunter3", hash); err != nil || ok {
+		t.Fatalf("VerifySecret(wrong): got (%t, %v), want (false, nil)", ok, err)
+	}
+
+	// Hashes are salted.
+	other, err := HashSecret("hunter2", MinHashIterations)
+	if err != nil {
+		t.Fatalf("HashSecret: %v", err)
+	}
+	if other == hash {
+		t.Fatalf("HashSecret: same hash %q generated twice", hash)
+	}
+
+	for _, iterations := range []int{-1, MinHashIterations - 1, MaxHashIterations + 1} {
+		if _, err := HashSecret("hunter2", iterations); err == nil {
+			t.Errorf("HashSecret(%d iterations): got nil, want an error", iterations)
+		}
+	}
+}
+
+func TestMalformedSecretHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+		"bcrypt$4096$salt$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+		"pbkdf2-sha256$4096$salt",
+		"pbkdf2-sha256$x$salt$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+		// The work of verifications is bounded.
+		"pbkdf2-sha256$1000000000$salt$xeR41ZKIyEGqUw22hFxMjZYok6ABzk4RpJY4c6qYE0o",
+		"pbkdf2-sha256$4096$salt$xeR41ZKI",
+		"pbkdf2-sha256$4096$salt$!!",
+	} {
+		if err := CheckSecretHash(hash); err == nil {
+			t.Errorf("CheckSecretHash(%q): got nil, want an error", hash)
+		}
+		if ok, err := VerifySecret("password", hash); err == nil || ok {
+			t.Errorf("VerifySecret(%q): got (%t, %v), want an error", hash, ok, err)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !Equal("secret", "secret") {
+		t.Errorf("Equal: got false for equal secrets")
+	}
+	for _, b := range []string{"", "secreT", "secret2"} {
+		if Equal("secret", b) {
+			t.Errorf("Equal(%q, %q): got true, want false", "secret", b)
+		}
+	}
+}
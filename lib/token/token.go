@@ -12,7 +12,10 @@ import (
 
 const (
 	tokenLength = 16
-	a62         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789__"
+	// a62 is a base64 alphabet whose last two symbols are dropped from
+	// tokens, which only contain its 62 alphanumeric characters (base64
+	// rejects alphabets with duplicate symbols).
+	a62 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
 )
 
 var tokens = make(tokenFountain, 512)
@@ -25,7 +28,7 @@ func (f tokenFountain) Write(
 	var token [tokenLength]byte
 	var i int
 	for _, b := range buf {
-		if b != '_' {
+		if b != '-' && b != '_' {
 			token[i] = b
 			i++
 		}
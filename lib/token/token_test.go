@@ -0,0 +1,42 @@
+package token
+
+import (
+	"strings"
+	"testing"
+)
+
+// isAlphanumeric returns whether s only contains ASCII letters and digits.
+func isAlphanumeric(
+	s string,
+) bool {
+	for _, r := range s {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandStr(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		s := RandStr()
+		if len(s) != tokenLength || !isAlphanumeric(s) {
+			t.Fatalf("RandStr: got %q, want %d alphanumeric characters", s, tokenLength)
+		}
+		if seen[s] {
+			t.Fatalf("RandStr: %q generated twice", s)
+		}
+		seen[s] = true
+	}
+}
+
+func TestNew(t *testing.T) {
+	tok := New("session")
+	if !strings.HasPrefix(tok, "session_") {
+		t.Fatalf("New: got %q, want a session_ prefix", tok)
+	}
+	if s := strings.TrimPrefix(tok, "session_"); len(s) != tokenLength || !isAlphanumeric(s) {
+		t.Fatalf("New: got %q, want %d alphanumeric characters after the prefix", tok, tokenLength)
+	}
+}
@@ -0,0 +1,274 @@
+// Package websocket implements the server side of the WebSocket protocol (RFC
+// 6455), enough to stream data to browsers.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+)
+
+// Opcodes of the frames.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// MaxMessageSize is the maximum size in bytes of the messages read from a peer.
+// Longer messages are rejected as the server only expects small control
+// messages from browsers.
+const MaxMessageSize = 64 * 1024
+
+// closeTimeout bounds the time spent sending the close frame.
+const closeTimeout = 1 * time.Second
+
+// acceptGUID is appended to the key of the client to compute the accept key
+// of the handshake.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Conn is a WebSocket connection upgraded from an HTTP request. Writes are
+// thread-safe, reads must happen from a single goroutine.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeMutex *sync.Mutex
+	closeOnce  *sync.Once
+}
+
+// headerContains returns whether the comma-separated header h of r contains
+// token (case insensitive).
+func headerContains(
+	r *http.Request,
+	h string,
+	token string,
+) bool {
+	for _, v := range r.Header[http.CanonicalHeaderKey(h)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade performs the WebSocket handshake of request r and returns the
+// resulting connection. An HTTP error is written to w if the handshake fails.
+func Upgrade(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r, "Connection", "upgrade") ||
+		!headerContains(r, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.Trace(
+			errors.Newf("Not a WebSocket upgrade request"),
+		)
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.Trace(
+			errors.Newf("Unsupported WebSocket version: %s", v),
+		)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.Trace(
+			errors.Newf("The response can't be hijacked"),
+		)
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.Trace(
+			errors.Newf("Hijack error: %v", err),
+		)
+	}
+	// Deadlines set by the HTTP server don't apply to the connection anymore.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) +
+		"\r\n\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		conn.Close()
+		return nil, errors.Trace(
+			errors.Newf("Handshake error: %v", err),
+		)
+	}
+
+	return &Conn{
+		conn:       conn,
+		br:         brw.Reader,
+		writeMutex: &sync.Mutex{},
+		closeOnce:  &sync.Once{},
+	}, nil
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// WriteMessage writes data as a single (unfragmented) frame of type opcode.
+func (c *Conn) WriteMessage(
+	opcode byte,
+	data []byte,
+) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(data) < 126:
+		header = append(header, byte(len(data)))
+	case len(data) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// readFrame reads a frame, unmasking its payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := h[0]&0x80 != 0, h[0]&0x0f
+	masked := h[1]&0x80 != 0
+	size := uint64(h[1] & 0x7f)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, errors.Trace(err)
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, errors.Trace(err)
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+	// Clients must mask their frames.
+	if !masked {
+		return false, 0, nil, errors.Trace(
+			errors.Newf("Unmasked frame received"),
+		)
+	}
+	if size > MaxMessageSize {
+		return false, 0, nil, errors.Trace(
+			errors.Newf(
+				"Frame too large: %d bytes (max: %d)",
+				size, MaxMessageSize,
+			),
+		)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, errors.Trace(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		return false, 0, nil, errors.Trace(err)
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	return fin, opcode, data, nil
+}
+
+// ReadMessage reads the next text or binary message, reassembling fragmented
+// ones. Pings are answered and io.EOF is returned once the peer closed the
+// connection.
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, errors.Trace(err)
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			c.Close()
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if message == nil {
+				return 0, nil, errors.Trace(
+					errors.Newf("Unexpected continuation frame"),
+				)
+			}
+		case OpText, OpBinary:
+			if message != nil {
+				return 0, nil, errors.Trace(
+					errors.Newf("Unexpected data frame in a fragmented message"),
+				)
+			}
+			opcode = op
+			message = []byte{}
+		default:
+			return 0, nil, errors.Trace(
+				errors.Newf("Unknown opcode: %d", op),
+			)
+		}
+		message = append(message, data...)
+		if len(message) > MaxMessageSize {
+			return 0, nil, errors.Trace(
+				errors.Newf(
+					"Message too large: %d bytes (max: %d)",
+					len(message), MaxMessageSize,
+				),
+			)
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// Close sends a close frame (best effort) and closes the connection. It is
+// safe to call multiple times.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.WriteMessage(OpClose, []byte{0x03, 0xe8}) // 1000: normal closure.
+		c.conn.Close()
+	})
+	return nil
+}
@@ -1,6 +1,17 @@
 package warp
 
-import "regexp"
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/token"
+)
 
 //
 // Remote Warpd Protocol
@@ -9,9 +20,129 @@ import "regexp"
 // Version is the current warp version.
 var Version = "0.0.3"
 
+// ProtocolVersion is the version of the protocol spoken between warp and warpd.
+// It is bumped on incompatible changes to the messages they exchange.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version still supported, for
+// peers that are not up to date.
+const MinProtocolVersion = 1
+
+// NegotiateProtocolVersion returns the protocol version to use with a peer
+// speaking up to version peer: the lowest of the two versions (the most recent
+// version both sides know). The peer is incompatible if the result is lower
+// than MinProtocolVersion. Peers predating the negotiation send version 0 and
+// are therefore incompatible.
+func NegotiateProtocolVersion(
+	peer int,
+) int {
+	if peer < ProtocolVersion {
+		return peer
+	}
+	return ProtocolVersion
+}
+
 // DefaultAddress to connect to
 var DefaultAddress = "warp.link:4242"
 
+// UnixAddressPrefix prefixes warpd addresses designating a unix socket path
+// (`unix:/var/run/warpd.sock`) instead of a TCP address.
+var UnixAddressPrefix = "unix:"
+
+// NormalizeAddress validates a TCP warpd address (host:port) and returns it in
+// canonical form. The host may be a hostname, an IPv4 address or a bracketed
+// IPv6 address (`[::1]:4242`); it may be empty to designate all local
+// addresses. URLs (`quic://host:port`) are rejected, TCP being the only
+// transport.
+func NormalizeAddress(
+	address string,
+) (string, error) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return "", errors.Trace(
+			errors.Newf(
+				"Malformed address %s: unsupported scheme %s (addresses are "+
+					"host:port)",
+				address, address[:i],
+			),
+		)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return "", errors.Trace(
+				errors.Newf(
+					"Malformed address %s: IPv6 addresses must be bracketed "+
+						"(`[::1]:4242`)",
+					address,
+				),
+			)
+		}
+		return "", errors.Trace(
+			errors.Newf("Malformed address %s: %v", address, err),
+		)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return "", errors.Trace(
+			errors.Newf("Malformed address %s: invalid port %q", address, port),
+		)
+	}
+	if strings.ContainsAny(host, "[]/ ") {
+		return "", errors.Trace(
+			errors.Newf("Malformed address %s: invalid host %q", address, host),
+		)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p)), nil
+}
+
+// DefaultStreamWindow is the default receive window in bytes of the channels
+// of the sessions between warp and warpd, which is also the minimum supported
+// by yamux. The throughput of the data channel is bounded by its window per
+// round-trip (under 3MiB/s over a 50ms round-trip with the default window):
+// larger windows speed up bulk output over high latency links at the cost of
+// memory per session.
+const DefaultStreamWindow = 256 * 1024
+
+// DefaultKeepAlive is the default interval of the TCP keepalive probes sent on
+// the connections between warp and warpd.
+const DefaultKeepAlive = 30 * time.Second
+
+// TuneConn sets the socket options of a TCP connection between warp and
+// warpd (possibly wrapped in TLS): TCP_NODELAY, so that keystrokes are sent
+// right away instead of being delayed by Nagle's algorithm, and keepalive
+// probes every keepAlive, so that dead peers are detected by the OS
+// (DefaultKeepAlive if 0, disabled if negative). Other connections (unix
+// sockets) are left untouched.
+func TuneConn(
+	conn net.Conn,
+	keepAlive time.Duration,
+) error {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(true); err != nil {
+		return errors.Trace(err)
+	}
+	if keepAlive < 0 {
+		return errors.Trace(tcp.SetKeepAlive(false))
+	}
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	// Probes start after keepAlive of inactivity and are then repeated every
+	// keepAlive, the number of probes being left to the OS.
+	return errors.Trace(tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     keepAlive,
+		Interval: keepAlive,
+		Count:    -1,
+	}))
+}
+
 // WarpRegexp warp token regular expression.
 var WarpRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-_.]{0,255}$")
 
@@ -25,10 +156,65 @@ const (
 	//   ModeVoicekRead|ModeVoicekWrite|ModeVoicekMuted
 	//   ModeVerified
 
+	// DefaultHostMode is the mode of the host user's sessions.
 	DefaultHostMode = ModeShellRead | ModeShellWrite
+	// DefaultUserMode is the mode every client joins a warp with. Clients
+	// can't request a mode: write is only ever granted by the host through a
+	// HostUpdate (`warp authorize`), and dropped if the warp changes hands.
 	DefaultUserMode = ModeShellRead
+
+	// ModeMask is the set of all known mode flags.
+	ModeMask = ModeShellRead | ModeShellWrite
 )
 
+// Valid returns whether the mode only contains known flags.
+func (m Mode) Valid() bool {
+	return m&^ModeMask == 0
+}
+
+// ParseMode parses a mode as named on the command line: read, write or rw (read
+// and write). Write implies read, as a user can't write to a shell without
+// seeing its output, so write and rw are the same mode.
+func ParseMode(
+	s string,
+) (Mode, error) {
+	switch s {
+	case "read":
+		return ModeShellRead, nil
+	case "write", "rw":
+		return ModeShellRead | ModeShellWrite, nil
+	}
+	return 0, errors.Trace(
+		errors.Newf("Invalid mode: %s (expected read, write or rw)", s),
+	)
+}
+
+// MaxUsernameLength is the maximum length in bytes of a username.
+const MaxUsernameLength = 64
+
+// ValidateUsername checks that a username is not empty, not too long and free
+// of control characters, as usernames are printed in participants' terminals.
+func ValidateUsername(
+	username string,
+) error {
+	if username == "" {
+		return errors.Trace(errors.Newf("Empty username"))
+	}
+	if len(username) > MaxUsernameLength {
+		return errors.Trace(
+			errors.Newf("Username too long: %d bytes", len(username)),
+		)
+	}
+	for _, r := range username {
+		if unicode.IsControl(r) {
+			return errors.Trace(
+				errors.Newf("Invalid character in username: %q", username),
+			)
+		}
+	}
+	return nil
+}
+
 // SessionType encodes the type of the session:
 type SessionType string
 
@@ -39,6 +225,15 @@ const (
 	SsTpShellClient SessionType = "shell"
 	// SsTpChatClient chat client session (`warp chat`)
 	SsTpChatClient SessionType = "chat"
+	// SsTpList list session used to enumerate the warps served by warpd
+	// (`warp list`)
+	SsTpList SessionType = "list"
+	// SsTpPing ping session used to check that warpd is reachable (`warp
+	// ping`)
+	SsTpPing SessionType = "ping"
+	// SsTpPane pane session sharing the output of an additional command of
+	// the host as a read-only pane of its warp (`warp pane`)
+	SsTpPane SessionType = "pane"
 )
 
 // User represents a user of a warp.
@@ -59,8 +254,100 @@ type Session struct {
 
 // Error is th struct sent over the network in case of errors.
 type Error struct {
-	Code    string
+	Code    errors.Code
 	Message string
+	// ExitStatus is the exit status of the host shell on ErrShellExited
+	// errors.
+	ExitStatus int
+}
+
+// Codes of the errors sent by warpd over the error channel of a session.
+const (
+	ErrAccessDenied         errors.Code = "access_denied"
+	ErrAuthorizationFailed  errors.Code = "authorization_failed"
+	ErrClientCertRequired   errors.Code = "client_cert_required"
+	ErrClientTooSlow        errors.Code = "client_too_slow"
+	ErrDisconnectedByHost   errors.Code = "disconnected_by_host"
+	ErrHostDisconnected     errors.Code = "host_disconnected"
+	ErrHostHandedOff        errors.Code = "host_handed_off"
+	ErrInternal             errors.Code = "internal_error"
+	ErrJoinDenied           errors.Code = "join_denied"
+	ErrListDisabled         errors.Code = "list_disabled"
+	ErrPaneInvalid          errors.Code = "pane_invalid"
+	ErrProtocolIncompatible errors.Code = "protocol_incompatible"
+	ErrServerAtCapacity     errors.Code = "server_at_capacity"
+	ErrServerShutdown       errors.Code = "server_shutdown"
+	ErrSessionReplaced      errors.Code = "session_replaced"
+	ErrShellExited          errors.Code = "shell_exited"
+	ErrUpdateInvalid        errors.Code = "update_invalid"
+	ErrWarpExpired          errors.Code = "warp_expired"
+	ErrWarpFull             errors.Code = "warp_full"
+	ErrWarpIdle             errors.Code = "warp_idle"
+	ErrWarpInUse            errors.Code = "warp_in_use"
+	ErrWarpInvalid          errors.Code = "warp_invalid"
+	ErrWarpUnknown          errors.Code = "warp_unknown"
+)
+
+// DisconnectReason is the reason for which warpd intentionally disconnected a
+// participant from a warp. It is carried by the code of the Error sent over
+// the error channel of its session before the channels get closed (see
+// DisconnectReasonOf).
+type DisconnectReason string
+
+const (
+	// DisconnectUnknown is the reason of unexpected disconnections (loss of
+	// the connection, internal errors) and of sessions refused by warpd.
+	DisconnectUnknown DisconnectReason = "unknown"
+	// DisconnectClosed is the reason of participants that closed their
+	// session on purpose, signaling it to warpd (see ClientUpdate.Closing).
+	// It is only known to warpd.
+	DisconnectClosed DisconnectReason = "closed"
+	// DisconnectKicked is the reason of clients disconnected by the host.
+	DisconnectKicked DisconnectReason = "kicked"
+	// DisconnectHostExited is the reason of clients disconnected as the host
+	// shell exited or the host disconnected.
+	DisconnectHostExited DisconnectReason = "host_exited"
+	// DisconnectHandedOff is the reason of hosts disconnected as they handed
+	// off the warp to another host.
+	DisconnectHandedOff DisconnectReason = "handed_off"
+	// DisconnectExpired is the reason of participants disconnected as the
+	// warp expired or was idle for too long.
+	DisconnectExpired DisconnectReason = "expired"
+	// DisconnectServerShutdown is the reason of participants disconnected as
+	// warpd is shutting down.
+	DisconnectServerShutdown DisconnectReason = "server_shutdown"
+	// DisconnectTooSlow is the reason of clients disconnected as they could
+	// not keep up with the output of the warp.
+	DisconnectTooSlow DisconnectReason = "too_slow"
+	// DisconnectReplaced is the reason of sessions replaced by a new session
+	// of the same participant.
+	DisconnectReplaced DisconnectReason = "replaced"
+)
+
+// DisconnectReasonOf returns the reason of a disconnection given the code of
+// the error sent by warpd, DisconnectUnknown if the code is not one of an
+// intentional disconnection.
+func DisconnectReasonOf(
+	code errors.Code,
+) DisconnectReason {
+	switch code {
+	case ErrDisconnectedByHost:
+		return DisconnectKicked
+	case ErrShellExited, ErrHostDisconnected:
+		return DisconnectHostExited
+	case ErrHostHandedOff:
+		return DisconnectHandedOff
+	case ErrWarpExpired, ErrWarpIdle:
+		return DisconnectExpired
+	case ErrServerShutdown:
+		return DisconnectServerShutdown
+	case ErrClientTooSlow:
+		return DisconnectTooSlow
+	case ErrSessionReplaced:
+		return DisconnectReplaced
+	default:
+		return DisconnectUnknown
+	}
 }
 
 // Size reprensents a window size.
@@ -69,11 +356,138 @@ type Size struct {
 	Cols int
 }
 
+const (
+	// MaxWindowRows is the maximum number of rows of a window size.
+	MaxWindowRows = 1000
+	// MaxWindowCols is the maximum number of columns of a window size.
+	MaxWindowCols = 1000
+)
+
+// Sanitize returns the size clamped to MaxWindowRows and MaxWindowCols. It
+// errors on negative dimensions. Zero dimensions are left untouched as a zero
+// size means that the size is unknown.
+func (s Size) Sanitize() (Size, error) {
+	if s.Rows < 0 || s.Cols < 0 {
+		return s, errors.Trace(
+			errors.Newf("Invalid window size: %dx%d", s.Cols, s.Rows),
+		)
+	}
+	if s.Rows > MaxWindowRows {
+		s.Rows = MaxWindowRows
+	}
+	if s.Cols > MaxWindowCols {
+		s.Cols = MaxWindowCols
+	}
+	return s, nil
+}
+
 // State is the struct sent over the network to update sessions state.
 type State struct {
 	Warp       string
 	WindowSize Size
 	Users      map[string]User
+	// Compression is specific to the receiving session and indicates whether
+	// its data channel is compressed.
+	Compression bool
+	// Sequenced is specific to the receiving session and indicates whether
+	// the data sent over its data channel is framed with sequence numbers
+	// (see SessionHello.Sequenced).
+	Sequenced bool
+	// Chat is set on states relaying a chat message to all participants.
+	// Chat messages are ephemeral and not part of subsequent states.
+	Chat *ChatMessage
+	// Pending are the users waiting for the host approval to join the warp,
+	// if the host requires it. They are only sent to the host session.
+	Pending map[string]User
+	// RateLimit is the rate in bytes per second at which warpd forwards the
+	// data of each client session to the host (0 if unlimited). RateBurst is
+	// the associated burst size in bytes.
+	RateLimit int
+	RateBurst int
+	// ExpiresAt is the time at which the warp gets closed if it was opened
+	// with a TTL (zero otherwise).
+	ExpiresAt time.Time
+	// CreatedAt is the time at which the warp was created, as measured by
+	// warpd.
+	CreatedAt time.Time
+	// WriteLock indicates that only one user at a time can write to the warp:
+	// WriteHolder, the token of the user holding the keyboard (empty if
+	// nobody does). WriteRequests are the tokens of the users that requested
+	// the keyboard, oldest first.
+	WriteLock     bool
+	WriteHolder   string
+	WriteRequests []string
+	// E2ECheck, if not empty, indicates that the data of the warp is
+	// encrypted end to end and lets clients verify their passphrase (see
+	// e2e.Check).
+	E2ECheck []byte
+	// Banner, if not empty, is a notice set by the host to display to users
+	// joining the warp. BannerAck indicates that clients must acknowledge it
+	// (with a ClientUpdate) before receiving the warp data. Both are only set
+	// in the first state sent to each session.
+	Banner    string
+	BannerAck bool
+	// Version is the version of warpd. ProtocolVersion is specific to the
+	// receiving session and is the protocol version negotiated for it.
+	Version         string
+	ProtocolVersion int
+	// AccessRequests are the tokens of the users without write access that
+	// asked the host for it, oldest first.
+	AccessRequests []string
+	// Paused indicates that the host paused the warp: the input of the
+	// clients is held if PausedHold is set, dropped otherwise, until it is
+	// resumed, and the output of the warp is not forwarded to them if
+	// PausedOutput is set (see HostUpdate.Pause).
+	Paused       bool
+	PausedHold   bool
+	PausedOutput bool
+	// Panes are the labels of the panes shared by the host in addition to
+	// its shell, sorted. Clients select the pane they view with a
+	// ClientUpdate.
+	Panes []string
+}
+
+// MaxChatLength is the maximum length in bytes of a chat message.
+const MaxChatLength = 512
+
+// MaxBannerLength is the maximum length in bytes of a warp banner.
+const MaxBannerLength = 4096
+
+// MaxAccessListLength is the maximum number of usernames of the access lists
+// of a warp.
+const MaxAccessListLength = 256
+
+// ChatMessage is a message sent by a participant of a warp to all the others.
+type ChatMessage struct {
+	// User is the token of the user that sent the message.
+	User     string
+	Username string
+	Text     string
+	Time     time.Time
+}
+
+// PingReply is sent over the state channel of ping sessions before warpd
+// closes them.
+type PingReply struct {
+	Version         string
+	ProtocolVersion int
+	// Time is the time of warpd when replying, letting clients check their
+	// clock (zero if warpd predates it).
+	Time time.Time
+}
+
+// WarpSummary summarizes a warp served by warpd. A list of WarpSummary is sent
+// over the state channel of list sessions.
+type WarpSummary struct {
+	Warp        string
+	Host        string
+	ClientCount int
+	WindowSize  Size
+	CreatedAt   time.Time
+	// Age is the time elapsed since the warp was created. It is measured by
+	// warpd so that ages are comparable across warps whatever the clock of
+	// the client.
+	Age time.Duration
 }
 
 // SessionHello is the initial message sent over a session update channel to
@@ -82,9 +496,28 @@ type SessionHello struct {
 	Warp    string
 	From    Session
 	Version string
+	// ProtocolVersion is the most recent protocol version spoken by the
+	// client, see NegotiateProtocolVersion.
+	ProtocolVersion int
 
 	Type     SessionType
 	Username string
+
+	// Compression requests compression of the data channel. It is enabled
+	// if the first State received sets Compression.
+	Compression bool
+	// ReadOnly indicates that the session never writes to the warp. Data
+	// received from it is dropped even if its user is authorized to write.
+	ReadOnly bool
+	// Sequenced requests the data sent to a shell client session to be framed
+	// with sequence numbers (see package frame), so that it can resume the
+	// warp output where it left it when reconnecting: ResumeFrom, if not 0,
+	// is the offset in the output of the host shell up to which the previous
+	// session of the client received it. Sequencing is enabled if the first
+	// State received sets Sequenced, which it doesn't for warps encrypted end
+	// to end.
+	Sequenced  bool
+	ResumeFrom uint64
 }
 
 // HostUpdate represents an update to the warp state from its host.
@@ -92,9 +525,174 @@ type HostUpdate struct {
 	Warp string
 	From Session
 
+	// WindowSize is the size of the host terminal. A zero size leaves it
+	// unchanged (updates sent by local commands don't know it).
 	WindowSize Size
 	// Modes is a map from user token to mode.
 	Modes map[string]Mode
+	// Disconnect is a list of user tokens whose sessions should be
+	// disconnected from the warp.
+	Disconnect []string
+	// MaxClients is the maximum number of client sessions (excluding the
+	// host's own sessions) the warp accepts (0 for warpd's maximum). It is
+	// only taken into account in the initial host update.
+	MaxClients int
+	// Chat, if not empty, is a chat message to relay to all participants.
+	Chat string
+	// Handoff, if not empty, is the token of a connected user nominated to
+	// take over the warp as its new host by opening it from their machine.
+	Handoff string
+	// Approval, if true, requires the host to approve each user before they
+	// join the warp. It is only taken into account in the initial host update.
+	Approval bool
+	// Approve and Deny are lists of pending user tokens whose request to join
+	// the warp is approved or denied.
+	Approve []string
+	Deny    []string
+	// WarpSecretHash, if not empty, is the hash (as computed by
+	// HashWarpSecret) of a secret that clients must present to join the warp.
+	// It is only taken into account in the initial host update.
+	WarpSecretHash string
+	// TTL, if not 0, is the duration after which the warp is closed whatever
+	// its activity. It is only taken into account in the initial host update.
+	TTL time.Duration
+	// WriteLock, if true, lets only one user at a time write to the warp
+	// among the users authorized to. It is only taken into account in the
+	// initial host update.
+	WriteLock bool
+	// WriteGrant, if not empty, is the token of a user the keyboard is handed
+	// to. WriteRelease frees the keyboard.
+	WriteGrant   string
+	WriteRelease bool
+	// ShellExited indicates that the host shell exited with ExitStatus, the
+	// warp ending as the host disconnects.
+	ShellExited bool
+	ExitStatus  int
+	// E2ECheck, if not empty, indicates that the data of the warp is
+	// encrypted end to end with a key derived from a passphrase only known to
+	// the participants (see e2e.Check). It is only taken into account in the
+	// initial host update.
+	E2ECheck []byte
+	// Banner, if not empty, is a notice displayed to users joining the warp,
+	// who must acknowledge it if BannerAck is set. They are only taken into
+	// account in the initial host update.
+	Banner    string
+	BannerAck bool
+	// AllowUsers, if not empty, are the usernames allowed to join the warp
+	// and DenyUsers the usernames denied, taking precedence. Usernames are
+	// self-asserted by clients so these lists only guard against mistakes,
+	// not attackers, unless combined with a warp secret. They are only taken
+	// into account in the initial host update.
+	AllowUsers []string
+	DenyUsers  []string
+	// DenyAccess is a list of user tokens whose request for write access is
+	// denied. Requests are granted by updating the user modes (see Modes).
+	DenyAccess []string
+	// Pause pauses the warp: the input of the clients (other than the host's
+	// own sessions) is dropped, or held and written once the warp is resumed
+	// if PauseHold is set, and the output of the warp is not forwarded to
+	// them if PauseOutput is set. Pausing a paused warp updates these
+	// options. Resume resumes the warp.
+	Pause       bool
+	PauseHold   bool
+	PauseOutput bool
+	Resume      bool
+	// Closing signals that the host is about to close its session on
+	// purpose, so that warpd does not take the end of the session for a lost
+	// connection. A shell exit (see ShellExited) signals it as well.
+	Closing bool
+}
+
+// EnvWarpSecret is the env variable from which the warp secret is read, so
+// that it does not land in the shell history.
+var EnvWarpSecret = "WARP_SECRET"
+
+// EnvWarpPassphrase is the env variable from which the passphrase used to
+// encrypt the warp data end to end is read.
+var EnvWarpPassphrase = "WARP_PASSPHRASE"
+
+// HashWarpSecret hashes a warp secret with a salted key derivation function
+// (see token.HashSecret), so that the secret can't be recovered from the hash.
+// Only the hash is sent by the host and stored by warpd.
+func HashWarpSecret(
+	secret string,
+) (string, error) {
+	hash, err := token.HashSecret(secret, 0)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return hash, nil
+}
+
+// ClientUpdate represents an update from a shell client session. Clients
+// sending updates opt in for the warp window size to fit their terminal.
+type ClientUpdate struct {
+	Warp string
+	From Session
+
+	// WindowSize is the size of the client terminal. The warp window size is
+	// the minimum of the host's and the opted-in clients' window sizes.
+	WindowSize Size
+	// Chat, if not empty, is a chat message to relay to all participants.
+	// WindowSize is ignored on updates carrying a chat message.
+	Chat string
+	// WarpSecret is the secret required to join warps protected by one. It is
+	// sent in the first update of the session, which is expected right after
+	// the session is opened for such warps.
+	WarpSecret string
+	// WriteRequest requests the keyboard of a warp opened with a write lock,
+	// acquiring it if nobody holds it. WriteRelease releases the keyboard
+	// (passing it to the oldest request) or withdraws the request. WriteGrant,
+	// if not empty, is the token of a user the holder hands the keyboard to.
+	// WindowSize is ignored on updates carrying any of them.
+	WriteRequest bool
+	WriteRelease bool
+	WriteGrant   string
+	// BannerAck acknowledges the banner of the warp, if the host requires it.
+	// WindowSize is ignored on updates carrying it.
+	BannerAck bool
+	// AccessRequest asks the host for write access to the warp. The request
+	// is pending (see State.AccessRequests) until the host grants or denies
+	// it. WindowSize is ignored on updates carrying it.
+	AccessRequest bool
+	// SelectPane switches the data channel of the session to the output of
+	// Pane (the host shell if empty), starting with its scrollback. The input
+	// of sessions viewing a pane is dropped as panes are read-only.
+	// WindowSize is ignored on updates carrying it.
+	SelectPane bool
+	Pane       string
+	// Closing signals that the client is about to close its session on
+	// purpose (the user quit), so that warpd does not take the end of the
+	// session for a lost connection. WindowSize is ignored on updates
+	// carrying it.
+	Closing bool
+}
+
+// PaneUpdate is the initial update of a pane session, sent right after the
+// session is opened. Panes are opened with the credentials of the host user.
+type PaneUpdate struct {
+	Warp  string
+	From  Session
+	Label string
+}
+
+// PaneRegexp pane label regular expression.
+var PaneRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-_.]{0,31}$")
+
+// ValidatePaneLabel checks that label is a valid pane label.
+func ValidatePaneLabel(
+	label string,
+) error {
+	if !PaneRegexp.MatchString(label) {
+		return errors.Trace(
+			errors.Newf(
+				"Invalid pane label: %q (expected up to 32 letters, digits "+
+					"or `-_.`, starting with a letter or digit)",
+				label,
+			),
+		)
+	}
+	return nil
 }
 
 //
@@ -114,6 +712,27 @@ const (
 	CmdTpAuthorize CommandType = "authorize"
 	// CmdTpRevoke a (or all) user(s) authorization to write.
 	CmdTpRevoke CommandType = "revoke"
+	// CmdTpDisconnect disconnects a user from the warp.
+	CmdTpDisconnect CommandType = "disconnect"
+	// CmdTpChat sends a chat message to all participants.
+	CmdTpChat CommandType = "chat"
+	// CmdTpHandoff nominates a user to take over the warp as its host.
+	CmdTpHandoff CommandType = "handoff"
+	// CmdTpGrant hands the keyboard to a user (or frees it) if the warp was
+	// opened with a write lock.
+	CmdTpGrant CommandType = "grant"
+	// CmdTpPause pauses the warp, with the options passed as arguments
+	// (PauseArgHold, PauseArgOutput).
+	CmdTpPause CommandType = "pause"
+	// CmdTpResume resumes a paused warp.
+	CmdTpResume CommandType = "resume"
+)
+
+// Arguments of the CmdTpPause command, mapping to the options of
+// HostUpdate.Pause.
+const (
+	PauseArgHold   = "hold"
+	PauseArgOutput = "output"
 )
 
 // Command is used to send command to the local host.
@@ -129,3 +748,11 @@ type CommandResult struct {
 	SessionState State
 	Error        Error
 }
+
+// AttachUpdate is sent by a terminal attached to a detached warp (see the
+// `attach` command): input to write to the shell and the window size of the
+// terminal if it changed.
+type AttachUpdate struct {
+	Data       []byte
+	WindowSize Size
+}
@@ -0,0 +1,265 @@
+package warp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spolu/warp/lib/errors"
+	"github.com/spolu/warp/lib/token"
+)
+
+func TestSizeSanitize(t *testing.T) {
+	for _, tc := range []struct {
+		size Size
+		want Size
+		err  bool
+	}{
+		{Size{Rows: 24, Cols: 80}, Size{Rows: 24, Cols: 80}, false},
+		{Size{}, Size{}, false},
+		{
+			Size{Rows: 1 << 30, Cols: 1 << 30},
+			Size{Rows: MaxWindowRows, Cols: MaxWindowCols}, false,
+		},
+		{Size{Rows: -1, Cols: 80}, Size{}, true},
+		{Size{Rows: 24, Cols: -(1 << 30)}, Size{}, true},
+	} {
+		got, err := tc.size.Sanitize()
+		if tc.err {
+			if err == nil {
+				t.Errorf("Sanitize(%v): got %v, want an error", tc.size, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf(
+				"Sanitize(%v): got (%v, %v), want (%v, nil)",
+				tc.size, got, err, tc.want,
+			)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for address, want := range map[string]string{
+		"[::1]:4242":     "[::1]:4242",
+		"localhost:4242": "localhost:4242",
+		"warp.link:4242": "warp.link:4242",
+		"10.0.0.1:4242":  "10.0.0.1:4242",
+		"localhost:0042": "localhost:42",
+		// An empty host designates all local addresses.
+		":4242": ":4242",
+	} {
+		if got, err := NormalizeAddress(address); err != nil || got != want {
+			t.Errorf(
+				"NormalizeAddress(%q): got (%q, %v), want (%q, nil)",
+				address, got, err, want,
+			)
+		}
+	}
+	for _, address := range []string{
+		// Unbracketed IPv6.
+		"::1:4242",
+		"localhost:http",
+		"localhost:65536",
+		"localhost:-1",
+		"localhost",
+		"",
+		"[::1]]:4242",
+		// TCP is the only transport.
+		"quic://warp.link:4242",
+		"tcp://warp.link:4242",
+	} {
+		if got, err := NormalizeAddress(address); err == nil {
+			t.Errorf("NormalizeAddress(%q): got %q, want an error", address, got)
+		}
+	}
+}
+
+func TestDisconnectReasonOf(t *testing.T) {
+	for code, want := range map[errors.Code]DisconnectReason{
+		ErrDisconnectedByHost: DisconnectKicked,
+		ErrShellExited:        DisconnectHostExited,
+		ErrHostDisconnected:   DisconnectHostExited,
+		ErrHostHandedOff:      DisconnectHandedOff,
+		ErrWarpExpired:        DisconnectExpired,
+		ErrWarpIdle:           DisconnectExpired,
+		ErrServerShutdown:     DisconnectServerShutdown,
+		ErrClientTooSlow:      DisconnectTooSlow,
+		ErrSessionReplaced:    DisconnectReplaced,
+		// Errors other than intentional disconnections.
+		ErrInternal:    DisconnectUnknown,
+		ErrWarpUnknown: DisconnectUnknown,
+		"":             DisconnectUnknown,
+	} {
+		if got := DisconnectReasonOf(code); got != want {
+			t.Errorf("DisconnectReasonOf(%q): got %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestHashWarpSecret(t *testing.T) {
+	hash, err := HashWarpSecret("hunter2")
+	if err != nil {
+		t.Fatalf("HashWarpSecret: %v", err)
+	}
+	// The hash is salted and derived with the default cost.
+	if !strings.HasPrefix(hash, fmt.Sprintf("pbkdf2-sha256$%d$", token.DefaultHashIterations)) {
+		t.Fatalf("HashWarpSecret: got %q, want a pbkdf2-sha256 hash", hash)
+	}
+	if ok, err := token.VerifySecret("hunter2", hash); err != nil || !ok {
+		t.Fatalf("VerifySecret: got (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := token.VerifySecret("hunter3", hash); err != nil || ok {
+		t.Fatalf("VerifySecret(wrong): got (%t, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestModeValid(t *testing.T) {
+	for _, mode := range []Mode{0, ModeShellRead, ModeShellRead | ModeShellWrite} {
+		if !mode.Valid() {
+			t.Errorf("Valid(%d): got false, want true", mode)
+		}
+	}
+	for _, mode := range []Mode{ModeMask + 1, 1 << 63, ^Mode(0)} {
+		if mode.Valid() {
+			t.Errorf("Valid(%d): got true, want false", mode)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, username := range []string{"alice", "Bob Smith", "élodie"} {
+		if err := ValidateUsername(username); err != nil {
+			t.Errorf("ValidateUsername(%q): %v", username, err)
+		}
+	}
+	for _, username := range []string{
+		"",
+		strings.Repeat("a", MaxUsernameLength+1),
+		"alice\x1b[2J",
+		"bob\r\nmallory",
+	} {
+		if err := ValidateUsername(username); err == nil {
+			t.Errorf("ValidateUsername(%q): got nil, want an error", username)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for s, want := range map[string]Mode{
+		"read": ModeShellRead,
+		// Write implies read.
+		"write": ModeShellRead | ModeShellWrite,
+		"rw":    ModeShellRead | ModeShellWrite,
+	} {
+		if got, err := ParseMode(s); err != nil || got != want {
+			t.Errorf("ParseMode(%q): got (%d, %v), want (%d, nil)", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "wr", "READ", "admin"} {
+		if _, err := ParseMode(s); err == nil {
+			t.Errorf("ParseMode(%q): got nil, want an error", s)
+		}
+	}
+}
+
+// sockopt returns the value of the socket option opt at level of conn.
+func sockopt(
+	t *testing.T,
+	conn *net.TCPConn,
+	level int,
+	opt int,
+) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if serr != nil {
+		t.Fatalf("GetsockoptInt: %v", serr)
+	}
+	return v
+}
+
+func TestTuneConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	for _, tc := range []struct {
+		keepAlive time.Duration
+		want      bool
+	}{
+		{0, true},
+		{time.Minute, true},
+		{-1, false},
+	} {
+		// Go enables keepalives on dialed connections by default.
+		conn, err := (&net.Dialer{KeepAlive: -1}).Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		tcp := conn.(*net.TCPConn)
+		if err := tcp.SetNoDelay(false); err != nil {
+			t.Fatalf("SetNoDelay: %v", err)
+		}
+
+		if err := TuneConn(conn, tc.keepAlive); err != nil {
+			t.Fatalf("TuneConn(%s): %v", tc.keepAlive, err)
+		}
+		if v := sockopt(t, tcp, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+			t.Errorf("TuneConn(%s): TCP_NODELAY not set", tc.keepAlive)
+		}
+		v := sockopt(t, tcp, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if got := v != 0; got != tc.want {
+			t.Errorf("TuneConn(%s): SO_KEEPALIVE: got %t, want %t", tc.keepAlive, got, tc.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestTuneConnTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	conn, err := (&net.Dialer{KeepAlive: -1}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The options are set on the TCP connection underlying TLS.
+	if err := TuneConn(tls.Client(conn, &tls.Config{}), 0); err != nil {
+		t.Fatalf("TuneConn: %v", err)
+	}
+	tcp := conn.(*net.TCPConn)
+	if v := sockopt(t, tcp, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Fatalf("SO_KEEPALIVE not set")
+	}
+}
+
+func TestTuneConnNotTCP(t *testing.T) {
+	// Connections other than TCP are left untouched.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := TuneConn(a, 0); err != nil {
+		t.Fatalf("TuneConn: %v", err)
+	}
+}